@@ -1,5 +1,10 @@
 package godb
 
+import (
+	"context"
+	"fmt"
+)
+
 type Aggregator struct {
 	// Expressions that when applied to tuples from the child operators,
 	// respectively, return the value of the group by key tuple
@@ -10,6 +15,20 @@ type Aggregator struct {
 	newAggState []AggState
 
 	child Operator // the child operator for the inputs to aggregate
+
+	// The maximum number of groups whose aggregation states are kept in
+	// memory at once.  Input tuples of groups beyond this limit are
+	// partitioned on their group key and spilled to disk, and each partition
+	// is aggregated separately once the in-memory groups are returned.  A
+	// value <= 0 disables spilling.
+	maxGroups int
+
+	// Whether the child produces its tuples sorted on groupByFields.  If so,
+	// the aggregator computes one group at a time as tuples stream past,
+	// rather than building a hash table of all groups.
+	sortedInput bool
+
+	memStat //group keys and aggregation states of the hash aggregation
 }
 
 type AggType int
@@ -21,14 +40,41 @@ const (
 
 const DefaultGroup int = 0 // for handling the case of no group-by
 
+// The approximate number of bytes of memory used by an aggregation state.
+const aggStateMemory = 64
+
+// Default number of groups an aggregator keeps in memory before spilling
+const DefaultMaxAggGroups int = 100000
+
+// Number of partitions spilled groups are hashed into
+const aggSpillPartitions int = 16
+
+// Number of recursion depths at which spilled groups can be partitioned: each
+// depth picks a partition by the next 4 bits of the 64 bit group key hash
+const aggSpillMaxDepth int = 16
+
 // Constructor for an aggregator with a group-by
 func NewGroupedAggregator(emptyAggState []AggState, groupByFields []Expr, child Operator) *Aggregator {
-	return &Aggregator{groupByFields, emptyAggState, child}
+	return &Aggregator{groupByFields, emptyAggState, child, DefaultMaxAggGroups, false, memStat{}}
+}
+
+// Constructor for an aggregator with a group-by whose child produces tuples
+// sorted on the group-by fields (e.g., an [OrderBy] on the same expressions).
+// Groups are aggregated one at a time, so memory use does not depend on the
+// number of groups.
+func NewSortedAggregator(emptyAggState []AggState, groupByFields []Expr, child Operator) *Aggregator {
+	return &Aggregator{groupByFields, emptyAggState, child, DefaultMaxAggGroups, true, memStat{}}
 }
 
 // Constructor for an aggregator with no group-by
 func NewAggregator(emptyAggState []AggState, child Operator) *Aggregator {
-	return &Aggregator{nil, emptyAggState, child}
+	return &Aggregator{nil, emptyAggState, child, DefaultMaxAggGroups, false, memStat{}}
+}
+
+// Set the maximum number of groups the aggregator keeps in memory before
+// spilling to disk.  A value <= 0 disables spilling.
+func (a *Aggregator) SetMaxGroups(maxGroups int) {
+	a.maxGroups = maxGroups
 }
 
 // Return a TupleDescriptor for this aggregation. If the aggregator has no group-by, the
@@ -50,11 +96,11 @@ func (a *Aggregator) Descriptor() *TupleDesc {
 		}
 	}
 	// 然后将聚合状态的fields加入fields
-	td := TupleDesc{fields}
+	td := &TupleDesc{fields}
 	for _, aggState := range a.newAggState {
-		td.merge(aggState.GetTupleDesc())
+		td = td.merge(aggState.GetTupleDesc())
 	}
-	return &td // TODO change me
+	return td // TODO change me
 }
 
 // Aggregate operator implementation: This function should iterate over the results of
@@ -63,8 +109,12 @@ func (a *Aggregator) Descriptor() *TupleDesc {
 // is no group-by, the iterator simply iterates through only one tuple, representing the
 // aggregation of all child tuples.
 func (a *Aggregator) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	return a.IteratorContext(context.Background(), tid)
+}
+
+func (a *Aggregator) IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error) {
 	// the child iterator
-	childIter, err := a.child.Iterator(tid)
+	childIter, err := IteratorContext(ctx, a.child, tid)
 	if err != nil {
 		return nil, err
 	}
@@ -72,46 +122,139 @@ func (a *Aggregator) Iterator(tid TransactionID) (func() (*Tuple, error), error)
 		return nil, GoDBError{MalformedDataError, "child iter unexpectedly nil"}
 
 	}
-	// the map that stores the aggregation state of each group
-	aggState := make(map[any]*[]AggState)
 	if a.groupByFields == nil {
-		var newAggState []AggState
-		for _, as := range a.newAggState {
-			copy := as.Copy()
-			if copy == nil {
-				return nil, GoDBError{MalformedDataError, "aggState Copy unexpectedly returned nil"}
-			}
-			newAggState = append(newAggState, copy)
-		}
+		return a.singleGroupIterator(ctx, childIter)
+	}
+	if a.sortedInput {
+		return a.sortedIterator(ctx, childIter), nil
+	}
+	return a.hashIterator(ctx, childIter, 0), nil
+}
 
-		aggState[DefaultGroup] = &newAggState
+// Return an iterator that aggregates all child tuples into a single group
+// (the case of no group-by).
+func (a *Aggregator) singleGroupIterator(ctx context.Context, childIter func() (*Tuple, error)) (func() (*Tuple, error), error) {
+	var newAggState []AggState
+	for _, as := range a.newAggState {
+		copy := as.Copy()
+		if copy == nil {
+			return nil, GoDBError{MalformedDataError, "aggState Copy unexpectedly returned nil"}
+		}
+		newAggState = append(newAggState, copy)
 	}
-	// the list of group key tuples
-	var groupByList []*Tuple
-	// the iterator for iterating thru the finalized aggregation results for each group
-	var finalizedIter func() (*Tuple, error)
+	unregister := onClose(ctx, func() { closeAggStates(newAggState) })
+	done := false
 	return func() (*Tuple, error) {
-		// iterates thru all child tuples
-		for t, err := childIter(); t != nil || err != nil; t, err = childIter() {
+		if done {
+			return nil, nil
+		}
+		for {
+			t, err := childIter()
 			if err != nil {
 				return nil, err
 			}
 			if t == nil {
-				return nil, nil
+				break
 			}
+			for i := 0; i < len(newAggState); i++ {
+				newAggState[i].AddTuple(t)
+			}
+		}
+		done = true
+		unregister()
+		return finalizeAggStates(nil, newAggState)
+	}, nil
+}
 
-			if a.groupByFields == nil { // adds tuple to the aggregation in the case of no group-by
-				for i := 0; i < len(a.newAggState); i++ {
-					(*aggState[DefaultGroup])[i].AddTuple(t)
+// Return an iterator that hash-aggregates the tuples of childIter.  At most
+// a.maxGroups groups are kept in memory, and fewer if more would exceed the
+// memory limit of the query; tuples that belong to any other group are
+// written to one of aggSpillPartitions spill files, chosen by the hash of
+// their group key.  Once the in-memory groups have been returned, each
+// spill file is aggregated in turn by a recursive hashIterator.  depth is the
+// recursion depth, which selects the bits of the key hash used to pick a
+// partition so that an overflowing partition is split differently; the
+// aggregation fails if a partition at the last depth still overflows.
+func (a *Aggregator) hashIterator(ctx context.Context, childIter func() (*Tuple, error), depth int) func() (*Tuple, error) {
+	// the map that stores the aggregation state of each group
+	aggState := make(map[any]*[]AggState)
+	// the list of group key tuples, and the bytes of memory of the groups
+	var groupByList []*Tuple
+	var groupBytes int64
+	mem := a.account(ctx, "aggregate")
+	// the spilled partitions, and the one currently being aggregated
+	var partitions []*spillFile
+	var curPartition int
+	var partIter func() (*Tuple, error)
+	// the iterator for iterating thru the finalized aggregation results for each group
+	var finalizedIter func() (*Tuple, error)
+
+	// remove the spill files and release the groups, if the aggregation fails
+	// or the query is closed before all groups have been returned
+	cleanup := func() {
+		for _, p := range partitions {
+			if p != nil {
+				p.close()
+			}
+		}
+		partitions = nil
+		for _, st := range aggState {
+			closeAggStates(*st)
+		}
+		mem.release(groupBytes)
+		groupBytes = 0
+	}
+	unregister := onClose(ctx, cleanup)
+
+	return func() (*Tuple, error) {
+		if finalizedIter == nil {
+			// iterates thru all child tuples
+			for {
+				t, err := childIter()
+				if err != nil {
+					cleanup()
+					return nil, err
+				}
+				if t == nil {
+					break
 				}
-			} else { // adds tuple to the aggregation with grouping
 				keygenTup, err := extractGroupByKeyTuple(a, t)
 				if err != nil {
+					cleanup()
 					return nil, err
 				}
 
 				key := keygenTup.tupleKey()
 				if aggState[key] == nil {
+					size := groupMemory(keygenTup, len(a.newAggState))
+					// 内存中的分组已满或超出查询的内存限制，将元组写入对应的分区文件
+					if len(groupByList) > 0 && (a.maxGroups > 0 && len(groupByList) >= a.maxGroups || !mem.fits(size)) {
+						if depth >= aggSpillMaxDepth {
+							cleanup()
+							return nil, GoDBError{MemoryLimitError, "aggregate cannot split its spilled groups any further"}
+						}
+						if partitions == nil {
+							partitions = make([]*spillFile, aggSpillPartitions)
+						}
+						p := spillPartition(key.(uint64), depth)
+						if partitions[p] == nil {
+							partitions[p], err = newSpillFile(a.child.Descriptor())
+							if err != nil {
+								cleanup()
+								return nil, err
+							}
+						}
+						if err := partitions[p].append(t); err != nil {
+							cleanup()
+							return nil, err
+						}
+						continue
+					}
+					if err := mem.grow(size); err != nil {
+						cleanup()
+						return nil, err
+					}
+					groupBytes += size
 					asNew := make([]AggState, len(a.newAggState))
 					aggState[key] = &asNew
 					groupByList = append(groupByList, keygenTup)
@@ -119,23 +262,120 @@ func (a *Aggregator) Iterator(tid TransactionID) (func() (*Tuple, error), error)
 
 				addTupleToGrpAggState(a, t, aggState[key])
 			}
+			finalizedIter = getFinalizedTuplesIterator(a, groupByList, aggState)
+		}
+
+		if t, err := finalizedIter(); t != nil || err != nil {
+			if err != nil {
+				cleanup()
+			}
+			return t, err
 		}
+		mem.release(groupBytes)
+		groupBytes = 0
+		// 内存中的分组已全部返回，依次聚合各个分区
+		for curPartition < len(partitions) {
+			p := partitions[curPartition]
+			if p == nil {
+				curPartition++
+				continue
+			}
+			if partIter == nil {
+				spilledIter, err := p.iterator()
+				if err != nil {
+					cleanup()
+					return nil, err
+				}
+				partIter = a.hashIterator(ctx, spilledIter, depth+1)
+			}
+			t, err := partIter()
+			if err != nil {
+				cleanup()
+				return nil, err
+			}
+			if t != nil {
+				return t, nil
+			}
+			p.close()
+			partitions[curPartition] = nil
+			partIter = nil
+			curPartition++
+		}
+		unregister()
+		return nil, nil
+	}
+}
+
+// Choose the spill partition for a group key hash at the given recursion
+// depth, which must be less than aggSpillMaxDepth.
+func spillPartition(hash uint64, depth int) int {
+	return int((hash >> (4 * depth)) % uint64(aggSpillPartitions))
+}
+
+// Return an iterator that aggregates the tuples of childIter, which must be
+// sorted on the group-by fields.  Only the states of the current group are
+// kept; a group is finalized and returned as soon as a tuple of the next
+// group (or the end of the input) is seen.
+func (a *Aggregator) sortedIterator(ctx context.Context, childIter func() (*Tuple, error)) func() (*Tuple, error) {
+	var curKey *Tuple
+	var curState []AggState
+	done := false
+	unregister := onClose(ctx, func() { closeAggStates(curState) })
 
-		if finalizedIter == nil { // builds the iterator for iterating thru the finalized aggregation results for each group
-			if a.groupByFields == nil {
-				var tup *Tuple
-				for i := 0; i < len(a.newAggState); i++ {
-					newTup := (*aggState[DefaultGroup])[i].Finalize()
-					tup = joinTuples(tup, newTup)
+	finalize := func() (*Tuple, error) {
+		retTuple := joinTuples(&Tuple{TupleDesc{[]FieldType{}}, []DBValue{}, nil}, curKey)
+		return finalizeAggStates(retTuple, curState)
+	}
+
+	return func() (*Tuple, error) {
+		for !done {
+			t, err := childIter()
+			if err != nil {
+				return nil, err
+			}
+			if t == nil {
+				done = true
+				unregister()
+				if curKey != nil {
+					return finalize()
 				}
-				finalizedIter = func() (*Tuple, error) { return nil, nil }
-				return tup, nil
-			} else {
-				finalizedIter = getFinalizedTuplesIterator(a, groupByList, aggState)
+				return nil, nil
+			}
+			keygenTup, err := extractGroupByKeyTuple(a, t)
+			if err != nil {
+				return nil, err
+			}
+			var retTuple *Tuple
+			if curKey != nil && !sameGroup(curKey, keygenTup) {
+				// 遇到新的分组，返回上一个分组的结果
+				if retTuple, err = finalize(); err != nil {
+					return nil, err
+				}
+			}
+			if curKey == nil || retTuple != nil {
+				curKey = keygenTup
+				curState = make([]AggState, len(a.newAggState))
+			}
+			addTupleToGrpAggState(a, t, &curState)
+			if retTuple != nil {
+				return retTuple, nil
 			}
 		}
-		return finalizedIter()
-	}, nil
+		return nil, nil
+	}
+}
+
+// Return true if the two group key tuples have equal fields.
+func sameGroup(k1 *Tuple, k2 *Tuple) bool {
+	if len(k1.Fields) != len(k2.Fields) {
+		return false
+	}
+	for i := range k1.Fields {
+		if k1.Fields[i] != k2.Fields[i] {
+			return false
+		}
+	}
+	return true
 }
 
 // Given a tuple t from a child iteror, return a tuple that identifies t's group.
@@ -207,13 +447,343 @@ func getFinalizedTuplesIterator(a *Aggregator, groupByList []*Tuple, aggState ma
 		key := groupByList[curGbyTuple].tupleKey()
 		// 获取该组的聚合状态列表
 		grpAggState := *aggState[key]
-		// 遍历聚合状态列表，将结果添加到结果元组中
-		for i := 0; i < len(a.newAggState); i++ {
-			newTup := grpAggState[i].Finalize()
-			retTuple = joinTuples(retTuple, newTup)
-		}
 		// 组ID++
 		curGbyTuple++
-		return retTuple, nil // TODO change me
+		// 遍历聚合状态列表，将结果添加到结果元组中
+		return finalizeAggStates(retTuple, grpAggState[:len(a.newAggState)])
+	}
+}
+
+// Vectorized aggregate implementation.  The group of each row of a batch of
+// the child is looked up from the group-by columns, and the rows of each
+// group are added to its aggregation states together, a column at a time for
+// states that implement batchAggState.  As in the tuple-at-a-time hash
+// aggregation, at most a.maxGroups groups are kept in memory and the rows of
+// other groups are spilled to disk and aggregated afterwards.  An aggregator
+// over sorted input is run a tuple at a time.
+func (a *Aggregator) BatchIterator(ctx context.Context, tid TransactionID) (func() (*Batch, error), error) {
+	if a.groupByFields != nil && a.sortedInput {
+		iter, err := IteratorContext(ctx, a, tid)
+		if err != nil {
+			return nil, err
+		}
+		return batchTuples(iter), nil
+	}
+	childIter, err := BatchIterator(ctx, a.child, tid)
+	if err != nil {
+		return nil, err
+	}
+	var results func() (*Batch, error)
+	return func() (*Batch, error) {
+		if results == nil {
+			iter, err := a.aggregateBatches(ctx, childIter)
+			if err != nil {
+				return nil, err
+			}
+			results = batchTuples(iter)
+		}
+		return results()
+	}, nil
+}
+
+// aggGroups holds the groups of a vectorized hash aggregation.  The ith
+// group has the identifier ids[i] (a group-by value, or the key of the tuple
+// of group-by values if there are several), the group-by values keys[i] and
+// the aggregation states states[i].
+type aggGroups struct {
+	index  map[any]int // group identifier to index of the group
+	ids    []any
+	keys   []*Tuple
+	states [][]AggState
+	bytes  int64       // memory of the groups
+	mem    *memAccount // where the memory of the groups is recorded
+}
+
+func newAggGroups(mem *memAccount) *aggGroups {
+	return &aggGroups{index: make(map[any]int), mem: mem}
+}
+
+// Return the approximate number of bytes of memory used by a group with the
+// group-by values key and the specified number of aggregation states.
+func groupMemory(key *Tuple, states int) int64 {
+	return tupleMemory(key) + aggStateMemory*int64(states)
+}
+
+// Add a group with fresh aggregation states, returning its index.
+func (a *Aggregator) newGroup(g *aggGroups, id any, key *Tuple) (int, error) {
+	st := make([]AggState, len(a.newAggState))
+	for i, as := range a.newAggState {
+		if st[i] = as.Copy(); st[i] == nil {
+			return -1, GoDBError{MalformedDataError, "aggState Copy unexpectedly returned nil"}
+		}
+	}
+	size := groupMemory(key, len(st))
+	if err := g.mem.grow(size); err != nil {
+		return -1, err
+	}
+	g.bytes += size
+	g.insert(id, key, st)
+	return len(g.keys) - 1, nil
+}
+
+func (g *aggGroups) insert(id any, key *Tuple, states []AggState) {
+	g.index[id] = len(g.keys)
+	g.ids = append(g.ids, id)
+	g.keys = append(g.keys, key)
+	g.states = append(g.states, states)
+}
+
+// Merge the groups of other, whose states must be mergeable, into g.  The
+// groups of other that are not in g are moved to g along with their memory.
+func (g *aggGroups) merge(other *aggGroups) error {
+	for j, id := range other.ids {
+		i, ok := g.index[id]
+		if !ok {
+			g.insert(id, other.keys[j], other.states[j])
+			size := groupMemory(other.keys[j], len(other.states[j]))
+			g.bytes += size
+			other.bytes -= size
+			continue
+		}
+		for s, as := range g.states[i] {
+			m, ok := as.(MergeableAggState)
+			if !ok {
+				return GoDBError{IllegalOperationError, fmt.Sprintf("aggregation state %T cannot be merged", as)}
+			}
+			if err := m.Merge(other.states[j][s]); err != nil {
+				return err
+			}
+		}
+	}
+	other.mem.release(other.bytes)
+	other.bytes = 0
+	return nil
+}
+
+// Release the memory of the groups, and the resources held by the states of
+// groups that have not been finalized.
+func (g *aggGroups) close() {
+	for _, st := range g.states {
+		closeAggStates(st)
+	}
+	g.mem.release(g.bytes)
+	g.bytes = 0
+}
+
+// Return the finalized result of the ith group.
+func (g *aggGroups) finalize(i int) (*Tuple, error) {
+	retTuple := joinTuples(&Tuple{TupleDesc{[]FieldType{}}, []DBValue{}, nil}, g.keys[i])
+	return finalizeAggStates(retTuple, g.states[i])
+}
+
+// Return the descriptor of the group-by values of the aggregator.
+func (a *Aggregator) groupByDesc() TupleDesc {
+	keyDesc := TupleDesc{[]FieldType{}}
+	for _, expr := range a.groupByFields {
+		keyDesc.Fields = append(keyDesc.Fields, expr.GetExprType())
+	}
+	return keyDesc
+}
+
+// Aggregate all batches of childIter into groups.  If spill is not nil, rows
+// of new groups are passed to it rather than added to g once g holds
+// a.maxGroups groups.
+func (a *Aggregator) aggregateInto(g *aggGroups, childIter func() (*Batch, error), spill func(t *Tuple, key *Tuple) error) error {
+	keyDesc := a.groupByDesc()
+	if a.groupByFields == nil && len(g.keys) == 0 {
+		if _, err := a.newGroup(g, nil, &Tuple{keyDesc, []DBValue{}, nil}); err != nil {
+			return err
+		}
+	}
+	for {
+		b, err := childIter()
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			return nil
+		}
+		if err := a.addBatch(b, keyDesc, g, spill); err != nil {
+			return err
+		}
+	}
+}
+
+// Aggregate all batches of childIter, returning an iterator over the
+// finalized groups followed by those of the spilled rows.
+func (a *Aggregator) aggregateBatches(ctx context.Context, childIter func() (*Batch, error)) (func() (*Tuple, error), error) {
+	g := newAggGroups(a.account(ctx, "aggregate"))
+	var partitions []*spillFile
+	cleanup := func() {
+		for _, p := range partitions {
+			if p != nil {
+				p.close()
+			}
+		}
+		partitions = nil
+		g.close()
+	}
+	unregister := onClose(ctx, cleanup)
+	spill := func(t *Tuple, key *Tuple) error {
+		if partitions == nil {
+			partitions = make([]*spillFile, aggSpillPartitions)
+		}
+		p := spillPartition(key.tupleKey().(uint64), 0)
+		if partitions[p] == nil {
+			f, err := newSpillFile(a.child.Descriptor())
+			if err != nil {
+				return err
+			}
+			partitions[p] = f
+		}
+		return partitions[p].append(t)
+	}
+	if err := a.aggregateInto(g, childIter, spill); err != nil {
+		cleanup()
+		unregister()
+		return nil, err
+	}
+
+	i := 0
+	curPartition := 0
+	var partIter func() (*Tuple, error)
+	return func() (*Tuple, error) {
+		if i < len(g.keys) {
+			i++
+			t, err := g.finalize(i - 1)
+			if err != nil {
+				cleanup()
+				unregister()
+			}
+			return t, err
+		}
+		g.mem.release(g.bytes)
+		g.bytes = 0
+		for curPartition < len(partitions) {
+			p := partitions[curPartition]
+			if p == nil {
+				curPartition++
+				continue
+			}
+			if partIter == nil {
+				spilledIter, err := p.iterator()
+				if err != nil {
+					cleanup()
+					return nil, err
+				}
+				partIter = a.hashIterator(ctx, spilledIter, 1)
+			}
+			t, err := partIter()
+			if err != nil {
+				cleanup()
+				return nil, err
+			}
+			if t != nil {
+				return t, nil
+			}
+			p.close()
+			partitions[curPartition] = nil
+			partIter = nil
+			curPartition++
+		}
+		unregister()
+		return nil, nil
+	}, nil
+}
+
+// Add the rows of a batch to the states of their groups in g, creating the
+// groups that are not yet in g.  If spill is not nil and g already holds
+// a.maxGroups groups, or another group would exceed the memory limit of the
+// query, the rows of new groups are passed to spill instead.
+func (a *Aggregator) addBatch(b *Batch, keyDesc TupleDesc, g *aggGroups, spill func(t *Tuple, key *Tuple) error) error {
+	// the rows of each group in the batch, in order of first appearance
+	var order []int
+	rowsOf := make(map[int][]int)
+	if a.groupByFields == nil {
+		order = []int{0}
+		rowsOf[0] = make([]int, b.n)
+		for r := range rowsOf[0] {
+			rowsOf[0][r] = r
+		}
+	} else {
+		keyVecs := make([]*Vector, len(a.groupByFields))
+		for i, expr := range a.groupByFields {
+			v, err := evalVector(expr, b)
+			if err != nil {
+				return err
+			}
+			keyVecs[i] = v
+		}
+		keyTuple := func(r int) *Tuple {
+			fields := make([]DBValue, len(keyVecs))
+			for i, v := range keyVecs {
+				fields[i] = v.Value(r)
+			}
+			return &Tuple{keyDesc, fields, nil}
+		}
+		for r := 0; r < b.n; r++ {
+			var id any
+			if len(keyVecs) == 1 {
+				id = keyVecs[0].raw(r)
+			} else {
+				id = keyTuple(r).tupleKey()
+			}
+			gid, ok := g.index[id]
+			if !ok {
+				key := keyTuple(r)
+				if spill != nil && (a.maxGroups > 0 && len(g.keys) >= a.maxGroups ||
+					len(g.keys) > 0 && !g.mem.fits(groupMemory(key, len(a.newAggState)))) {
+					if err := spill(b.Tuple(r), key); err != nil {
+						return err
+					}
+					continue
+				}
+				var err error
+				if gid, err = a.newGroup(g, id, key); err != nil {
+					return err
+				}
+			}
+			if _, ok := rowsOf[gid]; !ok {
+				order = append(order, gid)
+			}
+			rowsOf[gid] = append(rowsOf[gid], r)
+		}
+	}
+
+	// the values of the expression of each state that can add rows at once;
+	// a state whose expression fails on the batch adds its tuples one at a
+	// time, which ignores the rows it fails on
+	args := make([]*Vector, len(a.newAggState))
+	vectorized := make([]bool, len(a.newAggState))
+	for j, as := range a.newAggState {
+		bs, ok := as.(batchAggState)
+		if !ok {
+			continue
+		}
+		if expr := bs.batchExpr(); expr != nil {
+			v, err := evalVector(expr, b)
+			if err != nil {
+				continue
+			}
+			args[j] = v
+		}
+		vectorized[j] = true
+	}
+	tuples := make([]*Tuple, b.n)
+	for _, gid := range order {
+		rows := rowsOf[gid]
+		for j, as := range g.states[gid] {
+			if vectorized[j] {
+				as.(batchAggState).addRows(args[j], rows)
+				continue
+			}
+			for _, r := range rows {
+				if tuples[r] == nil {
+					tuples[r] = b.Tuple(r)
+				}
+				as.AddTuple(tuples[r])
+			}
+		}
 	}
+	return nil
 }
@@ -1,6 +1,10 @@
 package godb
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -290,3 +294,245 @@ func TestRepeatedIteration(t *testing.T) {
 	}
 
 }
+
+// insert n tuples into hf, spread round-robin over ngroups names, with
+// ages 0..n-1
+func insertGroupedTuples(t *testing.T, hf *HeapFile, tid TransactionID, n int, ngroups int) {
+	for i := 0; i < n; i++ {
+		tup := Tuple{*hf.Descriptor(),
+			[]DBValue{
+				StringField{fmt.Sprintf("name%d", i%ngroups)},
+				IntField{int64(i)},
+			}, nil}
+		err := hf.insertTuple(&tup, tid)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+}
+
+func expectedGroupSums(hf *HeapFile, n int, ngroups int) []*Tuple {
+	fields := []FieldType{
+		{"name", "", StringType},
+		{"sum", "", IntType},
+	}
+	sums := make([]int64, ngroups)
+	for i := 0; i < n; i++ {
+		sums[i%ngroups] += int64(i)
+	}
+	var ts []*Tuple
+	for g, sum := range sums {
+		ts = append(ts, &Tuple{TupleDesc{fields},
+			[]DBValue{
+				StringField{fmt.Sprintf("name%d", g)},
+				IntField{sum},
+			}, nil})
+	}
+	return ts
+}
+
+func TestGbySumAggSpill(t *testing.T) {
+	_, t1, _, hf, _, tid := makeTestVars()
+	insertGroupedTuples(t, hf, tid, 60, 20)
+	gbyFields := []Expr{&FieldExpr{hf.Descriptor().Fields[0]}}
+
+	sa := SumAggState[int64]{}
+	expr := FieldExpr{t1.Desc.Fields[1]}
+	sa.Init("sum", &expr, intAggGetter)
+
+	agg := NewGroupedAggregator([]AggState{&sa}, gbyFields, hf)
+	agg.SetMaxGroups(3)
+	iter, err := agg.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !CheckIfOutputMatches(iter, expectedGroupSums(hf, 60, 20)) {
+		t.Errorf("spilled aggregation did not match expected groups")
+	}
+}
+
+func TestGbyAggSpillDepth(t *testing.T) {
+	// each depth picks a partition by other bits of the hash
+	hash := uint64(0xfedcba9876543210)
+	for depth := 0; depth < aggSpillMaxDepth; depth++ {
+		if p := spillPartition(hash, depth); p != depth {
+			t.Errorf("depth %d: expected partition %d, got %d", depth, depth, p)
+		}
+	}
+
+	// groups that overflow at the last depth cannot be split further
+	_, t1, _, hf, _, tid := makeTestVars()
+	insertGroupedTuples(t, hf, tid, 10, 5)
+	sa := SumAggState[int64]{}
+	sa.Init("sum", &FieldExpr{t1.Desc.Fields[1]}, intAggGetter)
+	agg := NewGroupedAggregator([]AggState{&sa}, []Expr{&FieldExpr{hf.Descriptor().Fields[0]}}, hf)
+	agg.SetMaxGroups(2)
+	childIter, err := hf.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter := agg.hashIterator(context.Background(), childIter, aggSpillMaxDepth)
+	if _, err := iter(); err == nil {
+		t.Errorf("expected an error spilling groups at the last depth")
+	}
+}
+
+func TestGbySumAggSorted(t *testing.T) {
+	_, t1, _, hf, _, tid := makeTestVars()
+	insertGroupedTuples(t, hf, tid, 30, 7)
+	gbyFields := []Expr{&FieldExpr{hf.Descriptor().Fields[0]}}
+
+	oby, err := NewOrderBy(gbyFields, hf, []bool{true})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !sortedOn(oby, gbyFields) {
+		t.Fatalf("expected order by to be sorted on group by fields")
+	}
+
+	sa := SumAggState[int64]{}
+	expr := FieldExpr{t1.Desc.Fields[1]}
+	sa.Init("sum", &expr, intAggGetter)
+
+	agg := NewSortedAggregator([]AggState{&sa}, gbyFields, oby)
+	iter, err := agg.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !CheckIfOutputMatches(iter, expectedGroupSums(hf, 30, 7)) {
+		t.Errorf("sorted aggregation did not match expected groups")
+	}
+}
+
+// Sort keys match group by keys only if they refer to the same column, not
+// merely to columns of the same name, e.g., of a join.
+func TestSortedOnQualifiedFields(t *testing.T) {
+	td := TupleDesc{Fields: []FieldType{
+		{Fname: "a", TableQualifier: "t", Ftype: IntType},
+		{Fname: "a", TableQualifier: "s", Ftype: IntType},
+	}}
+	bp := NewBufferPool(3)
+	os.Remove(TestingFile)
+	hf, err := NewHeapFile(TestingFile, &td, bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ta, sa := &FieldExpr{td.Fields[0]}, &FieldExpr{td.Fields[1]}
+	oby, err := NewOrderBy([]Expr{ta}, hf, []bool{true})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !sortedOn(oby, []Expr{ta}) {
+		t.Errorf("expected order by t.a to be sorted on t.a")
+	}
+	if sortedOn(oby, []Expr{sa}) {
+		t.Errorf("expected order by t.a not to be sorted on s.a")
+	}
+	named := &namedExpr{sa, FieldType{"a", "t", IntType}}
+	if sortedOn(oby, []Expr{named}) {
+		t.Errorf("expected order by t.a not to be sorted on an expression named t.a")
+	}
+}
+
+func TestGbyCountDistinctAggSpill(t *testing.T) {
+	_, t1, _, hf, _, tid := makeTestVars()
+	// 3 groups, each with 10 distinct ages seen twice
+	for i := 0; i < 2; i++ {
+		insertGroupedTuples(t, hf, tid, 30, 3)
+	}
+	gbyFields := []Expr{&FieldExpr{hf.Descriptor().Fields[0]}}
+
+	ca := NewDistinctAggState(&CountAggState{})
+	ca.SetMaxValues(4)
+	expr := FieldExpr{t1.Desc.Fields[1]}
+	ca.Init("count", &expr, nil)
+
+	agg := NewGroupedAggregator([]AggState{ca}, gbyFields, hf)
+	agg.SetMaxGroups(2)
+	iter, err := agg.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	fields := []FieldType{
+		{"name", "", StringType},
+		{"count", "", IntType},
+	}
+	var ts []*Tuple
+	for g := 0; g < 3; g++ {
+		ts = append(ts, &Tuple{TupleDesc{fields},
+			[]DBValue{
+				StringField{fmt.Sprintf("name%d", g)},
+				IntField{10},
+			}, nil})
+	}
+	if !CheckIfOutputMatches(iter, ts) {
+		t.Errorf("distinct count did not match expected groups")
+	}
+}
+
+// failingExpr is an expression whose evaluation always fails
+type failingExpr struct {
+	FieldExpr
+}
+
+func (e *failingExpr) EvalExpr(_ *Tuple) (DBValue, error) {
+	return nil, GoDBError{TypeMismatchError, "cannot evaluate"}
+}
+
+func TestDistinctAggErrors(t *testing.T) {
+	_, t1, _, hf, _, tid := makeTestVars()
+	insertGroupedTuples(t, hf, tid, 30, 3)
+	run := func(expr Expr) error {
+		ca := NewDistinctAggState(&CountAggState{})
+		ca.SetMaxValues(4)
+		ca.Init("count", expr, nil)
+		iter, err := NewAggregator([]AggState{ca}, hf).Iterator(tid)
+		if err != nil {
+			return err
+		}
+		_, err = iter()
+		return err
+	}
+
+	// a value that cannot be evaluated
+	if err := run(&failingExpr{FieldExpr{t1.Desc.Fields[1]}}); err == nil {
+		t.Errorf("expected an error evaluating the aggregate")
+	}
+	// values that cannot be spilled
+	t.Setenv("TMPDIR", filepath.Join(t.TempDir(), "missing"))
+	if err := run(&FieldExpr{t1.Desc.Fields[1]}); err == nil {
+		t.Errorf("expected an error spilling the distinct values")
+	}
+}
+
+func TestDistinctAggCopy(t *testing.T) {
+	_, t1, _, _, _, _ := makeTestVars()
+	tuple := func(age int64) *Tuple {
+		return &Tuple{t1.Desc, []DBValue{StringField{"sam"}, IntField{age}}, nil}
+	}
+	ca := NewDistinctAggState(&CountAggState{})
+	ca.SetMaxValues(2)
+	ca.Init("count", &FieldExpr{t1.Desc.Fields[1]}, nil)
+	for _, age := range []int64{1, 2, 1, 3, 4, 3} {
+		ca.AddTuple(tuple(age))
+	}
+
+	// the copy has the values seen and spilled so far, but not those added
+	// to the original afterwards
+	cp := ca.Copy()
+	ca.AddTuple(tuple(5))
+	cp.AddTuple(tuple(2))
+	cp.AddTuple(tuple(4))
+	for _, c := range []struct {
+		as       AggState
+		expected int64
+	}{{cp, 4}, {ca, 5}} {
+		tup, err := finalizeAggStates(nil, []AggState{c.as})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if n := tup.Fields[0].(IntField).Value; n != c.expected {
+			t.Errorf("expected a count of %d, got %d", c.expected, n)
+		}
+	}
+}
@@ -1,6 +1,14 @@
 package godb
 
-import "golang.org/x/exp/constraints"
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/hashstructure/v2"
+	"golang.org/x/exp/constraints"
+)
 
 type Number interface {
 	constraints.Integer | constraints.Float
@@ -27,6 +35,73 @@ type AggState interface {
 	GetTupleDesc() *TupleDesc
 }
 
+// interface for an aggregation state that can be computed in parallel: each
+// worker aggregates part of the input into its own copy of the state, and the
+// partial states are then combined with Merge
+type MergeableAggState interface {
+	AggState
+
+	// Adds the partial aggregate of other, which must be a state of the same
+	// type and have been initialized identically, to this state.
+	Merge(other AggState) error
+}
+
+// interface for an aggregation state that may fail to add tuples, e.g.,
+// because they could not be spilled to disk; aggregation fails with the
+// first error of such a state once it is finalized
+type failingAggState interface {
+	aggError() error
+}
+
+// Finalize states, appending their results to t, or return the first error a
+// state failed with.
+func finalizeAggStates(t *Tuple, states []AggState) (*Tuple, error) {
+	for _, as := range states {
+		t = joinTuples(t, as.Finalize())
+		if f, ok := as.(failingAggState); ok {
+			if err := f.aggError(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return t, nil
+}
+
+// interface for an aggregation state that holds resources, such as spill
+// files, until it is finalized
+type aggStateCloser interface {
+	close()
+}
+
+// Release the resources of aggregation states that are abandoned without
+// being finalized.
+func closeAggStates(states []AggState) {
+	for _, as := range states {
+		if c, ok := as.(aggStateCloser); ok {
+			c.close()
+		}
+	}
+}
+
+func mergeTypeError(a AggState, other AggState) error {
+	return GoDBError{TypeMismatchError, fmt.Sprintf("cannot merge aggregation state %T into %T", other, a)}
+}
+
+// interface for an aggregation state that can add many rows at once, given
+// the values of its expression for a batch of rows; see
+// [Aggregator.BatchIterator]
+type batchAggState interface {
+	AggState
+
+	// Returns the expression whose values addRows expects, or nil if the
+	// state does not use the values of its input.
+	batchExpr() Expr
+
+	// Adds the rows at the specified positions of a batch, where v holds the
+	// values of batchExpr for the rows of the batch.
+	addRows(v *Vector, rows []int)
+}
+
 // Implements the aggregation state for COUNT
 type CountAggState struct {
 	alias string
@@ -38,6 +113,15 @@ func (a *CountAggState) Copy() AggState {
 	return &CountAggState{a.alias, a.expr, a.count}
 }
 
+func (a *CountAggState) Merge(other AggState) error {
+	o, ok := other.(*CountAggState)
+	if !ok {
+		return mergeTypeError(a, other)
+	}
+	a.count += o.count
+	return nil
+}
+
 func (a *CountAggState) Init(alias string, expr Expr, getter func(DBValue) any) error {
 	a.count = 0
 	a.expr = expr
@@ -49,6 +133,14 @@ func (a *CountAggState) AddTuple(t *Tuple) {
 	a.count++
 }
 
+func (a *CountAggState) batchExpr() Expr {
+	return nil
+}
+
+func (a *CountAggState) addRows(_ *Vector, rows []int) {
+	a.count += len(rows)
+}
+
 func (a *CountAggState) Finalize() *Tuple {
 	td := a.GetTupleDesc()
 	f := IntField{int64(a.count)}
@@ -80,6 +172,15 @@ func (a *SumAggState[T]) Copy() AggState {
 	return &SumAggState[T]{a.alias, a.expr, a.sum, a.getter} // TODO change me
 }
 
+func (a *SumAggState[T]) Merge(other AggState) error {
+	o, ok := other.(*SumAggState[T])
+	if !ok {
+		return mergeTypeError(a, other)
+	}
+	a.sum += o.sum
+	return nil
+}
+
 func intAggGetter(v DBValue) any {
 	// TODO: some code goes here
 	intV := v.(IntField)
@@ -113,6 +214,17 @@ func (a *SumAggState[T]) AddTuple(t *Tuple) {
 	a.sum += val
 }
 
+func (a *SumAggState[T]) batchExpr() Expr {
+	return a.expr
+}
+
+func (a *SumAggState[T]) addRows(v *Vector, rows []int) {
+	vals := vectorValues(v, func(v DBValue) T { return a.getter(v).(T) })
+	for _, r := range rows {
+		a.sum += vals[r]
+	}
+}
+
 func (a *SumAggState[T]) GetTupleDesc() *TupleDesc {
 	// TODO: some code goes here
 	// 构造Desc
@@ -165,6 +277,16 @@ func (a *AvgAggState[T]) Copy() AggState {
 	return &AvgAggState[T]{a.alias, a.expr, a.sum, a.count, a.getter} // TODO change me
 }
 
+func (a *AvgAggState[T]) Merge(other AggState) error {
+	o, ok := other.(*AvgAggState[T])
+	if !ok {
+		return mergeTypeError(a, other)
+	}
+	a.sum += o.sum
+	a.count += o.count
+	return nil
+}
+
 func (a *AvgAggState[T]) Init(alias string, expr Expr, getter func(DBValue) any) error {
 	// TODO: some code goes here
 	a.alias = alias
@@ -186,6 +308,18 @@ func (a *AvgAggState[T]) AddTuple(t *Tuple) {
 	a.count++
 }
 
+func (a *AvgAggState[T]) batchExpr() Expr {
+	return a.expr
+}
+
+func (a *AvgAggState[T]) addRows(v *Vector, rows []int) {
+	vals := vectorValues(v, func(v DBValue) T { return a.getter(v).(T) })
+	for _, r := range rows {
+		a.sum += vals[r]
+	}
+	a.count += len(rows)
+}
+
 func (a *AvgAggState[T]) GetTupleDesc() *TupleDesc {
 	// TODO: some code goes here
 	var ft FieldType
@@ -231,6 +365,18 @@ func (a *MaxAggState[T]) Copy() AggState {
 	return &MaxAggState[T]{a.alias, a.expr, a.max, true, a.getter}
 }
 
+func (a *MaxAggState[T]) Merge(other AggState) error {
+	o, ok := other.(*MaxAggState[T])
+	if !ok {
+		return mergeTypeError(a, other)
+	}
+	if !o.null && (a.null || o.max > a.max) {
+		a.max = o.max
+		a.null = false
+	}
+	return nil
+}
+
 func (a *MaxAggState[T]) Init(alias string, expr Expr, getter func(DBValue) any) error {
 	a.expr = expr
 	a.getter = getter
@@ -252,6 +398,22 @@ func (a *MaxAggState[T]) AddTuple(t *Tuple) {
 	}
 }
 
+func (a *MaxAggState[T]) batchExpr() Expr {
+	return a.expr
+}
+
+func (a *MaxAggState[T]) addRows(v *Vector, rows []int) {
+	vals := vectorValues(v, func(v DBValue) T { return a.getter(v).(T) })
+	for _, r := range rows {
+		if a.null {
+			a.max = vals[r]
+			a.null = false
+		} else if vals[r] > a.max {
+			a.max = vals[r]
+		}
+	}
+}
+
 func (a *MaxAggState[T]) GetTupleDesc() *TupleDesc {
 	var ft FieldType
 	switch any(a.max).(type) {
@@ -298,6 +460,18 @@ func (a *MinAggState[T]) Copy() AggState {
 	return &MinAggState[T]{a.alias, a.expr, a.min, a.null, a.getter} // TODO change me
 }
 
+func (a *MinAggState[T]) Merge(other AggState) error {
+	o, ok := other.(*MinAggState[T])
+	if !ok {
+		return mergeTypeError(a, other)
+	}
+	if !o.null && (a.null || o.min < a.min) {
+		a.min = o.min
+		a.null = false
+	}
+	return nil
+}
+
 func (a *MinAggState[T]) Init(alias string, expr Expr, getter func(DBValue) any) error {
 	// TODO: some code goes here
 	a.alias = alias
@@ -322,6 +496,22 @@ func (a *MinAggState[T]) AddTuple(t *Tuple) {
 	}
 }
 
+func (a *MinAggState[T]) batchExpr() Expr {
+	return a.expr
+}
+
+func (a *MinAggState[T]) addRows(v *Vector, rows []int) {
+	vals := vectorValues(v, func(v DBValue) T { return a.getter(v).(T) })
+	for _, r := range rows {
+		if a.null {
+			a.min = vals[r]
+			a.null = false
+		} else if vals[r] < a.min {
+			a.min = vals[r]
+		}
+	}
+}
+
 func (a *MinAggState[T]) GetTupleDesc() *TupleDesc {
 	// TODO: some code goes here
 	var ft FieldType
@@ -351,3 +541,496 @@ func (a *MinAggState[T]) Finalize() *Tuple {
 	t := Tuple{*td, fs, nil}
 	return &t // TODO change me
 }
+
+// Default number of distinct values a [DistinctAggState] keeps in memory
+// before spilling values to disk
+const DefaultMaxDistinctValues int = 100000
+
+// Implements DISTINCT aggregates, e.g., COUNT(DISTINCT x), by wrapping another
+// aggregation state: a tuple is only passed on to the wrapped state the first
+// time its aggregate value is seen.
+//
+// At most maxValues distinct values are remembered in memory.  Tuples with
+// values that are not in memory once it is full are spilled to disk, and are
+// deduplicated one hash partition at a time in [DistinctAggState.Finalize].
+type DistinctAggState struct {
+	agg       AggState
+	expr      Expr
+	seen      map[DBValue]*Tuple // a tuple with each distinct value seen
+	maxValues int
+	spilled   *spillFile
+	err       error // first error adding a tuple, returned by aggError
+}
+
+// Construct a DISTINCT aggregation state that wraps agg.  The returned state
+// must still be initialized with [DistinctAggState.Init].
+func NewDistinctAggState(agg AggState) *DistinctAggState {
+	return &DistinctAggState{agg: agg, maxValues: DefaultMaxDistinctValues}
+}
+
+// Set the maximum number of distinct values kept in memory before spilling.
+func (a *DistinctAggState) SetMaxValues(maxValues int) {
+	a.maxValues = maxValues
+}
+
+// Copies the distinct values seen, including the spilled ones, which are
+// written to a spill file of the copy.
+func (a *DistinctAggState) Copy() AggState {
+	c := &DistinctAggState{agg: a.agg.Copy(), expr: a.expr, maxValues: a.maxValues, err: a.err}
+	if a.seen != nil {
+		c.seen = make(map[DBValue]*Tuple, len(a.seen))
+		for v, t := range a.seen {
+			c.seen[v] = t
+		}
+	}
+	if a.spilled != nil && c.err == nil {
+		c.err = c.copySpilled(a.spilled)
+	}
+	return c
+}
+
+// Write the tuples of s to a new spill file of the state.
+func (a *DistinctAggState) copySpilled(s *spillFile) error {
+	iter, err := s.iterator()
+	if err != nil {
+		return err
+	}
+	if a.spilled, err = newSpillFile(s.desc); err != nil {
+		return err
+	}
+	for {
+		t, err := iter()
+		if err != nil || t == nil {
+			return err
+		}
+		if err := a.spilled.append(t); err != nil {
+			return err
+		}
+	}
+}
+
+// Adds the values of other that have not been seen by this state to the
+// wrapped state; spilled tuples of other are spilled by this state too.
+func (a *DistinctAggState) Merge(other AggState) error {
+	o, ok := other.(*DistinctAggState)
+	if !ok {
+		return mergeTypeError(a, other)
+	}
+	if o.err != nil {
+		return o.err
+	}
+	for _, t := range o.seen {
+		a.AddTuple(t)
+	}
+	if o.spilled != nil {
+		iter, err := o.spilled.iterator()
+		if err != nil {
+			return err
+		}
+		for {
+			t, err := iter()
+			if err != nil {
+				return err
+			}
+			if t == nil {
+				break
+			}
+			a.AddTuple(t)
+		}
+		o.spilled.close()
+		o.spilled = nil
+	}
+	return a.err
+}
+
+// Remove the spill file of the state, if the aggregation is abandoned
+// before the state is finalized.
+func (a *DistinctAggState) close() {
+	if a.spilled != nil {
+		a.spilled.close()
+		a.spilled = nil
+	}
+}
+
+func (a *DistinctAggState) Init(alias string, expr Expr, getter func(DBValue) any) error {
+	a.expr = expr
+	a.seen = make(map[DBValue]*Tuple)
+	return a.agg.Init(alias, expr, getter)
+}
+
+func (a *DistinctAggState) AddTuple(t *Tuple) {
+	if a.err != nil {
+		return
+	}
+	v, err := a.expr.EvalExpr(t)
+	if err != nil {
+		a.err = err
+		return
+	}
+	if a.seen[v] != nil {
+		return
+	}
+	if a.maxValues > 0 && len(a.seen) >= a.maxValues {
+		// 内存中的去重集合已满，写入spill文件，在Finalize时再去重
+		if a.spilled == nil {
+			if a.spilled, err = newSpillFile(&t.Desc); err != nil {
+				a.err = err
+				return
+			}
+		}
+		if err := a.spilled.append(t); err != nil {
+			a.err = err
+		}
+		return
+	}
+	a.seen[v] = t
+	a.agg.AddTuple(t)
+}
+
+// Deduplicate the spilled tuples by splitting them into hash partitions on
+// their aggregate value, so that only one partition's values are held in
+// memory at a time, and add the new values to the wrapped state.
+func (a *DistinctAggState) addSpilled() error {
+	defer func() {
+		a.spilled.close()
+		a.spilled = nil
+	}()
+	iter, err := a.spilled.iterator()
+	if err != nil {
+		return err
+	}
+	partitions := make([]*spillFile, aggSpillPartitions)
+	defer func() {
+		for _, p := range partitions {
+			if p != nil {
+				p.close()
+			}
+		}
+	}()
+	for {
+		t, err := iter()
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			break
+		}
+		v, err := a.expr.EvalExpr(t)
+		if err != nil {
+			return err
+		}
+		if a.seen[v] != nil {
+			continue
+		}
+		hash, _ := hashstructure.Hash(v, hashstructure.FormatV2, nil)
+		p := spillPartition(hash, 0)
+		if partitions[p] == nil {
+			if partitions[p], err = newSpillFile(a.spilled.desc); err != nil {
+				return err
+			}
+		}
+		if err := partitions[p].append(t); err != nil {
+			return err
+		}
+	}
+	for _, p := range partitions {
+		if p == nil {
+			continue
+		}
+		partIter, err := p.iterator()
+		if err != nil {
+			return err
+		}
+		partSeen := make(map[DBValue]bool)
+		for {
+			t, err := partIter()
+			if err != nil {
+				return err
+			}
+			if t == nil {
+				break
+			}
+			v, err := a.expr.EvalExpr(t)
+			if err != nil {
+				return err
+			}
+			if partSeen[v] {
+				continue
+			}
+			partSeen[v] = true
+			a.agg.AddTuple(t)
+		}
+	}
+	return nil
+}
+
+// Finalize the wrapped state once the spilled tuples, if any, have been
+// deduplicated; an error doing so is returned by aggError.
+func (a *DistinctAggState) Finalize() *Tuple {
+	if a.spilled != nil {
+		if err := a.addSpilled(); err != nil && a.err == nil {
+			a.err = err
+		}
+	}
+	return a.agg.Finalize()
+}
+
+func (a *DistinctAggState) aggError() error {
+	return a.err
+}
+
+func (a *DistinctAggState) GetTupleDesc() *TupleDesc {
+	return a.agg.GetTupleDesc()
+}
+
+// Implements the aggregation states for VAR_SAMP, VAR_POP, STDDEV_SAMP and
+// STDDEV_POP over ints.  The variance is computed incrementally with
+// Welford's algorithm; like AVG, the result is truncated to an int.  A sample
+// variance of fewer than two values, or a population variance of no values,
+// is 0.
+type VarianceAggState struct {
+	alias  string
+	expr   Expr
+	count  int
+	mean   float64
+	m2     float64 // sum of squared differences from the current mean
+	sample bool    // sample (n - 1) rather than population (n) variance
+	stddev bool    // return the square root of the variance
+	getter func(DBValue) any
+}
+
+func (a *VarianceAggState) Copy() AggState {
+	return &VarianceAggState{a.alias, a.expr, a.count, a.mean, a.m2, a.sample, a.stddev, a.getter}
+}
+
+// Combines the partial variances with the parallel variant of Welford's
+// algorithm (Chan et al.)
+func (a *VarianceAggState) Merge(other AggState) error {
+	o, ok := other.(*VarianceAggState)
+	if !ok {
+		return mergeTypeError(a, other)
+	}
+	if o.count == 0 {
+		return nil
+	}
+	n := float64(a.count + o.count)
+	delta := o.mean - a.mean
+	a.m2 += o.m2 + delta*delta*float64(a.count)*float64(o.count)/n
+	a.mean += delta * float64(o.count) / n
+	a.count += o.count
+	return nil
+}
+
+func (a *VarianceAggState) Init(alias string, expr Expr, getter func(DBValue) any) error {
+	a.alias = alias
+	a.expr = expr
+	a.getter = getter
+	a.count = 0
+	a.mean = 0
+	a.m2 = 0
+	return nil
+}
+
+func (a *VarianceAggState) AddTuple(t *Tuple) {
+	v, err := a.expr.EvalExpr(t)
+	if err != nil {
+		return
+	}
+	val := float64(a.getter(v).(int64))
+	a.count++
+	delta := val - a.mean
+	a.mean += delta / float64(a.count)
+	a.m2 += delta * (val - a.mean)
+}
+
+func (a *VarianceAggState) GetTupleDesc() *TupleDesc {
+	return &TupleDesc{[]FieldType{{a.alias, "", IntType}}}
+}
+
+func (a *VarianceAggState) Finalize() *Tuple {
+	n := a.count
+	if a.sample {
+		n--
+	}
+	variance := 0.0
+	if n > 0 {
+		variance = a.m2 / float64(n)
+	}
+	if a.stddev {
+		variance = math.Sqrt(variance)
+	}
+	return &Tuple{*a.GetTupleDesc(), []DBValue{IntField{int64(variance)}}, nil}
+}
+
+// Implements the aggregation states for MEDIAN, PERCENTILE_CONT and
+// PERCENTILE_DISC over ints.  All values of a group are kept in memory until
+// Finalize.  PERCENTILE_DISC returns the first value whose position in the
+// sorted values is at least fraction; PERCENTILE_CONT (and MEDIAN, which is
+// PERCENTILE_CONT with a fraction of 0.5) linearly interpolates between the
+// two nearest values, truncating the result to an int.
+type PercentileAggState struct {
+	alias    string
+	expr     Expr
+	values   []int64
+	fraction float64 // between 0 and 1
+	discrete bool
+	getter   func(DBValue) any
+}
+
+func (a *PercentileAggState) Copy() AggState {
+	values := make([]int64, len(a.values))
+	copy(values, a.values)
+	return &PercentileAggState{a.alias, a.expr, values, a.fraction, a.discrete, a.getter}
+}
+
+func (a *PercentileAggState) Merge(other AggState) error {
+	o, ok := other.(*PercentileAggState)
+	if !ok {
+		return mergeTypeError(a, other)
+	}
+	a.values = append(a.values, o.values...)
+	return nil
+}
+
+func (a *PercentileAggState) Init(alias string, expr Expr, getter func(DBValue) any) error {
+	if a.fraction < 0 || a.fraction > 1 {
+		return GoDBError{IllegalOperationError, fmt.Sprintf("percentile %v is not between 0 and 1", a.fraction)}
+	}
+	a.alias = alias
+	a.expr = expr
+	a.getter = getter
+	a.values = nil
+	return nil
+}
+
+func (a *PercentileAggState) AddTuple(t *Tuple) {
+	v, err := a.expr.EvalExpr(t)
+	if err != nil {
+		return
+	}
+	a.values = append(a.values, a.getter(v).(int64))
+}
+
+func (a *PercentileAggState) GetTupleDesc() *TupleDesc {
+	return &TupleDesc{[]FieldType{{a.alias, "", IntType}}}
+}
+
+func (a *PercentileAggState) Finalize() *Tuple {
+	var result int64
+	n := len(a.values)
+	if n > 0 {
+		sort.Slice(a.values, func(i, j int) bool { return a.values[i] < a.values[j] })
+		if a.discrete {
+			idx := int(math.Ceil(a.fraction*float64(n))) - 1
+			if idx < 0 {
+				idx = 0
+			}
+			result = a.values[idx]
+		} else {
+			pos := a.fraction * float64(n-1)
+			lo := int(math.Floor(pos))
+			hi := int(math.Ceil(pos))
+			loVal := float64(a.values[lo])
+			result = int64(loVal + (float64(a.values[hi])-loVal)*(pos-float64(lo)))
+		}
+	}
+	return &Tuple{*a.GetTupleDesc(), []DBValue{IntField{result}}, nil}
+}
+
+// Implements the aggregation state for STRING_AGG (or GROUP_CONCAT), which
+// concatenates the values of a group, separated by sep.  Int values are
+// formatted in decimal.  If orderBy is non-empty, values are concatenated in
+// the order of these expressions (evaluated on the input tuples), otherwise
+// in input order.
+type StringAggState struct {
+	alias     string
+	expr      Expr
+	sep       string
+	orderBy   []Expr
+	ascending []bool
+	tuples    []*Tuple // input tuples, kept to sort on orderBy in Finalize
+	values    []string
+}
+
+func (a *StringAggState) Copy() AggState {
+	tuples := make([]*Tuple, len(a.tuples))
+	copy(tuples, a.tuples)
+	values := make([]string, len(a.values))
+	copy(values, a.values)
+	return &StringAggState{a.alias, a.expr, a.sep, a.orderBy, a.ascending, tuples, values}
+}
+
+func (a *StringAggState) Merge(other AggState) error {
+	o, ok := other.(*StringAggState)
+	if !ok {
+		return mergeTypeError(a, other)
+	}
+	a.values = append(a.values, o.values...)
+	a.tuples = append(a.tuples, o.tuples...)
+	return nil
+}
+
+// Sets the expressions the concatenated values are ordered by.  Must be
+// called before Init.
+func (a *StringAggState) setOrderBy(orderBy []Expr, ascending []bool) {
+	a.orderBy = orderBy
+	a.ascending = ascending
+}
+
+func (a *StringAggState) Init(alias string, expr Expr, getter func(DBValue) any) error {
+	if len(a.orderBy) != len(a.ascending) {
+		return GoDBError{MalformedDataError, "length of orderBy and ascending not equal"}
+	}
+	a.alias = alias
+	a.expr = expr
+	a.tuples = nil
+	a.values = nil
+	return nil
+}
+
+func (a *StringAggState) AddTuple(t *Tuple) {
+	v, err := a.expr.EvalExpr(t)
+	if err != nil {
+		return
+	}
+	var str string
+	switch v := v.(type) {
+	case IntField:
+		str = fmt.Sprintf("%d", v.Value)
+	case StringField:
+		str = v.Value
+	}
+	a.values = append(a.values, str)
+	if len(a.orderBy) > 0 {
+		a.tuples = append(a.tuples, t)
+	}
+}
+
+func (a *StringAggState) GetTupleDesc() *TupleDesc {
+	return &TupleDesc{[]FieldType{{a.alias, "", StringType}}}
+}
+
+func (a *StringAggState) Finalize() *Tuple {
+	values := a.values
+	if len(a.orderBy) > 0 {
+		idx := make([]int, len(a.tuples))
+		for i := range idx {
+			idx[i] = i
+		}
+		sort.SliceStable(idx, func(i, j int) bool {
+			for k, e := range a.orderBy {
+				res, err := a.tuples[idx[i]].compareField(a.tuples[idx[j]], e)
+				if err != nil || res == OrderedEqual {
+					continue
+				}
+				return (res == OrderedLessThan) == a.ascending[k]
+			}
+			return false
+		})
+		values = make([]string, len(idx))
+		for i, j := range idx {
+			values[i] = a.values[j]
+		}
+	}
+	return &Tuple{*a.GetTupleDesc(), []DBValue{StringField{strings.Join(values, a.sep)}}, nil}
+}
@@ -0,0 +1,237 @@
+package godb
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// AggregateFactory creates an empty aggregation state for an aggregate
+// function.  argType is the type of the aggregated expression (the first
+// argument of the function), and params are the values of the remaining
+// arguments, which must be constants, e.g., the separator of string_agg.  The
+// factory should return an error if argType or params are not supported.
+//
+// The returned state is initialized by the planner with [AggState.Init].
+// States that also implement [MergeableAggState] can be computed in parallel.
+type AggregateFactory func(argType DBType, params []DBValue) (AggState, error)
+
+// interface for aggregation states whose result depends on the order of
+// their input, e.g., group_concat(x order by y)
+type orderedAggState interface {
+	setOrderBy(orderBy []Expr, ascending []bool)
+}
+
+var aggregatesMutex sync.RWMutex
+
+var aggregates = map[string]AggregateFactory{
+	//note should all be lower case
+	"count":           countAggFactory,
+	"sum":             sumAggFactory,
+	"avg":             avgAggFactory,
+	"min":             minAggFactory,
+	"max":             maxAggFactory,
+	"var_samp":        varianceAggFactory(true, false),
+	"variance":        varianceAggFactory(true, false),
+	"var_pop":         varianceAggFactory(false, false),
+	"stddev_samp":     varianceAggFactory(true, true),
+	"stddev":          varianceAggFactory(true, true),
+	"stddev_pop":      varianceAggFactory(false, true),
+	"median":          medianAggFactory,
+	"percentile_cont": percentileAggFactory(false),
+	"percentile_disc": percentileAggFactory(true),
+	"string_agg":      stringAggFactory,
+}
+
+// Register an aggregate function, after which it can be used in queries under
+// the supplied (case insensitive) name.  factory is called once per use of the
+// function in a query to create the template aggregation state that each
+// group's state is copied from.  Returns an error if an aggregate or
+// function with the same name already exists.
+func RegisterAggregate(name string, factory AggregateFactory) error {
+	name = strings.ToLower(name)
+	if factory == nil {
+		return GoDBError{IllegalOperationError, fmt.Sprintf("nil factory for aggregate %s", name)}
+	}
+	if isFunc(name) {
+		return GoDBError{DuplicateFunctionError, fmt.Sprintf("a function named '%s' already exists", name)}
+	}
+	if isConditionalForm(name) {
+		return GoDBError{DuplicateFunctionError, fmt.Sprintf("'%s' is a built-in conditional expression", name)}
+	}
+	aggregatesMutex.Lock()
+	defer aggregatesMutex.Unlock()
+	if _, ok := aggregates[name]; ok {
+		return GoDBError{DuplicateFunctionError, fmt.Sprintf("an aggregate named '%s' already exists", name)}
+	}
+	aggregates[name] = factory
+	return nil
+}
+
+func isAgg(funcName string) bool {
+	aggregatesMutex.RLock()
+	defer aggregatesMutex.RUnlock()
+	_, ok := aggregates[funcName]
+	return ok
+}
+
+// Create the template aggregation state for the aggregate funcName.
+func newAggState(funcName string, argType DBType, params []DBValue) (AggState, error) {
+	aggregatesMutex.RLock()
+	factory, ok := aggregates[funcName]
+	aggregatesMutex.RUnlock()
+	if !ok {
+		return nil, GoDBError{IllegalOperationError, fmt.Sprintf("unknown aggregate function %s", funcName)}
+	}
+	as, err := factory(argType, params)
+	if err != nil {
+		return nil, err
+	}
+	if as == nil {
+		return nil, GoDBError{MalformedDataError, fmt.Sprintf("aggregate %s returned a nil state", funcName)}
+	}
+	return as, nil
+}
+
+// Return a getter that extracts the Go value of a DBValue of the given type,
+// as expected by [AggState.Init].
+func aggGetter(t DBType) func(DBValue) any {
+	switch t {
+	case IntType:
+		return intAggGetter
+	case StringType:
+		return stringAggGetter
+	}
+	return nil
+}
+
+func listOfAggregates() string {
+	aggregatesMutex.RLock()
+	names := make([]string, 0, len(aggregates))
+	for name := range aggregates {
+		names = append(names, name)
+	}
+	aggregatesMutex.RUnlock()
+	sort.Strings(names)
+	aList := ""
+	for _, name := range names {
+		aList = aList + "\t" + name + "(...) [aggregate]\n"
+	}
+	return aList
+}
+
+func checkAggParams(name string, params []DBValue, n int) error {
+	if len(params) != n {
+		return GoDBError{ParseError, fmt.Sprintf("expected %d argument(s) to aggregate %s", n+1, name)}
+	}
+	return nil
+}
+
+func checkAggIntArg(name string, argType DBType) error {
+	if argType != IntType {
+		return GoDBError{TypeMismatchError, fmt.Sprintf("aggregate %s requires an int argument", name)}
+	}
+	return nil
+}
+
+func countAggFactory(argType DBType, params []DBValue) (AggState, error) {
+	if err := checkAggParams("count", params, 0); err != nil {
+		return nil, err
+	}
+	return &CountAggState{}, nil
+}
+
+func sumAggFactory(argType DBType, params []DBValue) (AggState, error) {
+	if err := checkAggParams("sum", params, 0); err != nil {
+		return nil, err
+	}
+	return &SumAggState[int64]{}, nil
+}
+
+func avgAggFactory(argType DBType, params []DBValue) (AggState, error) {
+	if err := checkAggParams("avg", params, 0); err != nil {
+		return nil, err
+	}
+	return &AvgAggState[int64]{}, nil
+}
+
+func minAggFactory(argType DBType, params []DBValue) (AggState, error) {
+	if err := checkAggParams("min", params, 0); err != nil {
+		return nil, err
+	}
+	if argType == StringType {
+		return &MinAggState[string]{}, nil
+	}
+	return &MinAggState[int64]{}, nil
+}
+
+func maxAggFactory(argType DBType, params []DBValue) (AggState, error) {
+	if err := checkAggParams("max", params, 0); err != nil {
+		return nil, err
+	}
+	if argType == StringType {
+		return &MaxAggState[string]{}, nil
+	}
+	return &MaxAggState[int64]{}, nil
+}
+
+func varianceAggFactory(sample bool, stddev bool) AggregateFactory {
+	return func(argType DBType, params []DBValue) (AggState, error) {
+		if err := checkAggParams("variance", params, 0); err != nil {
+			return nil, err
+		}
+		if err := checkAggIntArg("variance", argType); err != nil {
+			return nil, err
+		}
+		return &VarianceAggState{sample: sample, stddev: stddev}, nil
+	}
+}
+
+func medianAggFactory(argType DBType, params []DBValue) (AggState, error) {
+	if err := checkAggParams("median", params, 0); err != nil {
+		return nil, err
+	}
+	if err := checkAggIntArg("median", argType); err != nil {
+		return nil, err
+	}
+	return &PercentileAggState{fraction: 0.5}, nil
+}
+
+func percentileAggFactory(discrete bool) AggregateFactory {
+	return func(argType DBType, params []DBValue) (AggState, error) {
+		if err := checkAggParams("percentile", params, 1); err != nil {
+			return nil, err
+		}
+		if err := checkAggIntArg("percentile", argType); err != nil {
+			return nil, err
+		}
+		var fraction float64
+		switch p := params[0].(type) {
+		case IntField:
+			fraction = float64(p.Value)
+		case StringField:
+			var err error
+			fraction, err = strconv.ParseFloat(p.Value, 64)
+			if err != nil {
+				return nil, GoDBError{ParseError, fmt.Sprintf("expected numeric percentile, got %s", p.Value)}
+			}
+		}
+		return &PercentileAggState{fraction: fraction, discrete: discrete}, nil
+	}
+}
+
+func stringAggFactory(argType DBType, params []DBValue) (AggState, error) {
+	if err := checkAggParams("string_agg", params, 1); err != nil {
+		return nil, err
+	}
+	var sep string
+	switch p := params[0].(type) {
+	case IntField:
+		sep = strconv.FormatInt(p.Value, 10)
+	case StringField:
+		sep = p.Value
+	}
+	return &StringAggState{sep: sep}, nil
+}
@@ -0,0 +1,144 @@
+package godb
+
+import (
+	"strings"
+	"testing"
+)
+
+// user-defined aggregate computing the product of an int expression
+type productAggState struct {
+	alias   string
+	expr    Expr
+	product int64
+}
+
+func (a *productAggState) Init(alias string, expr Expr, getter func(DBValue) any) error {
+	a.alias = alias
+	a.expr = expr
+	a.product = 1
+	return nil
+}
+
+func (a *productAggState) Copy() AggState {
+	return &productAggState{a.alias, a.expr, a.product}
+}
+
+func (a *productAggState) AddTuple(t *Tuple) {
+	v, err := a.expr.EvalExpr(t)
+	if err != nil {
+		return
+	}
+	a.product *= v.(IntField).Value
+}
+
+func (a *productAggState) Merge(other AggState) error {
+	o, ok := other.(*productAggState)
+	if !ok {
+		return mergeTypeError(a, other)
+	}
+	a.product *= o.product
+	return nil
+}
+
+func (a *productAggState) Finalize() *Tuple {
+	td := a.GetTupleDesc()
+	return &Tuple{*td, []DBValue{IntField{a.product}}, nil}
+}
+
+func (a *productAggState) GetTupleDesc() *TupleDesc {
+	return &TupleDesc{[]FieldType{{a.alias, "", IntType}}}
+}
+
+func registerProductAgg(t *testing.T) {
+	if isAgg("product") {
+		return
+	}
+	err := RegisterAggregate("Product", func(argType DBType, params []DBValue) (AggState, error) {
+		if argType != IntType {
+			return nil, GoDBError{TypeMismatchError, "product requires an int argument"}
+		}
+		return &productAggState{}, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to register aggregate, %s", err.Error())
+	}
+}
+
+func TestRegisterAggregate(t *testing.T) {
+	registerProductAgg(t)
+	c, bp := makeParserTestCatalog(t)
+
+	res := runParsedQuery(t, c, bp, "select product(age) from t where name = 'sam'")
+	if len(res) != 1 || res[0].Fields[0].(IntField).Value != 25*99 {
+		t.Errorf("unexpected product %v", res)
+	}
+	res = runParsedQuery(t, c, bp, "select name, product(distinct age) from t where name = 'sam' group by name")
+	if len(res) != 1 || res[0].Fields[1].(IntField).Value != 25*99 {
+		t.Errorf("unexpected distinct product %v", res)
+	}
+
+	_, _, err := Parse(c, "select product(name) from t")
+	if err == nil {
+		t.Errorf("expected product of strings to fail")
+	}
+
+	err = RegisterAggregate("product", func(DBType, []DBValue) (AggState, error) { return &CountAggState{}, nil })
+	if err == nil {
+		t.Errorf("expected duplicate aggregate registration to fail")
+	}
+	err = RegisterAggregate("sq", func(DBType, []DBValue) (AggState, error) { return &CountAggState{}, nil })
+	if err == nil {
+		t.Errorf("expected aggregate with the name of a function to fail")
+	}
+
+	if !strings.Contains(ListOfFunctions(), "product(...) [aggregate]") {
+		t.Errorf("expected registered aggregate in the list of functions")
+	}
+}
+
+func TestMergeAggStates(t *testing.T) {
+	td := TupleDesc{[]FieldType{{"age", "", IntType}}}
+	expr := &FieldExpr{td.Fields[0]}
+	templates := []MergeableAggState{
+		&CountAggState{},
+		&SumAggState[int64]{},
+		&AvgAggState[int64]{},
+		&MaxAggState[int64]{},
+		&MinAggState[int64]{},
+		&VarianceAggState{sample: true},
+		&PercentileAggState{fraction: 0.5},
+		&StringAggState{sep: ","},
+		NewDistinctAggState(&SumAggState[int64]{}),
+		&productAggState{},
+	}
+	vals := []int64{5, 3, 8, 3, 1, 9, 4}
+	for _, tmpl := range templates {
+		if err := tmpl.Init("agg", expr, intAggGetter); err != nil {
+			t.Fatalf("failed to init %T, %s", tmpl, err.Error())
+		}
+		whole := tmpl.Copy()
+		left := tmpl.Copy().(MergeableAggState)
+		right := tmpl.Copy()
+		for i, v := range vals {
+			tup := &Tuple{td, []DBValue{IntField{v}}, nil}
+			whole.AddTuple(tup)
+			if i < 3 {
+				left.AddTuple(tup)
+			} else {
+				right.AddTuple(tup)
+			}
+		}
+		if err := left.Merge(right); err != nil {
+			t.Fatalf("failed to merge %T, %s", tmpl, err.Error())
+		}
+		expected := whole.Finalize()
+		got := left.Finalize()
+		if !expected.equals(got) {
+			t.Errorf("%T: merged result %v differs from %v", tmpl, got.Fields, expected.Fields)
+		}
+	}
+
+	if err := (&CountAggState{}).Merge(&SumAggState[int64]{}); err == nil {
+		t.Errorf("expected merge of different aggregates to fail")
+	}
+}
@@ -0,0 +1,124 @@
+package godb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Analyze computes the statistics of tables (see [TableStats]), records them
+// in the catalog for the optimizer, and returns a tuple with the number of
+// rows and pages of each table.
+type Analyze struct {
+	c      *Catalog
+	tables []string
+	desc   *TupleDesc
+}
+
+// Construct an Analyze operator for the named tables, or for all tables of
+// the catalog if there are none.
+func NewAnalyzeOp(c *Catalog, tables []string) (*Analyze, error) {
+	if len(tables) == 0 {
+		for _, t := range c.tables {
+			tables = append(tables, t.name)
+		}
+	}
+	for _, name := range tables {
+		if _, err := c.GetTable(name); err != nil {
+			return nil, err
+		}
+	}
+	desc := &TupleDesc{[]FieldType{{"table", "", StringType}, {"rows", "", IntType}, {"pages", "", IntType}}}
+	return &Analyze{c, tables, desc}, nil
+}
+
+func (a *Analyze) Descriptor() *TupleDesc {
+	return a.desc.copy()
+}
+
+// Analyze the tables and save their statistics when the iterator is created.
+func (a *Analyze) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	return a.IteratorContext(context.Background(), tid)
+}
+
+func (a *Analyze) IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error) {
+	if err := a.c.Analyze(tid, a.tables...); err != nil {
+		return nil, err
+	}
+	tuples := make([]*Tuple, len(a.tables))
+	for i, name := range a.tables {
+		s, err := a.c.TableStats(name)
+		if err != nil {
+			return nil, err
+		}
+		tuples[i] = &Tuple{*a.desc, []DBValue{StringField{name}, IntField{s.Rows}, IntField{int64(s.Pages)}}, nil}
+	}
+	return tupleSliceIterator(tuples), nil
+}
+
+// Analyze scans the named tables, or all tables if none are named, in the
+// transaction tid and records their statistics in the catalog.  If the
+// catalog was loaded from a file, the statistics are saved alongside it.
+// Statements may be planned while the tables are scanned: the statistics
+// are only published once all of them have been computed.
+func (c *Catalog) Analyze(tid TransactionID, tables ...string) error {
+	if len(tables) == 0 {
+		for _, t := range c.tables {
+			tables = append(tables, t.name)
+		}
+	}
+	stats := make([]*TableStats, len(tables))
+	for i, name := range tables {
+		s, err := c.analyzeTable(name, tid)
+		if err != nil {
+			return err
+		}
+		stats[i] = s
+	}
+	c.planState.mutex.Lock()
+	for i, name := range tables {
+		c.stats[name] = stats[i]
+	}
+	c.version++
+	c.planState.mutex.Unlock()
+	return c.saveStats()
+}
+
+// TableStats returns the statistics of the named table collected by the last
+// ANALYZE of it, or nil if it has not been analyzed.
+func (c *Catalog) TableStats(table string) (*TableStats, error) {
+	if _, err := c.GetTable(table); err != nil {
+		return nil, err
+	}
+	c.planState.mutex.RLock()
+	defer c.planState.mutex.RUnlock()
+	return c.stats[table], nil
+}
+
+// Parse an ANALYZE statement, ANALYZE [TABLE] [table [, table ...]], returning
+// false if query is not one.  The MySQL parser only accepts ANALYZE TABLE, as
+// an ALTER statement without the table names, so the statement is parsed here.
+func parseAnalyze(c *Catalog, query string) (*Analyze, bool, error) {
+	words := strings.Fields(strings.ReplaceAll(strings.TrimSuffix(strings.TrimSpace(query), ";"), ",", " , "))
+	if len(words) == 0 || strings.ToLower(words[0]) != "analyze" {
+		return nil, false, nil
+	}
+	words = words[1:]
+	if len(words) > 0 && strings.ToLower(words[0]) == "table" {
+		words = words[1:]
+		if len(words) == 0 {
+			return nil, true, GoDBError{ParseError, "analyze table expects a table name"}
+		}
+	}
+	var tables []string
+	for i, w := range words {
+		if (i%2 == 1) != (w == ",") || (i == len(words)-1 && w == ",") {
+			return nil, true, GoDBError{ParseError, fmt.Sprintf("analyze expects a comma separated list of tables, got '%s'", strings.Join(words, " "))}
+		}
+		if i%2 == 0 {
+			tables = append(tables, strings.Trim(w, "`"))
+		}
+	}
+	op, err := NewAnalyzeOp(c, tables)
+	return op, true, err
+}
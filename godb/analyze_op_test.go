@@ -0,0 +1,137 @@
+package godb
+
+import (
+	"math"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	for _, n := range []int{10, 1000, 100000} {
+		h := newHyperLogLog()
+		for i := 0; i < n; i++ {
+			h.add(IntField{int64(i)})
+			h.add(IntField{int64(i)})
+		}
+		if est := h.estimate(); math.Abs(float64(est-int64(n))) > 0.05*float64(n) {
+			t.Errorf("expected about %d distinct values, got %d", n, est)
+		}
+	}
+}
+
+func TestHistogramSelectivity(t *testing.T) {
+	var vals []DBValue
+	for i := 0; i < 10000; i++ {
+		vals = append(vals, IntField{int64(i)})
+	}
+	// a heavy hitter, filling several buckets
+	for i := 0; i < 5000; i++ {
+		vals = append(vals, IntField{9000})
+	}
+	sort.Slice(vals, func(i, j int) bool { return compareValues(vals[i], vals[j]) < 0 })
+	s := &ColumnStats{IntType, 10000, equiDepthBounds(vals, IntField{0}, IntField{9999})}
+
+	for _, c := range []struct {
+		op       BoolOp
+		v        int64
+		expected float64
+	}{
+		{OpLt, 2500, 2500.0 / 15000},
+		{OpGe, 2500, 12500.0 / 15000},
+		{OpEq, 9000, 5001.0 / 15000},
+		{OpEq, 5, 1.0 / 15000},
+		{OpLt, -1, 0},
+		{OpLe, 9999, 1},
+		{OpGt, 9999, 0},
+	} {
+		sel := s.Selectivity(c.op, IntField{c.v})
+		if math.Abs(sel-c.expected) > 0.03 {
+			t.Errorf("%s %d: expected selectivity %f, got %f", opToStr(c.op), c.v, c.expected, sel)
+		}
+	}
+	if sel := s.Selectivity(OpEq, StringField{"x"}); sel != defaultRangeSelectivity {
+		t.Errorf("expected default selectivity for a value of another type, got %f", sel)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+	c.statsFile = filepath.Join(t.TempDir(), "catalog.stats.json")
+
+	count := runParsedQuery(t, c, bp, "select count(*) from t")[0].Fields[0].(IntField).Value
+	names := runParsedQuery(t, c, bp, "select count(distinct name) from t")[0].Fields[0].(IntField).Value
+	ages := runParsedQuery(t, c, bp, "select min(age), max(age) from t")[0]
+
+	res := runParsedQuery(t, c, bp, "analyze table t")
+	if len(res) != 1 || res[0].Fields[0].(StringField).Value != "t" || res[0].Fields[1].(IntField).Value != count {
+		t.Fatalf("expected a tuple with %d rows of t, got %v", count, res)
+	}
+	s, err := c.TableStats("t")
+	if err != nil || s == nil {
+		t.Fatalf("expected statistics of t, %v", err)
+	}
+	if s.Rows != count || s.Columns["name"].Distinct != names {
+		t.Errorf("expected %d rows with %d names, got %d rows with %d names", count, names, s.Rows, s.Columns["name"].Distinct)
+	}
+	bounds := s.Columns["age"].Bounds
+	if bounds[0] != ages.Fields[0] || bounds[len(bounds)-1] != ages.Fields[1] {
+		t.Errorf("expected ages from %v to %v, got %v", ages.Fields[0], ages.Fields[1], bounds)
+	}
+	if s, _ := c.TableStats("t2"); s != nil {
+		t.Errorf("expected t2 not to be analyzed")
+	}
+
+	// the statistics are saved, and loaded with the catalog
+	if res := runParsedQuery(t, c, bp, "analyze"); len(res) != 2 {
+		t.Errorf("expected both tables to be analyzed, got %v", res)
+	}
+	loaded := *c
+	loaded.planState = &planState{stats: make(map[string]*TableStats)}
+	if err := loaded.loadStats(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !reflect.DeepEqual(loaded.stats, c.stats) {
+		t.Errorf("expected saved statistics %v, got %v", c.stats, loaded.stats)
+	}
+
+	for _, sql := range []string{"analyze nosuch", "analyze table", "analyze t,", "analyze t t2"} {
+		if _, _, err := Parse(c, sql); err == nil {
+			t.Errorf("expected '%s' to fail", sql)
+		}
+	}
+}
+
+// Statements are planned by other sessions while ANALYZE records the
+// statistics they are planned with.
+func TestAnalyzeConcurrentPlanning(t *testing.T) {
+	db := makeTestDB(t, nil)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if _, err := db.Exec("analyze t"); err != nil {
+				t.Errorf(err.Error())
+				return
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		stmt, err := db.Prepare("select a.name from t a, t b where a.age = b.age and a.age > ?")
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		plan, err := stmt.Bind(IntField{int64(i)})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		stmt.Release(plan)
+	}
+	wg.Wait()
+	if s, err := db.Catalog().TableStats("t"); err != nil || s == nil || s.Rows != 4 {
+		t.Errorf("expected the statistics of t, got %v, %v", s, err)
+	}
+}
@@ -0,0 +1,415 @@
+package godb
+
+import (
+	"context"
+	"fmt"
+)
+
+// The number of rows in the batches passed between vectorized operators.
+var BatchSize = 1024
+
+// Vector holds the values of one column of a [Batch].  Depending on Type,
+// the values are stored in either Ints or Strings.
+type Vector struct {
+	Type    DBType
+	Ints    []int64
+	Strings []string
+}
+
+// Create an empty vector of the specified type with room for capacity values.
+func newVector(t DBType, capacity int) *Vector {
+	v := &Vector{Type: t}
+	if t == StringType {
+		v.Strings = make([]string, 0, capacity)
+	} else {
+		v.Ints = make([]int64, 0, capacity)
+	}
+	return v
+}
+
+// Return the number of values in the vector.
+func (v *Vector) Len() int {
+	if v.Type == StringType {
+		return len(v.Strings)
+	}
+	return len(v.Ints)
+}
+
+// Return the ith value of the vector as a field value.
+func (v *Vector) Value(i int) DBValue {
+	if v.Type == StringType {
+		return StringField{v.Strings[i]}
+	}
+	return IntField{v.Ints[i]}
+}
+
+// Return the ith value of the vector as an int64 or a string, as passed to
+// the implementation of a function.
+func (v *Vector) raw(i int) any {
+	if v.Type == StringType {
+		return v.Strings[i]
+	}
+	return v.Ints[i]
+}
+
+// Append a field value, which must be of the vector's type.
+func (v *Vector) appendValue(val DBValue) error {
+	switch val := val.(type) {
+	case IntField:
+		if v.Type == IntType {
+			v.Ints = append(v.Ints, val.Value)
+			return nil
+		}
+	case StringField:
+		if v.Type == StringType {
+			v.Strings = append(v.Strings, val.Value)
+			return nil
+		}
+	}
+	return GoDBError{TypeMismatchError, fmt.Sprintf("cannot add %v to a vector of %s", val, typeNames[v.Type])}
+}
+
+// Append the ith value of src, which must be of the vector's type.
+func (v *Vector) appendFrom(src *Vector, i int) {
+	if v.Type == StringType {
+		v.Strings = append(v.Strings, src.Strings[i])
+	} else {
+		v.Ints = append(v.Ints, src.Ints[i])
+	}
+}
+
+// Return a new vector with the values at the specified positions.
+func (v *Vector) gather(rows []int) *Vector {
+	out := newVector(v.Type, len(rows))
+	for _, i := range rows {
+		out.appendFrom(v, i)
+	}
+	return out
+}
+
+// Return a vector of n copies of a constant.
+func constVector(val DBValue, t DBType, n int) (*Vector, error) {
+	v := newVector(t, n)
+	for i := 0; i < n; i++ {
+		if err := v.appendValue(val); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// Return the values of a vector as a slice of T, if the vector stores its
+// values as T.
+func vectorSlice[T any](v *Vector) ([]T, bool) {
+	switch v.Type {
+	case IntType:
+		s, ok := any(v.Ints).([]T)
+		return s, ok
+	case StringType:
+		s, ok := any(v.Strings).([]T)
+		return s, ok
+	}
+	return nil, false
+}
+
+// Return the values of a vector as a slice of T, using getter to convert
+// them if the vector does not store its values as T.
+func vectorValues[T any](v *Vector, getter func(DBValue) T) []T {
+	if vals, ok := vectorSlice[T](v); ok {
+		return vals
+	}
+	vals := make([]T, v.Len())
+	for i := range vals {
+		vals[i] = getter(v.Value(i))
+	}
+	return vals
+}
+
+// Batch is a set of rows stored column by column: the ith column of the
+// batch holds the values of the ith field of Desc.  Batches are passed
+// between vectorized operators in place of single tuples, and must not be
+// modified once they are returned by an iterator, since an operator may pass
+// on the columns of its input as its output.
+//
+// The rows of a batch do not carry the record ids of the tuples they were
+// read from.
+type Batch struct {
+	Desc    *TupleDesc
+	Columns []*Vector
+	n       int
+}
+
+// Create an empty batch with columns of the specified types.
+func newBatch(desc *TupleDesc, types []DBType, capacity int) *Batch {
+	cols := make([]*Vector, len(types))
+	for i, t := range types {
+		cols[i] = newVector(t, capacity)
+	}
+	return &Batch{desc, cols, 0}
+}
+
+// Return the number of rows in the batch.
+func (b *Batch) Len() int {
+	return b.n
+}
+
+// Return the ith row of the batch as a tuple.
+func (b *Batch) Tuple(i int) *Tuple {
+	fields := make([]DBValue, len(b.Columns))
+	for j, c := range b.Columns {
+		fields[j] = c.Value(i)
+	}
+	return &Tuple{*b.Desc, fields, nil}
+}
+
+// Append a tuple as a row of the batch.
+func (b *Batch) appendTuple(t *Tuple) error {
+	if len(t.Fields) != len(b.Columns) {
+		return GoDBError{MalformedDataError, fmt.Sprintf("cannot add a tuple of %d fields to a batch of %d columns", len(t.Fields), len(b.Columns))}
+	}
+	for i, f := range t.Fields {
+		if err := b.Columns[i].appendValue(f); err != nil {
+			return err
+		}
+	}
+	b.n++
+	return nil
+}
+
+// Append the row formed by the lrow'th row of left followed by the rrow'th
+// row of right, whose columns must be of the types of the batch's columns.
+func (b *Batch) appendJoined(left *Batch, lrow int, right *Batch, rrow int) {
+	for i, c := range left.Columns {
+		b.Columns[i].appendFrom(c, lrow)
+	}
+	off := len(left.Columns)
+	for i, c := range right.Columns {
+		b.Columns[off+i].appendFrom(c, rrow)
+	}
+	b.n++
+}
+
+// Return a new batch with the rows at the specified positions.
+func (b *Batch) gather(rows []int) *Batch {
+	cols := make([]*Vector, len(b.Columns))
+	for i, c := range b.Columns {
+		cols[i] = c.gather(rows)
+	}
+	return &Batch{b.Desc, cols, len(rows)}
+}
+
+// Return the index of the column that a [FieldExpr] on field reads, or -1 if
+// there is none.  As in [Tuple.project], a column whose table qualifier
+// matches is preferred, and otherwise the last column with the field's name
+// is used.
+func (b *Batch) fieldIndex(field FieldType) int {
+	idx := -1
+	for i, f := range b.Desc.Fields {
+		if f.Fname == field.Fname {
+			idx = i
+			if f.TableQualifier == field.TableQualifier {
+				break
+			}
+		}
+	}
+	return idx
+}
+
+// Return the approximate number of bytes of memory used by the ith row of
+// the batch, counted as by [tupleMemory].
+func (b *Batch) rowMemory(i int) int64 {
+	size := int64(48)
+	for _, c := range b.Columns {
+		size += 16
+		if c.Type == StringType {
+			size += int64(len(c.Strings[i]))
+		}
+	}
+	return size
+}
+
+// BatchOperator is implemented by operators that have a vectorized
+// implementation, which produces the same rows as their Iterator but a batch
+// of up to [BatchSize] rows at a time.
+type BatchOperator interface {
+	Operator
+
+	// Return an iterator over batches of the output of the operator.  The
+	// iterator returns nil once all of the output has been returned, and
+	// never returns an empty batch.
+	BatchIterator(ctx context.Context, tid TransactionID) (func() (*Batch, error), error)
+}
+
+// Return an iterator over batches of the output of op.  If op is a
+// [BatchOperator], its vectorized implementation is used; otherwise the
+// tuples of its Iterator are collected into batches, so that any operator
+// can be the child of a vectorized one.
+func BatchIterator(ctx context.Context, op Operator, tid TransactionID) (func() (*Batch, error), error) {
+	if bop, ok := op.(BatchOperator); ok {
+		return bop.BatchIterator(ctx, tid)
+	}
+	iter, err := IteratorContext(ctx, op, tid)
+	if err != nil {
+		return nil, err
+	}
+	return batchTuples(iter), nil
+}
+
+// Return an iterator over batches of the tuples of iter.  Each batch takes
+// its descriptor from its first tuple.
+func batchTuples(iter func() (*Tuple, error)) func() (*Batch, error) {
+	return func() (*Batch, error) {
+		if iter == nil {
+			return nil, nil
+		}
+		var b *Batch
+		for b == nil || b.n < BatchSize {
+			t, err := iter()
+			if err != nil {
+				return nil, err
+			}
+			if t == nil {
+				iter = nil
+				break
+			}
+			if b == nil {
+				desc := t.Desc
+				types := make([]DBType, len(t.Fields))
+				for i, f := range t.Fields {
+					if _, ok := f.(StringField); ok {
+						types[i] = StringType
+					}
+				}
+				b = newBatch(&desc, types, BatchSize)
+			}
+			if err := b.appendTuple(t); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+}
+
+// Return a tuple-at-a-time iterator over the rows of the batches of iter.
+func batchRows(iter func() (*Batch, error)) func() (*Tuple, error) {
+	var b *Batch
+	i := 0
+	return func() (*Tuple, error) {
+		for b == nil || i >= b.n {
+			if iter == nil {
+				return nil, nil
+			}
+			next, err := iter()
+			if err != nil {
+				return nil, err
+			}
+			if next == nil {
+				iter = nil
+				return nil, nil
+			}
+			b, i = next, 0
+		}
+		i++
+		return b.Tuple(i - 1), nil
+	}
+}
+
+// Return an iterator over the tuples of op.  If op is a [BatchOperator],
+// its output is computed with its vectorized implementation and then
+// returned a tuple at a time, so that op can be used in place of its
+// Iterator by a tuple-at-a-time parent; otherwise op's Iterator is used.
+func VectorizedIterator(ctx context.Context, op Operator, tid TransactionID) (func() (*Tuple, error), error) {
+	bop, ok := op.(BatchOperator)
+	if !ok {
+		return IteratorContext(ctx, op, tid)
+	}
+	iter, err := bop.BatchIterator(ctx, tid)
+	if err != nil {
+		return nil, err
+	}
+	return batchRows(iter), nil
+}
+
+// Evaluate an expression on every row of a batch, returning a vector of the
+// results.  Fields, constants and functions are evaluated a column at a
+// time; other expressions are evaluated on each row in turn.
+func evalVector(e Expr, b *Batch) (*Vector, error) {
+	switch e := e.(type) {
+	case *FieldExpr:
+		if i := b.fieldIndex(e.selectField); i >= 0 {
+			return b.Columns[i], nil
+		}
+	case *ConstExpr:
+		return constVector(e.val, e.constType, b.n)
+	case *namedExpr:
+		return evalVector(e.Expr, b)
+	case *FuncExpr:
+		if e.fType != nil {
+			return e.evalVector(b)
+		}
+	}
+	vals := make([]DBValue, b.n)
+	for i := range vals {
+		v, err := e.EvalExpr(b.Tuple(i))
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = v
+	}
+	t := e.GetExprType().Ftype
+	if len(vals) > 0 {
+		// the type of an expression is not always known before it is evaluated
+		switch vals[0].(type) {
+		case IntField:
+			t = IntType
+		case StringField:
+			t = StringType
+		}
+	}
+	v := newVector(t, len(vals))
+	for _, val := range vals {
+		if err := v.appendValue(val); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// Evaluate a function on every row of a batch, applying its implementation
+// to the vectors of its arguments.
+func (f *FuncExpr) evalVector(b *Batch) (*Vector, error) {
+	fType := *f.fType
+	args := make([]*Vector, len(f.args))
+	for i, arg := range f.args {
+		v, err := evalVector(*arg, b)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	out := newVector(fType.outType, b.n)
+	argvals := make([]any, len(args))
+	for r := 0; r < b.n; r++ {
+		for i, v := range args {
+			argvals[i] = v.raw(r)
+		}
+		result := fType.f(argvals)
+		if err, ok := result.(error); ok {
+			return nil, err
+		}
+		switch v := result.(type) {
+		case int64:
+			if out.Type == IntType {
+				out.Ints = append(out.Ints, v)
+				continue
+			}
+		case string:
+			if out.Type == StringType {
+				out.Strings = append(out.Strings, v)
+				continue
+			}
+		}
+		return nil, GoDBError{TypeMismatchError, fmt.Sprintf("function %s returned %T, expected %s", f.op, result, typeNames[fType.outType])}
+	}
+	return out, nil
+}
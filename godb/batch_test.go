@@ -0,0 +1,196 @@
+package godb
+
+import (
+	"context"
+	"testing"
+)
+
+// check that the vectorized and tuple-at-a-time iterators of op return the
+// same tuples in the same order
+func checkVectorized(t *testing.T, name string, op Operator, tid TransactionID) {
+	expected := collectTuples(t, op, tid)
+	iter, err := VectorizedIterator(context.Background(), op, tid)
+	if err != nil {
+		t.Fatalf("%s: %s", name, err.Error())
+	}
+	var res []*Tuple
+	for {
+		tup, err := iter()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+		if tup == nil {
+			break
+		}
+		res = append(res, tup)
+	}
+	if len(res) != len(expected) {
+		t.Fatalf("%s: expected %d tuples, got %d", name, len(expected), len(res))
+	}
+	for i := range res {
+		if !res[i].equals(expected[i]) {
+			t.Errorf("%s: tuple %d: expected %s, got %s", name, i, expected[i].PrettyPrintString(false), res[i].PrettyPrintString(false))
+		}
+	}
+}
+
+func TestBatchQueries(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+	defer func(size int) { BatchSize = size }(BatchSize)
+
+	queries := []string{
+		"select name, age from t where age > 30",
+		"select name, age + 1 from t where name like '%a%'",
+		"select distinct name from t",
+		"select name, count(*), sum(age), avg(age), min(age), max(name) from t group by name",
+		"select age, count(*) from t group by age order by age",
+		"select count(*), sum(age) from t where age > 1000",
+		"select t.name, t2.age from t join t2 on t.name = t2.name where t.age > 25",
+		"select t.age, count(*) from t, t2 where t.age = t2.age group by t.age",
+	}
+	for _, size := range []int{1024, 3} {
+		BatchSize = size
+		for _, sql := range queries {
+			plan := parsePlan(t, c, sql)
+			tid := NewTID()
+			bp.BeginTransaction(tid)
+			checkVectorized(t, sql, plan, tid)
+			bp.CommitTransaction(tid)
+		}
+	}
+}
+
+func TestBatchAggSpill(t *testing.T) {
+	_, t1, _, hf, _, tid := makeTestVars()
+	insertGroupedTuples(t, hf, tid, 60, 20)
+	defer func(size int) { BatchSize = size }(BatchSize)
+	BatchSize = 8
+
+	sa := SumAggState[int64]{}
+	expr := FieldExpr{t1.Desc.Fields[1]}
+	sa.Init("sum", &expr, intAggGetter)
+	agg := NewGroupedAggregator([]AggState{&sa}, []Expr{&FieldExpr{hf.Descriptor().Fields[0]}}, hf)
+	agg.SetMaxGroups(3)
+
+	iter, err := agg.BatchIterator(context.Background(), tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !CheckIfOutputMatches(batchRows(iter), expectedGroupSums(hf, 60, 20)) {
+		t.Errorf("spilled vectorized aggregation did not match expected groups")
+	}
+	if agg.peakMemory() == 0 {
+		t.Errorf("expected memory of the groups to be recorded")
+	}
+}
+
+func TestBatchJoinBlocks(t *testing.T) {
+	_, t1, _, hf, _, tid := makeTestVars()
+	insertGroupedTuples(t, hf, tid, 40, 7)
+	defer func(size int) { BatchSize = size }(BatchSize)
+
+	nameExpr := &FieldExpr{t1.Desc.Fields[0]}
+	for _, size := range []int{1024, 6} {
+		BatchSize = size
+		for _, bufSize := range []int{100, 5, 1} {
+			join, err := NewStringJoin(hf, nameExpr, hf, nameExpr, bufSize)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			checkVectorized(t, "join", join, tid)
+		}
+	}
+}
+
+func TestBatchFilterProject(t *testing.T) {
+	_, t1, _, hf, _, tid := makeTestVars()
+	insertGroupedTuples(t, hf, tid, 50, 5)
+	defer func(size int) { BatchSize = size }(BatchSize)
+	BatchSize = 7
+
+	ageExpr := &FieldExpr{t1.Desc.Fields[1]}
+	nameExpr := &FieldExpr{t1.Desc.Fields[0]}
+	filter, err := NewIntFilter(&ConstExpr{IntField{20}, IntType}, OpGe, ageExpr, hf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	checkVectorized(t, "filter", filter, tid)
+
+	var plus Expr = &FuncExpr{"+", []*Expr{ptr[Expr](ageExpr), ptr[Expr](&ConstExpr{IntField{1}, IntType})}, nil}
+	for _, distinct := range []bool{false, true} {
+		proj, err := NewProjectOp([]Expr{nameExpr, plus}, []string{"name", "next"}, distinct, filter)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		checkVectorized(t, "project", proj, tid)
+		proj, err = NewProjectOp([]Expr{nameExpr}, []string{"name"}, distinct, filter)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		checkVectorized(t, "project name", proj, tid)
+	}
+
+	// a filter that removes every row of some batches
+	filter, err = NewIntFilter(&ConstExpr{IntField{45}, IntType}, OpGt, ageExpr, hf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, err := filter.BatchIterator(context.Background(), tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	n := 0
+	for {
+		b, err := iter()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if b == nil {
+			break
+		}
+		if b.Len() == 0 {
+			t.Errorf("filter returned an empty batch")
+		}
+		n += b.Len()
+	}
+	if n != 4 {
+		t.Errorf("expected 4 rows, got %d", n)
+	}
+}
+
+func TestBatchAdapters(t *testing.T) {
+	_, _, _, hf, _, tid := makeTestVars()
+	insertGroupedTuples(t, hf, tid, 25, 5)
+	defer func(size int) { BatchSize = size }(BatchSize)
+	BatchSize = 10
+
+	// a heap file has no vectorized implementation, so its tuples are
+	// collected into batches
+	iter, err := BatchIterator(context.Background(), hf, tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var sizes []int
+	for {
+		b, err := iter()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if b == nil {
+			break
+		}
+		if len(b.Columns) != 2 || b.Columns[0].Type != StringType || b.Columns[1].Type != IntType {
+			t.Fatalf("unexpected columns in batch")
+		}
+		for i := 0; i < b.Len(); i++ {
+			if b.Tuple(i).Fields[1].(IntField).Value != int64(len(sizes)*10+i) {
+				t.Errorf("unexpected row %d of batch %d", i, len(sizes))
+			}
+		}
+		sizes = append(sizes, b.Len())
+	}
+	if len(sizes) != 3 || sizes[0] != 10 || sizes[1] != 10 || sizes[2] != 5 {
+		t.Errorf("expected batches of 10, 10 and 5 rows, got %v", sizes)
+	}
+	checkVectorized(t, "heap file", hf, tid)
+}
@@ -1,9 +1,9 @@
 package godb
 
 import (
-	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,9 +24,13 @@ type BufferPool struct {
 	// TODO: some code goes here
 	pages    map[uint64]*Page                    // 用于存储页面, key为pageKey(FileName, PageNo) map[uint64]*Page
 	numPages int                                 // BufferPool的容量
-	mutexMap map[uint64]*sync.RWMutex            // 用于存储页面锁 map[uint64]*sync.RWMutex
+	mutexMap map[uint64]*pageLock                // 用于存储页面锁 map[uint64]*pageLock
 	tidMap   map[TransactionID]map[uint64]RWPerm // 用于存储tid持有的锁 map[TransactionID]map[uint64]RWPerm
 	mutex    *sync.Mutex                         // 用于保护pages和mutexMap
+	txnLocks map[TransactionID]*sync.Mutex       // 每个事务的加锁互斥量，使并行查询的多个worker依次为同一事务加锁
+
+	pageRequests int64 // number of calls to GetPage, accessed atomically
+	pageReads    int64 // number of pages GetPage read from disk, accessed atomically
 }
 
 // Create a new BufferPool with the specified number of pages
@@ -34,9 +38,10 @@ func NewBufferPool(numPages int) *BufferPool {
 	// TODO: some code goes here
 	// 初始化BufferPool
 	pages := make(map[uint64]*Page)
-	mutexMap := make(map[uint64]*sync.RWMutex)
+	mutexMap := make(map[uint64]*pageLock)
 	tidMap := make(map[TransactionID]map[uint64]RWPerm)
-	return &BufferPool{pages, numPages, mutexMap, tidMap, &sync.Mutex{}}
+	txnLocks := make(map[TransactionID]*sync.Mutex)
+	return &BufferPool{pages, numPages, mutexMap, tidMap, &sync.Mutex{}, txnLocks, 0, 0}
 }
 
 // Testing method -- iterate through all pages in the buffer pool
@@ -70,14 +75,13 @@ func (bp *BufferPool) AbortTransaction(tid TransactionID) {
 		return
 	}
 	for key, v := range mutexMap {
-		if v == ReadPerm {
-			bp.mutexMap[key].RUnlock()
-		} else {
+		if v != ReadPerm {
 			delete(bp.pages, key)
-			bp.mutexMap[key].Unlock()
 		}
+		bp.mutexMap[key].release(v)
 	}
 	delete(bp.tidMap, tid)
+	delete(bp.txnLocks, tid)
 }
 
 // Commit the transaction, releasing locks. Because GoDB is FORCE/NO STEAL, none
@@ -97,19 +101,18 @@ func (bp *BufferPool) CommitTransaction(tid TransactionID) {
 		return
 	}
 	for key, v := range mutexMap {
-		if v == ReadPerm {
-			bp.mutexMap[key].RUnlock()
-		} else {
+		if v != ReadPerm {
 			page := bp.pages[key]
 			if page != nil {
 				file := (*page).getFile()
 				(*file).flushPage(page)
 			}
 			delete(bp.pages, key)
-			bp.mutexMap[key].Unlock()
 		}
+		bp.mutexMap[key].release(v)
 	}
 	delete(bp.tidMap, tid)
+	delete(bp.txnLocks, tid)
 }
 
 func (bp *BufferPool) BeginTransaction(tid TransactionID) error {
@@ -117,11 +120,14 @@ func (bp *BufferPool) BeginTransaction(tid TransactionID) error {
 	// 添加tid到tidMap中
 	bp.mutex.Lock()
 	bp.tidMap[tid] = make(map[uint64]RWPerm)
+	bp.txnLocks[tid] = &sync.Mutex{}
 	bp.mutex.Unlock()
 	return nil
 }
 
 func (bp *BufferPool) HasTransaction(tid TransactionID) bool {
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
 	if _, ok := bp.tidMap[tid]; ok {
 		return true
 	} else {
@@ -129,79 +135,111 @@ func (bp *BufferPool) HasTransaction(tid TransactionID) bool {
 	}
 }
 
-func lockTimeout(lock *sync.RWMutex, perm RWPerm, timeOut int) bool {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeOut)*time.Millisecond)
-	defer cancel()
-
-	var lockAcquired bool
-
-	done := make(chan struct{})
-
-	go func() {
-		defer close(done)
-
-		if perm == ReadPerm {
-			lock.RLock()
-		} else {
-			lock.Lock()
-		}
+// pageLock is the lock of a page, held either by readers or by one writer.
+// It is guarded by the mutex of the buffer pool.  Transactions waiting for it
+// wait on wake, which is closed each time the lock is released, so that one
+// that stops waiting once its timeout expires leaves nothing behind.
+type pageLock struct {
+	readers int
+	writer  bool
+	wake    chan struct{}
+}
 
-		lockAcquired = true
-	}()
+func newPageLock() *pageLock {
+	return &pageLock{wake: make(chan struct{})}
+}
 
-	select {
-	case <-done:
-		// 在超时时间内获取到锁
-	case <-ctx.Done():
-		// 超时
-		fmt.Println("lock timeout")
-		if !lockAcquired {
-			// 如果没有获取到锁，释放可能已经获取到的锁
-			if perm == ReadPerm {
-				lock.RUnlock()
-			} else {
-				lock.Unlock()
-			}
-		}
+// Return true if the lock can be granted with perm to a transaction, which
+// already holds it for reading if upgrade is true.
+func (l *pageLock) available(perm RWPerm, upgrade bool) bool {
+	if l.writer {
+		return false
+	}
+	if perm == ReadPerm {
+		return true
+	}
+	held := 0
+	if upgrade {
+		held = 1
 	}
+	return l.readers == held
+}
 
-	return lockAcquired
+// Release the lock held with perm, waking up the transactions waiting for it.
+func (l *pageLock) release(perm RWPerm) {
+	if perm == ReadPerm {
+		l.readers--
+	} else {
+		l.writer = false
+	}
+	close(l.wake)
+	l.wake = make(chan struct{})
 }
 
+// Lock the page with key pageKey with perm for tid, waiting up to timeOut
+// milliseconds for the transactions holding it.  Returns false if the lock
+// was not granted in time, or if tid ended while waiting for it (e.g.,
+// another worker of the same query aborted it).
 func (bp *BufferPool) lockPage(pageKey uint64, tid TransactionID, perm RWPerm, timeOut int) bool {
 	bp.mutex.Lock()
+	// 同一事务的goroutine依次加锁，否则两个worker可能同时为同一事务请求同一页面，
+	// 后者会等待前者持有的锁直到超时
+	txnLock, ok := bp.txnLocks[tid]
+	bp.mutex.Unlock()
+	if !ok {
+		return false
+	}
+	txnLock.Lock()
+	defer txnLock.Unlock()
+	timer := time.NewTimer(time.Duration(timeOut) * time.Millisecond)
+	defer timer.Stop()
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
 	// 获取该页面的锁
 	lock, ok := bp.mutexMap[pageKey]
 	if !ok {
-		lock = &sync.RWMutex{}
+		lock = newPageLock()
 		bp.mutexMap[pageKey] = lock
 	}
-	// 判断当前的tid是否已经持有该页面的锁
-	curPerm, ok := bp.tidMap[tid][pageKey]
-	bp.mutex.Unlock()
-	if !ok {
-		// 如果当前的tid没有持有该页面的锁，就加锁
-		// 如果超时，就返回false
-		if !lockTimeout(lock, perm, timeOut) {
+	expired := false
+	for {
+		locks, ok := bp.tidMap[tid]
+		if !ok {
 			return false
 		}
-		bp.mutex.Lock()
-		bp.tidMap[tid][pageKey] = perm
-		bp.mutex.Unlock()
-	} else if curPerm == ReadPerm && perm == WritePerm {
-		// 如果当前的权限是Read，但是需要的权限是Write，就升级锁
-		lock.RUnlock()
-		bp.mutex.Lock()
-		delete(bp.tidMap[tid], pageKey)
-		bp.mutex.Unlock()
-		if !lockTimeout(lock, perm, timeOut) {
+		// 判断当前的tid是否已经持有该页面的锁
+		curPerm, held := locks[pageKey]
+		if held && (curPerm == WritePerm || perm == ReadPerm) {
+			return true
+		}
+		if lock.available(perm, held) {
+			// 如果当前的权限是Read，但是需要的权限是Write，就升级锁
+			if held {
+				lock.readers--
+			}
+			if perm == ReadPerm {
+				lock.readers++
+			} else {
+				lock.writer = true
+			}
+			locks[pageKey] = perm
+			return true
+		}
+		// 超时前最后一次检查锁之后仍不可用，就返回false
+		if expired {
+			fmt.Println("lock timeout")
 			return false
 		}
-		bp.mutex.Lock()
-		bp.tidMap[tid][pageKey] = perm
+		// 等待锁被释放或超时
+		wake := lock.wake
 		bp.mutex.Unlock()
+		select {
+		case <-wake:
+		case <-timer.C:
+			expired = true
+		}
+		bp.mutex.Lock()
 	}
-	return true
 }
 
 func (bp *BufferPool) unlockPage(pageKey uint64, tid TransactionID, perm RWPerm) (bool, error) {
@@ -225,11 +263,7 @@ func (bp *BufferPool) unlockPage(pageKey uint64, tid TransactionID, perm RWPerm)
 	}
 	// 释放锁
 	if curPerm == perm {
-		if perm == ReadPerm {
-			lock.RUnlock()
-		} else {
-			lock.Unlock()
-		}
+		lock.release(perm)
 		// 从tidMap中删除tid
 		delete(bp.tidMap[tid], pageKey)
 	}
@@ -261,6 +295,7 @@ func (bp *BufferPool) GetPage(file DBFile, pageNo int, tid TransactionID, perm R
 	// 读取页面
 	bp.mutex.Lock()
 	defer bp.mutex.Unlock()
+	atomic.AddInt64(&bp.pageRequests, 1)
 	page, ok := bp.pages[key]
 	if ok {
 		return page, nil
@@ -291,7 +326,14 @@ func (bp *BufferPool) GetPage(file DBFile, pageNo int, tid TransactionID, perm R
 		if err != nil {
 			return nil, err
 		}
+		atomic.AddInt64(&bp.pageReads, 1)
 		bp.pages[key] = page
 		return page, nil
 	}
 }
+
+// Return the number of pages requested from the buffer pool, and the number
+// of them that were read from disk, since it was created.
+func (bp *BufferPool) pageCounts() (int64, int64) {
+	return atomic.LoadInt64(&bp.pageRequests), atomic.LoadInt64(&bp.pageReads)
+}
@@ -0,0 +1,327 @@
+package godb
+
+import "fmt"
+
+// Conditional expressions: CASE, COALESCE, NULLIF and IF, together with the
+// comparisons and boolean connectives their conditions are built from.
+//
+// GoDB has no NULLs, so the zero value of a type (0 or the empty string)
+// stands in for NULL: it is the result of a CASE without a matching WHEN or an
+// ELSE, and of NULLIF when its arguments are equal, and COALESCE skips it.
+// Comparisons and connectives evaluate to 1 for true and 0 for false, as in
+// MySQL, and a condition holds if it evaluates to a non-zero integer.
+
+// Return the zero value of a type.
+func zeroValue(t DBType) DBValue {
+	if t == StringType {
+		return StringField{""}
+	}
+	return IntField{0}
+}
+
+// Return true if v is the zero value of its type.
+func isZeroValue(v DBValue) bool {
+	switch v := v.(type) {
+	case IntField:
+		return v.Value == 0
+	case StringField:
+		return v.Value == ""
+	}
+	return v == nil
+}
+
+// Return the integer value of a boolean.
+func boolValue(b bool) DBValue {
+	if b {
+		return IntField{1}
+	}
+	return IntField{0}
+}
+
+// Check that e is an integer condition.
+func checkCondition(e Expr, what string) error {
+	if t := e.GetExprType().Ftype; t != IntType && t != UnknownType {
+		return GoDBError{TypeMismatchError, fmt.Sprintf("%s must be a condition or integer, got %s", what, typeNames[t])}
+	}
+	return nil
+}
+
+// Return the type shared by exprs, or an error naming what they are if their
+// types differ.
+func commonType(exprs []Expr, what string) (DBType, error) {
+	t := UnknownType
+	for _, e := range exprs {
+		et := e.GetExprType().Ftype
+		if et == UnknownType {
+			continue
+		}
+		if t != UnknownType && et != t {
+			return UnknownType, GoDBError{TypeMismatchError, fmt.Sprintf("%s have different types %s and %s", what, typeNames[t], typeNames[et])}
+		}
+		t = et
+	}
+	setParamTypes(exprs, t)
+	return t, nil
+}
+
+// CompareExpr compares the values of two expressions of the same type.
+type CompareExpr struct {
+	left, right Expr
+	op          BoolOp
+}
+
+// Construct the comparison left op right.
+func NewCompareExpr(left Expr, op BoolOp, right Expr) (*CompareExpr, error) {
+	if _, err := commonType([]Expr{left, right}, "compared expressions"); err != nil {
+		return nil, err
+	}
+	return &CompareExpr{left, right, op}, nil
+}
+
+func (c *CompareExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	l, err := c.left.EvalExpr(t)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.right.EvalExpr(t)
+	if err != nil {
+		return nil, err
+	}
+	b, err := evalValuePred(l, r, c.op)
+	if err != nil {
+		return nil, err
+	}
+	return boolValue(b), nil
+}
+
+func (c *CompareExpr) GetExprType() FieldType {
+	return FieldType{opToStr(c.op), "", IntType}
+}
+
+// BoolExpr is the conjunction ("and"), disjunction ("or") or negation ("not")
+// of conditions.  Conjunctions and disjunctions evaluate their arguments from
+// left to right, only as far as needed to determine the result.
+type BoolExpr struct {
+	op   string
+	args []Expr
+}
+
+// Construct a boolean connective of conditions.
+func NewBoolExpr(op string, args []Expr) (*BoolExpr, error) {
+	switch op {
+	case "and", "or":
+		if len(args) < 2 {
+			return nil, GoDBError{ParseError, fmt.Sprintf("%s expects at least two conditions", op)}
+		}
+	case "not":
+		if len(args) != 1 {
+			return nil, GoDBError{ParseError, "not expects one condition"}
+		}
+	default:
+		return nil, GoDBError{ParseError, fmt.Sprintf("unknown boolean operator %s", op)}
+	}
+	for _, a := range args {
+		if err := checkCondition(a, fmt.Sprintf("argument of %s", op)); err != nil {
+			return nil, err
+		}
+	}
+	return &BoolExpr{op, args}, nil
+}
+
+func (b *BoolExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	for _, a := range b.args {
+		v, err := a.EvalExpr(t)
+		if err != nil {
+			return nil, err
+		}
+		holds := !isZeroValue(v)
+		switch {
+		case b.op == "not":
+			return boolValue(!holds), nil
+		case b.op == "and" && !holds:
+			return boolValue(false), nil
+		case b.op == "or" && holds:
+			return boolValue(true), nil
+		}
+	}
+	return boolValue(b.op == "and"), nil
+}
+
+func (b *BoolExpr) GetExprType() FieldType {
+	return FieldType{b.op, "", IntType}
+}
+
+// CaseExpr is a CASE expression.  A searched CASE (without operand) returns
+// the result of the first WHEN whose condition holds; a simple CASE returns
+// the result of the first WHEN whose value equals its operand.  If no WHEN
+// applies, the result is that of ELSE, or the zero value of the result type if
+// there is no ELSE.
+type CaseExpr struct {
+	operand  Expr //nil for a searched CASE
+	whens    []Expr
+	thens    []Expr
+	elseExpr Expr //may be nil
+	ftype    DBType
+}
+
+// Construct a CASE expression.  All results, including that of ELSE, must
+// have the same type, which is the type of the expression.
+func NewCaseExpr(operand Expr, whens []Expr, thens []Expr, elseExpr Expr) (*CaseExpr, error) {
+	if len(whens) == 0 || len(whens) != len(thens) {
+		return nil, GoDBError{ParseError, "case expects one result for each of at least one when"}
+	}
+	if operand == nil {
+		for _, w := range whens {
+			if err := checkCondition(w, "when of case"); err != nil {
+				return nil, err
+			}
+		}
+	} else if _, err := commonType(append([]Expr{operand}, whens...), "case operand and when values"); err != nil {
+		return nil, err
+	}
+	results := thens
+	if elseExpr != nil {
+		results = append(append([]Expr{}, thens...), elseExpr)
+	}
+	ftype, err := commonType(results, "results of case")
+	if err != nil {
+		return nil, err
+	}
+	return &CaseExpr{operand, whens, thens, elseExpr, ftype}, nil
+}
+
+func (c *CaseExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	var operand DBValue
+	if c.operand != nil {
+		var err error
+		operand, err = c.operand.EvalExpr(t)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, w := range c.whens {
+		v, err := w.EvalExpr(t)
+		if err != nil {
+			return nil, err
+		}
+		if (c.operand == nil && !isZeroValue(v)) || (c.operand != nil && v == operand) {
+			return c.thens[i].EvalExpr(t)
+		}
+	}
+	if c.elseExpr != nil {
+		return c.elseExpr.EvalExpr(t)
+	}
+	return zeroValue(c.ftype), nil
+}
+
+func (c *CaseExpr) GetExprType() FieldType {
+	return FieldType{"case", "", c.ftype}
+}
+
+// CoalesceExpr returns the value of the first of its arguments whose value is
+// not the zero value of their type, or the zero value if there is none.
+type CoalesceExpr struct {
+	args  []Expr
+	ftype DBType
+}
+
+// Construct a COALESCE of arguments of the same type.
+func NewCoalesceExpr(args []Expr) (*CoalesceExpr, error) {
+	if len(args) == 0 {
+		return nil, GoDBError{ParseError, "coalesce expects at least one argument"}
+	}
+	ftype, err := commonType(args, "arguments of coalesce")
+	if err != nil {
+		return nil, err
+	}
+	return &CoalesceExpr{args, ftype}, nil
+}
+
+func (c *CoalesceExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	for _, a := range c.args {
+		v, err := a.EvalExpr(t)
+		if err != nil {
+			return nil, err
+		}
+		if !isZeroValue(v) {
+			return v, nil
+		}
+	}
+	return zeroValue(c.ftype), nil
+}
+
+func (c *CoalesceExpr) GetExprType() FieldType {
+	return FieldType{"coalesce", "", c.ftype}
+}
+
+// The parser represents conditional expressions as calls of functions with
+// these names, with the arguments:
+//
+//	case:        when1, then1, when2, then2, ..., [else]
+//	simple case: operand, when1, then1, ..., [else]
+//	coalesce:    args...
+//	nullif:      a, b
+//	if:          condition, then, else
+//	and, or:     conditions...
+//	not:         condition
+//	=, <, ...:   left, right (the keys of BoolOpMap)
+//
+// They cannot be registered as functions or aggregates.
+var conditionalForms = map[string]bool{
+	"case": true, "simple case": true, "coalesce": true, "nullif": true, "if": true,
+	"and": true, "or": true, "not": true,
+}
+
+func isConditionalForm(name string) bool {
+	_, isComparison := BoolOpMap[name]
+	return conditionalForms[name] || isComparison
+}
+
+// Split the arguments of a case form into whens, thens and else.
+func caseArgs(args []Expr) ([]Expr, []Expr, Expr) {
+	var whens, thens []Expr
+	for i := 0; i+1 < len(args); i += 2 {
+		whens = append(whens, args[i])
+		thens = append(thens, args[i+1])
+	}
+	var elseExpr Expr
+	if len(args)%2 == 1 {
+		elseExpr = args[len(args)-1]
+	}
+	return whens, thens, elseExpr
+}
+
+// Construct the expression of a conditional form.
+func newConditionalExpr(name string, args []Expr) (Expr, error) {
+	if op, ok := BoolOpMap[name]; ok {
+		if len(args) != 2 {
+			return nil, GoDBError{ParseError, fmt.Sprintf("%s expects two arguments", name)}
+		}
+		return NewCompareExpr(args[0], op, args[1])
+	}
+	switch name {
+	case "case":
+		whens, thens, elseExpr := caseArgs(args)
+		return NewCaseExpr(nil, whens, thens, elseExpr)
+	case "simple case":
+		if len(args) == 0 {
+			return nil, GoDBError{ParseError, "case expects an operand"}
+		}
+		whens, thens, elseExpr := caseArgs(args[1:])
+		return NewCaseExpr(args[0], whens, thens, elseExpr)
+	case "coalesce":
+		return NewCoalesceExpr(args)
+	case "nullif":
+		if len(args) != 2 {
+			return nil, GoDBError{ParseError, "nullif expects two arguments"}
+		}
+		zero := &ConstExpr{zeroValue(args[0].GetExprType().Ftype), args[0].GetExprType().Ftype}
+		return NewCaseExpr(args[0], []Expr{args[1]}, []Expr{zero}, args[0])
+	case "if":
+		if len(args) != 3 {
+			return nil, GoDBError{ParseError, "if expects three arguments"}
+		}
+		return NewCaseExpr(nil, []Expr{args[0]}, []Expr{args[1]}, args[2])
+	}
+	return NewBoolExpr(name, args)
+}
@@ -0,0 +1,57 @@
+package godb
+
+import "testing"
+
+func TestCaseExpr(t *testing.T) {
+	td, t1, t2, _, _, _ := makeTestVars()
+	age := &FieldExpr{td.Fields[1]}
+	name := &FieldExpr{td.Fields[0]}
+	old, err := NewCompareExpr(age, OpGt, &ConstExpr{IntField{100}, IntType})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// without else, the result is the zero value of the result type
+	e, err := NewCaseExpr(nil, []Expr{old}, []Expr{name}, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, tc := range []struct {
+		tup      *Tuple
+		expected DBValue
+	}{{&t1, StringField{""}}, {&t2, StringField{"george jones"}}} {
+		v, err := e.EvalExpr(tc.tup)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if v != tc.expected {
+			t.Errorf("expected %v, got %v", tc.expected, v)
+		}
+	}
+
+	coalesce, err := NewCoalesceExpr([]Expr{e, &ConstExpr{StringField{"young"}, StringType}})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if v, _ := coalesce.EvalExpr(&t1); v != (StringField{"young"}) {
+		t.Errorf("expected coalesce to skip the zero value, got %v", v)
+	}
+
+	notOld, err := NewBoolExpr("not", []Expr{old})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if v, _ := notOld.EvalExpr(&t1); v != (IntField{1}) {
+		t.Errorf("expected not to hold, got %v", v)
+	}
+
+	if _, err := NewCaseExpr(nil, []Expr{old}, []Expr{name}, age); err == nil {
+		t.Errorf("expected case with results of different types to fail")
+	}
+	if _, err := NewCaseExpr(nil, []Expr{name}, []Expr{age}, nil); err == nil {
+		t.Errorf("expected case with a string condition to fail")
+	}
+	if _, err := NewBoolExpr("and", []Expr{old}); err == nil {
+		t.Errorf("expected and of one condition to fail")
+	}
+}
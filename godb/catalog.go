@@ -2,9 +2,13 @@ package godb
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
+	"sync"
+
+	"github.com/xwb1989/sqlparser"
 )
 
 type Table struct {
@@ -18,6 +22,40 @@ type Catalog struct {
 	columnMap map[string][]*Table
 	bp        *BufferPool
 	rootPath  string
+	ctes      map[string]*cteTable //common table expressions visible to the query being parsed
+	statsFile string               //file the statistics are saved to, if any
+	*planState
+
+	parallelism int //number of workers of parallel plans; see SetParallelism
+
+	params *stmtParams //parameters of the statement being prepared, if any
+
+	setOps map[*sqlparser.Select]setOpMark //set operations of the statement being parsed, see withSetOps
+}
+
+// planState is the part of a catalog that statements read when they are
+// planned and that ANALYZE changes while it runs, concurrently with the
+// planning of other statements.  It is shared by the copies of the catalog
+// made to plan statements.
+type planState struct {
+	mutex   sync.RWMutex
+	stats   map[string]*TableStats //statistics collected by ANALYZE, by table name
+	version int                    //incremented by changes that may invalidate prepared plans
+}
+
+// Return the version of the catalog, which changes whenever prepared plans
+// may have to be planned again.
+func (c *Catalog) planVersion() int {
+	c.planState.mutex.RLock()
+	defer c.planState.mutex.RUnlock()
+	return c.version
+}
+
+// Record a change of the catalog that may invalidate prepared plans.
+func (c *Catalog) invalidatePlans() {
+	c.planState.mutex.Lock()
+	defer c.planState.mutex.Unlock()
+	c.version++
 }
 
 func (c *Catalog) SaveToFile(catalogFile string, rootPath string) error {
@@ -28,12 +66,58 @@ func (c *Catalog) SaveToFile(catalogFile string, rootPath string) error {
 	}
 	f.WriteString(catalogString)
 	f.Close()
+	c.statsFile = statsFileName(catalogFile, rootPath)
+	return c.saveStats()
+}
+
+// Return the name of the file the statistics of the tables of a catalog file
+// are saved to.
+func statsFileName(catalogFile string, rootPath string) string {
+	return rootPath + "/" + strings.TrimSuffix(catalogFile, ".txt") + ".stats.json"
+}
+
+// Save the statistics of the tables to the statistics file, if any.
+func (c *Catalog) saveStats() error {
+	if c.statsFile == "" {
+		return nil
+	}
+	c.planState.mutex.RLock()
+	data, err := json.MarshalIndent(c.stats, "", "  ")
+	c.planState.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.statsFile, data, 0644)
+}
+
+// Load the statistics of the tables from the statistics file, if it exists.
+func (c *Catalog) loadStats() error {
+	data, err := os.ReadFile(c.statsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var stats map[string]*TableStats
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return GoDBError{MalformedDataError, fmt.Sprintf("malformed statistics file %s: %s", c.statsFile, err.Error())}
+	}
+	for name, s := range stats {
+		if c.tableMap[name] != nil {
+			c.stats[name] = s
+		}
+	}
 	return nil
 }
 
 func (c *Catalog) dropTable(table string) error {
 	for i, t := range c.tables {
 		if t.name == table {
+			c.planState.mutex.Lock()
+			c.version++
+			delete(c.stats, table)
+			c.planState.mutex.Unlock()
 			c.tableMap[table] = nil
 			c.columnMap[table] = nil
 			c.tables = append(c.tables[:i], c.tables[i+1:]...)
@@ -122,11 +206,13 @@ func NewCatalogFromFile(catalogFile string, bp *BufferPool, rootPath string) (*C
 	if err != nil {
 		return nil, err
 	}
-	c := &Catalog{make([]*Table, 0), make(map[string]*Table), make(map[string][]*Table), bp, rootPath}
+	c := &Catalog{make([]*Table, 0), make(map[string]*Table), make(map[string][]*Table), bp, rootPath, nil, statsFileName(catalogFile, rootPath), &planState{stats: make(map[string]*TableStats)}, 1, nil, nil}
 	for i, t := range tabs {
 		c.addTable(names[i], t)
 	}
-
+	if err := c.loadStats(); err != nil {
+		return nil, err
+	}
 	return c, nil
 
 }
@@ -135,6 +221,7 @@ func (c *Catalog) addTable(named string, desc TupleDesc) error {
 	_, err := c.GetTable(named)
 	if err != nil {
 		t := &Table{named, desc}
+		c.invalidatePlans()
 		c.tables = append(c.tables, t)
 		c.tableMap[named] = t
 		for _, f := range desc.Fields {
@@ -164,6 +251,23 @@ func (c *Catalog) GetTable(named string) (DBFile, error) {
 
 }
 
+// Return a copy of the catalog in which the common table expression cte
+// hides any table with the same name.
+func (c *Catalog) withCTE(cte *cteTable) *Catalog {
+	cc := *c
+	cc.ctes = make(map[string]*cteTable)
+	for name, t := range c.ctes {
+		cc.ctes[name] = t
+	}
+	cc.ctes[cte.name] = cte
+	return &cc
+}
+
+// Return the common table expression named name, or nil if there is none.
+func (c *Catalog) getCTE(name string) *cteTable {
+	return c.ctes[name]
+}
+
 func (c *Catalog) findTablesWithColumn(named string) []*Table {
 	t := c.columnMap[named]
 	return t
@@ -0,0 +1,221 @@
+package godb
+
+import (
+	"context"
+	"fmt"
+)
+
+// Materialize computes the tuples of its child once per transaction and
+// returns them from memory to every iterator, so that a common table
+// expression referenced several times by a query is only evaluated once.
+type Materialize struct {
+	child  Operator
+	tid    TransactionID // transaction the tuples were computed in
+	tuples []*Tuple
+	memStat
+}
+
+// Construct a Materialize operator over child.
+func NewMaterialize(child Operator) *Materialize {
+	return &Materialize{child: child}
+}
+
+func (m *Materialize) Descriptor() *TupleDesc {
+	return m.child.Descriptor()
+}
+
+func (m *Materialize) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	return m.IteratorContext(context.Background(), tid)
+}
+
+func (m *Materialize) IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error) {
+	if m.tid != tid {
+		// 只释放统计中的内存，之前的查询已经结束
+		m.memStat.release(tuplesMemory(m.tuples))
+		m.tid = nil
+		m.tuples = nil
+		iter, err := IteratorContext(ctx, m.child, tid)
+		if err != nil {
+			return nil, err
+		}
+		mem := m.account(ctx, "materialize")
+		for {
+			t, err := iter()
+			if err == nil && t != nil {
+				err = mem.grow(tupleMemory(t))
+			}
+			if err != nil {
+				mem.release(tuplesMemory(m.tuples))
+				m.tuples = nil
+				return nil, err
+			}
+			if t == nil {
+				break
+			}
+			m.tuples = append(m.tuples, t)
+		}
+		m.tid = tid
+	}
+	return tupleSliceIterator(m.tuples), nil
+}
+
+// Return an iterator over a snapshot of a slice of tuples.
+func tupleSliceIterator(tuples []*Tuple) func() (*Tuple, error) {
+	i := 0
+	return func() (*Tuple, error) {
+		if i >= len(tuples) {
+			return nil, nil
+		}
+		i++
+		return tuples[i-1], nil
+	}
+}
+
+// WorkTable holds the tuples produced by the previous iteration of a
+// [RecursiveUnion], which its recursive side reads.
+type WorkTable struct {
+	desc   *TupleDesc
+	tuples []*Tuple
+}
+
+// Construct an empty work table with the specified descriptor.
+func NewWorkTable(desc *TupleDesc) *WorkTable {
+	return &WorkTable{desc: desc.copy()}
+}
+
+func (w *WorkTable) Descriptor() *TupleDesc {
+	return w.desc.copy()
+}
+
+func (w *WorkTable) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	return w.IteratorContext(context.Background(), tid)
+}
+
+func (w *WorkTable) IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error) {
+	return tupleSliceIterator(w.tuples), nil
+}
+
+// The maximum number of iterations of a recursive query before it is assumed
+// not to terminate.
+var MaxRecursionDepth = 1000
+
+// RecursiveUnion computes the fixpoint of a recursive common table
+// expression.  It returns the tuples of its anchor, and then repeatedly
+// evaluates its recursive side over a [WorkTable] holding the tuples of the
+// previous iteration, until an iteration produces no new tuples.  Unless all
+// is set, duplicates are removed, which guarantees termination over acyclic
+// and cyclic data alike; with all set, the recursion must end by itself or
+// fail after MaxRecursionDepth iterations.
+type RecursiveUnion struct {
+	anchor, recursive Operator
+	work              *WorkTable
+	all               bool
+	desc              *TupleDesc
+}
+
+// Construct a recursive union whose recursive side reads work.  The anchor,
+// the recursive side and the work table must have fields of the same types.
+func NewRecursiveUnion(anchor Operator, recursive Operator, work *WorkTable, all bool) (*RecursiveUnion, error) {
+	ad := anchor.Descriptor()
+	for _, d := range []*TupleDesc{recursive.Descriptor(), work.desc} {
+		if len(ad.Fields) != len(d.Fields) {
+			return nil, GoDBError{IncompatibleTypesError, fmt.Sprintf("recursive query returns %d fields, but its anchor returns %d", len(d.Fields), len(ad.Fields))}
+		}
+		for i := range ad.Fields {
+			if ad.Fields[i].Ftype != d.Fields[i].Ftype {
+				return nil, GoDBError{IncompatibleTypesError, fmt.Sprintf("field %d of recursive query has type %s, but %s in its anchor", i+1, typeNames[d.Fields[i].Ftype], typeNames[ad.Fields[i].Ftype])}
+			}
+		}
+	}
+	return &RecursiveUnion{anchor, recursive, work, all, ad.copy()}, nil
+}
+
+func (r *RecursiveUnion) Descriptor() *TupleDesc {
+	return r.desc.copy()
+}
+
+// Return an iterator that streams the tuples of each iteration as they are
+// produced, collecting them as the work table of the next iteration.
+func (r *RecursiveUnion) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	return r.IteratorContext(context.Background(), tid)
+}
+
+func (r *RecursiveUnion) IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error) {
+	iter, err := IteratorContext(ctx, r.anchor, tid)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[any]bool)
+	var produced []*Tuple
+	depth := 0
+	return func() (*Tuple, error) {
+		for {
+			t, err := iter()
+			if err != nil {
+				return nil, err
+			}
+			if t == nil {
+				if len(produced) == 0 {
+					return nil, nil
+				}
+				depth++
+				if err := contextError(ctx); err != nil {
+					return nil, err
+				}
+				if depth > MaxRecursionDepth {
+					return nil, GoDBError{IllegalOperationError, fmt.Sprintf("recursive query did not terminate after %d iterations", MaxRecursionDepth)}
+				}
+				r.work.tuples = produced
+				produced = nil
+				iter, err = IteratorContext(ctx, r.recursive, tid)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			tup := &Tuple{*r.desc, t.Fields, nil}
+			if !r.all {
+				key := tup.tupleKey()
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+			}
+			produced = append(produced, tup)
+			return tup, nil
+		}
+	}, nil
+}
+
+// cteScan reads a common table expression referenced by a query, giving its
+// tuples the descriptor of the reference.
+type cteScan struct {
+	cte  *cteTable
+	desc *TupleDesc
+}
+
+func (s *cteScan) Descriptor() *TupleDesc {
+	return s.desc.copy()
+}
+
+func (s *cteScan) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	return s.IteratorContext(context.Background(), tid)
+}
+
+func (s *cteScan) IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error) {
+	src := s.cte.op
+	if s.cte.mat != nil && s.cte.refs > 1 {
+		src = s.cte.mat
+	}
+	iter, err := IteratorContext(ctx, src, tid)
+	if err != nil {
+		return nil, err
+	}
+	return func() (*Tuple, error) {
+		t, err := iter()
+		if err != nil || t == nil {
+			return nil, err
+		}
+		return &Tuple{*s.desc, t.Fields, t.Rid}, nil
+	}, nil
+}
@@ -0,0 +1,76 @@
+package godb
+
+import "testing"
+
+// count the iterations of the child of a Materialize operator
+type countingOp struct {
+	Operator
+	iterations int
+}
+
+func (c *countingOp) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	c.iterations++
+	return c.Operator.Iterator(tid)
+}
+
+func TestMaterialize(t *testing.T) {
+	_, t1, t2, hf, bp, tid := makeTestVars()
+	hf.insertTuple(&t1, tid)
+	hf.insertTuple(&t2, tid)
+
+	child := &countingOp{hf, 0}
+	m := NewMaterialize(child)
+	for i := 0; i < 3; i++ {
+		if res := collectTuples(t, m, tid); len(res) != 2 {
+			t.Fatalf("expected 2 tuples, got %d", len(res))
+		}
+	}
+	if child.iterations != 1 {
+		t.Errorf("expected the child to be read once, got %d", child.iterations)
+	}
+	bp.CommitTransaction(tid)
+	tid = NewTID()
+	bp.BeginTransaction(tid)
+	collectTuples(t, m, tid)
+	if child.iterations != 2 {
+		t.Errorf("expected the child to be read again in a new transaction")
+	}
+}
+
+func TestRecursiveUnion(t *testing.T) {
+	_, t1, _, hf, _, tid := makeTestVars()
+	hf.insertTuple(&t1, tid)
+
+	// each iteration adds one year to the ages of the previous iteration,
+	// until they reach 30
+	desc := hf.Descriptor()
+	work := NewWorkTable(desc)
+	nameField, ageField := desc.Fields[0], desc.Fields[1]
+	older, err := NewProjectOp([]Expr{&FieldExpr{nameField}, &FuncExpr{"+", []*Expr{ptr[Expr](&FieldExpr{ageField}), ptr[Expr](&ConstExpr{IntField{1}, IntType})}, nil}}, []string{"name", "age"}, false, work)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	recursive, err := NewIntFilter(&ConstExpr{IntField{30}, IntType}, OpLe, &FieldExpr{older.Descriptor().Fields[1]}, older)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ru, err := NewRecursiveUnion(hf, recursive, work, true)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	res := collectTuples(t, ru, tid)
+	if len(res) != 6 || res[5].Fields[1].(IntField).Value != 30 {
+		t.Errorf("expected ages 25 to 30, got %v", res)
+	}
+
+	if _, err := NewRecursiveUnion(hf, older, NewWorkTable(older.Descriptor()), true); err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+	}
+	proj, err := NewProjectOp([]Expr{&FieldExpr{ageField}}, []string{"age"}, false, work)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := NewRecursiveUnion(hf, proj, work, true); err == nil {
+		t.Errorf("expected recursive union of different numbers of fields to fail")
+	}
+}
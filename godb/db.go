@@ -0,0 +1,514 @@
+package godb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Options configures a database opened with [Open].  Fields left at their
+// zero value take the defaults of the REPL.
+type Options struct {
+	Catalog         string // name of the catalog file in the directory; default catalog.txt
+	BufferPoolPages int    // number of pages of the buffer pool; default 10000
+	Parallelism     int    // number of workers of parallel plans; default 1 (see Catalog.SetParallelism)
+	MemoryLimit     int64  // bytes each query may buffer; default 0 (no limit, see WithMemoryLimit)
+	Vectorized      bool   // run queries a batch at a time (see VectorizedIterator)
+}
+
+// DB is a database opened with [Open], on which statements are run with
+// [DB.Exec] and [DB.Query], as in the REPL: each statement runs in its own
+// transaction, which commits once the statement is done, unless a
+// transaction was started with [DB.Begin], in which case statements are run
+// in it until [DB.Commit] or [DB.Rollback] is called.
+//
+// The methods of a DB may be called from several goroutines, but they share
+// one transaction.  Clients that each need a transaction of their own get a
+// [Session] from [DB.NewSession].
+type DB struct {
+	mutex   sync.Mutex // guards the catalog, which statements are planned in
+	dir     string
+	opts    Options
+	bp      *BufferPool
+	c       *Catalog
+	session *Session // of the methods of the DB itself
+}
+
+// Open the database whose catalog and tables are in the directory dir,
+// creating an empty catalog if there is none.  opts may be nil.
+func Open(dir string, opts *Options) (*DB, error) {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.Catalog == "" {
+		o.Catalog = "catalog.txt"
+	}
+	if o.BufferPoolPages <= 0 {
+		o.BufferPoolPages = 10000
+	}
+	if o.Parallelism <= 0 {
+		o.Parallelism = 1
+	}
+	f, err := os.OpenFile(filepath.Join(dir, o.Catalog), os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	bp := NewBufferPool(o.BufferPoolPages)
+	c, err := NewCatalogFromFile(o.Catalog, bp, dir)
+	if err != nil {
+		return nil, err
+	}
+	c.SetParallelism(o.Parallelism)
+	db := &DB{dir: dir, opts: o, bp: bp, c: c}
+	db.session = db.NewSession()
+	return db, nil
+}
+
+// Return the catalog of the database.
+func (db *DB) Catalog() *Catalog {
+	return db.c
+}
+
+// Roll back the transaction started with [DB.Begin], if any.  Rows that
+// are still open must be closed before the database is.
+func (db *DB) Close() error {
+	return db.session.Close()
+}
+
+// Start a transaction, in which the statements run until it is committed or
+// rolled back.
+func (db *DB) Begin() error {
+	return db.session.Begin()
+}
+
+// Commit the transaction started with [DB.Begin].
+func (db *DB) Commit() error {
+	return db.session.Commit()
+}
+
+// Roll back the transaction started with [DB.Begin].
+func (db *DB) Rollback() error {
+	return db.session.Rollback()
+}
+
+// Run a statement, returning the number of tuples it inserted or deleted, or,
+// for a query, the number of tuples it returned.  The statement may be a
+// query, an insert or a delete, BEGIN, COMMIT or ROLLBACK, or a CREATE or
+// DROP TABLE, which is saved to the catalog file.  args are bound to the ? or
+// $n parameters of the statement, as with [Prepare], and may be values of
+// type int, int32, int64 or string, or IntFields and StringFields.
+func (db *DB) Exec(query string, args ...any) (int64, error) {
+	return db.session.ExecContext(context.Background(), query, args...)
+}
+
+// Like [DB.Exec], but the statement stops with a [QueryCancelledError] once
+// ctx is done.
+func (db *DB) ExecContext(ctx context.Context, query string, args ...any) (int64, error) {
+	return db.session.ExecContext(ctx, query, args...)
+}
+
+// Run a statement, returning its tuples, which must be closed once they are
+// no longer needed.  In autocommit, the statement's transaction commits when
+// the rows are closed, or is rolled back if the statement failed.  The
+// statement and args are as for [DB.Exec]; statements other than queries
+// return no rows.
+func (db *DB) Query(query string, args ...any) (*Rows, error) {
+	return db.session.QueryContext(context.Background(), query, args...)
+}
+
+// Like [DB.Query], but the statement stops with a [QueryCancelledError] once
+// ctx is done.
+func (db *DB) QueryContext(ctx context.Context, query string, args ...any) (*Rows, error) {
+	return db.session.QueryContext(ctx, query, args...)
+}
+
+// Prepare a statement, to be run with [Session.QueryStmt] or
+// [Session.ExecStmt], in the catalog of the database.  See [Prepare].
+func (db *DB) Prepare(query string) (*Stmt, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return Prepare(db.c, query)
+}
+
+// Session runs statements on a [DB] in a transaction of its own, like a
+// connection to a database server: statements run in autocommit until a
+// transaction is started with [Session.Begin].  The sessions of a DB may be
+// used from different goroutines at the same time, and their transactions
+// are isolated from each other by the locks of the buffer pool.
+type Session struct {
+	db    *DB
+	mutex sync.Mutex    // guards tid
+	tid   TransactionID // transaction started with Begin, or nil
+}
+
+// Return a new session on the database.
+func (db *DB) NewSession() *Session {
+	return &Session{db: db}
+}
+
+// Return true if a transaction was started with [Session.Begin] and has not
+// ended yet.
+func (s *Session) InTransaction() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.tid != nil
+}
+
+// Roll back the transaction of the session, if any.
+func (s *Session) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.tid != nil {
+		s.db.bp.AbortTransaction(s.tid)
+		s.tid = nil
+	}
+	return nil
+}
+
+// Start a transaction, in which the statements of the session run until it
+// is committed or rolled back.
+func (s *Session) Begin() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.begin()
+}
+
+// Commit the transaction started with [Session.Begin].
+func (s *Session) Commit() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.commit()
+}
+
+// Roll back the transaction started with [Session.Begin].
+func (s *Session) Rollback() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.rollback()
+}
+
+func (s *Session) begin() error {
+	if s.tid != nil {
+		return GoDBError{IllegalOperationError, "cannot start a transaction while in a transaction"}
+	}
+	s.tid = NewTID()
+	return s.db.bp.BeginTransaction(s.tid)
+}
+
+func (s *Session) commit() error {
+	if s.tid == nil {
+		return GoDBError{IllegalOperationError, "cannot commit unless in a transaction"}
+	}
+	s.db.bp.CommitTransaction(s.tid)
+	s.tid = nil
+	return nil
+}
+
+func (s *Session) rollback() error {
+	if s.tid == nil {
+		return GoDBError{IllegalOperationError, "cannot roll back unless in a transaction"}
+	}
+	s.db.bp.AbortTransaction(s.tid)
+	s.tid = nil
+	return nil
+}
+
+// Run a statement in the session.  See [DB.Exec].
+func (s *Session) ExecContext(ctx context.Context, query string, args ...any) (int64, error) {
+	return countRows(s.QueryContext(ctx, query, args...))
+}
+
+// Run a statement in the session, returning its tuples.  See [DB.Query].
+func (s *Session) QueryContext(ctx context.Context, query string, args ...any) (*Rows, error) {
+	if len(args) > 0 {
+		stmt, err := s.db.Prepare(query)
+		if err != nil {
+			return nil, err
+		}
+		return s.QueryStmt(ctx, stmt, args...)
+	}
+	// data definition statements cannot be prepared, and take effect when
+	// they are parsed
+	s.db.mutex.Lock()
+	qtype, plan, err := Parse(s.db.c, query)
+	if err == nil && (qtype == CreateTableQueryType || qtype == DropTableQueryType) {
+		err = s.db.c.SaveToFile(s.db.opts.Catalog, s.db.dir)
+	}
+	s.db.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return s.run(ctx, qtype, plan)
+}
+
+// Run a prepared statement in the session with its parameters bound to args,
+// returning the number of tuples, as for [DB.Exec].
+func (s *Session) ExecStmt(ctx context.Context, stmt *Stmt, args ...any) (int64, error) {
+	return countRows(s.QueryStmt(ctx, stmt, args...))
+}
+
+// Run a prepared statement in the session with its parameters bound to args,
+// returning its tuples, as for [DB.Query].  The statement may be run again,
+// in any session, before its rows are closed.
+func (s *Session) QueryStmt(ctx context.Context, stmt *Stmt, args ...any) (*Rows, error) {
+	values := make([]DBValue, len(args))
+	for i, arg := range args {
+		v, err := toDBValue(arg)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	// binding the statement plans it again if the catalog has changed
+	s.db.mutex.Lock()
+	plan, err := stmt.Bind(values...)
+	s.db.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.run(ctx, stmt.QueryType(), plan)
+	if err != nil || rows.q == nil {
+		stmt.Release(plan)
+		return rows, err
+	}
+	rows.stmt, rows.plan = stmt, plan
+	return rows, nil
+}
+
+// Run a planned statement of type qtype, whose plan is nil unless it is a
+// query.
+func (s *Session) run(ctx context.Context, qtype QueryType, plan Operator) (*Rows, error) {
+	s.mutex.Lock()
+	var err error
+	switch qtype {
+	case BeginXactionType:
+		err = s.begin()
+	case CommitXactionType:
+		err = s.commit()
+	case AbortXactionType:
+		err = s.rollback()
+	}
+	tid := s.tid
+	s.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if plan == nil {
+		return &Rows{}, nil
+	}
+	bp := s.db.bp
+	autocommit := tid == nil
+	if autocommit {
+		tid = NewTID()
+		bp.BeginTransaction(tid)
+	}
+	q, err := OpenQuery(WithMemoryLimit(ctx, s.db.opts.MemoryLimit), plan, tid, s.db.opts.Vectorized)
+	if err != nil {
+		if autocommit {
+			bp.AbortTransaction(tid)
+		}
+		return nil, err
+	}
+	rows := &Rows{bp: bp, q: q, tid: tid, autocommit: autocommit}
+	switch plan.(type) {
+	case *InsertOp, *DeleteOp:
+		rows.counts = true
+	}
+	return rows, nil
+}
+
+// Read rows to the end, returning the number of tuples they inserted or
+// deleted or, for a query, the number of tuples.
+func countRows(rows *Rows, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	n := int64(0)
+	for rows.Next() {
+		if rows.counts {
+			n = rows.cur.Fields[0].(IntField).Value
+		} else {
+			n++
+		}
+	}
+	return n, rows.Err()
+}
+
+// Return the DBValue of a Go value bound to a parameter.
+func toDBValue(v any) (DBValue, error) {
+	switch v := v.(type) {
+	case IntField, StringField:
+		return v, nil
+	case int:
+		return IntField{int64(v)}, nil
+	case int32:
+		return IntField{int64(v)}, nil
+	case int64:
+		return IntField{v}, nil
+	case string:
+		return StringField{v}, nil
+	}
+	return nil, GoDBError{TypeMismatchError, fmt.Sprintf("unsupported parameter value of type %T", v)}
+}
+
+// Rows are the tuples returned by [DB.Query], read with [Rows.Next] and
+// [Rows.Scan]:
+//
+//	rows, err := db.Query("select name, age from t where age > ?", 30)
+//	...
+//	defer rows.Close()
+//	for rows.Next() {
+//		var name string
+//		var age int64
+//		if err := rows.Scan(&name, &age); err != nil {
+//			...
+//		}
+//	}
+//	if err := rows.Err(); err != nil {
+//		...
+//	}
+type Rows struct {
+	bp         *BufferPool
+	q          *Query // nil for statements that are not queries
+	tid        TransactionID
+	autocommit bool // tid was started for the statement, and ends with it
+	counts     bool // the single tuple is the number of tuples inserted or deleted
+	cur        *Tuple
+	err        error
+	closed     bool
+	stmt       *Stmt    // prepared statement the rows are of, if any
+	plan       Operator // plan of stmt, given back once the rows are closed
+}
+
+// Return the names of the columns of the rows.
+func (r *Rows) Columns() []string {
+	if r.q == nil {
+		return nil
+	}
+	fields := r.q.Descriptor().Fields
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = f.Fname
+	}
+	return names
+}
+
+// Return the types of the columns of the rows.
+func (r *Rows) ColumnTypes() []DBType {
+	if r.q == nil {
+		return nil
+	}
+	fields := r.q.Descriptor().Fields
+	types := make([]DBType, len(fields))
+	for i, f := range fields {
+		types[i] = f.Ftype
+	}
+	return types
+}
+
+// Advance to the next row, returning false once there are no more rows or
+// the statement failed, as reported by [Rows.Err], in which case the rows
+// are closed.
+func (r *Rows) Next() bool {
+	if r.closed || r.q == nil {
+		return false
+	}
+	tup, err := r.q.Next()
+	if err != nil || tup == nil {
+		r.err = err
+		r.Close()
+		return false
+	}
+	r.cur = tup
+	return true
+}
+
+// Return the current row.
+func (r *Rows) Tuple() *Tuple {
+	return r.cur
+}
+
+// Copy the fields of the current row into dest, which must have one pointer
+// per column: a *int64, *int or *string of the column's type, a *DBValue,
+// or a *any, which is set to an int64 or a string.
+func (r *Rows) Scan(dest ...any) error {
+	if r.cur == nil {
+		return GoDBError{IllegalOperationError, "Scan called without calling Next"}
+	}
+	if len(dest) != len(r.cur.Fields) {
+		return GoDBError{IllegalOperationError, fmt.Sprintf("expected %d destinations, got %d", len(r.cur.Fields), len(dest))}
+	}
+	for i, v := range r.cur.Fields {
+		if err := scanValue(v, dest[i]); err != nil {
+			return GoDBError{TypeMismatchError, fmt.Sprintf("column %d: %s", i, err.Error())}
+		}
+	}
+	return nil
+}
+
+// Store v into the value dest points to.
+func scanValue(v DBValue, dest any) error {
+	switch d := dest.(type) {
+	case *DBValue:
+		*d = v
+		return nil
+	case *any:
+		switch v := v.(type) {
+		case IntField:
+			*d = v.Value
+		case StringField:
+			*d = v.Value
+		default:
+			*d = v
+		}
+		return nil
+	}
+	switch v := v.(type) {
+	case IntField:
+		switch d := dest.(type) {
+		case *int64:
+			*d = v.Value
+			return nil
+		case *int:
+			*d = int(v.Value)
+			return nil
+		}
+	case StringField:
+		if d, ok := dest.(*string); ok {
+			*d = v.Value
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot scan %T into %T", v, dest)
+}
+
+// Return the error the statement failed with, if any.
+func (r *Rows) Err() error {
+	return r.err
+}
+
+// Stop the statement and, in autocommit, end its transaction, which commits
+// unless the statement failed.  Close may be called more than once.
+func (r *Rows) Close() error {
+	if r.closed || r.q == nil {
+		return nil
+	}
+	r.closed = true
+	r.q.Close()
+	if r.stmt != nil {
+		r.stmt.Release(r.plan)
+	}
+	if r.autocommit {
+		if r.err != nil {
+			r.bp.AbortTransaction(r.tid)
+		} else {
+			r.bp.CommitTransaction(r.tid)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package godb
+
+import (
+	"reflect"
+	"testing"
+)
+
+// open a database in a new directory with a table t of names and ages
+func makeTestDB(t *testing.T, opts *Options) *DB {
+	t.Helper()
+	db, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := db.Exec("create table t (name varchar(20), age int)"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for i, name := range []string{"sam", "kathy", "bill", "ang"} {
+		if n, err := db.Exec("insert into t values (?, ?)", name, 20+10*i); err != nil || n != 1 {
+			t.Fatalf("expected one tuple to be inserted, got %d, %v", n, err)
+		}
+	}
+	return db
+}
+
+// return the names of the people in t older than age, in order
+func namesOlderThan(t *testing.T, db *DB, age int) []string {
+	t.Helper()
+	rows, err := db.Query("select name, age from t where age > $1 order by age", age)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer rows.Close()
+	if cols := rows.Columns(); !reflect.DeepEqual(cols, []string{"name", "age"}) {
+		t.Errorf("expected columns name and age, got %v", cols)
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		var a int
+		if err := rows.Scan(&name, &a); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if a <= age {
+			t.Errorf("expected ages over %d, got %d", age, a)
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	return names
+}
+
+func TestDBQuery(t *testing.T) {
+	for _, opts := range []*Options{nil, {Vectorized: true, Parallelism: 4}} {
+		db := makeTestDB(t, opts)
+		if names := namesOlderThan(t, db, 25); !reflect.DeepEqual(names, []string{"kathy", "bill", "ang"}) {
+			t.Errorf("expected kathy, bill and ang, got %v", names)
+		}
+		if n, err := db.Exec("select * from t"); err != nil || n != 4 {
+			t.Errorf("expected 4 tuples, got %d, %v", n, err)
+		}
+		if n, err := db.Exec("delete from t where age < ?", 35); err != nil || n != 2 {
+			t.Errorf("expected 2 tuples to be deleted, got %d, %v", n, err)
+		}
+		if names := namesOlderThan(t, db, 0); !reflect.DeepEqual(names, []string{"bill", "ang"}) {
+			t.Errorf("expected bill and ang, got %v", names)
+		}
+		db.Close()
+	}
+}
+
+func TestDBReopen(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := db.Exec("create table u (a int)"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := db.Exec("insert into u values (1)"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	db.Close()
+
+	// the table and its committed tuples are found again
+	db, err = Open(dir, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	rows, err := db.Query("select a from u")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var values []any
+	for rows.Next() {
+		var v any
+		rows.Scan(&v)
+		values = append(values, v)
+	}
+	if !reflect.DeepEqual(values, []any{int64(1)}) {
+		t.Errorf("expected one tuple with 1, got %v", values)
+	}
+}
+
+func TestDBTransactions(t *testing.T) {
+	db := makeTestDB(t, nil)
+	defer db.Close()
+
+	if err := db.Begin(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := db.Begin(); err == nil {
+		t.Errorf("expected an error starting a transaction in a transaction")
+	}
+	db.Exec("insert into t values ('tim', 60)")
+	if names := namesOlderThan(t, db, 50); !reflect.DeepEqual(names, []string{"tim"}) {
+		t.Errorf("expected the transaction to see its insert, got %v", names)
+	}
+	if err := db.Rollback(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if names := namesOlderThan(t, db, 50); len(names) != 0 {
+		t.Errorf("expected the insert to be rolled back, got %v", names)
+	}
+
+	// transactions may also be started and ended with statements
+	if _, err := db.Exec("begin"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	db.Exec("insert into t values ('tim', 60)")
+	if _, err := db.Exec("commit"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if names := namesOlderThan(t, db, 50); !reflect.DeepEqual(names, []string{"tim"}) {
+		t.Errorf("expected the insert to be committed, got %v", names)
+	}
+	if err := db.Commit(); err == nil {
+		t.Errorf("expected an error committing outside of a transaction")
+	}
+}
+
+func TestDBErrors(t *testing.T) {
+	db := makeTestDB(t, nil)
+	defer db.Close()
+
+	if _, err := db.Exec("select name from t where age > ?"); err == nil {
+		t.Errorf("expected an error running a query without its parameter")
+	}
+	if _, err := db.Exec("select name from t where age > ?", 1.5); err == nil {
+		t.Errorf("expected an error binding a float")
+	}
+	rows, err := db.Query("select name, age from t")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	rows.Next()
+	var name, age string
+	if err := rows.Scan(&name, &age); err == nil {
+		t.Errorf("expected an error scanning an int into a string")
+	}
+	if err := rows.Scan(&name); err == nil {
+		t.Errorf("expected an error scanning too few columns")
+	}
+	rows.Close()
+	if rows.Next() {
+		t.Errorf("expected no rows once closed")
+	}
+
+	// a failed statement is rolled back
+	db.opts.MemoryLimit = 10
+	_, err = db.Exec("insert into t select name, age from t order by age")
+	checkMemoryLimit(t, err)
+	db.opts.MemoryLimit = 0
+	if n, err := db.Exec("select * from t"); err != nil || n != 4 {
+		t.Errorf("expected 4 tuples, got %d, %v", n, err)
+	}
+}
@@ -1,5 +1,7 @@
 package godb
 
+import "context"
+
 type DeleteOp struct {
 	// TODO: some code goes here
 	deleteFile DBFile     // 删除的文件
@@ -33,15 +35,24 @@ func (i *DeleteOp) Descriptor() *TupleDesc {
 // were deleted.  Tuples should be deleted using the [DBFile.deleteTuple]
 // method.
 func (dop *DeleteOp) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	return dop.IteratorContext(context.Background(), tid)
+}
+
+func (dop *DeleteOp) IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error) {
 	// TODO: some code goes here
 	// 返回一个迭代器
-	iter, err := dop.child.Iterator(tid)
+	iter, err := IteratorContext(ctx, dop.child, tid)
 	if err != nil {
-		return nil, nil
+		return nil, err
 	}
 	count := 0
 
+	done := false
 	return func() (*Tuple, error) {
+		// 计数元组只返回一次
+		if done {
+			return nil, nil
+		}
 		for {
 			// 迭代
 			tuple, err := iter()
@@ -59,6 +70,7 @@ func (dop *DeleteOp) Iterator(tid TransactionID) (func() (*Tuple, error), error)
 			// 计数
 			count++
 		}
+		done = true
 		// 返回一个只有一个字段的元组，字段为count，类型为int
 		return &Tuple{
 			Desc: *dop.desc,
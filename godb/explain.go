@@ -0,0 +1,225 @@
+package godb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// memStat records the bytes of tuples that an operator buffers in memory,
+// such as the input of a sort or the hash table of a join.  Operators that
+// buffer tuples embed it, and EXPLAIN ANALYZE reports the peak.
+type memStat struct {
+	cur, peak int64 // accessed atomically
+}
+
+// Record that bytes more are held in memory.
+func (m *memStat) grow(bytes int64) {
+	cur := atomic.AddInt64(&m.cur, bytes)
+	for {
+		peak := atomic.LoadInt64(&m.peak)
+		if cur <= peak || atomic.CompareAndSwapInt64(&m.peak, peak, cur) {
+			return
+		}
+	}
+}
+
+// Record that bytes are no longer held in memory.
+func (m *memStat) release(bytes int64) {
+	atomic.AddInt64(&m.cur, -bytes)
+}
+
+// Return the most bytes held in memory at once.
+func (m *memStat) peakMemory() int64 {
+	return atomic.LoadInt64(&m.peak)
+}
+
+// memoryUser is implemented by operators that embed a [memStat].
+type memoryUser interface {
+	peakMemory() int64
+}
+
+// Return the approximate number of bytes of memory used by a tuple.
+func tupleMemory(t *Tuple) int64 {
+	size := int64(48) // the tuple and its slice of fields
+	for _, f := range t.Fields {
+		size += 16
+		if s, ok := f.(StringField); ok {
+			size += int64(len(s.Value))
+		}
+	}
+	return size
+}
+
+// Return the approximate number of bytes of memory used by tuples.
+func tuplesMemory(tuples []*Tuple) int64 {
+	var size int64
+	for _, t := range tuples {
+		size += tupleMemory(t)
+	}
+	return size
+}
+
+// PlanStats describes an operator of a plan run by [ExplainAnalyze], and its
+// children.  Rows, Time, Pages and PageReads include the work of the
+// children, whereas Memory is that of the operator alone.
+type PlanStats struct {
+	Operator      string        // the operator, as printed by EXPLAIN
+	EstimatedRows float64       // the number of tuples estimated by the optimizer
+	Rows          int64         // the number of tuples produced
+	Time          time.Duration // time spent producing them
+	Pages         int64         // pages requested from the buffer pool
+	PageReads     int64         // pages read from disk because they were not buffered
+	Memory        int64         // peak bytes of tuples buffered in memory
+	Children      []*PlanStats
+
+	op Operator
+}
+
+// String returns the plan as indented text, one operator per line.
+func (s *PlanStats) String() string {
+	var b strings.Builder
+	s.write(&b, "")
+	return b.String()
+}
+
+func (s *PlanStats) write(b *strings.Builder, indent string) {
+	fmt.Fprintf(b, "%s%s (estimated rows=%.0f) (rows=%d time=%v pages=%d reads=%d memory=%s)\n",
+		indent, s.Operator, s.EstimatedRows, s.Rows, s.Time, s.Pages, s.PageReads, formatBytes(s.Memory))
+	for _, c := range s.Children {
+		c.write(b, indent+"\t")
+	}
+}
+
+// Format a number of bytes with a binary unit.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// instrumentedOp measures the work done by the operator it wraps.
+type instrumentedOp struct {
+	op    Operator
+	stats *PlanStats
+	bp    *BufferPool
+}
+
+func (i *instrumentedOp) Descriptor() *TupleDesc {
+	return i.op.Descriptor()
+}
+
+// Run f, adding the time it takes and the pages it requests to the stats.
+func (i *instrumentedOp) measure(f func()) {
+	requests, reads := i.bp.pageCounts()
+	start := time.Now()
+	f()
+	// the copies of an operator run by the workers of a parallel plan share
+	// its stats
+	atomic.AddInt64((*int64)(&i.stats.Time), int64(time.Since(start)))
+	requests2, reads2 := i.bp.pageCounts()
+	atomic.AddInt64(&i.stats.Pages, requests2-requests)
+	atomic.AddInt64(&i.stats.PageReads, reads2-reads)
+}
+
+// Return an iterator over iter that counts and measures the tuples it
+// returns.
+func (i *instrumentedOp) wrap(iter func() (*Tuple, error)) func() (*Tuple, error) {
+	return func() (*Tuple, error) {
+		var t *Tuple
+		var err error
+		i.measure(func() { t, err = iter() })
+		if t != nil {
+			atomic.AddInt64(&i.stats.Rows, 1)
+		}
+		return t, err
+	}
+}
+
+func (i *instrumentedOp) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	return i.IteratorContext(context.Background(), tid)
+}
+
+func (i *instrumentedOp) IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error) {
+	var iter func() (*Tuple, error)
+	var err error
+	i.measure(func() { iter, err = IteratorContext(ctx, i.op, tid) })
+	if err != nil {
+		return nil, err
+	}
+	return i.wrap(iter), nil
+}
+
+// The wrapped operator's top-k iterator is used if it has one, so that
+// measuring a plan does not change it.
+func (i *instrumentedOp) topIterator(ctx context.Context, tid TransactionID, k int) (func() (*Tuple, error), error) {
+	top, ok := i.op.(topKOperator)
+	if !ok {
+		return IteratorContext(ctx, i, tid)
+	}
+	var iter func() (*Tuple, error)
+	var err error
+	i.measure(func() { iter, err = top.topIterator(ctx, tid, k) })
+	if err != nil {
+		return nil, err
+	}
+	return i.wrap(iter), nil
+}
+
+// Wrap op and its descendants in instrumentedOps, returning the wrapped
+// operator and the stats it records.
+func instrumentPlan(c *Catalog, op Operator) (Operator, *PlanStats) {
+	stats := &PlanStats{Operator: describeOp(op), EstimatedRows: c.estimateOp(op).rows, op: op}
+	for _, child := range planChildren(op) {
+		var childStats *PlanStats
+		*child, childStats = instrumentPlan(c, *child)
+		stats.Children = append(stats.Children, childStats)
+	}
+	return &instrumentedOp{op, stats, c.bp}, stats
+}
+
+// Record the memory used by the operators of a plan after it has run.
+func (s *PlanStats) collectMemory() {
+	if m, ok := s.op.(memoryUser); ok {
+		s.Memory = m.peakMemory()
+	}
+	for _, c := range s.Children {
+		c.collectMemory()
+	}
+}
+
+// ExplainAnalyze runs the plan op, which must not have been run before, in
+// the transaction tid, discarding its results, and returns the optimizer's
+// estimate and the measured work of each of its operators.  Running the plan
+// instruments it, so it should not be run again afterwards.  Pages are
+// counted for the whole buffer pool, so they include the pages requested by
+// other transactions running at the same time.  The plan stops with an error
+// once ctx is done.
+func ExplainAnalyze(ctx context.Context, c *Catalog, op Operator, tid TransactionID) (*PlanStats, error) {
+	root, stats := instrumentPlan(c, op)
+	q, err := OpenQuery(ctx, root, tid, false)
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	for {
+		t, err := q.Next()
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			break
+		}
+	}
+	stats.collectMemory()
+	return stats, nil
+}
@@ -0,0 +1,91 @@
+package godb
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// return the stats of the first operator of s, in preorder, for which f holds
+func findPlanStats(s *PlanStats, f func(*PlanStats) bool) *PlanStats {
+	if f(s) {
+		return s
+	}
+	for _, c := range s.Children {
+		if found := findPlanStats(c, f); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func countPlanStats(s *PlanStats) int {
+	n := 1
+	for _, c := range s.Children {
+		n += countPlanStats(c)
+	}
+	return n
+}
+
+func TestExplainAnalyze(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+	for _, sql := range []string{
+		"select t.name, t2.age from t join t2 on t.name = t2.name order by t2.age",
+		"select name, count(*) from t group by name order by name limit 2",
+		"select name, age from t where age > 30 order by age limit 3",
+	} {
+		expected := len(runParsedQuery(t, c, bp, sql))
+
+		_, plan, err := Parse(c, sql)
+		if err != nil {
+			t.Fatalf("failed to parse, q=%s, %s", sql, err.Error())
+		}
+		tid := NewTID()
+		bp.BeginTransaction(tid)
+		stats, err := ExplainAnalyze(context.Background(), c, plan, tid)
+		bp.CommitTransaction(tid)
+		if err != nil {
+			t.Fatalf("failed to run, q=%s, %s", sql, err.Error())
+		}
+
+		if stats.Rows != int64(expected) {
+			t.Errorf("q=%s: expected %d rows, got %d", sql, expected, stats.Rows)
+		}
+		scan := findPlanStats(stats, func(s *PlanStats) bool { return strings.HasPrefix(s.Operator, "Heap Scan") })
+		if scan == nil || scan.Pages == 0 || scan.Rows == 0 || scan.EstimatedRows == 0 {
+			t.Errorf("q=%s: expected a heap scan reading pages, got %v", sql, scan)
+		}
+		sort := findPlanStats(stats, func(s *PlanStats) bool { return strings.HasPrefix(s.Operator, "Order By") })
+		if sort == nil || sort.Memory == 0 {
+			t.Errorf("q=%s: expected a sort buffering tuples, got %v", sql, sort)
+		}
+		if stats.Time < sort.Time || stats.Pages < scan.Pages {
+			t.Errorf("q=%s: expected the root to include the work of its children", sql)
+		}
+		if lines := strings.Count(stats.String(), "\n"); lines != countPlanStats(stats) {
+			t.Errorf("q=%s: expected one line per operator, got\n%s", sql, stats.String())
+		}
+	}
+
+	// the join buffers its build side
+	_, plan, _ := Parse(c, "select t.name from t join t2 on t.name = t2.name")
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+	stats, err := ExplainAnalyze(context.Background(), c, plan, tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	join := findPlanStats(stats, func(s *PlanStats) bool { return strings.HasPrefix(s.Operator, "Join") })
+	if join == nil || join.Memory == 0 || len(join.Children) != 2 {
+		t.Errorf("expected a join buffering its build side, got %v", join)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, expected := range map[int64]string{0: "0B", 1023: "1023B", 1536: "1.5KiB", 3 << 20: "3.0MiB"} {
+		if s := formatBytes(n); s != expected {
+			t.Errorf("expected %d bytes to format as %s, got %s", n, expected, s)
+		}
+	}
+}
@@ -3,6 +3,9 @@ package godb
 import (
 	"fmt"
 	"math/rand"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -48,13 +51,52 @@ func (c *ConstExpr) EvalExpr(_ *Tuple) (DBValue, error) {
 	return c.val, nil
 }
 
+// namedExpr gives the result of an expression a field name, such as that of
+// the output field of a GROUP BY expression.
+type namedExpr struct {
+	Expr
+	field FieldType
+}
+
+func (n *namedExpr) GetExprType() FieldType {
+	return n.field
+}
+
 type FuncExpr struct {
-	op   string
-	args []*Expr
+	op    string
+	args  []*Expr
+	fType *FuncType //resolved by newFuncExpr; looked up by op if nil
+}
+
+// Create a function expression, checking that the function exists and that
+// the types of args match its declared argument types.
+func newFuncExpr(op string, args []*Expr) (*FuncExpr, error) {
+	fType, exists := lookupFunc(op)
+	if !exists {
+		return nil, GoDBError{ParseError, fmt.Sprintf("unknown function %s", op)}
+	}
+	argTypes := make([]DBType, len(args))
+	for i, arg := range args {
+		if i < len(fType.argTypes) || fType.variadic {
+			setParamTypes([]Expr{*arg}, fType.argType(i))
+		}
+		argTypes[i] = (*arg).GetExprType().Ftype
+	}
+	if err := fType.checkArgs(op, argTypes); err != nil {
+		return nil, err
+	}
+	return &FuncExpr{op, args, &fType}, nil
+}
+
+func (f *FuncExpr) funcType() (FuncType, bool) {
+	if f.fType != nil {
+		return *f.fType, true
+	}
+	return lookupFunc(f.op)
 }
 
 func (f *FuncExpr) GetExprType() FieldType {
-	fType, exists := funcs[f.op]
+	fType, exists := f.funcType()
 	//todo return err
 	if !exists {
 		return FieldType{f.op, "", IntType}
@@ -71,32 +113,144 @@ func (f *FuncExpr) GetExprType() FieldType {
 }
 
 type FuncType struct {
-	argTypes []DBType
-	outType  DBType
-	f        func([]any) any
+	argTypes      []DBType
+	outType       DBType
+	f             func([]any) any
+	variadic      bool //the last of argTypes may be repeated zero or more times
+	deterministic bool //same arguments always give the same result, so calls on constants can be folded
+}
+
+// Check that a call with arguments of the specified types matches the
+// declared argument types of the function.
+func (ft FuncType) checkArgs(name string, argTypes []DBType) error {
+	n := len(ft.argTypes)
+	if ft.variadic {
+		if len(argTypes) < n-1 {
+			return GoDBError{ParseError, fmt.Sprintf("function %s expected at least %d args", name, n-1)}
+		}
+	} else if len(argTypes) != n {
+		return GoDBError{ParseError, fmt.Sprintf("function %s expected %d args", name, n)}
+	}
+	for i, t := range argTypes {
+		expected := ft.argType(i)
+		if t != expected && t != UnknownType {
+			return GoDBError{TypeMismatchError, fmt.Sprintf("function %s expected arg %d of type %s, got %s", name, i+1, typeNames[expected], typeNames[t])}
+		}
+	}
+	return nil
 }
 
+// Return the declared type of the i-th argument.
+func (ft FuncType) argType(i int) DBType {
+	if i >= len(ft.argTypes) {
+		return ft.argTypes[len(ft.argTypes)-1]
+	}
+	return ft.argTypes[i]
+}
+
+var funcsMutex sync.RWMutex
+
 var funcs = map[string]FuncType{
 	//note should all be lower case
-	"+":                     {[]DBType{IntType, IntType}, IntType, addFunc},
-	"-":                     {[]DBType{IntType, IntType}, IntType, minusFunc},
-	"*":                     {[]DBType{IntType, IntType}, IntType, timesFunc},
-	"/":                     {[]DBType{IntType, IntType}, IntType, divFunc},
-	"mod":                   {[]DBType{IntType, IntType}, IntType, modFunc},
-	"rand":                  {[]DBType{}, IntType, randIntFunc},
-	"sq":                    {[]DBType{IntType}, IntType, sqFunc},
-	"getsubstr":             {[]DBType{StringType, IntType, IntType}, StringType, subStrFunc},
-	"epoch":                 {[]DBType{}, IntType, epoch},
-	"datetimestringtoepoch": {[]DBType{StringType}, IntType, dateTimeToEpoch},
-	"datestringtoepoch":     {[]DBType{StringType}, IntType, dateToEpoch},
-	"epochtodatetimestring": {[]DBType{IntType}, StringType, dateString},
-	"imin":                  {[]DBType{IntType, IntType}, IntType, minFunc},
-	"imax":                  {[]DBType{IntType, IntType}, IntType, maxFunc},
+	"+":                     {[]DBType{IntType, IntType}, IntType, addFunc, false, true},
+	"-":                     {[]DBType{IntType, IntType}, IntType, minusFunc, false, true},
+	"*":                     {[]DBType{IntType, IntType}, IntType, timesFunc, false, true},
+	"/":                     {[]DBType{IntType, IntType}, IntType, divFunc, false, true},
+	"mod":                   {[]DBType{IntType, IntType}, IntType, modFunc, false, true},
+	"rand":                  {[]DBType{}, IntType, randIntFunc, false, false},
+	"sq":                    {[]DBType{IntType}, IntType, sqFunc, false, true},
+	"getsubstr":             {[]DBType{StringType, IntType, IntType}, StringType, subStrFunc, false, true},
+	"epoch":                 {[]DBType{}, IntType, epoch, false, false},
+	"datetimestringtoepoch": {[]DBType{StringType}, IntType, dateTimeToEpoch, false, true},
+	"datestringtoepoch":     {[]DBType{StringType}, IntType, dateToEpoch, false, true},
+	"epochtodatetimestring": {[]DBType{IntType}, StringType, dateString, false, true},
+	"imin":                  {[]DBType{IntType, IntType}, IntType, minFunc, false, true},
+	"imax":                  {[]DBType{IntType, IntType}, IntType, maxFunc, false, true},
+}
+
+// FunctionSpec declares a scalar function for [RegisterFunction].
+type FunctionSpec struct {
+	// Types of the arguments.  If Variadic is set, the last type may be
+	// repeated zero or more times.
+	ArgTypes []DBType
+	Variadic bool
+
+	// Type of the result.
+	ReturnType DBType
+
+	// Set if the function always returns the same result for the same
+	// arguments, which allows calls on constant arguments to be evaluated
+	// once, when the query is planned.
+	Deterministic bool
+
+	// Implementation of the function.  Args are int64 values for IntType
+	// arguments and string values for StringType arguments, and the result
+	// must be of the same form.
+	Func func(args []any) (any, error)
+}
+
+// Register a scalar function, after which it can be used in expressions under
+// the supplied (case insensitive) name.  Calls are type checked against
+// spec when queries are parsed.  Returns an error if a function or aggregate
+// with the same name already exists.
+func RegisterFunction(name string, spec FunctionSpec) error {
+	name = strings.ToLower(name)
+	if spec.Func == nil {
+		return GoDBError{IllegalOperationError, fmt.Sprintf("nil implementation for function %s", name)}
+	}
+	if spec.Variadic && len(spec.ArgTypes) == 0 {
+		return GoDBError{IllegalOperationError, fmt.Sprintf("variadic function %s must declare an argument type", name)}
+	}
+	for _, t := range append([]DBType{spec.ReturnType}, spec.ArgTypes...) {
+		if t != IntType && t != StringType {
+			return GoDBError{IllegalOperationError, fmt.Sprintf("function %s has unsupported type %d", name, t)}
+		}
+	}
+	if isAgg(name) {
+		return GoDBError{DuplicateFunctionError, fmt.Sprintf("an aggregate named '%s' already exists", name)}
+	}
+	if isConditionalForm(name) {
+		return GoDBError{DuplicateFunctionError, fmt.Sprintf("'%s' is a built-in conditional expression", name)}
+	}
+	funcsMutex.Lock()
+	defer funcsMutex.Unlock()
+	if _, ok := funcs[name]; ok {
+		return GoDBError{DuplicateFunctionError, fmt.Sprintf("a function named '%s' already exists", name)}
+	}
+	fn := spec.Func
+	f := func(args []any) any {
+		v, err := fn(args)
+		if err != nil {
+			return err
+		}
+		return v
+	}
+	funcs[name] = FuncType{append([]DBType{}, spec.ArgTypes...), spec.ReturnType, f, spec.Variadic, spec.Deterministic}
+	return nil
+}
+
+func lookupFunc(funcName string) (FuncType, bool) {
+	funcsMutex.RLock()
+	defer funcsMutex.RUnlock()
+	fType, ok := funcs[funcName]
+	return fType, ok
+}
+
+func isFunc(funcName string) bool {
+	_, ok := lookupFunc(funcName)
+	return ok
 }
 
 func ListOfFunctions() string {
+	funcsMutex.RLock()
+	names := make([]string, 0, len(funcs))
+	for name := range funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 	fList := ""
-	for name, f := range funcs {
+	for _, name := range names {
+		f := funcs[name]
 		args := "("
 		argList := f.argTypes
 		hasArg := false
@@ -112,11 +266,16 @@ func ListOfFunctions() string {
 			}
 			hasArg = true
 		}
+		if f.variadic {
+			args = args + "..."
+		}
 		args = args + ")"
 		fList = fList + "\t" + name + args + "\n"
 	}
-	return fList
+	funcsMutex.RUnlock()
+	return fList + listOfAggregates()
 }
+
 func minFunc(args []any) any {
 	first := args[0].(int64)
 	second := args[1].(int64)
@@ -211,41 +370,47 @@ func subStrFunc(args []any) any {
 }
 
 func (f *FuncExpr) EvalExpr(t *Tuple) (DBValue, error) {
-	fType, exists := funcs[f.op]
+	fType, exists := f.funcType()
 	if !exists {
 		return nil, GoDBError{ParseError, fmt.Sprintf("unknown function %s", f.op)}
 	}
-	if len(f.args) != len(fType.argTypes) {
-		return nil, GoDBError{ParseError, fmt.Sprintf("function %s expected %d args", f.op, len(fType.argTypes))}
-	}
-	argvals := make([]any, len(fType.argTypes))
-	for i, argType := range fType.argTypes {
-		arg := *f.args[i]
-		if arg.GetExprType().Ftype != argType {
-			typeName := "string"
-			switch argType {
-			case IntType:
-				typeName = "int"
-			}
-			return nil, GoDBError{ParseError, fmt.Sprintf("function %s expected arg of type %s", f.op, typeName)}
+	if f.fType == nil {
+		argTypes := make([]DBType, len(f.args))
+		for i, arg := range f.args {
+			argTypes[i] = (*arg).GetExprType().Ftype
 		}
-		val, err := arg.EvalExpr(t)
+		if err := fType.checkArgs(f.op, argTypes); err != nil {
+			return nil, err
+		}
+	}
+	argvals := make([]any, len(f.args))
+	for i, arg := range f.args {
+		val, err := (*arg).EvalExpr(t)
 		if err != nil {
 			return nil, err
 		}
-		switch argType {
-		case IntType:
-			argvals[i] = val.(IntField).Value
-		case StringType:
-			argvals[i] = val.(StringField).Value
+		switch val := val.(type) {
+		case IntField:
+			argvals[i] = val.Value
+		case StringField:
+			argvals[i] = val.Value
+		default:
+			return nil, GoDBError{TypeMismatchError, fmt.Sprintf("function %s got arg of unknown type %T", f.op, val)}
 		}
 	}
 	result := fType.f(argvals)
+	if err, ok := result.(error); ok {
+		return nil, err
+	}
 	switch fType.outType {
 	case IntType:
-		return IntField{result.(int64)}, nil
+		if v, ok := result.(int64); ok {
+			return IntField{v}, nil
+		}
 	case StringType:
-		return StringField{result.(string)}, nil
+		if v, ok := result.(string); ok {
+			return StringField{v}, nil
+		}
 	}
-	return nil, GoDBError{ParseError, "unknown result type in function"}
+	return nil, GoDBError{TypeMismatchError, fmt.Sprintf("function %s returned %T, expected %s", f.op, result, typeNames[fType.outType])}
 }
@@ -0,0 +1,136 @@
+package godb
+
+import (
+	"strings"
+	"testing"
+)
+
+func registerTestFunctions(t *testing.T) {
+	if isFunc("concat_all") {
+		return
+	}
+	err := RegisterFunction("CONCAT_ALL", FunctionSpec{
+		ArgTypes:      []DBType{StringType},
+		Variadic:      true,
+		ReturnType:    StringType,
+		Deterministic: true,
+		Func: func(args []any) (any, error) {
+			var sb strings.Builder
+			for _, a := range args {
+				sb.WriteString(a.(string))
+			}
+			return sb.String(), nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to register function, %s", err.Error())
+	}
+	err = RegisterFunction("checked_div", FunctionSpec{
+		ArgTypes:   []DBType{IntType, IntType},
+		ReturnType: IntType,
+		Func: func(args []any) (any, error) {
+			if args[1].(int64) == 0 {
+				return nil, GoDBError{IllegalOperationError, "division by zero"}
+			}
+			return args[0].(int64) / args[1].(int64), nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to register function, %s", err.Error())
+	}
+}
+
+func TestRegisterFunction(t *testing.T) {
+	registerTestFunctions(t)
+	c, bp := makeParserTestCatalog(t)
+
+	res := runParsedQuery(t, c, bp, "select concat_all(name, '-', name), concat_all(), checked_div(age, 5) from t where name = 'bo'")
+	if len(res) != 1 {
+		t.Fatalf("expected one result, got %d", len(res))
+	}
+	if v := res[0].Fields[0].(StringField).Value; v != "bo-bo" {
+		t.Errorf("expected bo-bo, got %s", v)
+	}
+	if v := res[0].Fields[1].(StringField).Value; v != "" {
+		t.Errorf("expected empty string, got %s", v)
+	}
+	if v := res[0].Fields[2].(IntField).Value; v != 19 {
+		t.Errorf("expected 19, got %d", v)
+	}
+
+	for _, sql := range []string{
+		"select concat_all(name, age) from t",
+		"select checked_div(age) from t",
+		"select checked_div(name, 1) from t",
+		"select age + name from t",
+		"select no_such_function(age) from t",
+	} {
+		if _, _, err := Parse(c, sql); err == nil {
+			t.Errorf("expected type check of '%s' to fail", sql)
+		}
+	}
+
+	// errors returned by the function are reported by the iterator
+	_, plan, err := Parse(c, "select checked_div(age, age - age) from t")
+	if err != nil {
+		t.Fatalf("failed to parse, %s", err.Error())
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+	iter, err := plan.Iterator(tid)
+	if err != nil {
+		t.Fatalf("failed to get iterator, %s", err.Error())
+	}
+	if _, err := iter(); err == nil {
+		t.Errorf("expected division by zero to fail")
+	}
+
+	err = RegisterFunction("imin", FunctionSpec{ArgTypes: []DBType{IntType}, ReturnType: IntType, Func: func(args []any) (any, error) { return args[0], nil }})
+	if err == nil {
+		t.Errorf("expected duplicate function registration to fail")
+	}
+	err = RegisterFunction("count", FunctionSpec{ArgTypes: []DBType{IntType}, ReturnType: IntType, Func: func(args []any) (any, error) { return args[0], nil }})
+	if err == nil {
+		t.Errorf("expected function with the name of an aggregate to fail")
+	}
+	if !strings.Contains(ListOfFunctions(), "concat_all(string...)") {
+		t.Errorf("expected registered function in the list of functions")
+	}
+}
+
+func TestConstantFolding(t *testing.T) {
+	registerTestFunctions(t)
+	c, _ := makeParserTestCatalog(t)
+
+	node := NewFuncSelectNode("+", []*LogicalSelectNode{ptr(NewConstSelectNode("1", "")), ptr(NewConstSelectNode("2", ""))}, "")
+	expr, _, err := node.generateExpr(c, &TupleDesc{}, nil)
+	if err != nil {
+		t.Fatalf("failed to generate expression, %s", err.Error())
+	}
+	ce, ok := expr.(*ConstExpr)
+	if !ok || ce.val != (IntField{3}) {
+		t.Errorf("expected 1+2 to be folded to 3, got %v", expr)
+	}
+
+	// nondeterministic and user functions that are not declared deterministic
+	// are evaluated per tuple
+	for _, op := range []string{"rand", "checked_div"} {
+		var args []*LogicalSelectNode
+		if op == "checked_div" {
+			args = []*LogicalSelectNode{ptr(NewConstSelectNode("4", "")), ptr(NewConstSelectNode("2", ""))}
+		}
+		node = NewFuncSelectNode(op, args, "")
+		expr, _, err = node.generateExpr(c, &TupleDesc{}, nil)
+		if err != nil {
+			t.Fatalf("failed to generate expression, %s", err.Error())
+		}
+		if _, ok := expr.(*FuncExpr); !ok {
+			t.Errorf("expected %s not to be folded", op)
+		}
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
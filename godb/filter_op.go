@@ -1,6 +1,9 @@
 package godb
 
-import "golang.org/x/exp/constraints"
+import (
+	"context"
+	"golang.org/x/exp/constraints"
+)
 
 type Filter[T constraints.Ordered] struct {
 	op     BoolOp          // 比较符号
@@ -57,18 +60,17 @@ func (f *Filter[T]) Descriptor() *TupleDesc {
 // the predicate.
 // HINT: you can use the evalPred function defined in types.go to compare two values
 func (f *Filter[T]) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	return f.IteratorContext(context.Background(), tid)
+}
+
+func (f *Filter[T]) IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error) {
 	// TODO: some code goes here
 	// 若左边表达式的类型不等于右边表达式的类型，则返回错误
 	if f.left.GetExprType().Ftype != f.right.GetExprType().Ftype {
 		return nil, GoDBError{IncompatibleTypesError, "cannot apply filter to non matching types"}
 	}
 	// 获取迭代器
-	iter, err := f.child.Iterator(tid)
-	if err != nil {
-		return nil, err
-	}
-	// 右表达式为定值，提前计算
-	rightVal, err := f.right.EvalExpr(nil)
+	iter, err := IteratorContext(ctx, f.child, tid)
 	if err != nil {
 		return nil, err
 	}
@@ -88,10 +90,15 @@ func (f *Filter[T]) Iterator(tid TransactionID) (func() (*Tuple, error), error)
 				break
 			}
 			// 获取左右表达式的值
+			// 右表达式不一定是常量（例如HAVING中的聚合结果），需对每个tuple求值
 			leftVal, err := f.left.EvalExpr(tuple)
 			if err != nil {
 				return nil, err
 			}
+			rightVal, err := f.right.EvalExpr(tuple)
+			if err != nil {
+				return nil, err
+			}
 			// 比较左右表达式的值
 			if evalPred[T](f.getter(leftVal), f.getter(rightVal), f.op) {
 				return tuple, nil
@@ -100,3 +107,46 @@ func (f *Filter[T]) Iterator(tid TransactionID) (func() (*Tuple, error), error)
 		return nil, nil
 	}, nil
 }
+
+// Vectorized filter implementation.  The predicate is evaluated on the
+// columns of each batch of the child, and the rows that satisfy it are
+// gathered into the output batch.
+func (f *Filter[T]) BatchIterator(ctx context.Context, tid TransactionID) (func() (*Batch, error), error) {
+	if f.left.GetExprType().Ftype != f.right.GetExprType().Ftype {
+		return nil, GoDBError{IncompatibleTypesError, "cannot apply filter to non matching types"}
+	}
+	iter, err := BatchIterator(ctx, f.child, tid)
+	if err != nil {
+		return nil, err
+	}
+	var sel []int
+	return func() (*Batch, error) {
+		for {
+			b, err := iter()
+			if err != nil || b == nil {
+				return nil, err
+			}
+			left, err := evalVector(f.left, b)
+			if err != nil {
+				return nil, err
+			}
+			right, err := evalVector(f.right, b)
+			if err != nil {
+				return nil, err
+			}
+			lvals, rvals := vectorValues(left, f.getter), vectorValues(right, f.getter)
+			sel = sel[:0]
+			for i := range lvals {
+				if evalPred(lvals[i], rvals[i], f.op) {
+					sel = append(sel, i)
+				}
+			}
+			if len(sel) == b.n {
+				return b, nil
+			}
+			if len(sel) > 0 {
+				return b.gather(sel), nil
+			}
+		}
+	}, nil
+}
@@ -3,6 +3,7 @@ package godb
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"strconv"
@@ -305,17 +306,35 @@ func (f *HeapFile) Descriptor() *TupleDesc {
 // You should esnure that Tuples returned by this method have their Rid object
 // set appropriate so that [deleteTuple] will work (see additional comments there).
 func (f *HeapFile) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	return f.IteratorContext(context.Background(), tid)
+}
+
+func (f *HeapFile) IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error) {
+	return f.pagesIterator(ctx, tid, 0, 1)
+}
+
+// Return a function that iterates through the records on the pages first,
+// first+stride, first+2*stride, ... of the heap file.  Workers of a parallel
+// scan each read the pages of a different first page.  The scan stops with an
+// error before reading a page once ctx is done.
+func (f *HeapFile) pagesIterator(ctx context.Context, tid TransactionID, first int, stride int) (func() (*Tuple, error), error) {
 	if !f.bufPool.HasTransaction(tid) {
 		return nil, GoDBError{code: 0, errString: "transaction not found"}
 	}
 	// 迭代page
-	pageNo := 0
+	pageNo := first
 	// page迭代tuple
 	var iter func() (*Tuple, error) = nil
 	// TODO: some code goes here
 	return func() (*Tuple, error) {
 		// 遍历page
 		for pageNo < f.NumPages() {
+			if iter == nil {
+				// 读取新的page之前检查查询是否已被取消
+				if err := contextError(ctx); err != nil {
+					return nil, err
+				}
+			}
 			// 获取page
 			page, err := f.bufPool.GetPage(f, pageNo, tid, WritePerm)
 			if err != nil {
@@ -340,7 +359,7 @@ func (f *HeapFile) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
 				return t, nil
 			}
 			// 上一个页面迭代完毕
-			pageNo++
+			pageNo += stride
 			iter = nil
 		}
 		return nil, nil
@@ -0,0 +1,453 @@
+// Package httpapi serves a GoDB database over HTTP, to clients such as
+// dashboards that send SQL and read JSON.
+//
+// A statement is run by POSTing it to /query, either as the body, or, with a
+// Content-Type of application/json, as
+//
+//	{"sql": "select name from t where age > ?", "args": [30]}
+//
+// whose args, integers or strings, are bound to the ? or $n parameters of
+// the statement.  Its rows are streamed as they are produced, as a JSON
+// object
+//
+//	{"columns": [{"name": "name", "type": "string"}], "rows": [["sam"], ...]}
+//
+// or, if the request accepts application/x-ndjson or has ?format=ndjson, as
+// newline delimited JSON: a line with the columns, followed by a line per
+// row.  Inserts and deletes return one row, with the number of tuples they
+// inserted or deleted; other statements return no rows.
+//
+// Errors are returned as {"error": {"code": 8, "name": "NoSuchTableError",
+// "message": "..."}}, with the [godb.GoDBErrorCode] of the error, if any.
+// If a statement fails once its rows have started, the error is the last
+// field of the object, or the last line of the stream.
+//
+// Statements run in autocommit, unless the request has a Godb-Session
+// header with the token of a session, which is created by POSTing to
+// /sessions and closed, rolling back its transaction, by DELETEing
+// /sessions/{token}.  A session runs its statements, including BEGIN,
+// COMMIT and ROLLBACK, one at a time, in a transaction of its own.  A session
+// that runs no statement for the idle timeout of the handler is closed as if
+// it were deleted, so that a client that goes away does not hold the locks
+// of its transaction forever.
+package httpapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/srmadden/godb"
+)
+
+// SessionHeader is the header with the token of the session a statement
+// runs in.
+const SessionHeader = "Godb-Session"
+
+// The largest request body accepted.
+const maxRequestSize = 1 << 20
+
+// DefaultIdleTimeout is how long a session may be idle before it is closed,
+// unless the handler is given another timeout with
+// [Handler.SetIdleTimeout].
+const DefaultIdleTimeout = 10 * time.Minute
+
+// Handler serves the API of a database.
+type Handler struct {
+	db  *godb.DB
+	mux *http.ServeMux
+
+	mutex       sync.Mutex // guards the fields below, and the busy and used fields of sessions
+	sessions    map[string]*session
+	idleTimeout time.Duration
+}
+
+// session is a [godb.Session] created by a client.
+type session struct {
+	mutex sync.Mutex // held while a statement of the session runs
+	s     *godb.Session
+	timer *time.Timer // fires to close the session if it has been idle
+	busy  int         // number of requests running statements of the session
+	used  time.Time   // time the last statement of the session ended
+}
+
+// Return a handler serving the API of db.
+func NewHandler(db *godb.DB) *Handler {
+	h := &Handler{db: db, mux: http.NewServeMux(), sessions: make(map[string]*session), idleTimeout: DefaultIdleTimeout}
+	h.mux.HandleFunc("/query", h.serveQuery)
+	h.mux.HandleFunc("/sessions", h.serveSessions)
+	h.mux.HandleFunc("/sessions/", h.serveSession)
+	return h
+}
+
+// Set how long a session may run no statement before it is closed, rolling
+// back its transaction.  A timeout of 0 keeps the sessions created
+// afterwards open until they are deleted.
+func (h *Handler) SetIdleTimeout(timeout time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.idleTimeout = timeout
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// Close the sessions, rolling back their transactions.
+func (h *Handler) Close() error {
+	h.mutex.Lock()
+	sessions := h.sessions
+	h.sessions = make(map[string]*session)
+	h.mutex.Unlock()
+	for _, sess := range sessions {
+		sess.close()
+	}
+	return nil
+}
+
+// Stop the timer of the session, and close it once the statement it is
+// running, if any, ends.
+func (sess *session) close() {
+	if sess.timer != nil {
+		sess.timer.Stop()
+	}
+	sess.mutex.Lock()
+	sess.s.Close()
+	sess.mutex.Unlock()
+}
+
+// Close the session with token if it has been idle for the idle timeout, or
+// check again once it could have been.
+func (h *Handler) expire(token string, sess *session) {
+	h.mutex.Lock()
+	if h.sessions[token] != sess {
+		// the session was deleted
+		h.mutex.Unlock()
+		return
+	}
+	switch idle := time.Since(sess.used); {
+	case h.idleTimeout <= 0:
+		// idle sessions are kept open
+	case sess.busy > 0:
+		sess.timer.Reset(h.idleTimeout)
+	case idle < h.idleTimeout:
+		sess.timer.Reset(h.idleTimeout - idle)
+	default:
+		delete(h.sessions, token)
+		h.mutex.Unlock()
+		sess.close()
+		return
+	}
+	h.mutex.Unlock()
+}
+
+// Return false, after replying with an error, unless r has the method.
+func allow(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, requestError{http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method)})
+	return false
+}
+
+// Create a session: POST /sessions.
+func (h *Handler) serveSessions(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodPost) {
+		return
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		writeError(w, err)
+		return
+	}
+	token := hex.EncodeToString(b[:])
+	sess := &session{s: h.db.NewSession(), used: time.Now()}
+	h.mutex.Lock()
+	h.sessions[token] = sess
+	if h.idleTimeout > 0 {
+		sess.timer = time.AfterFunc(h.idleTimeout, func() { h.expire(token, sess) })
+	}
+	h.mutex.Unlock()
+	writeJSON(w, http.StatusCreated, map[string]string{"session": token})
+}
+
+// Close a session: DELETE /sessions/{token}.
+func (h *Handler) serveSession(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodDelete) {
+		return
+	}
+	token := strings.TrimPrefix(r.URL.Path, "/sessions/")
+	h.mutex.Lock()
+	sess, ok := h.sessions[token]
+	delete(h.sessions, token)
+	h.mutex.Unlock()
+	if !ok {
+		writeError(w, errNoSession)
+		return
+	}
+	// wait for the statement the session is running, if any
+	sess.close()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var errNoSession = requestError{http.StatusNotFound, "no such session"}
+
+// Run a statement: POST /query.
+func (h *Handler) serveQuery(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodPost) {
+		return
+	}
+	query, args, err := readQuery(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var s *godb.Session
+	if token := r.Header.Get(SessionHeader); token != "" {
+		h.mutex.Lock()
+		sess, ok := h.sessions[token]
+		if ok {
+			sess.busy++
+		}
+		h.mutex.Unlock()
+		if !ok {
+			writeError(w, errNoSession)
+			return
+		}
+		// the session is idle again once the rows have been written
+		defer func() {
+			h.mutex.Lock()
+			sess.busy--
+			sess.used = time.Now()
+			h.mutex.Unlock()
+		}()
+		sess.mutex.Lock()
+		defer sess.mutex.Unlock()
+		s = sess.s
+	} else {
+		// a transaction begun without a session ends with the request
+		s = h.db.NewSession()
+		defer s.Close()
+	}
+
+	// the statement is cancelled if the client goes away
+	rows, err := s.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer rows.Close()
+	writeRows(w, rows, wantsNDJSON(r))
+}
+
+// Return the statement and arguments of a request.
+func readQuery(w http.ResponseWriter, r *http.Request) (string, []any, error) {
+	body := http.MaxBytesReader(w, r.Body, maxRequestSize)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		text, err := io.ReadAll(body)
+		if err != nil {
+			return "", nil, requestError{http.StatusBadRequest, err.Error()}
+		}
+		return string(text), nil, nil
+	}
+
+	var req struct {
+		SQL  string `json:"sql"`
+		Args []any  `json:"args"`
+	}
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+	if err := dec.Decode(&req); err != nil {
+		return "", nil, requestError{http.StatusBadRequest, fmt.Sprintf("invalid request: %s", err.Error())}
+	}
+	// json numbers are bound as integers
+	for i, arg := range req.Args {
+		switch arg := arg.(type) {
+		case json.Number:
+			n, err := arg.Int64()
+			if err != nil {
+				return "", nil, requestError{http.StatusBadRequest, fmt.Sprintf("argument %d is not an integer: %s", i+1, arg)}
+			}
+			req.Args[i] = n
+		case string:
+		default:
+			return "", nil, requestError{http.StatusBadRequest, fmt.Sprintf("argument %d is not an integer or a string", i+1)}
+		}
+	}
+	return req.SQL, req.Args, nil
+}
+
+// Return true if the rows are to be returned as newline delimited JSON.
+func wantsNDJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "ndjson" {
+		return true
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/x-ndjson") || strings.Contains(accept, "application/ndjson")
+}
+
+type column struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// Return the columns of rows.
+func columns(rows *godb.Rows) []column {
+	cols := make([]column, 0)
+	types := rows.ColumnTypes()
+	for i, name := range rows.Columns() {
+		typ := "string"
+		if types[i] == godb.IntType {
+			typ = "int"
+		}
+		cols = append(cols, column{name, typ})
+	}
+	return cols
+}
+
+// Return the values of a row.
+func values(t *godb.Tuple) []any {
+	vals := make([]any, len(t.Fields))
+	for i, f := range t.Fields {
+		switch f := f.(type) {
+		case godb.IntField:
+			vals[i] = f.Value
+		case godb.StringField:
+			vals[i] = f.Value
+		}
+	}
+	return vals
+}
+
+// Write rows as they are produced, as a JSON object or, if ndjson, as a line
+// per row, each of which is flushed to the client.
+func writeRows(w http.ResponseWriter, rows *godb.Rows, ndjson bool) {
+	flusher, _ := w.(http.Flusher)
+	cols, _ := json.Marshal(columns(rows))
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		fmt.Fprintf(w, "{\"columns\":%s}\n", cols)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "{\"columns\":%s,\"rows\":[", cols)
+	}
+	for n := 0; rows.Next(); n++ {
+		row, _ := json.Marshal(values(rows.Tuple()))
+		if ndjson {
+			fmt.Fprintf(w, "%s\n", row)
+			if flusher != nil {
+				flusher.Flush()
+			}
+			continue
+		}
+		if n > 0 {
+			io.WriteString(w, ",")
+		}
+		w.Write(row)
+	}
+
+	// the status was sent with the first write, so a statement that fails
+	// now can only report its error in the body
+	var errJSON []byte
+	if err := rows.Err(); err != nil {
+		body, _ := errorOf(err)
+		errJSON, _ = json.Marshal(body)
+	}
+	switch {
+	case ndjson && errJSON != nil:
+		fmt.Fprintf(w, "{\"error\":%s}\n", errJSON)
+	case !ndjson && errJSON != nil:
+		fmt.Fprintf(w, "],\"error\":%s}\n", errJSON)
+	case !ndjson:
+		io.WriteString(w, "]}\n")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// requestError is an error of a request, rather than of its statement.
+type requestError struct {
+	status int
+	msg    string
+}
+
+func (e requestError) Error() string {
+	return e.msg
+}
+
+// errorBody is the JSON of an error.
+type errorBody struct {
+	Code    *godb.GoDBErrorCode `json:"code,omitempty"`
+	Name    string              `json:"name,omitempty"`
+	Message string              `json:"message"`
+}
+
+// Names of the codes of GoDBErrors.
+var errorNames = map[godb.GoDBErrorCode]string{
+	godb.TupleNotFoundError:      "TupleNotFoundError",
+	godb.PageFullError:           "PageFullError",
+	godb.IncompatibleTypesError:  "IncompatibleTypesError",
+	godb.TypeMismatchError:       "TypeMismatchError",
+	godb.MalformedDataError:      "MalformedDataError",
+	godb.BufferPoolFullError:     "BufferPoolFullError",
+	godb.ParseError:              "ParseError",
+	godb.DuplicateTableError:     "DuplicateTableError",
+	godb.NoSuchTableError:        "NoSuchTableError",
+	godb.AmbiguousNameError:      "AmbiguousNameError",
+	godb.IllegalOperationError:   "IllegalOperationError",
+	godb.DeadlockError:           "DeadlockError",
+	godb.IllegalTransactionError: "IllegalTransactionError",
+	godb.DuplicateFunctionError:  "DuplicateFunctionError",
+	godb.QueryCancelledError:     "QueryCancelledError",
+	godb.MemoryLimitError:        "MemoryLimitError",
+}
+
+// HTTP statuses of the codes of GoDBErrors that are not the client's
+// mistake; the others are reported as bad requests.
+var errorStatuses = map[godb.GoDBErrorCode]int{
+	godb.PageFullError:           http.StatusInternalServerError,
+	godb.BufferPoolFullError:     http.StatusServiceUnavailable,
+	godb.DeadlockError:           http.StatusConflict,
+	godb.IllegalTransactionError: http.StatusConflict,
+	godb.QueryCancelledError:     http.StatusServiceUnavailable,
+	godb.MemoryLimitError:        http.StatusServiceUnavailable,
+}
+
+// Return the JSON and HTTP status of an error.
+func errorOf(err error) (errorBody, int) {
+	var rerr requestError
+	if errors.As(err, &rerr) {
+		return errorBody{Message: rerr.msg}, rerr.status
+	}
+	var gerr godb.GoDBError
+	if errors.As(err, &gerr) {
+		code := gerr.Code()
+		status, ok := errorStatuses[code]
+		if !ok {
+			status = http.StatusBadRequest
+		}
+		return errorBody{Code: &code, Name: errorNames[code], Message: gerr.Message()}, status
+	}
+	return errorBody{Message: err.Error()}, http.StatusInternalServerError
+}
+
+// Reply with an error, before anything else is written.
+func writeError(w http.ResponseWriter, err error) {
+	body, status := errorOf(err)
+	writeJSON(w, status, map[string]errorBody{"error": body})
+}
@@ -0,0 +1,303 @@
+package httpapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/srmadden/godb"
+)
+
+// start a server of a database with a table t of names and ages
+func startTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv, _ := startTestHandler(t)
+	return srv
+}
+
+// start a server of a database with a table t of names and ages, returning
+// its handler too
+func startTestHandler(t *testing.T) (*httptest.Server, *Handler) {
+	t.Helper()
+	db, err := godb.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, sql := range []string{
+		"create table t (name varchar(20), age int)",
+		"insert into t values ('sam', 20)",
+		"insert into t values ('kathy', 30)",
+		"insert into t values ('bill', 40)",
+	} {
+		if _, err := db.Exec(sql); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+	h := NewHandler(db)
+	srv := httptest.NewServer(h)
+	t.Cleanup(func() {
+		srv.Close()
+		h.Close()
+	})
+	return srv, h
+}
+
+// result is the JSON of a response.
+type result struct {
+	Columns []column   `json:"columns"`
+	Rows    [][]any    `json:"rows"`
+	Error   *errorBody `json:"error"`
+	Session string     `json:"session"`
+	status  int
+}
+
+// POST body, of a content type, to path, returning the response
+func post(t *testing.T, srv *httptest.Server, path string, contentType string, body string, header http.Header) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return resp
+}
+
+// run a statement, in the session with token, if any, returning its result
+func query(t *testing.T, srv *httptest.Server, token string, sql string, args ...any) result {
+	t.Helper()
+	header := http.Header{}
+	if token != "" {
+		header.Set(SessionHeader, token)
+	}
+	body, _ := json.Marshal(map[string]any{"sql": sql, "args": args})
+	resp := post(t, srv, "/query", "application/json", string(body), header)
+	defer resp.Body.Close()
+	res := result{status: resp.StatusCode}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf("%s: %v", sql, err)
+	}
+	return res
+}
+
+func TestQuery(t *testing.T) {
+	srv := startTestServer(t)
+
+	res := query(t, srv, "", "select name, age from t where age > ? order by age", 25)
+	expected := result{
+		Columns: []column{{"name", "string"}, {"age", "int"}},
+		Rows:    [][]any{{"kathy", float64(30)}, {"bill", float64(40)}},
+		status:  http.StatusOK,
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+
+	// the statement may be the body
+	resp := post(t, srv, "/query", "text/plain", "select count(*) from t where name <> 'sam'", nil)
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !reflect.DeepEqual(res.Rows, [][]any{{float64(2)}}) {
+		t.Errorf("expected a count of 2, got %v", res.Rows)
+	}
+
+	res = query(t, srv, "", "insert into t values ($1, $2)", "ang", 50)
+	if res.status != http.StatusOK || !reflect.DeepEqual(res.Rows, [][]any{{float64(1)}}) {
+		t.Errorf("expected one tuple to be inserted, got %v", res)
+	}
+	if res = query(t, srv, "", "create table u (a int)"); res.status != http.StatusOK || len(res.Rows) != 0 {
+		t.Errorf("expected the table to be created, got %v", res)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	srv := startTestServer(t)
+
+	for _, c := range []struct {
+		sql    string
+		args   []any
+		status int
+		code   godb.GoDBErrorCode
+	}{
+		{"select * from nosuchtable", nil, http.StatusBadRequest, godb.NoSuchTableError},
+		{"selct 1", nil, http.StatusBadRequest, godb.ParseError},
+		{"select name from t where age > ?", []any{"old"}, http.StatusBadRequest, godb.TypeMismatchError},
+		{"commit", nil, http.StatusBadRequest, godb.IllegalOperationError},
+	} {
+		res := query(t, srv, "", c.sql, c.args...)
+		if res.status != c.status || res.Error == nil || res.Error.Code == nil || *res.Error.Code != c.code {
+			t.Errorf("%s: expected error %d with status %d, got %d, %+v", c.sql, c.code, c.status, res.status, res.Error)
+			continue
+		}
+		if res.Error.Name != errorNames[c.code] {
+			t.Errorf("%s: expected %s, got %s", c.sql, errorNames[c.code], res.Error.Name)
+		}
+	}
+
+	// errors of requests have no code
+	res := query(t, srv, "", "select name from t where age > ?", 2.5)
+	if res.status != http.StatusBadRequest || res.Error == nil || res.Error.Code != nil {
+		t.Errorf("expected an invalid argument, got %d, %+v", res.status, res.Error)
+	}
+	if res := query(t, srv, "nosuchsession", "select name from t"); res.status != http.StatusNotFound {
+		t.Errorf("expected an unknown session, got %d", res.status)
+	}
+	resp, err := srv.Client().Get(srv.URL + "/query")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != http.MethodPost {
+		t.Errorf("expected GET to be rejected, got %d", resp.StatusCode)
+	}
+}
+
+func newSession(t *testing.T, srv *httptest.Server) string {
+	t.Helper()
+	resp := post(t, srv, "/sessions", "application/json", "", nil)
+	defer resp.Body.Close()
+	var res result
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected a session, got %d, %v", resp.StatusCode, err)
+	}
+	return res.Session
+}
+
+func closeSession(t *testing.T, srv *httptest.Server, token string) int {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/sessions/"+token, nil)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestSessions(t *testing.T) {
+	srv := startTestServer(t)
+	s1, s2 := newSession(t, srv), newSession(t, srv)
+
+	query(t, srv, s1, "begin")
+	query(t, srv, s1, "insert into t values ('tim', 60)")
+	if res := query(t, srv, s1, "select name from t where age > 50"); len(res.Rows) != 1 {
+		t.Errorf("expected the transaction to see its insert, got %v", res)
+	}
+	// a session out of the transaction cannot commit it
+	if res := query(t, srv, s2, "commit"); res.Error == nil {
+		t.Errorf("expected an error committing without a transaction")
+	}
+	if res := query(t, srv, s1, "commit"); res.Error != nil {
+		t.Fatalf("expected the transaction to commit, got %+v", res.Error)
+	}
+	if res := query(t, srv, s2, "select name from t where age > 50"); len(res.Rows) != 1 {
+		t.Errorf("expected the insert to be committed, got %v", res)
+	}
+
+	// closing a session rolls back its transaction
+	query(t, srv, s2, "begin")
+	query(t, srv, s2, "delete from t")
+	if status := closeSession(t, srv, s2); status != http.StatusNoContent {
+		t.Errorf("expected the session to be closed, got %d", status)
+	}
+	if status := closeSession(t, srv, s2); status != http.StatusNotFound {
+		t.Errorf("expected the session to be gone, got %d", status)
+	}
+	if res := query(t, srv, s1, "select count(*) from t"); !reflect.DeepEqual(res.Rows, [][]any{{float64(4)}}) {
+		t.Errorf("expected the delete to be rolled back, got %v", res.Rows)
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	srv, h := startTestHandler(t)
+	h.SetIdleTimeout(200 * time.Millisecond)
+	active, idle := newSession(t, srv), newSession(t, srv)
+	query(t, srv, idle, "begin")
+	query(t, srv, idle, "insert into t values ('tim', 60)")
+
+	// a session that runs statements stays open, while the idle one is
+	// closed, rolling back its transaction
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if res := query(t, srv, active, "select name from t where age < 30"); res.status != http.StatusOK {
+			t.Fatalf("expected the active session to stay open, got %d, %+v", res.status, res.Error)
+		}
+		h.mutex.Lock()
+		_, ok := h.sessions[idle]
+		h.mutex.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the idle session to be closed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if res := query(t, srv, idle, "commit"); res.status != http.StatusNotFound {
+		t.Errorf("expected the idle session to be gone, got %d", res.status)
+	}
+	if res := query(t, srv, "", "select count(*) from t"); !reflect.DeepEqual(res.Rows, [][]any{{float64(3)}}) {
+		t.Errorf("expected the insert to be rolled back, got %v, %+v", res.Rows, res.Error)
+	}
+	if status := closeSession(t, srv, active); status != http.StatusNoContent {
+		t.Errorf("expected the active session to be closed, got %d", status)
+	}
+}
+
+// run a statement, returning the lines of its NDJSON response
+func queryNDJSON(t *testing.T, srv *httptest.Server, sql string) []string {
+	t.Helper()
+	resp := post(t, srv, "/query?format=ndjson", "text/plain", sql, nil)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("expected NDJSON, got %d, %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var lines []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+func TestNDJSON(t *testing.T) {
+	srv := startTestServer(t)
+
+	lines := queryNDJSON(t, srv, "select name, age from t order by age")
+	expected := []string{
+		`{"columns":[{"name":"name","type":"string"},{"name":"age","type":"int"}]}`,
+		`["sam",20]`,
+		`["kathy",30]`,
+		`["bill",40]`,
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected %v, got %v", expected, lines)
+	}
+
+	// a statement that fails once its columns are sent ends with the error:
+	// here, waiting for the lock of a transaction on t
+	s := newSession(t, srv)
+	query(t, srv, s, "begin")
+	query(t, srv, s, "insert into t values ('tim', 60)")
+	lines = queryNDJSON(t, srv, "select name from t")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], `{"error":{"code":11,"name":"DeadlockError"`) {
+		t.Errorf("expected the columns and an error, got %v", lines)
+	}
+	res := query(t, srv, "", "select name from t")
+	if res.status != http.StatusOK || res.Error == nil || res.Error.Name != "DeadlockError" || len(res.Rows) != 0 {
+		t.Errorf("expected no rows and an error, got %d, %+v", res.status, res.Error)
+	}
+}
@@ -1,5 +1,7 @@
 package godb
 
+import "context"
+
 // TODO: some code goes here
 type InsertOp struct {
 	// TODO: some code goes here
@@ -33,15 +35,24 @@ func (i *InsertOp) Descriptor() *TupleDesc {
 // were inserted.  Tuples should be inserted using the [DBFile.insertTuple]
 // method.
 func (iop *InsertOp) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	return iop.IteratorContext(context.Background(), tid)
+}
+
+func (iop *InsertOp) IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error) {
 	// TODO: some code goes here
 	// 返回一个迭代器
-	iter, err := iop.child.Iterator(tid)
+	iter, err := IteratorContext(ctx, iop.child, tid)
 	if err != nil {
-		return nil, nil
+		return nil, err
 	}
 	// 计数
 	count := 0
+	done := false
 	return func() (*Tuple, error) {
+		// 计数元组只返回一次
+		if done {
+			return nil, nil
+		}
 		for {
 			// 迭代
 			tuple, err := iter()
@@ -59,6 +70,7 @@ func (iop *InsertOp) Iterator(tid TransactionID) (func() (*Tuple, error), error)
 			// 计数
 			count++
 		}
+		done = true
 		// 返回结果元组，包含插入的数量
 		return &Tuple{
 			Desc: *iop.desc,
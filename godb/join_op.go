@@ -1,5 +1,7 @@
 package godb
 
+import "context"
+
 type EqualityJoin[T comparable] struct {
 	// Expressions that when applied to tuples from the left or right operators,
 	// respectively, return the value of the left or right side of the join
@@ -16,6 +18,8 @@ type EqualityJoin[T comparable] struct {
 	// The maximum number of records of intermediate state that the join should use
 	// (only required for optional exercise)
 	maxBufferSize int
+
+	memStat //tuples of the left child in the hash table
 }
 
 // Constructor for a  join of integer expressions
@@ -28,7 +32,7 @@ func NewIntJoin(left Operator, leftField Expr, right Operator, rightField Expr,
 	case StringType:
 		return nil, GoDBError{TypeMismatchError, "join field is not an int"}
 	case IntType:
-		return &EqualityJoin[int64]{leftField, rightField, &left, &right, intFilterGetter, maxBufferSize}, nil
+		return &EqualityJoin[int64]{leftField, rightField, &left, &right, intFilterGetter, maxBufferSize, memStat{}}, nil
 	}
 	return nil, GoDBError{TypeMismatchError, "unknown type"}
 }
@@ -42,7 +46,7 @@ func NewStringJoin(left Operator, leftField Expr, right Operator, rightField Exp
 	}
 	switch leftField.GetExprType().Ftype {
 	case StringType:
-		return &EqualityJoin[string]{leftField, rightField, &left, &right, stringFilterGetter, maxBufferSize}, nil
+		return &EqualityJoin[string]{leftField, rightField, &left, &right, stringFilterGetter, maxBufferSize, memStat{}}, nil
 	case IntType:
 		return nil, GoDBError{TypeMismatchError, "join field is not a string"}
 	}
@@ -64,96 +68,255 @@ func (hj *EqualityJoin[T]) Descriptor() *TupleDesc {
 // joinOp.right, applying the joinOp.leftField and joinOp.rightField expressions
 // to the tuples of the left and right iterators respectively, and joining them
 // using an equality predicate.
-// HINT: When implementing the simple nested loop join, you should keep in mind that
-// you only iterate through the left iterator once (outer loop) but iterate through the right iterator
-// once for every tuple in the the left iterator (inner loop).
-// HINT: You can use joinTuples function you implemented in lab1 to join two tuples.
 //
-// OPTIONAL EXERCISE:  the operator implementation should not use more than
-// maxBufferSize records, and should pass the testBigJoin test without timing
-// out.  To pass this test, you will need to use something other than a nested
-// loops join.
+// The join is a block hash join with the left child as its build side: it
+// reads up to maxBufferSize tuples of the left child into a hash table on
+// their join values, and then probes the table with every tuple of the right
+// child, repeating for each further block of the left child.  The right child
+// is therefore scanned once per block, and the left child should be the
+// smaller input.
 func (joinOp *EqualityJoin[T]) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
-	// TODO: some code goes here
+	return joinOp.IteratorContext(context.Background(), tid)
+}
+
+func (joinOp *EqualityJoin[T]) IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error) {
 	if joinOp.leftField.GetExprType().Ftype != joinOp.rightField.GetExprType().Ftype {
 		return nil, GoDBError{TypeMismatchError, "can't join fields of different types"}
 	}
+	leftIter, err := IteratorContext(ctx, (*joinOp.left), tid)
+	if err != nil {
+		return nil, err
+	}
+	blockSize := joinOp.maxBufferSize
+	if blockSize < 1 {
+		blockSize = 1
+	}
 
-	var retFunc func() (*Tuple, error)
-	// 方法一，暴力遍历
-	leftIter, _ := (*joinOp.left).Iterator(tid)
-	rightIter, _ := (*joinOp.right).Iterator(tid)
-	leftTuple, _ := leftIter()
-	rightTuple, _ := rightIter()
-	retFunc = func() (*Tuple, error) {
-		for {
-			if leftTuple == nil {
+	var (
+		block      map[T][]*Tuple // hash table over the current block of the left child
+		blockBytes int64          // bytes of tuples in block
+		leftDone   bool
+		rightIter  func() (*Tuple, error)
+		rightTup   *Tuple
+		matches    []*Tuple // left tuples matching rightTup not yet returned
+		pending    *Tuple   // left tuple that did not fit in the previous block
+	)
+	mem := joinOp.account(ctx, "join")
+	// read the next block of the left child, returning false if it is empty.
+	// A block ends early if another tuple would exceed the memory limit of the
+	// query.
+	nextBlock := func() (bool, error) {
+		mem.release(blockBytes)
+		block, blockBytes = make(map[T][]*Tuple), 0
+		n := 0
+		for n < blockSize && !leftDone {
+			t := pending
+			pending = nil
+			if t == nil {
+				if t, err = leftIter(); err != nil {
+					return false, err
+				}
+			}
+			if t == nil {
+				leftDone = true
 				break
 			}
-			for {
-				if rightTuple == nil {
+			size := tupleMemory(t)
+			if n > 0 && !mem.fits(size) {
+				pending = t
+				break
+			}
+			if err := mem.grow(size); err != nil {
+				return false, err
+			}
+			blockBytes += size
+			v, err := joinOp.leftField.EvalExpr(t)
+			if err != nil {
+				return false, err
+			}
+			k := joinOp.getter(v)
+			block[k] = append(block[k], t)
+			n++
+		}
+		if n == 0 {
+			return false, nil
+		}
+		rightIter, err = IteratorContext(ctx, (*joinOp.right), tid)
+		return err == nil, err
+	}
+
+	return func() (*Tuple, error) {
+		for {
+			if len(matches) > 0 {
+				t := joinTuples(matches[0], rightTup)
+				matches = matches[1:]
+				return t, nil
+			}
+			if rightIter != nil {
+				t, err := rightIter()
+				if err != nil {
+					return nil, err
+				}
+				if t != nil {
+					v, err := joinOp.rightField.EvalExpr(t)
+					if err != nil {
+						return nil, err
+					}
+					rightTup, matches = t, block[joinOp.getter(v)]
+					continue
+				}
+				rightIter = nil
+			}
+			if leftDone {
+				mem.release(blockBytes)
+				blockBytes = 0
+				return nil, nil
+			}
+			ok, err := nextBlock()
+			if err != nil || !ok {
+				return nil, err
+			}
+		}
+	}, nil
+}
+
+// A row of a batch in the hash table of a vectorized join.
+type batchRow struct {
+	b   *Batch
+	row int
+}
+
+// Vectorized join implementation.  As in Iterator, blocks of up to
+// maxBufferSize rows of the left child are loaded into a hash table, which is
+// then probed with the join values of each batch of the right child; matching
+// pairs of rows are copied into output batches column by column.
+func (joinOp *EqualityJoin[T]) BatchIterator(ctx context.Context, tid TransactionID) (func() (*Batch, error), error) {
+	if joinOp.leftField.GetExprType().Ftype != joinOp.rightField.GetExprType().Ftype {
+		return nil, GoDBError{TypeMismatchError, "can't join fields of different types"}
+	}
+	leftIter, err := BatchIterator(ctx, *joinOp.left, tid)
+	if err != nil {
+		return nil, err
+	}
+	blockSize := joinOp.maxBufferSize
+	if blockSize < 1 {
+		blockSize = 1
+	}
+
+	var (
+		block      map[T][]batchRow // hash table over the current block of the left child
+		blockBytes int64            // bytes of rows in block
+		leftDone   bool
+		leftBatch  *Batch // batch of the left child not yet added to a block
+		leftRow    int    // first row of leftBatch not yet added
+		rightIter  func() (*Batch, error)
+		rightBatch *Batch
+		rightKeys  []T
+		rightRow   int        // row of rightBatch being probed
+		matches    []batchRow // left rows matching rightRow not yet returned
+		desc       *TupleDesc
+		types      []DBType
+	)
+	mem := joinOp.account(ctx, "join")
+	// read the next block of the left child, returning false if it is empty
+	nextBlock := func() (bool, error) {
+		mem.release(blockBytes)
+		block, blockBytes = make(map[T][]batchRow), 0
+		n := 0
+		full := false
+		for n < blockSize && !leftDone && !full {
+			if leftBatch == nil || leftRow >= leftBatch.n {
+				b, err := leftIter()
+				if err != nil {
+					return false, err
+				}
+				if b == nil {
+					leftDone = true
 					break
 				}
-				// 比较左右两个值
-				leftValue, _ := joinOp.leftField.EvalExpr(leftTuple)
-				rightValue, _ := joinOp.rightField.EvalExpr(rightTuple)
-				if joinOp.getter(leftValue) == joinOp.getter(rightValue) {
-					resTuple := joinTuples(leftTuple, rightTuple)
-					// 开启下一轮right循环
-					rightTuple, _ = rightIter()
-					return resTuple, nil
-				} else {
-					rightTuple, _ = rightIter()
+				leftBatch, leftRow = b, 0
+			}
+			v, err := evalVector(joinOp.leftField, leftBatch)
+			if err != nil {
+				return false, err
+			}
+			keys := vectorValues(v, joinOp.getter)
+			for ; leftRow < leftBatch.n && n < blockSize; leftRow++ {
+				size := leftBatch.rowMemory(leftRow)
+				if n > 0 && !mem.fits(size) {
+					full = true
+					break
+				}
+				if err := mem.grow(size); err != nil {
+					return false, err
 				}
+				blockBytes += size
+				k := keys[leftRow]
+				block[k] = append(block[k], batchRow{leftBatch, leftRow})
+				n++
 			}
-			leftTuple, _ = leftIter()
-			rightIter, _ = (*joinOp.right).Iterator(tid)
-			rightTuple, _ = rightIter()
 		}
-		return nil, nil
+		if n == 0 {
+			return false, nil
+		}
+		rightIter, err = BatchIterator(ctx, *joinOp.right, tid)
+		return err == nil, err
 	}
-	return retFunc, nil
-	// 方法二
-	// 读取右表的所有元组，将其放入哈希表中
-	// rightIter, _ := (*joinOp.right).Iterator(tid)
-	// rightHash := make(map[T][]*Tuple)
-	// for {
-	// 	rightTuple, _ := rightIter()
-	// 	if rightTuple == nil {
-	// 		break
-	// 	}
-	// 	rightValue, _ := joinOp.rightField.EvalExpr(rightTuple)
-	// 	rightHash[joinOp.getter(rightValue)] = append(rightHash[joinOp.getter(rightValue)], rightTuple)
-	// }
-	// // 遍历左表
-	// leftIter, _ := (*joinOp.left).Iterator(tid)
-	// // 初始化第一次迭代
-	// leftTuple, _ := leftIter()
-	// leftValue, _ := joinOp.leftField.EvalExpr(leftTuple)
-	// rightTuples := rightHash[joinOp.getter(leftValue)]
-	// rightNum := 0
-	// var rightTuple *Tuple
-	// retFunc = func() (*Tuple, error) {
-	// 	for {
-	// 		for {
-	// 			if rightNum >= len(rightTuples) {
-	// 				break
-	// 			}
-	// 			rightTuple = rightTuples[rightNum]
-	// 			rightNum++
-	// 			retTuple := joinTuples(leftTuple, rightTuple)
-	// 			return retTuple, nil
-	// 		}
-	// 		// 开启下一轮left循环
-	// 		leftTuple, _ = leftIter()
-	// 		if leftTuple == nil {
-	// 			break
-	// 		}
-	// 		leftValue, _ = joinOp.leftField.EvalExpr(leftTuple)
-	// 		rightTuples = rightHash[joinOp.getter(leftValue)]
-	// 		rightNum = 0
-	// 	}
-	// 	return nil, nil
-	// }
-	// return retFunc, nil
+
+	return func() (*Batch, error) {
+		var out *Batch
+		for out == nil || out.n < BatchSize {
+			if len(matches) > 0 {
+				if out == nil {
+					if desc == nil {
+						desc = matches[0].b.Desc.merge(rightBatch.Desc)
+						for _, c := range matches[0].b.Columns {
+							types = append(types, c.Type)
+						}
+						for _, c := range rightBatch.Columns {
+							types = append(types, c.Type)
+						}
+					}
+					out = newBatch(desc, types, BatchSize)
+				}
+				out.appendJoined(matches[0].b, matches[0].row, rightBatch, rightRow)
+				matches = matches[1:]
+				continue
+			}
+			if rightBatch != nil && rightRow+1 < rightBatch.n {
+				rightRow++
+				matches = block[rightKeys[rightRow]]
+				continue
+			}
+			if rightIter != nil {
+				b, err := rightIter()
+				if err != nil {
+					return nil, err
+				}
+				if b != nil {
+					v, err := evalVector(joinOp.rightField, b)
+					if err != nil {
+						return nil, err
+					}
+					rightBatch, rightKeys, rightRow = b, vectorValues(v, joinOp.getter), 0
+					matches = block[rightKeys[0]]
+					continue
+				}
+				rightIter, rightBatch = nil, nil
+			}
+			if leftDone {
+				mem.release(blockBytes)
+				blockBytes = 0
+				break
+			}
+			ok, err := nextBlock()
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				break
+			}
+		}
+		return out, nil
+	}, nil
 }
@@ -0,0 +1,368 @@
+package godb
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// The optimizer orders the equality joins of a query by cost rather than in
+// the order they appear in the WHERE clause.  The cost of a plan is the
+// number of tuples it reads, hashes and produces, estimated from the
+// statistics of the tables (see [TableStats]): joining inputs of r1 and r2
+// tuples on fields with d1 and d2 distinct values is assumed to produce
+// r1*r2/max(d1, d2) tuples.  Joins of up to MaxDPJoinRelations inputs are
+// ordered by dynamic programming over all subsets of the inputs, as in System
+// R but also considering bushy plans; larger joins are ordered greedily by
+// repeatedly performing the join with the smallest result.  Either way, cross
+// products are never considered, and the smaller input of each join is made
+// its build side.
+
+// The largest number of join inputs ordered by dynamic programming.
+var MaxDPJoinRelations = 10
+
+// The cost of inserting a tuple into the hash table of a join, relative to
+// that of probing the table with a tuple.
+const hashBuildCost = 2.0
+
+// joinEdge is an equality predicate between fields of two join inputs,
+// identified by their index.  If both fields are of the same input, the
+// predicate is a filter on that input.
+type joinEdge struct {
+	left, right         int
+	leftExpr, rightExpr Expr
+	sel                 float64
+}
+
+// Return true if e joins an input in one set to an input in the other.
+func (e *joinEdge) connects(in1 func(int) bool, in2 func(int) bool) bool {
+	return (in1(e.left) && in2(e.right)) || (in2(e.left) && in1(e.right))
+}
+
+// joinTree is a plan for joining some of the inputs: either a single input,
+// or the join of a build side and a probe side on a set of predicates, the
+// first of which is the key of the hash join and the others are filters over
+// its result.
+type joinTree struct {
+	rel          int // index of the input of a leaf, or -1
+	build, probe *joinTree
+	edges        []*joinEdge
+	rows, cost   float64
+}
+
+// Return a leaf of an input with the specified number of tuples.
+func newJoinLeaf(rel int, rows float64) *joinTree {
+	return &joinTree{rel: rel, rows: rows, cost: rows}
+}
+
+// Return the plan that joins build and probe on edges.
+func newJoinTree(build *joinTree, probe *joinTree, edges []*joinEdge) *joinTree {
+	sel := 1.0
+	for _, e := range edges {
+		sel *= e.sel
+	}
+	rows := math.Max(build.rows*probe.rows*sel, 1)
+	blocks := math.Ceil(build.rows / float64(JoinBufferSize))
+	cost := build.cost + probe.cost + hashBuildCost*build.rows + blocks*probe.rows + rows
+	return &joinTree{-1, build, probe, edges, rows, cost}
+}
+
+// Return the cheaper of the plans that join t1 and t2 on edges, with either
+// as the build side.
+func bestJoinTree(t1 *joinTree, t2 *joinTree, edges []*joinEdge) *joinTree {
+	j1 := newJoinTree(t1, t2, edges)
+	j2 := newJoinTree(t2, t1, edges)
+	if j2.cost < j1.cost {
+		return j2
+	}
+	return j1
+}
+
+// Return true if the input rel is joined by t.
+func (t *joinTree) contains(rel int) bool {
+	if t.rel >= 0 {
+		return t.rel == rel
+	}
+	return t.build.contains(rel) || t.probe.contains(rel)
+}
+
+// Return the predicates of edges that connect t1 and t2.
+func connectingEdges(edges []*joinEdge, t1 *joinTree, t2 *joinTree) []*joinEdge {
+	var es []*joinEdge
+	for _, e := range edges {
+		if e.connects(t1.contains, t2.contains) {
+			es = append(es, e)
+		}
+	}
+	return es
+}
+
+// Return the cheapest plan joining all of leaves by dynamic programming, or
+// nil if they cannot be joined without a cross product.
+func dpJoinOrder(leaves []*joinTree, edges []*joinEdge) *joinTree {
+	n := len(leaves)
+	best := make([]*joinTree, 1<<n)
+	for i, l := range leaves {
+		best[1<<i] = l
+	}
+	for set := 1; set < 1<<n; set++ {
+		if bits.OnesCount(uint(set)) < 2 {
+			continue
+		}
+		low := set & -set
+		// each split is considered once, with the lowest input in s1;
+		// bestJoinTree tries both sides as the build side
+		for s1 := (set - 1) & set; s1 > 0; s1 = (s1 - 1) & set {
+			s2 := set ^ s1
+			if s1&low == 0 || best[s1] == nil || best[s2] == nil {
+				continue
+			}
+			in1 := func(rel int) bool { return s1&(1<<rel) != 0 }
+			in2 := func(rel int) bool { return s2&(1<<rel) != 0 }
+			var es []*joinEdge
+			for _, e := range edges {
+				if e.connects(in1, in2) {
+					es = append(es, e)
+				}
+			}
+			if len(es) == 0 {
+				continue
+			}
+			t := bestJoinTree(best[s1], best[s2], es)
+			if best[set] == nil || t.cost < best[set].cost {
+				best[set] = t
+			}
+		}
+	}
+	return best[1<<n-1]
+}
+
+// Return a plan joining all of leaves, built greedily by joining the two
+// connected plans whose join has the fewest tuples until one plan is left,
+// or nil if they cannot be joined without a cross product.
+func greedyJoinOrder(leaves []*joinTree, edges []*joinEdge) *joinTree {
+	trees := append([]*joinTree{}, leaves...)
+	for len(trees) > 1 {
+		var best *joinTree
+		var bestI, bestJ int
+		for i := range trees {
+			for j := i + 1; j < len(trees); j++ {
+				es := connectingEdges(edges, trees[i], trees[j])
+				if len(es) == 0 {
+					continue
+				}
+				t := bestJoinTree(trees[i], trees[j], es)
+				if best == nil || t.rows < best.rows || (t.rows == best.rows && t.cost < best.cost) {
+					best, bestI, bestJ = t, i, j
+				}
+			}
+		}
+		if best == nil {
+			return nil
+		}
+		trees[bestI] = best
+		trees = append(trees[:bestJ], trees[bestJ+1:]...)
+	}
+	return trees[0]
+}
+
+// Return a filter of child on left = right.
+func newEqualityFilter(left Expr, right Expr, child Operator) (Operator, error) {
+	switch left.GetExprType().Ftype {
+	case IntType:
+		return NewIntFilter(right, OpEq, left, child)
+	case StringType:
+		return NewStringFilter(right, OpEq, left, child)
+	}
+	return nil, GoDBError{TypeMismatchError, "unknown type"}
+}
+
+// Construct the operators of the plan t over the inputs ops.
+func (t *joinTree) makeOp(ops []Operator) (Operator, error) {
+	if t.rel >= 0 {
+		return ops[t.rel], nil
+	}
+	build, err := t.build.makeOp(ops)
+	if err != nil {
+		return nil, err
+	}
+	probe, err := t.probe.makeOp(ops)
+	if err != nil {
+		return nil, err
+	}
+	key := t.edges[0]
+	buildExpr, probeExpr := key.leftExpr, key.rightExpr
+	if !t.build.contains(key.left) {
+		buildExpr, probeExpr = probeExpr, buildExpr
+	}
+	var op Operator
+	switch buildExpr.GetExprType().Ftype {
+	case IntType:
+		op, err = NewIntJoin(build, buildExpr, probe, probeExpr, JoinBufferSize)
+	case StringType:
+		op, err = NewStringJoin(build, buildExpr, probe, probeExpr, JoinBufferSize)
+	default:
+		err = GoDBError{TypeMismatchError, "unknown type"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range t.edges[1:] {
+		op, err = newEqualityFilter(e.leftExpr, e.rightExpr, op)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return op, nil
+}
+
+// Return the estimated selectivity of e given estimates of its inputs.
+func (e *joinEdge) estimateSelectivity(ests []opEstimate) float64 {
+	if e.left == e.right {
+		return defaultEqSelectivity
+	}
+	return 1 / math.Max(math.Max(ests[e.left].exprDistinct(e.leftExpr), ests[e.right].exprDistinct(e.rightExpr)), 1)
+}
+
+// Return a projection of op, the join of the inputs in tableMap, whose
+// fields are in the order of the tables of the FROM clause of plan rather
+// than in the order the optimizer chose to join them in, as SELECT * returns
+// them, or op itself if they already are or the query selects columns.
+func projectFromOrder(plan *LogicalPlan, tableMap map[string]*PlanNode, op Operator) (Operator, error) {
+	selectAll := false
+	for _, s := range plan.selects {
+		selectAll = selectAll || (s.exprType == ExprStar && s.field == "*" && s.funcOp == nil)
+	}
+	if !selectAll {
+		return op, nil
+	}
+	var exprs []Expr
+	var names []string
+	for _, name := range plan.from {
+		node, ok := tableMap[name]
+		if !ok {
+			return op, nil
+		}
+		for _, f := range node.desc.Fields {
+			exprs = append(exprs, &FieldExpr{f})
+			names = append(names, f.Fname)
+		}
+	}
+	fields := op.Descriptor().Fields
+	if len(exprs) != len(fields) {
+		return op, nil
+	}
+	inOrder := true
+	for i, e := range exprs {
+		inOrder = inOrder && e.GetExprType() == fields[i]
+	}
+	if inOrder {
+		return op, nil
+	}
+	return NewProjectOp(exprs, names, false, op)
+}
+
+// Apply the joins of plan to the inputs in tableMap, in the order chosen by
+// the optimizer, and map every table to the result.
+func planJoins(c *Catalog, plan *LogicalPlan, tableMap map[string]*PlanNode) error {
+	//inputs, in the order of the FROM clause
+	var ops []Operator
+	relIndex := func(op Operator) int {
+		for i, o := range ops {
+			if o == op {
+				return i
+			}
+		}
+		ops = append(ops, op)
+		return len(ops) - 1
+	}
+	for _, p := range plan.subqueries {
+		relIndex(tableMap[p.alias].op)
+	}
+	for _, t := range plan.tables {
+		name := t.tableName
+		if t.alias != "" {
+			name = t.alias
+		}
+		relIndex(tableMap[name].op)
+	}
+
+	var edges []*joinEdge
+	for _, j := range plan.joins {
+		lTabName, lFieldName, err := j.left.getTableField(c, plan.subqueries, plan.tables)
+		if err != nil {
+			return err
+		}
+		node1, err := fieldToOp(lTabName, lFieldName, tableMap)
+		if err != nil {
+			return err
+		}
+		rTabName, rFieldName, err := j.right.getTableField(c, plan.subqueries, plan.tables)
+		if err != nil {
+			return err
+		}
+		node2, err := fieldToOp(rTabName, rFieldName, tableMap)
+		if err != nil {
+			return err
+		}
+		leftExpr, _, err := j.left.generateExpr(c, node1.desc, tableMap)
+		if err != nil {
+			return err
+		}
+		rightExpr, _, err := j.right.generateExpr(c, node2.desc, tableMap)
+		if err != nil {
+			return err
+		}
+		if leftExpr.GetExprType().Ftype != rightExpr.GetExprType().Ftype {
+			return GoDBError{TypeMismatchError, fmt.Sprintf("can't join fields %s and %s of different types", exprToStr(leftExpr), exprToStr(rightExpr))}
+		}
+		edges = append(edges, &joinEdge{relIndex(node1.op), relIndex(node2.op), leftExpr, rightExpr, 0})
+	}
+
+	ests := make([]opEstimate, len(ops))
+	for i, op := range ops {
+		ests[i] = c.estimateOp(op)
+	}
+	//predicates between fields of the same input filter that input
+	var joinEdges []*joinEdge
+	for _, e := range edges {
+		e.sel = e.estimateSelectivity(ests)
+		if e.left != e.right {
+			joinEdges = append(joinEdges, e)
+			continue
+		}
+		op, err := newEqualityFilter(e.leftExpr, e.rightExpr, ops[e.left])
+		if err != nil {
+			return err
+		}
+		ops[e.left] = op
+		ests[e.left].rows = math.Max(ests[e.left].rows*e.sel, 1)
+	}
+
+	leaves := make([]*joinTree, len(ops))
+	for i := range ops {
+		leaves[i] = newJoinLeaf(i, ests[i].rows)
+	}
+	var tree *joinTree
+	if len(leaves) <= MaxDPJoinRelations {
+		tree = dpJoinOrder(leaves, joinEdges)
+	} else {
+		tree = greedyJoinOrder(leaves, joinEdges)
+	}
+	if tree == nil {
+		return GoDBError{ParseError, "not all tables are joined, cross products are not supported in GoDB"}
+	}
+	op, err := tree.makeOp(ops)
+	if err != nil {
+		return err
+	}
+	op, err = projectFromOrder(plan, tableMap, op)
+	if err != nil {
+		return err
+	}
+	newNode := &PlanNode{op, op.Descriptor()}
+	for key := range tableMap {
+		tableMap[key] = newNode
+	}
+	return nil
+}
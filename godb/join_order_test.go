@@ -0,0 +1,155 @@
+package godb
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// return the inputs joined by a plan, in order
+func joinTreeRels(t *joinTree) []int {
+	if t.rel >= 0 {
+		return []int{t.rel}
+	}
+	return append(joinTreeRels(t.build), joinTreeRels(t.probe)...)
+}
+
+func TestJoinOrder(t *testing.T) {
+	// a chain a - b - c, in which b and c are joined on a key of b, so the
+	// small join of b and c should be performed first
+	leaves := []*joinTree{newJoinLeaf(0, 1e6), newJoinLeaf(1, 1e6), newJoinLeaf(2, 100)}
+	edges := []*joinEdge{{left: 0, right: 1, sel: 1e-6}, {left: 1, right: 2, sel: 1e-4}}
+
+	for _, order := range []func([]*joinTree, []*joinEdge) *joinTree{dpJoinOrder, greedyJoinOrder} {
+		tree := order(leaves, edges)
+		if tree == nil {
+			t.Fatalf("expected a plan")
+		}
+		bc, a := tree.build, tree.probe
+		if a.rel != 0 {
+			t.Fatalf("expected a to be joined last, as the probe side, got %v", joinTreeRels(tree))
+		}
+		if bc.build.rel != 2 || bc.probe.rel != 1 {
+			t.Errorf("expected c to be the build side of its join with b, got %v", joinTreeRels(bc))
+		}
+		if bc.rows != 1e4 || tree.rows != 1e4 {
+			t.Errorf("unexpected estimates %f and %f", bc.rows, tree.rows)
+		}
+	}
+
+	// a and c are not joined
+	if dpJoinOrder(leaves, edges[:1]) != nil || greedyJoinOrder(leaves, edges[:1]) != nil {
+		t.Errorf("expected no plan without a cross product")
+	}
+
+	// a chain too long for dynamic programming
+	leaves, edges = nil, nil
+	for i := 0; i < 14; i++ {
+		leaves = append(leaves, newJoinLeaf(i, float64(100*(i%4+1))))
+		if i > 0 {
+			edges = append(edges, &joinEdge{left: i - 1, right: i, sel: 0.01})
+		}
+	}
+	tree := greedyJoinOrder(leaves, edges)
+	if tree == nil {
+		t.Fatalf("expected a plan")
+	}
+	rels := joinTreeRels(tree)
+	sort.Ints(rels)
+	if len(rels) != len(leaves) || rels[0] != 0 || rels[len(rels)-1] != len(leaves)-1 {
+		t.Errorf("expected every input to be joined once, got %v", rels)
+	}
+	if dp := dpJoinOrder(leaves[:8], edges[:7]); dp.cost > greedyJoinOrder(leaves[:8], edges[:7]).cost {
+		t.Errorf("expected dynamic programming to find a plan no worse than the greedy one")
+	}
+}
+
+func TestParseJoinOrder(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+
+	// the same join written in different orders, and with a redundant
+	// predicate that closes a cycle
+	var expected []string
+	for _, sql := range []string{
+		"select a.name from t a, t2 b, t c where a.age = b.age and b.age = c.age and c.name = 'sam'",
+		"select a.name from t c, t2 b, t a where c.name = 'sam' and b.age = c.age and a.age = b.age",
+		"select a.name from t a join t2 b on a.age = b.age join t c on c.age = b.age where c.name = 'sam' and a.age = c.age",
+	} {
+		names := queryNames(t, c, bp, sql)
+		if len(names) == 0 {
+			t.Fatalf("%s: expected results", sql)
+		}
+		if expected == nil {
+			expected = names
+		} else if !reflect.DeepEqual(names, expected) {
+			t.Errorf("%s: expected %v, got %v", sql, expected, names)
+		}
+	}
+
+	// with statistics saying that c.age = 50 is selective, the filtered
+	// scan of c is the build side of the first join
+	for _, name := range []string{"t", "t2"} {
+		c.stats[name] = &TableStats{Rows: 1000000, Pages: 10000, Columns: map[string]*ColumnStats{
+			"name": {StringType, 1000000, []DBValue{StringField{"a"}, StringField{"z"}}},
+			"age":  {IntType, 1000000, []DBValue{IntField{0}, IntField{1000000}}},
+		}}
+	}
+	_, plan, err := Parse(c, "select a.name from t a, t2 b, t c where a.age = b.age and b.name = c.name and c.age = 50")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	top, ok := plan.(*Project).child.(*EqualityJoin[int64])
+	if !ok {
+		t.Fatalf("expected a join on age last, got %T", plan.(*Project).child)
+	}
+	first, ok := (*top.left).(*EqualityJoin[string])
+	if !ok {
+		t.Fatalf("expected the join of b and c to be the build side, got %T", *top.left)
+	}
+	//the scan of c is narrowed to the columns used by the joins
+	build := *first.left
+	if proj, ok := build.(*Project); ok {
+		build = proj.child
+	}
+	if _, ok := build.(*Filter[int64]); !ok {
+		t.Errorf("expected the filtered scan of c to be the build side, got %T", build)
+	}
+
+	if _, _, err := Parse(c, "select a.name from t a, t2 b where a.age = b.name"); err == nil {
+		t.Errorf("expected join of fields of different types to fail")
+	}
+}
+
+func TestJoinOrderSelectAll(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+	// with statistics saying that t is much larger than t2, t2 is the build
+	// side of the join, but SELECT * still returns the columns of t first
+	c.stats["t"] = &TableStats{Rows: 1000000, Pages: 10000}
+	c.stats["t2"] = &TableStats{Rows: 10, Pages: 1}
+	for _, q := range []struct {
+		sql    string
+		fields []FieldType
+	}{
+		{"select * from t, t2 where t.name = t2.name",
+			[]FieldType{{"name", "t", StringType}, {"age", "t", IntType}, {"name", "t2", StringType}, {"age", "t2", IntType}}},
+		{"select * from t a, t2 b, t c where a.age = b.age and b.name = c.name",
+			[]FieldType{{"name", "a", StringType}, {"age", "a", IntType}, {"name", "b", StringType}, {"age", "b", IntType}, {"name", "c", StringType}, {"age", "c", IntType}}},
+		{"select * from (select name from t) s join t2 on s.name = t2.name",
+			[]FieldType{{"name", "s", StringType}, {"name", "t2", StringType}, {"age", "t2", IntType}}},
+	} {
+		_, plan, err := Parse(c, q.sql)
+		if err != nil {
+			t.Fatalf("%s: %v", q.sql, err)
+		}
+		if fields := plan.Descriptor().Fields; !reflect.DeepEqual(fields, q.fields) {
+			t.Errorf("%s: expected fields %v, got %v", q.sql, q.fields, fields)
+		}
+	}
+
+	// the values are in the order of the fields
+	for _, tup := range runParsedQuery(t, c, bp, "select * from t, t2 where t.name = t2.name and t.age = t2.age") {
+		if tup.Fields[0] != tup.Fields[2] || tup.Fields[1] != tup.Fields[3] {
+			t.Errorf("expected the columns of t and t2 to match, got %v", tup.Fields)
+		}
+	}
+}
@@ -1,16 +1,79 @@
 package godb
 
+import (
+	"context"
+	"fmt"
+)
+
 type LimitOp struct {
 	child     Operator //required fields for parser
 	limitTups Expr
 	//add additional fields here, if needed
+	offset Expr //number of tuples to skip before returning any; nil for none
 }
 
 // Limit constructor -- should save how many tuples to return and the child op.
 // lim is how many tuples to return and child is the child op.
 func NewLimitOp(lim Expr, child Operator) *LimitOp {
 	// TODO: some code goes here
-	return &LimitOp{child, lim} //replace me
+	return &LimitOp{child, lim, nil} //replace me
+}
+
+// Evaluate the constant count of a LIMIT or OFFSET clause.
+func evalLimitCount(e Expr, clause string) (int64, error) {
+	// an empty tuple, so that references to fields fail rather than panic
+	v, err := e.EvalExpr(&Tuple{})
+	if err != nil {
+		return 0, GoDBError{ParseError, fmt.Sprintf("%s must be a constant: %s", clause, err.Error())}
+	}
+	n, ok := v.(IntField)
+	if !ok {
+		return 0, GoDBError{TypeMismatchError, fmt.Sprintf("%s must be an integer, got %v", clause, v)}
+	}
+	if n.Value < 0 {
+		return 0, GoDBError{ParseError, fmt.Sprintf("%s must not be negative, got %d", clause, n.Value)}
+	}
+	return n.Value, nil
+}
+
+// topKOperator is implemented by operators, like [OrderBy], that can produce
+// their first k tuples more cheaply than all of them.  topIterator returns
+// the same tuples as Iterator, but may end after the first k.
+type topKOperator interface {
+	topIterator(ctx context.Context, tid TransactionID, k int) (func() (*Tuple, error), error)
+}
+
+// Construct a limit that skips the first offset tuples of child and then
+// returns at most lim tuples, as in LIMIT lim OFFSET offset.  Both must be
+// non-negative integer constants or parameters, which is checked here, when
+// the query is planned.  Over an [OrderBy], only the first lim+offset tuples
+// in sort order are kept while sorting, so that fetching a page of a sorted
+// result, whether by offset or by a predicate on the sort key (keyset
+// pagination), needs memory for that page only.
+func NewLimitOffsetOp(lim Expr, offset Expr, child Operator) (*LimitOp, error) {
+	if err := checkLimitCount(lim, "limit"); err != nil {
+		return nil, err
+	}
+	if offset != nil {
+		if err := checkLimitCount(offset, "offset"); err != nil {
+			return nil, err
+		}
+	}
+	return &LimitOp{child, lim, offset}, nil
+}
+
+// Check the count of a limit or offset when the query is planned.  The value
+// of a parameter of a prepared statement is only known when the limit runs,
+// so only its type is checked here.
+func checkLimitCount(e Expr, clause string) error {
+	if p, ok := e.(*ParamExpr); ok {
+		if p.ftype != IntType {
+			return GoDBError{TypeMismatchError, fmt.Sprintf("%s must be an integer, got parameter $%d", clause, p.n)}
+		}
+		return nil
+	}
+	_, err := evalLimitCount(e, clause)
+	return err
 }
 
 // Return a TupleDescriptor for this limit
@@ -24,21 +87,42 @@ func (l *LimitOp) Descriptor() *TupleDesc {
 // results of the child iterator, and limit the result set to the first
 // [lim] tuples it sees (where lim is specified in the constructor).
 func (l *LimitOp) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	return l.IteratorContext(context.Background(), tid)
+}
+
+func (l *LimitOp) IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error) {
 	// TODO: some code goes here
 	// 获取limit的值
-	nValue, err := l.limitTups.EvalExpr(nil)
+	n, err := evalLimitCount(l.limitTups, "limit")
 	if err != nil {
-		return nil, nil
+		return nil, err
+	}
+	var offset int64
+	if l.offset != nil {
+		offset, err = evalLimitCount(l.offset, "offset")
+		if err != nil {
+			return nil, err
+		}
+	}
+	// 获取child的迭代器; a sort only needs to keep the tuples we return
+	var iter func() (*Tuple, error)
+	if top, ok := l.child.(topKOperator); ok {
+		iter, err = top.topIterator(ctx, tid, int(n+offset))
+	} else {
+		iter, err = IteratorContext(ctx, l.child, tid)
 	}
-	n := nValue.(IntField).Value
-	// 获取child的迭代器
-	iter, err := l.child.Iterator(tid)
 	if err != nil {
 		return nil, err
 	}
 	// 返回一个函数，该函数每次调用都会返回一个tuple
 	i := 0
 	return func() (*Tuple, error) {
+		for ; offset > 0; offset-- {
+			tup, err := iter()
+			if err != nil || tup == nil {
+				return nil, err
+			}
+		}
 		// 如果i大于等于n，说明已经返回了n个tuple，返回nil
 		if i >= int(n) {
 			return nil, nil
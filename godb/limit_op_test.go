@@ -87,3 +87,54 @@ func TestLimit50(t *testing.T) {
 func TestLimit100(t *testing.T) {
 	testLimitCount(t, 100)
 }
+
+func TestLimitOffset(t *testing.T) {
+	td, _, _, hf, _, tid := makeTestVars()
+	for i := 0; i < 20; i++ {
+		// insert ages out of order, with duplicates
+		tup := Tuple{td, []DBValue{StringField{"sam"}, IntField{int64((i * 7) % 10)}}, nil}
+		if err := hf.insertTuple(&tup, tid); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	ageField := &FieldExpr{td.Fields[1]}
+	ob, err := NewOrderBy([]Expr{ageField}, hf, []bool{false})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	sorted := collectTuples(t, ob, tid)
+
+	for _, c := range []struct{ lim, offset int64 }{{3, 0}, {3, 5}, {5, 18}, {0, 2}, {4, 30}} {
+		lim, err := NewLimitOffsetOp(&ConstExpr{IntField{c.lim}, IntType}, &ConstExpr{IntField{c.offset}, IntType}, ob)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		res := collectTuples(t, lim, tid)
+		var expected []*Tuple
+		if c.offset < int64(len(sorted)) {
+			expected = sorted[c.offset:]
+		}
+		if int64(len(expected)) > c.lim {
+			expected = expected[:c.lim]
+		}
+		if len(res) != len(expected) {
+			t.Fatalf("limit %d offset %d: expected %d tuples, got %d", c.lim, c.offset, len(expected), len(res))
+		}
+		for i := range res {
+			if !res[i].equals(expected[i]) {
+				t.Errorf("limit %d offset %d: tuple %d is %v, expected %v", c.lim, c.offset, i, res[i], expected[i])
+			}
+		}
+	}
+
+	for _, c := range []struct{ lim, offset Expr }{
+		{&ConstExpr{IntField{-1}, IntType}, nil},
+		{&ConstExpr{IntField{1}, IntType}, &ConstExpr{IntField{-2}, IntType}},
+		{&ConstExpr{IntField{1}, IntType}, &ConstExpr{StringField{"x"}, StringType}},
+		{&ConstExpr{IntField{1}, IntType}, ageField},
+	} {
+		if _, err := NewLimitOffsetOp(c.lim, c.offset, hf); err == nil {
+			t.Errorf("expected limit %v offset %v to fail", c.lim, c.offset)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package godb
 
 import (
+	"runtime"
 	"sync"
 	"testing"
 	"time"
@@ -153,3 +154,33 @@ func TestAcquireWriteAndReadLocks(t *testing.T) {
 		tid1, hf, 0, ReadPerm,
 		true)
 }
+
+// A transaction that stops waiting for a lock once its timeout expires must
+// leave nothing waiting behind it, e.g., blocking the readers that come after
+// it.
+func TestLockTimeoutLeavesNoWaiter(t *testing.T) {
+	bp, hf, tid1, tid2 := lockingTestSetUp(t)
+	if _, err := bp.GetPage(hf, 0, tid1, ReadPerm); err != nil {
+		t.Fatalf(err.Error())
+	}
+	before := runtime.NumGoroutine()
+	for i := 0; i < 5; i++ {
+		if _, err := bp.GetPage(hf, 0, tid2, WritePerm); err == nil {
+			t.Fatalf("expected the write lock to time out")
+		}
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("expected no goroutines to be left waiting, got %d more", after-before)
+	}
+	tid3 := NewTID()
+	bp.BeginTransaction(tid3)
+	if _, err := bp.GetPage(hf, 0, tid3, ReadPerm); err != nil {
+		t.Errorf("expected a read lock while another reader holds the page, got %v", err)
+	}
+	bp.CommitTransaction(tid1)
+	bp.CommitTransaction(tid3)
+	if _, err := bp.GetPage(hf, 0, tid2, WritePerm); err != nil {
+		t.Errorf("expected the write lock once the readers are done, got %v", err)
+	}
+	bp.CommitTransaction(tid2)
+}
@@ -0,0 +1,123 @@
+package godb
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// memTracker accounts for the memory that the operators of a query buffer,
+// such as sort inputs, hash tables and aggregation groups, and enforces the
+// query's memory limit.  Operators that can spill to disk do so rather than
+// exceed the limit; the others fail with a [MemoryLimitError].
+type memTracker struct {
+	limit int64 // no limit if <= 0
+	used  int64 // accessed atomically
+	peak  int64 // accessed atomically
+}
+
+type memoryLimitKey struct{}
+
+// Return a context in which queries opened with [OpenQuery] may buffer at
+// most bytes bytes of tuples in memory.  A limit <= 0 means no limit, which
+// is the default.
+func WithMemoryLimit(ctx context.Context, bytes int64) context.Context {
+	return context.WithValue(ctx, memoryLimitKey{}, bytes)
+}
+
+// Return a tracker with the memory limit set on ctx, if any.
+func newMemTracker(ctx context.Context) *memTracker {
+	limit, _ := ctx.Value(memoryLimitKey{}).(int64)
+	return &memTracker{limit: limit}
+}
+
+// Record that bytes more are buffered, unless that exceeds the limit, in
+// which case false is returned and nothing is recorded.
+func (t *memTracker) reserve(bytes int64) bool {
+	for {
+		used := atomic.LoadInt64(&t.used)
+		if t.limit > 0 && used+bytes > t.limit && bytes > 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&t.used, used, used+bytes) {
+			used += bytes
+			for {
+				peak := atomic.LoadInt64(&t.peak)
+				if used <= peak || atomic.CompareAndSwapInt64(&t.peak, peak, used) {
+					return true
+				}
+			}
+		}
+	}
+}
+
+// Return the most bytes buffered by the query at once.
+func (t *memTracker) peakMemory() int64 {
+	return atomic.LoadInt64(&t.peak)
+}
+
+// memAccount records the memory buffered by an iterator of an operator,
+// both in the operator's [memStat], which EXPLAIN ANALYZE reports, and in
+// the tracker of the query that the iterator runs in.
+type memAccount struct {
+	stat    *memStat
+	tracker *memTracker // nil outside of a query
+	op      string      // the operator, for errors
+}
+
+// Return an account of the memory that an iterator of op, which embeds m,
+// buffers while running in the query that ctx belongs to.
+func (m *memStat) account(ctx context.Context, op string) *memAccount {
+	var tracker *memTracker
+	if res, ok := ctx.Value(queryKey{}).(*queryResources); ok {
+		tracker = res.mem
+	}
+	return &memAccount{m, tracker, op}
+}
+
+// Return true if bytes more can be buffered without exceeding the memory
+// limit of the query.  Operators that can spill check this before growing.
+func (a *memAccount) fits(bytes int64) bool {
+	if a.tracker == nil || a.tracker.limit <= 0 {
+		return true
+	}
+	return atomic.LoadInt64(&a.tracker.used)+bytes <= a.tracker.limit
+}
+
+// Record that bytes more are buffered, or return a [MemoryLimitError] if
+// that exceeds the memory limit of the query.
+func (a *memAccount) grow(bytes int64) error {
+	if a.tracker != nil && !a.tracker.reserve(bytes) {
+		return GoDBError{MemoryLimitError, fmt.Sprintf("%s exceeded the query memory limit of %d bytes", a.op, a.tracker.limit)}
+	}
+	a.stat.grow(bytes)
+	return nil
+}
+
+// Record that bytes are no longer buffered.
+func (a *memAccount) release(bytes int64) {
+	if a.tracker != nil {
+		atomic.AddInt64(&a.tracker.used, -bytes)
+	}
+	a.stat.release(bytes)
+}
+
+// Return an iterator over tuples, whose bytes bytes have been recorded in a,
+// which releases them once it has returned all of the tuples or the query is
+// closed.
+func (a *memAccount) sliceIterator(ctx context.Context, tuples []*Tuple, bytes int64) func() (*Tuple, error) {
+	release := func() {
+		a.release(bytes)
+		bytes = 0
+	}
+	unregister := onClose(ctx, release)
+	iter := tupleSliceIterator(tuples)
+	return func() (*Tuple, error) {
+		t, err := iter()
+		if t == nil && bytes > 0 {
+			unregister()
+			release()
+		}
+		return t, err
+	}
+}
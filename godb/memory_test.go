@@ -0,0 +1,244 @@
+package godb
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// run op in a query with a memory limit of limit bytes, returning the tuples
+// as strings, in order, and the most memory the query buffered at once
+func runWithMemoryLimit(t *testing.T, op Operator, tid TransactionID, vectorized bool, limit int64) ([]string, int64, error) {
+	t.Helper()
+	q, err := OpenQuery(WithMemoryLimit(context.Background(), limit), op, tid, vectorized)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer q.Close()
+	var res []string
+	for {
+		tup, err := q.Next()
+		if err != nil {
+			return nil, 0, err
+		}
+		if tup == nil {
+			return res, q.res.mem.peakMemory(), nil
+		}
+		res = append(res, tup.PrettyPrintString(false))
+	}
+}
+
+// check that err is a MemoryLimitError
+func checkMemoryLimit(t *testing.T, err error) {
+	t.Helper()
+	if e, ok := err.(GoDBError); !ok || e.code != MemoryLimitError {
+		t.Errorf("expected a memory limit error, got %v", err)
+	}
+}
+
+func TestMemoryLimitAggregate(t *testing.T) {
+	bp := NewBufferPool(50)
+	hf := makeParallelTestFile(t, bp, 1000, 50)
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+
+	nameExpr := &FieldExpr{hf.Descriptor().Fields[0]}
+	ageExpr := &FieldExpr{hf.Descriptor().Fields[1]}
+	newAgg := func() *Aggregator {
+		cnt := &CountAggState{}
+		cnt.Init("cnt", ageExpr, intAggGetter)
+		sum := &SumAggState[int64]{}
+		sum.Init("sum", ageExpr, intAggGetter)
+		return NewGroupedAggregator([]AggState{cnt, sum}, []Expr{nameExpr}, hf)
+	}
+	expected := sortedTuples(t, newAgg(), tid)
+
+	// room for a few groups at a time, so the rest are spilled
+	const limit = 1000
+	for _, vectorized := range []bool{false, true} {
+		agg := newAgg()
+		res, peak, err := runWithMemoryLimit(t, agg, tid, vectorized, limit)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		sort.Strings(res)
+		if !reflect.DeepEqual(res, expected) {
+			t.Errorf("vectorized %t: expected %d groups, got %d", vectorized, len(expected), len(res))
+		}
+		if peak == 0 || peak > limit {
+			t.Errorf("vectorized %t: expected at most %d bytes to be buffered, got %d", vectorized, limit, peak)
+		}
+		if agg.cur != 0 {
+			t.Errorf("vectorized %t: expected the memory of the groups to be released, got %d", vectorized, agg.cur)
+		}
+	}
+	if n := countFiles(t, tmp); n != 0 {
+		t.Errorf("expected spill files to be removed, found %d", n)
+	}
+
+	// the workers of a parallel aggregation cannot spill
+	pa, err := NewParallelAggregator(newAgg(), 4)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, _, err = runWithMemoryLimit(t, pa, tid, true, limit)
+	checkMemoryLimit(t, err)
+}
+
+func TestMemoryLimitOrderBy(t *testing.T) {
+	bp := NewBufferPool(50)
+	hf := makeParallelTestFile(t, bp, 1000, 10)
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+
+	nameExpr := &FieldExpr{hf.Descriptor().Fields[0]}
+	ageExpr := &FieldExpr{hf.Descriptor().Fields[1]}
+	oby, err := NewOrderBy([]Expr{nameExpr, ageExpr}, hf, []bool{true, false})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var expected []string
+	for _, tup := range collectTuples(t, oby, tid) {
+		expected = append(expected, tup.PrettyPrintString(false))
+	}
+
+	// an external sort of many runs returns the tuples in the same order
+	const limit = 5000
+	res, peak, err := runWithMemoryLimit(t, oby, tid, false, limit)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected the external sort to match the in-memory sort")
+	}
+	if peak == 0 || peak > limit {
+		t.Errorf("expected at most %d bytes to be buffered, got %d", limit, peak)
+	}
+	if oby.cur != 0 {
+		t.Errorf("expected the memory of the sort to be released, got %d", oby.cur)
+	}
+	if n := countFiles(t, tmp); n != 0 {
+		t.Errorf("expected sorted runs to be removed, found %d", n)
+	}
+
+	// runs are removed when a query is closed before they are merged
+	q, err := OpenQuery(WithMemoryLimit(context.Background(), limit), oby, tid, false)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if tup, err := q.Next(); tup == nil || err != nil {
+		t.Fatalf("expected a tuple, got %v", err)
+	}
+	if countFiles(t, tmp) == 0 {
+		t.Errorf("expected the sort to write runs to disk")
+	}
+	q.Close()
+	if n := countFiles(t, tmp); n != 0 {
+		t.Errorf("expected sorted runs to be removed on close, found %d", n)
+	}
+
+	// the top tuples of a limit are kept in memory, so too many of them fail
+	limitOp := NewLimitOp(&ConstExpr{IntField{500}, IntType}, oby)
+	res, _, err = runWithMemoryLimit(t, limitOp, tid, false, 100000)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !reflect.DeepEqual(res, expected[:500]) {
+		t.Errorf("expected the first 500 sorted tuples")
+	}
+	_, _, err = runWithMemoryLimit(t, limitOp, tid, false, limit)
+	checkMemoryLimit(t, err)
+}
+
+func TestMemoryLimitJoin(t *testing.T) {
+	bp := NewBufferPool(50)
+	hf := makeParallelTestFile(t, bp, 300, 10)
+	os.Remove(TestingFile2)
+	hf2, err := NewHeapFile(TestingFile2, hf.Descriptor(), bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	insertParallelTestTuples(t, bp, hf2, 0, 7, 7)
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+
+	// the larger input is on the left, so it is read in blocks that end once
+	// the memory limit is reached
+	nameExpr := &FieldExpr{hf.Descriptor().Fields[0]}
+	join, err := NewStringJoin(hf, nameExpr, hf2, nameExpr, 1000)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected := sortedTuples(t, join, tid)
+	if len(expected) != 210 {
+		t.Fatalf("expected 210 joined tuples, got %d", len(expected))
+	}
+	const limit = 2000
+	for _, vectorized := range []bool{false, true} {
+		res, peak, err := runWithMemoryLimit(t, join, tid, vectorized, limit)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		sort.Strings(res)
+		if !reflect.DeepEqual(res, expected) {
+			t.Errorf("vectorized %t: expected %d joined tuples, got %d", vectorized, len(expected), len(res))
+		}
+		if peak == 0 || peak > limit {
+			t.Errorf("vectorized %t: expected at most %d bytes to be buffered, got %d", vectorized, limit, peak)
+		}
+	}
+
+	// a single tuple of the left input must fit
+	_, _, err = runWithMemoryLimit(t, join, tid, false, 10)
+	checkMemoryLimit(t, err)
+}
+
+func TestMemoryLimitNoSpill(t *testing.T) {
+	bp := NewBufferPool(50)
+	hf := makeParallelTestFile(t, bp, 1000, 10)
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+
+	ageExpr := &FieldExpr{hf.Descriptor().Fields[1]}
+	proj, err := NewProjectOp([]Expr{ageExpr}, []string{"age"}, true, hf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	rn, err := NewRankingWindowFunc(WindowRowNumber, "rn")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	window, err := NewWindow(nil, []Expr{ageExpr}, []bool{true}, []*WindowFunc{rn}, hf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// the error of a child that buffers its input when it starts reaches
+	// the client through the operators above it
+	overWindow, err := NewProjectOp([]Expr{ageExpr}, []string{"age"}, false, window)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, op := range []Operator{proj, window, NewMaterialize(hf), overWindow} {
+		for _, vectorized := range []bool{false, true} {
+			if _, _, err := runWithMemoryLimit(t, op, tid, vectorized, 2000); err != nil {
+				checkMemoryLimit(t, err)
+			} else {
+				t.Errorf("%T, vectorized %t: expected the query to exceed the memory limit", op, vectorized)
+			}
+		}
+		// without a limit, the same plan runs
+		if _, _, err := runWithMemoryLimit(t, op, tid, false, 0); err != nil {
+			t.Errorf("%T: %v", op, err)
+		}
+	}
+}
@@ -1,6 +1,11 @@
 package godb
 
-import "sort"
+import (
+	"container/heap"
+	"context"
+	"reflect"
+	"sort"
+)
 
 // TODO: some code goes here
 type OrderBy struct {
@@ -8,6 +13,7 @@ type OrderBy struct {
 	child   Operator
 	//add additional fields here
 	ascending []bool
+	memStat   //tuples buffered by the sort
 }
 
 // Order by constructor -- should save the list of field, child, and ascending
@@ -21,7 +27,7 @@ func NewOrderBy(orderByFields []Expr, child Operator, ascending []bool) (*OrderB
 	if len(orderByFields) != len(ascending) {
 		return nil, GoDBError{code: 0, errString: "length of orderByFields and ascending not equal"}
 	}
-	return &OrderBy{orderByFields, child, ascending}, nil //replace me
+	return &OrderBy{orderByFields, child, ascending, memStat{}}, nil //replace me
 
 }
 
@@ -75,34 +81,357 @@ func (d *Data) Less(i, j int) bool {
 // the sort algorithm will invoke to preduce a sorted list. See the first
 // example, example of SortMultiKeys, and documentation at: https://pkg.go.dev/sort
 func (o *OrderBy) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
-	// TODO: some code goes here
+	return o.IteratorContext(context.Background(), tid)
+}
+
+func (o *OrderBy) IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error) {
+	return o.topIterator(ctx, tid, -1)
+}
+
+// Compare two tuples in sort order, returning a negative number if t1 sorts
+// before t2, a positive number if it sorts after, and 0 if they are tied.
+func (o *OrderBy) compare(t1 *Tuple, t2 *Tuple) (int, error) {
+	for i, e := range o.orderBy {
+		res, err := t1.compareField(t2, e)
+		if err != nil {
+			return 0, err
+		}
+		if res == OrderedEqual {
+			continue
+		}
+		if (res == OrderedLessThan) == o.ascending[i] {
+			return -1, nil
+		}
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// A bounded heap of the first tuples in sort order seen so far, whose root
+// is the last of them, i.e., the one to evict when a tuple that sorts before
+// it arrives.  Ties are broken by arrival order, so the heap keeps the same
+// tuples as a stable sort would.
+type topTuples struct {
+	tuples []*Tuple
+	seqs   []int
+	o      *OrderBy
+	err    error
+	mem    *memAccount
+	bytes  int64 // memory of tuples
+}
+
+func (h *topTuples) Len() int {
+	return len(h.tuples)
+}
+
+func (h *topTuples) Swap(i, j int) {
+	h.tuples[i], h.tuples[j] = h.tuples[j], h.tuples[i]
+	h.seqs[i], h.seqs[j] = h.seqs[j], h.seqs[i]
+}
+
+// Return true if the i-th tuple sorts after the j-th one.
+func (h *topTuples) Less(i, j int) bool {
+	res, err := h.o.compare(h.tuples[i], h.tuples[j])
+	if err != nil && h.err == nil {
+		h.err = err
+	}
+	if res == 0 {
+		return h.seqs[i] > h.seqs[j]
+	}
+	return res > 0
+}
+
+func (h *topTuples) Push(x any) {
+	panic("topTuples grows with add")
+}
+
+func (h *topTuples) Pop() any {
+	n := len(h.tuples) - 1
+	t := h.tuples[n]
+	h.tuples = h.tuples[:n]
+	h.seqs = h.seqs[:n]
+	return t
+}
+
+// Add the seq-th tuple if it is among the first k in sort order.
+func (h *topTuples) add(t *Tuple, seq int, k int) error {
+	if len(h.tuples) < k {
+		if err := h.mem.grow(tupleMemory(t)); err != nil {
+			return err
+		}
+		h.bytes += tupleMemory(t)
+		h.tuples = append(h.tuples, t)
+		h.seqs = append(h.seqs, seq)
+		heap.Fix(h, len(h.tuples)-1)
+		return h.err
+	}
+	res, err := h.o.compare(t, h.tuples[0])
+	if err != nil {
+		return err
+	}
+	if res < 0 {
+		size := tupleMemory(t) - tupleMemory(h.tuples[0])
+		if err := h.mem.grow(size); err != nil {
+			return err
+		}
+		h.bytes += size
+		h.tuples[0] = t
+		h.seqs[0] = seq
+		heap.Fix(h, 0)
+	}
+	return h.err
+}
+
+// Return an iterator over the first k tuples of the child in sort order, or
+// over all of them if k is negative.  With k >= 0, only k tuples are held in
+// memory at a time, in a heap.  Otherwise, if the child's tuples do not fit
+// in the memory limit of the query, they are sorted in runs that are written
+// to disk and merged.
+func (o *OrderBy) topIterator(ctx context.Context, tid TransactionID, k int) (func() (*Tuple, error), error) {
+	if k == 0 {
+		return tupleSliceIterator(nil), nil
+	}
+	mem := o.account(ctx, "order by")
+	if k > 0 {
+		iter, err := IteratorContext(ctx, o.child, tid)
+		if err != nil {
+			return nil, err
+		}
+		h := &topTuples{o: o, mem: mem}
+		for seq := 0; ; seq++ {
+			t, err := iter()
+			if err == nil && t != nil {
+				err = h.add(t, seq, k)
+			}
+			if err != nil {
+				mem.release(h.bytes)
+				return nil, err
+			}
+			if t == nil {
+				break
+			}
+		}
+		// popping the last tuple repeatedly leaves the heap in sort order from
+		// the back
+		sorted := make([]*Tuple, h.Len())
+		for i := len(sorted) - 1; i >= 0; i-- {
+			sorted[i] = heap.Pop(h).(*Tuple)
+		}
+		if h.err != nil {
+			mem.release(h.bytes)
+			return nil, h.err
+		}
+		return mem.sliceIterator(ctx, sorted, h.bytes), nil
+	}
+
 	// 构造一个Data结构体，包含tuples和OrderBy
 	data := &Data{make([]*Tuple, 0), o}
-	iter, err := o.child.Iterator(tid)
-	if err != nil {
+	var dataBytes int64
+	var runs []*spillFile // 已排序并写入磁盘的run
+	cleanup := func() {
+		for _, r := range runs {
+			r.close()
+		}
+		runs = nil
+		mem.release(dataBytes)
+		dataBytes = 0
+	}
+	unregister := onClose(ctx, cleanup)
+	fail := func(err error) (func() (*Tuple, error), error) {
+		cleanup()
+		unregister()
 		return nil, err
 	}
-	// 遍历child的所有tuple，将其加入到data.tuples中
+	// 对内存中的元组排序，并写入一个新的run
+	spillRun := func() error {
+		sort.Sort(data)
+		run, err := newSpillFile(o.Descriptor())
+		if err != nil {
+			return err
+		}
+		runs = append(runs, run)
+		for _, t := range data.tuples {
+			if err := run.append(t); err != nil {
+				return err
+			}
+		}
+		data.tuples = nil
+		mem.release(dataBytes)
+		dataBytes = 0
+		return nil
+	}
+	iter, err := IteratorContext(ctx, o.child, tid)
+	if err != nil {
+		return fail(err)
+	}
+	// 遍历child的所有tuple，将其加入到data.tuples中；内存不足时先将已读取的元组写入run
 	for {
 		t, err := iter()
 		if err != nil {
-			return nil, err
+			return fail(err)
 		}
 		if t == nil {
 			break
 		}
+		size := tupleMemory(t)
+		if len(data.tuples) > 0 && !mem.fits(size) {
+			if err := spillRun(); err != nil {
+				return fail(err)
+			}
+		}
+		if err := mem.grow(size); err != nil {
+			return fail(err)
+		}
+		dataBytes += size
 		data.tuples = append(data.tuples, t)
 	}
-	// 使用sort.Sort()对data.tuples进行排序
-	sort.Sort(data)
-	i := 0
+	if len(runs) == 0 {
+		// 使用sort.Sort()对data.tuples进行排序，返回排序后的tuple
+		sort.Sort(data)
+		unregister()
+		return mem.sliceIterator(ctx, data.tuples, dataBytes), nil
+	}
+	if err := spillRun(); err != nil {
+		return fail(err)
+	}
+	merged, err := o.mergeRuns(runs)
+	if err != nil {
+		return fail(err)
+	}
+	return func() (*Tuple, error) {
+		t, err := merged()
+		if t == nil || err != nil {
+			cleanup()
+			unregister()
+		}
+		return t, err
+	}, nil
+}
+
+// A heap of the next tuple of each sorted run of an external sort, whose root
+// is the first of them in sort order.
+type sortRuns struct {
+	heads []*Tuple
+	iters []func() (*Tuple, error)
+	o     *OrderBy
+	err   error
+}
+
+func (h *sortRuns) Len() int {
+	return len(h.heads)
+}
+
+func (h *sortRuns) Swap(i, j int) {
+	h.heads[i], h.heads[j] = h.heads[j], h.heads[i]
+	h.iters[i], h.iters[j] = h.iters[j], h.iters[i]
+}
+
+func (h *sortRuns) Less(i, j int) bool {
+	res, err := h.o.compare(h.heads[i], h.heads[j])
+	if err != nil && h.err == nil {
+		h.err = err
+	}
+	return res < 0
+}
+
+func (h *sortRuns) Push(x any) {
+	panic("sortRuns is built by mergeRuns")
+}
+
+func (h *sortRuns) Pop() any {
+	n := len(h.heads) - 1
+	t := h.heads[n]
+	h.heads, h.iters = h.heads[:n], h.iters[:n]
+	return t
+}
+
+// Return an iterator that merges the sorted runs into a single run in sort
+// order, holding one tuple of each run in memory at a time.
+func (o *OrderBy) mergeRuns(runs []*spillFile) (func() (*Tuple, error), error) {
+	h := &sortRuns{o: o}
+	for _, r := range runs {
+		iter, err := r.iterator()
+		if err != nil {
+			return nil, err
+		}
+		t, err := iter()
+		if err != nil {
+			return nil, err
+		}
+		if t != nil {
+			h.heads = append(h.heads, t)
+			h.iters = append(h.iters, iter)
+		}
+	}
+	heap.Init(h)
 	return func() (*Tuple, error) {
-		if i >= len(data.tuples) {
-			return nil, nil
-		}
-		// 返回排序后的tuple
-		t := data.tuples[i]
-		i++
-		return t, nil
-	}, nil //replace me
+		if h.err != nil || h.Len() == 0 {
+			return nil, h.err
+		}
+		t := h.heads[0]
+		next, err := h.iters[0]()
+		if err != nil {
+			return nil, err
+		}
+		if next == nil {
+			heap.Pop(h)
+		} else {
+			h.heads[0] = next
+			heap.Fix(h, 0)
+		}
+		return t, h.err
+	}, nil
+}
+
+// Return true if the tuples produced by op are known to be sorted on exprs,
+// i.e., op is an [OrderBy] (possibly beneath operators that preserve order,
+// like filters and limits) whose leading sort expressions are exprs.
+func sortedOn(op Operator, exprs []Expr) bool {
+	switch op := op.(type) {
+	case *Filter[int64]:
+		return sortedOn(op.child, exprs)
+	case *Filter[string]:
+		return sortedOn(op.child, exprs)
+	case *LimitOp:
+		return sortedOn(op.child, exprs)
+	case *OrderBy:
+		if len(exprs) == 0 || len(op.orderBy) < len(exprs) {
+			return false
+		}
+		for i, e := range exprs {
+			if !sameSortExpr(op.Descriptor(), op.orderBy[i], e) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Return true if a and b are the same expression of tuples of desc.  Fields
+// are compared by the column of desc they refer to, since operators above a
+// subquery refer to its fields through the subquery's alias, rather than
+// the tables the subquery reads.
+func sameSortExpr(desc *TupleDesc, a Expr, b Expr) bool {
+	// 分组表达式可能被命名为groupN
+	if n, ok := a.(*namedExpr); ok {
+		a = n.Expr
+	}
+	if n, ok := b.(*namedExpr); ok {
+		b = n.Expr
+	}
+	af, aok := a.(*FieldExpr)
+	bf, bok := b.(*FieldExpr)
+	if aok != bok {
+		return false
+	}
+	if !aok {
+		return reflect.DeepEqual(a, b)
+	}
+	i, err := findFieldInTd(af.selectField, desc)
+	if err != nil {
+		return false
+	}
+	j, err := findFieldInTd(bf.selectField, desc)
+	return err == nil && i == j
 }
@@ -0,0 +1,433 @@
+package godb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"golang.org/x/exp/constraints"
+)
+
+// Intra-query parallelism.  A parallel plan runs a fragment of a plan in
+// several workers, each of which is a goroutine with its own copy of the
+// fragment.  In each copy, the scan of the fragment's largest table reads
+// only every nth page of the table, starting from the worker's number, so
+// that together the workers read each page once and the union of their
+// outputs is the output of the fragment.  A [Gather] collects the outputs of
+// the workers into one stream, and a [ParallelAggregator] aggregates each
+// worker's output separately and merges the partial aggregates.
+//
+// Fragments consist of heap file scans, filters, non-distinct projections
+// and joins.  All workers run in the query's transaction, and take page locks
+// through the buffer pool like any other operator.
+
+// parallelScan is the scan of a worker of a parallel plan, which reads the
+// pages worker, worker+workers, worker+2*workers, ... of a heap file.
+type parallelScan struct {
+	file    *HeapFile
+	worker  int
+	workers int
+}
+
+func (s *parallelScan) Descriptor() *TupleDesc {
+	return s.file.Descriptor()
+}
+
+func (s *parallelScan) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	return s.IteratorContext(context.Background(), tid)
+}
+
+func (s *parallelScan) IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error) {
+	return s.file.pagesIterator(ctx, tid, s.worker, s.workers)
+}
+
+// Return the heap files scanned by the plan op.
+func planFiles(op Operator) []*HeapFile {
+	switch op := op.(type) {
+	case *HeapFile:
+		return []*HeapFile{op}
+	case *instrumentedOp:
+		return planFiles(op.op)
+	}
+	var files []*HeapFile
+	for _, child := range planChildren(op) {
+		files = append(files, planFiles(*child)...)
+	}
+	return files
+}
+
+// Return a copy of the plan fragment op for a worker of a parallel plan, in
+// which the scan of part reads the worker's share of its pages, or false if
+// op is not a fragment that can be run in parallel.
+func clonePlan(op Operator, part *HeapFile, worker, workers int) (Operator, bool) {
+	switch op := op.(type) {
+	case *HeapFile:
+		if op == part {
+			return &parallelScan{op, worker, workers}, true
+		}
+		return op, true
+	case *Filter[int64]:
+		return cloneFilter(op, part, worker, workers)
+	case *Filter[string]:
+		return cloneFilter(op, part, worker, workers)
+	case *Project:
+		if op.distinct {
+			// each worker would only remove its own duplicates
+			return nil, false
+		}
+		child, ok := clonePlan(op.child, part, worker, workers)
+		if !ok {
+			return nil, false
+		}
+		clone := *op
+		clone.child = child
+		return &clone, true
+	case *EqualityJoin[int64]:
+		return cloneJoin(op, part, worker, workers)
+	case *EqualityJoin[string]:
+		return cloneJoin(op, part, worker, workers)
+	case *instrumentedOp:
+		inner, ok := clonePlan(op.op, part, worker, workers)
+		if !ok {
+			return nil, false
+		}
+		return &instrumentedOp{inner, op.stats, op.bp}, true
+	}
+	return nil, false
+}
+
+func cloneFilter[T constraints.Ordered](op *Filter[T], part *HeapFile, worker, workers int) (Operator, bool) {
+	child, ok := clonePlan(op.child, part, worker, workers)
+	if !ok {
+		return nil, false
+	}
+	clone := *op
+	clone.child = child
+	return &clone, true
+}
+
+func cloneJoin[T comparable](op *EqualityJoin[T], part *HeapFile, worker, workers int) (Operator, bool) {
+	left, ok := clonePlan(*op.left, part, worker, workers)
+	if !ok {
+		return nil, false
+	}
+	right, ok := clonePlan(*op.right, part, worker, workers)
+	if !ok {
+		return nil, false
+	}
+	return &EqualityJoin[T]{op.leftField, op.rightField, &left, &right, op.getter, op.maxBufferSize, memStat{}}, true
+}
+
+// Return the copies of the plan fragment op run by the workers of a parallel
+// plan.  The pages of the largest table of op are split between at most
+// workers workers, and there is at least one worker.
+func partitionPlan(op Operator, workers int) ([]Operator, error) {
+	var part *HeapFile
+	pages := 0
+	for _, f := range planFiles(op) {
+		if n := f.NumPages(); part == nil || n > pages {
+			part, pages = f, n
+		}
+	}
+	if part == nil {
+		return nil, GoDBError{IllegalOperationError, "parallel plan does not scan a table"}
+	}
+	if workers > pages {
+		workers = pages
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	plans := make([]Operator, workers)
+	for w := range plans {
+		plan, ok := clonePlan(op, part, w, workers)
+		if !ok {
+			return nil, GoDBError{IllegalOperationError, fmt.Sprintf("cannot run %s in parallel", describeOp(op))}
+		}
+		plans[w] = plan
+	}
+	return plans, nil
+}
+
+// Return an error unless op is a plan fragment that can be run in parallel.
+func checkParallel(op Operator) error {
+	if len(planFiles(op)) == 0 {
+		return GoDBError{IllegalOperationError, "parallel plan does not scan a table"}
+	}
+	if _, ok := clonePlan(op, nil, 0, 1); !ok {
+		return GoDBError{IllegalOperationError, fmt.Sprintf("cannot run %s in parallel", describeOp(op))}
+	}
+	return nil
+}
+
+// Start a goroutine for each plan that sends the batches of the plan to the
+// returned channel, which is closed once all plans are done.  A plan stops
+// early if it fails, after sending its error, or once ctx is done.
+func runWorkers(ctx context.Context, plans []Operator, tid TransactionID) <-chan workerResult {
+	results := make(chan workerResult, len(plans))
+	var wg sync.WaitGroup
+	for _, plan := range plans {
+		wg.Add(1)
+		go func(plan Operator) {
+			defer wg.Done()
+			iter, err := BatchIterator(ctx, plan, tid)
+			for err == nil {
+				var b *Batch
+				if b, err = iter(); b == nil {
+					break
+				}
+				select {
+				case results <- workerResult{b, nil}:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err != nil {
+				select {
+				case results <- workerResult{nil, err}:
+				case <-ctx.Done():
+				}
+			}
+		}(plan)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+type workerResult struct {
+	b   *Batch
+	err error
+}
+
+// Gather is an exchange operator that runs its child in several workers and
+// returns the union of their outputs, in no particular order.
+type Gather struct {
+	child   Operator
+	workers int
+}
+
+// Construct a gather of workers workers running child, which must be a plan
+// fragment that can be run in parallel.
+func NewGather(child Operator, workers int) (*Gather, error) {
+	if err := checkParallel(child); err != nil {
+		return nil, err
+	}
+	return &Gather{child, workers}, nil
+}
+
+func (g *Gather) Descriptor() *TupleDesc {
+	return g.child.Descriptor()
+}
+
+func (g *Gather) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	return g.IteratorContext(context.Background(), tid)
+}
+
+func (g *Gather) IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error) {
+	iter, err := g.BatchIterator(ctx, tid)
+	if err != nil {
+		return nil, err
+	}
+	return batchRows(iter), nil
+}
+
+// Return the batches of the workers as they produce them.  If a worker
+// fails, the others are stopped and its error is returned.  If the query is
+// closed before all batches have been read, the workers are stopped, and the
+// query waits for them to exit.
+func (g *Gather) BatchIterator(ctx context.Context, tid TransactionID) (func() (*Batch, error), error) {
+	plans, err := partitionPlan(g.child, g.workers)
+	if err != nil {
+		return nil, err
+	}
+	ctx, stop := context.WithCancel(ctx)
+	var results <-chan workerResult
+	unregister := onClose(ctx, func() {
+		stop()
+		if results != nil {
+			for range results {
+			}
+		}
+	})
+	return func() (*Batch, error) {
+		if results == nil {
+			results = runWorkers(ctx, plans, tid)
+		}
+		r, ok := <-results
+		if !ok {
+			unregister()
+			stop()
+			return nil, nil
+		}
+		if r.err != nil {
+			stop()
+			for range results {
+			}
+			unregister()
+			results = closedResults
+		}
+		return r.b, r.err
+	}, nil
+}
+
+// a closed channel of results, read from after the workers have exited
+var closedResults = func() chan workerResult {
+	c := make(chan workerResult)
+	close(c)
+	return c
+}()
+
+// ParallelAggregator computes an aggregate in several workers: each worker
+// aggregates its share of the input of the aggregator into partial
+// aggregation states, which are then merged with [MergeableAggState.Merge]
+// and finalized.  Unlike an [Aggregator], it keeps all groups in memory.
+type ParallelAggregator struct {
+	agg     *Aggregator
+	workers int
+}
+
+// Construct a parallel version of agg that runs in workers workers.  The
+// aggregation states of agg must be mergeable, and its child must be a plan
+// fragment that can be run in parallel.
+func NewParallelAggregator(agg *Aggregator, workers int) (*ParallelAggregator, error) {
+	if agg.sortedInput && agg.groupByFields != nil {
+		return nil, GoDBError{IllegalOperationError, "cannot compute a sorted aggregate in parallel"}
+	}
+	for _, as := range agg.newAggState {
+		if _, ok := as.(MergeableAggState); !ok {
+			return nil, GoDBError{IllegalOperationError, fmt.Sprintf("aggregation state %T cannot be merged", as)}
+		}
+	}
+	if err := checkParallel(agg.child); err != nil {
+		return nil, err
+	}
+	return &ParallelAggregator{agg, workers}, nil
+}
+
+func (p *ParallelAggregator) Descriptor() *TupleDesc {
+	return p.agg.Descriptor()
+}
+
+func (p *ParallelAggregator) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	return p.IteratorContext(context.Background(), tid)
+}
+
+func (p *ParallelAggregator) IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error) {
+	plans, err := partitionPlan(p.agg.child, p.workers)
+	if err != nil {
+		return nil, err
+	}
+	var g *aggGroups
+	unregister := func() {}
+	i := 0
+	return func() (*Tuple, error) {
+		if g == nil {
+			if g, err = p.aggregate(ctx, plans, tid); err != nil {
+				return nil, err
+			}
+			unregister = onClose(ctx, func() { g.close() })
+		}
+		if i < len(g.keys) {
+			i++
+			t, err := g.finalize(i - 1)
+			if err != nil {
+				unregister()
+				g.close()
+			}
+			return t, err
+		}
+		unregister()
+		g.close()
+		return nil, nil
+	}, nil
+}
+
+// Aggregate the output of each plan in its own worker, and merge the partial
+// aggregates of the workers.  If a worker fails, the others are stopped.
+func (p *ParallelAggregator) aggregate(ctx context.Context, plans []Operator, tid TransactionID) (*aggGroups, error) {
+	partials := make([]*aggGroups, len(plans))
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	// the error of the first worker to fail; the others fail once stopped
+	var failed sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+	for w, plan := range plans {
+		wg.Add(1)
+		go func(w int, plan Operator) {
+			defer wg.Done()
+			partials[w] = newAggGroups(p.agg.account(ctx, "aggregate"))
+			iter, err := BatchIterator(ctx, plan, tid)
+			if err == nil {
+				err = p.agg.aggregateInto(partials[w], iter, nil)
+			}
+			if err != nil {
+				failed.Do(func() {
+					firstErr = err
+					stop()
+				})
+			}
+		}(w, plan)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		for _, g := range partials {
+			g.close()
+		}
+		return nil, firstErr
+	}
+	g := partials[0]
+	for i, other := range partials[1:] {
+		if err := g.merge(other); err != nil {
+			g.close()
+			for _, g := range partials[i+1:] {
+				g.close()
+			}
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// Replace the parts of the plan op that can run in parallel with parallel
+// versions that use workers workers: an aggregate over a plan fragment that
+// can be run in parallel becomes a [ParallelAggregator], and such a fragment
+// itself is run by a [Gather].  Parallel plans return their results in no
+// particular order, so only fragments whose whole output is consumed by the
+// rest of the plan are replaced.
+func parallelizePlan(op Operator, workers int) Operator {
+	if workers <= 1 {
+		return op
+	}
+	if agg, ok := op.(*Aggregator); ok {
+		if p, err := NewParallelAggregator(agg, workers); err == nil {
+			return p
+		}
+	}
+	if g, err := NewGather(op, workers); err == nil {
+		return g
+	}
+	switch o := op.(type) {
+	case *Project, *Filter[int64], *Filter[string], *OrderBy, *Aggregator:
+		for _, child := range planChildren(op) {
+			*child = parallelizePlan(*child, workers)
+		}
+	case *LimitOp:
+		// a limit stops reading its input early, unless it is sorted first
+		if _, ok := o.child.(*OrderBy); ok {
+			o.child = parallelizePlan(o.child, workers)
+		}
+	}
+	return op
+}
+
+// Set the number of workers that queries planned with this catalog use to
+// scan, filter, join and aggregate tables.  A value <= 1 runs queries on a
+// single goroutine, and is the default.
+func (c *Catalog) SetParallelism(workers int) {
+	c.parallelism = workers
+	c.invalidatePlans()
+}
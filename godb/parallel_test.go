@@ -0,0 +1,267 @@
+package godb
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// create a heap file of n tuples, spread round-robin over ngroups names,
+// with ages 0..n-1, committed in several transactions
+func makeParallelTestFile(t *testing.T, bp *BufferPool, n int, ngroups int) *HeapFile {
+	td := TupleDesc{Fields: []FieldType{
+		{Fname: "name", Ftype: StringType},
+		{Fname: "age", Ftype: IntType},
+	}}
+	os.Remove(TestingFile)
+	hf, err := NewHeapFile(TestingFile, &td, bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	insertParallelTestTuples(t, bp, hf, 0, n, ngroups)
+	return hf
+}
+
+// insert the tuples from..to-1 into hf, committing every 200 tuples
+func insertParallelTestTuples(t *testing.T, bp *BufferPool, hf *HeapFile, from int, to int, ngroups int) {
+	for i := from; i < to; {
+		tid := NewTID()
+		bp.BeginTransaction(tid)
+		for end := i + 200; i < end && i < to; i++ {
+			tup := Tuple{*hf.Descriptor(), []DBValue{StringField{fmt.Sprintf("name%d", i%ngroups)}, IntField{int64(i)}}, nil}
+			if err := hf.insertTuple(&tup, tid); err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+		bp.CommitTransaction(tid)
+	}
+}
+
+// return the tuples of op as sorted strings
+func sortedTuples(t *testing.T, op Operator, tid TransactionID) []string {
+	var res []string
+	for _, tup := range collectTuples(t, op, tid) {
+		res = append(res, tup.PrettyPrintString(false))
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestParallelGather(t *testing.T) {
+	bp := NewBufferPool(50)
+	hf := makeParallelTestFile(t, bp, 2000, 10)
+	if hf.NumPages() < 4 {
+		t.Fatalf("expected at least 4 pages, got %d", hf.NumPages())
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+
+	ageExpr := &FieldExpr{hf.Descriptor().Fields[1]}
+	filter, err := NewIntFilter(&ConstExpr{IntField{150}, IntType}, OpGe, ageExpr, hf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected := sortedTuples(t, filter, tid)
+	for _, workers := range []int{1, 4, 100} {
+		g, err := NewGather(filter, workers)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if res := sortedTuples(t, g, tid); !reflect.DeepEqual(res, expected) {
+			t.Errorf("%d workers: expected %d tuples, got %d", workers, len(expected), len(res))
+		}
+	}
+
+	// a distinct projection removes duplicates across workers, so it cannot
+	// be gathered
+	proj, err := NewProjectOp([]Expr{ageExpr}, []string{"age"}, true, hf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := NewGather(proj, 4); err == nil {
+		t.Errorf("expected an error gathering a distinct projection")
+	}
+}
+
+func TestParallelJoin(t *testing.T) {
+	bp := NewBufferPool(50)
+	hf := makeParallelTestFile(t, bp, 1000, 10)
+	os.Remove(TestingFile2)
+	hf2, err := NewHeapFile(TestingFile2, hf.Descriptor(), bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	insertParallelTestTuples(t, bp, hf2, 0, 7, 7)
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+
+	nameExpr := &FieldExpr{hf.Descriptor().Fields[0]}
+	for _, bufSize := range []int{100, 3} {
+		// the larger input is split between the workers whichever side of
+		// the join it is on
+		for _, swap := range []bool{false, true} {
+			left, right := Operator(hf2), Operator(hf)
+			if swap {
+				left, right = right, left
+			}
+			join, err := NewStringJoin(left, nameExpr, right, nameExpr, bufSize)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			expected := sortedTuples(t, join, tid)
+			if len(expected) != 700 {
+				t.Fatalf("expected 700 joined tuples, got %d", len(expected))
+			}
+			g, err := NewGather(join, 4)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if res := sortedTuples(t, g, tid); !reflect.DeepEqual(res, expected) {
+				t.Errorf("bufSize %d, swap %t: parallel join did not match", bufSize, swap)
+			}
+		}
+	}
+}
+
+func TestParallelAggregator(t *testing.T) {
+	bp := NewBufferPool(50)
+	hf := makeParallelTestFile(t, bp, 2000, 13)
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+
+	nameExpr := &FieldExpr{hf.Descriptor().Fields[0]}
+	ageExpr := &FieldExpr{hf.Descriptor().Fields[1]}
+	newStates := func() []AggState {
+		cnt := &CountAggState{}
+		cnt.Init("cnt", ageExpr, intAggGetter)
+		sum := &SumAggState[int64]{}
+		sum.Init("sum", ageExpr, intAggGetter)
+		avg := &AvgAggState[int64]{}
+		avg.Init("avg", ageExpr, intAggGetter)
+		max := &MaxAggState[int64]{}
+		max.Init("max", ageExpr, intAggGetter)
+		min := &MinAggState[string]{}
+		min.Init("min", nameExpr, stringAggGetter)
+		return []AggState{cnt, sum, avg, max.Copy(), min}
+	}
+
+	for _, gby := range [][]Expr{nil, {nameExpr}, {nameExpr, ageExpr}} {
+		var agg *Aggregator
+		if gby == nil {
+			agg = NewAggregator(newStates(), hf)
+		} else {
+			agg = NewGroupedAggregator(newStates(), gby, hf)
+		}
+		expected := sortedTuples(t, agg, tid)
+		pa, err := NewParallelAggregator(agg, 4)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if res := sortedTuples(t, pa, tid); !reflect.DeepEqual(res, expected) {
+			t.Errorf("%d group by fields: expected %v, got %v", len(gby), expected, res)
+		}
+		if agg.peakMemory() == 0 {
+			t.Errorf("expected memory of the groups to be recorded")
+		}
+	}
+
+	// states that cannot be merged are rejected
+	agg := NewAggregator([]AggState{unmergeableAggState{&CountAggState{}}}, hf)
+	if _, err := NewParallelAggregator(agg, 4); err == nil {
+		t.Errorf("expected an error for an aggregation state that cannot be merged")
+	}
+}
+
+// an aggregation state without a Merge method
+type unmergeableAggState struct {
+	AggState
+}
+
+func TestParallelPlan(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+	hf, err := c.GetTable("t")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	insertParallelTestTuples(t, bp, hf.(*HeapFile), 0, 1500, 10)
+
+	for _, q := range []struct {
+		sql      string
+		parallel Operator
+	}{
+		{"select name, age from t where age > 100", &Gather{}},
+		{"select name, sum(age), count(*) from t group by name", &ParallelAggregator{}},
+		{"select count(*) from t, t2 where t.name = t2.name", &ParallelAggregator{}},
+		{"select distinct name from t", &Gather{}},
+		{"select name, age from t order by age limit 5", &Gather{}},
+	} {
+		c.SetParallelism(1)
+		expected := sortedResults(t, c, bp, q.sql)
+		c.SetParallelism(4)
+		found := false
+		for _, op := range planOps(parsePlan(t, c, q.sql)) {
+			found = found || reflect.TypeOf(op) == reflect.TypeOf(q.parallel)
+		}
+		if !found {
+			t.Errorf("%s: expected a %T in the plan", q.sql, q.parallel)
+		}
+		if res := sortedResults(t, c, bp, q.sql); !reflect.DeepEqual(res, expected) {
+			t.Errorf("%s: expected %d results, got %d", q.sql, len(expected), len(res))
+		}
+	}
+
+	// a limit without an order by is not run in parallel
+	c.SetParallelism(4)
+	for _, op := range planOps(parsePlan(t, c, "select name from t limit 5")) {
+		if _, ok := op.(*Gather); ok {
+			t.Errorf("unexpected gather under a limit")
+		}
+	}
+}
+
+func TestParallelLocking(t *testing.T) {
+	bp := NewBufferPool(50)
+	hf := makeParallelTestFile(t, bp, 2000, 10)
+
+	// another transaction holds a write lock on one of the pages, so the
+	// parallel scan must fail rather than read it
+	tid1 := NewTID()
+	bp.BeginTransaction(tid1)
+	if _, err := bp.GetPage(hf, 2, tid1, WritePerm); err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid2 := NewTID()
+	bp.BeginTransaction(tid2)
+	g, err := NewGather(hf, 4)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, err := g.Iterator(tid2)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for {
+		tup, err := iter()
+		if err != nil {
+			break
+		}
+		if tup == nil {
+			t.Fatalf("expected the scan of a locked page to fail")
+		}
+	}
+	bp.AbortTransaction(tid2)
+	bp.CommitTransaction(tid1)
+
+	// once the lock is released, the same scan succeeds
+	tid3 := NewTID()
+	bp.BeginTransaction(tid3)
+	defer bp.CommitTransaction(tid3)
+	if n := len(collectTuples(t, g, tid3)); n != 2000 {
+		t.Errorf("expected 2000 tuples, got %d", n)
+	}
+}
@@ -24,11 +24,16 @@ type LogicalJoinNode struct {
 type SelectExprType int
 
 const (
-	ExprField SelectExprType = iota
-	ExprConst SelectExprType = iota
-	ExprFunc  SelectExprType = iota
-	ExprStar  SelectExprType = iota
-	ExprAggr  SelectExprType = iota
+	ExprField  SelectExprType = iota
+	ExprConst  SelectExprType = iota
+	ExprFunc   SelectExprType = iota
+	ExprStar   SelectExprType = iota
+	ExprAggr   SelectExprType = iota
+	ExprWindow SelectExprType = iota
+	//a column of the query enclosing a correlated subquery
+	ExprOuterRef SelectExprType = iota
+	//a parameter of a prepared statement
+	ExprParam SelectExprType = iota
 )
 
 type LogicalSelectNode struct {
@@ -39,9 +44,22 @@ type LogicalSelectNode struct {
 	alias       string
 	value       string
 	args        []*LogicalSelectNode //for functions other than aggregates
+	distinct    bool                 //for aggregates over distinct values, e.g., count(distinct x)
+	aggOrderBy  []*OrderByNode       //for aggregates whose result depends on input order, e.g., string_agg
+	window      *LogicalWindowNode   //for window functions, the OVER clause
+	outer       *outerRef            //for references to columns of an enclosing query
+	param       int                  //for parameters, the number of the parameter
 	cachedField *FieldType
 }
 
+// The OVER clause of a window function
+type LogicalWindowNode struct {
+	spec        string //text of the clause; functions with the same spec are computed by one Window operator
+	partitionBy []*LogicalSelectNode
+	orderBy     []*OrderByNode
+	frame       *WindowFrame //nil for the default frame
+}
+
 func NewFieldSelectNode(table string, field string, alias string) LogicalSelectNode {
 	lsn := LogicalSelectNode{}
 	lsn.exprType = ExprField
@@ -117,10 +135,12 @@ func checkNameInTablesOrSubqueries(table string, field string, c *Catalog, subqu
 // if catalog is non null, will try to resolve table name from catalog
 // otherwise, will not
 func (lsn *LogicalSelectNode) getTableField(c *Catalog, subqueries []*LogicalPlan, ts []*LogicalTableNode) (string, string, error) {
-	if lsn.exprType == ExprConst {
+	//outer references are constant while a subquery is evaluated, and
+	//parameters while a statement is executed
+	if lsn.exprType == ExprConst || lsn.exprType == ExprOuterRef || lsn.exprType == ExprParam {
 		return "", "", nil
 	}
-	if lsn.exprType == ExprFunc || lsn.exprType == ExprAggr {
+	if lsn.exprType == ExprFunc || lsn.exprType == ExprAggr || lsn.exprType == ExprWindow {
 		tabName := ""
 		fieldName := ""
 		for _, subLsn := range lsn.args {
@@ -176,17 +196,29 @@ type LogicalPlan struct {
 	joins         []*LogicalJoinNode
 	selects       []*LogicalSelectNode
 	aggs          []*LogicalSelectNode
+	windows       []*LogicalSelectNode
 	tables        []*LogicalTableNode
 	subqueries    []*LogicalPlan
 	groupByFields []*GroupBy
+	having        []*LogicalFilterNode //predicates over group-by fields and aggregates
+	subqueryPreds []*LogicalSubqueryNode
 	orderByFields []*OrderByNode
 	limit         *LogicalSelectNode
+	offset        *LogicalSelectNode
 	distinct      bool
 	alias         string
+	cte           *cteTable //for references to common table expressions, which are planned already
+	from          []string  //names of the tables and subqueries of the FROM clause, in order
 }
 
 func (p *LogicalPlan) getSubplanFields(c *Catalog) []*FieldType {
 	var nodes []*FieldType
+	if p.cte != nil {
+		for _, f := range p.cte.desc.Fields {
+			nodes = append(nodes, &FieldType{f.Fname, p.alias, f.Ftype})
+		}
+		return nodes
+	}
 	for _, s := range p.selects {
 		_, field, _ := s.getTableField(c, p.subqueries, p.tables)
 		nodes = append(nodes, &FieldType{field, p.alias, UnknownType})
@@ -194,54 +226,288 @@ func (p *LogicalPlan) getSubplanFields(c *Catalog) []*FieldType {
 	return nodes
 }
 
-func parseWhere(c *Catalog, subqueries []*LogicalPlan, ts []*LogicalTableNode, expr sqlparser.Expr) ([]*LogicalFilterNode, []*LogicalJoinNode, error) {
+// A predicate on the result of a subquery in a WHERE clause
+type LogicalSubqueryNode struct {
+	predType  SubqueryPredType
+	expr      *LogicalSelectNode //left side of IN and comparison predicates
+	predOp    BoolOp             //operator of comparison predicates
+	plan      *LogicalPlan
+	outerRefs []*outerRef //references of the subquery to columns of the enclosing query
+}
+
+// The tables of the query enclosing a subquery, whose columns the WHERE
+// clause of the subquery may refer to.  Only the immediately enclosing query
+// is visible to a subquery.
+type outerScope struct {
+	tables     []*LogicalTableNode
+	subqueries []*LogicalPlan
+	refs       []*outerRef
+}
+
+// A reference from a correlated subquery to a column of the enclosing query
+type outerRef struct {
+	node LogicalSelectNode //the column, resolved against the enclosing query
+	expr *OuterRefExpr     //set when the enclosing query is planned
+}
+
+// Return true if a table or subquery of the FROM clause is named table.
+func fromHasTable(table string, subqueries []*LogicalPlan, ts []*LogicalTableNode) bool {
+	for _, t := range ts {
+		if t.alias == table || (t.alias == "" && t.tableName == table) {
+			return true
+		}
+	}
+	for _, q := range subqueries {
+		if q.alias == table {
+			return true
+		}
+	}
+	return false
+}
+
+// Replace the columns of node that do not belong to the tables of a subquery,
+// but to those of its enclosing query, by outer references.  Columns are
+// looked up in the subquery first, as in standard SQL.
+func (sc *outerScope) bind(c *Catalog, subqueries []*LogicalPlan, ts []*LogicalTableNode, node *LogicalSelectNode) error {
+	if sc == nil {
+		return nil
+	}
+	for _, arg := range node.args {
+		if err := sc.bind(c, subqueries, ts, arg); err != nil {
+			return err
+		}
+	}
+	if node.exprType != ExprField {
+		return nil
+	}
+	if node.table != "" {
+		if fromHasTable(node.table, subqueries, ts) || !fromHasTable(node.table, sc.subqueries, sc.tables) {
+			return nil
+		}
+	} else {
+		table, err := checkNameInTablesOrSubqueries("", node.field, c, subqueries, ts)
+		if err != nil || table != "" {
+			return err
+		}
+		table, err = checkNameInTablesOrSubqueries("", node.field, c, sc.subqueries, sc.tables)
+		if err != nil || table == "" {
+			return err
+		}
+	}
+	ref := &outerRef{node: NewFieldSelectNode(node.table, node.field, ""), expr: nil}
+	sc.refs = append(sc.refs, ref)
+	node.exprType = ExprOuterRef
+	node.outer = ref
+	return nil
+}
+
+// Return true if node refers to a column of an enclosing query.
+func hasOuterRef(node *LogicalSelectNode) bool {
+	if node.exprType == ExprOuterRef {
+		return true
+	}
+	for _, arg := range node.args {
+		if hasOuterRef(arg) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the operator that compares b to a when a op b.
+func flipBoolOp(op BoolOp) BoolOp {
+	switch op {
+	case OpGt:
+		return OpLt
+	case OpLt:
+		return OpGt
+	case OpGe:
+		return OpLe
+	case OpLe:
+		return OpGe
+	}
+	return op
+}
+
+// Parse a subquery of a WHERE clause whose enclosing query reads the given
+// tables and subqueries.
+func parseWhereSubquery(c *Catalog, subqueries []*LogicalPlan, ts []*LogicalTableNode, sq *sqlparser.Subquery) (*LogicalPlan, []*outerRef, error) {
+	stmt := sq.Select
+	for {
+		paren, ok := stmt.(*sqlparser.ParenSelect)
+		if !ok {
+			break
+		}
+		stmt = paren.Select
+	}
+	sel, ok := stmt.(*sqlparser.Select)
+	if !ok {
+		return nil, nil, GoDBError{ParseError, fmt.Sprintf("unsupported subquery type %s in where clause", reflect.TypeOf(stmt))}
+	}
+	scope := &outerScope{tables: ts, subqueries: subqueries}
+	plan, err := parseScopedStatement(c, sel, scope)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plan, scope.refs, nil
+}
+
+// Parse a WHERE clause into filters, joins and predicates on subqueries.  If
+// the clause belongs to a subquery, outer is the scope of its enclosing query.
+func parseWhere(c *Catalog, subqueries []*LogicalPlan, ts []*LogicalTableNode, outer *outerScope, expr sqlparser.Expr) ([]*LogicalFilterNode, []*LogicalJoinNode, []*LogicalSubqueryNode, error) {
 	switch expr := expr.(type) {
 	case *sqlparser.AndExpr:
 		//print("got and")
-		filterListLeft, joinListLeft, _ := parseWhere(c, subqueries, ts, expr.Left)
-		filterListRight, joinListRight, _ := parseWhere(c, subqueries, ts, expr.Right)
+		filterListLeft, joinListLeft, sqListLeft, err := parseWhere(c, subqueries, ts, outer, expr.Left)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		filterListRight, joinListRight, sqListRight, err := parseWhere(c, subqueries, ts, outer, expr.Right)
+		if err != nil {
+			return nil, nil, nil, err
+		}
 		filterExprs := append(filterListLeft, filterListRight...)
 		joinExprs := append(joinListLeft, joinListRight...)
-		return filterExprs, joinExprs, nil
+		sqExprs := append(sqListLeft, sqListRight...)
+		return filterExprs, joinExprs, sqExprs, nil
+	case *sqlparser.ParenExpr:
+		return parseWhere(c, subqueries, ts, outer, expr.Expr)
+	case *sqlparser.ExistsExpr:
+		plan, refs, err := parseWhereSubquery(c, subqueries, ts, expr.Subquery)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return nil, nil, []*LogicalSubqueryNode{{ExistsPred, nil, OpEq, plan, refs}}, nil
+	case *sqlparser.NotExpr:
+		if exists, ok := expr.Expr.(*sqlparser.ExistsExpr); ok {
+			plan, refs, err := parseWhereSubquery(c, subqueries, ts, exists.Subquery)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			return nil, nil, []*LogicalSubqueryNode{{NotExistsPred, nil, OpEq, plan, refs}}, nil
+		}
+		return nil, nil, nil, GoDBError{ParseError, "negation is only supported for exists in where clauses"}
 	case *sqlparser.ComparisonExpr:
-		op := BoolOpMap[expr.Operator]
+		op, ok := BoolOpMap[expr.Operator]
+		predType := ComparePred
+		switch expr.Operator {
+		case sqlparser.InStr, sqlparser.NotInStr:
+			if _, isSubquery := expr.Right.(*sqlparser.Subquery); !isSubquery {
+				return nil, nil, nil, GoDBError{ParseError, fmt.Sprintf("%s is only supported with a subquery", expr.Operator)}
+			}
+			predType = InPred
+			if expr.Operator == sqlparser.NotInStr {
+				predType = NotInPred
+			}
+			op, ok = OpEq, true
+		}
+		if !ok {
+			return nil, nil, nil, GoDBError{ParseError, fmt.Sprintf("unsupported operator %s in where clause", expr.Operator)}
+		}
 		//print(op)
 		//print("got compare")
 
-		left, err := parseExpr(c, expr.Left, "")
+		leftExpr, rightExpr := expr.Left, expr.Right
+		if sq, isSubquery := leftExpr.(*sqlparser.Subquery); isSubquery {
+			if _, bothSubqueries := rightExpr.(*sqlparser.Subquery); bothSubqueries {
+				return nil, nil, nil, GoDBError{ParseError, "comparisons of two subqueries are not supported"}
+			}
+			leftExpr, rightExpr = rightExpr, sq
+			op = flipBoolOp(op)
+		}
+		left, err := parseExpr(c, leftExpr, "")
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
-		right, err := parseExpr(c, expr.Right, "")
+		if err := outer.bind(c, subqueries, ts, left); err != nil {
+			return nil, nil, nil, err
+		}
+		if sq, isSubquery := rightExpr.(*sqlparser.Subquery); isSubquery {
+			plan, refs, err := parseWhereSubquery(c, subqueries, ts, sq)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			return nil, nil, []*LogicalSubqueryNode{{predType, left, op, plan, refs}}, nil
+		}
+		right, err := parseExpr(c, rightExpr, "")
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
+		}
+		if err := outer.bind(c, subqueries, ts, right); err != nil {
+			return nil, nil, nil, err
 		}
 		//here we want to search the catalog for the table id, if it's not specified
-		lTable, _, err := left.getTableField(c, subqueries, ts)
+		lTable, lField, err := left.getTableField(c, subqueries, ts)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
-		rTable, _, err := right.getTableField(c, subqueries, ts)
+		rTable, rField, err := right.getTableField(c, subqueries, ts)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
+		}
+		if lTable == "" && lField == "" && hasOuterRef(left) {
+			//filters are applied to the table of their left side
+			if rTable == "" && rField == "" {
+				return nil, nil, nil, GoDBError{ParseError, "predicates in subqueries must refer to a column of the subquery"}
+			}
+			left, right = right, left
+			lTable, rTable = rTable, lTable
+			op = flipBoolOp(op)
 		}
 		if lTable != "" && rTable != "" && lTable != rTable { //join
 
 			if op != OpEq {
-				return nil, nil, GoDBError{IllegalOperationError, "only equality joins are supported"}
+				return nil, nil, nil, GoDBError{IllegalOperationError, "only equality joins are supported"}
 			}
 			join := LogicalJoinNode{left, right, op}
 			lj := make([]*LogicalJoinNode, 1)
 			lj[0] = &join
-			return nil, lj, nil
+			return nil, lj, nil, nil
 		} else {
 			filter := LogicalFilterNode{*left, *right, op}
 			lf := make([]*LogicalFilterNode, 1)
 			lf[0] = &filter
-			return lf, nil, nil
+			return lf, nil, nil, nil
+		}
+	default:
+		return nil, nil, nil, GoDBError{ParseError, "where expression with non value or column on RHS (disjunctions and nested where expressions are not supported)"}
+	}
+}
+
+// Parse a HAVING clause into a list of conjunctive predicates.  Unlike WHERE
+// predicates, either side of a HAVING predicate may be an arbitrary expression
+// over group-by fields and aggregates, so predicates are never turned into
+// joins.
+func parseHaving(c *Catalog, expr sqlparser.Expr) ([]*LogicalFilterNode, error) {
+	switch expr := expr.(type) {
+	case *sqlparser.AndExpr:
+		left, err := parseHaving(c, expr.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := parseHaving(c, expr.Right)
+		if err != nil {
+			return nil, err
+		}
+		return append(left, right...), nil
+	case *sqlparser.ParenExpr:
+		return parseHaving(c, expr.Expr)
+	case *sqlparser.ComparisonExpr:
+		op, ok := BoolOpMap[expr.Operator]
+		if !ok {
+			return nil, GoDBError{ParseError, fmt.Sprintf("unsupported operator %s in having clause", expr.Operator)}
+		}
+		left, err := parseExpr(c, expr.Left, "")
+		if err != nil {
+			return nil, err
 		}
+		right, err := parseExpr(c, expr.Right, "")
+		if err != nil {
+			return nil, err
+		}
+		return []*LogicalFilterNode{{*left, *right, op}}, nil
 	default:
-		return nil, nil, GoDBError{ParseError, "where expression with non value or column on RHS (disjunctions and nested where expressions are not supported)"}
+		return nil, GoDBError{ParseError, "having expression must be a conjunction of comparisons"}
 	}
 }
 
@@ -266,6 +532,14 @@ func parseFrom(c *Catalog, t sqlparser.TableExpr) ([]*LogicalTableNode, []*Logic
 		case sqlparser.SimpleTableExpr:
 			tableName := strings.ToLower(sqlparser.GetTableName(tableEx.Expr).CompliantName())
 			//fmt.Printf("got simple table, name %s\n", tableName)
+			if cte := c.getCTE(tableName); cte != nil {
+				alias := strings.ToLower(sqlparser.String(tableEx.As))
+				if alias == "" {
+					alias = tableName
+				}
+				cte.refs++
+				return nil, []*LogicalPlan{{alias: alias, cte: cte}}, nil, nil
+			}
 			dbFile, err := c.GetTable(tableName)
 			if err != nil {
 				return nil, nil, nil, err
@@ -309,39 +583,59 @@ func parseFrom(c *Catalog, t sqlparser.TableExpr) ([]*LogicalTableNode, []*Logic
 		}
 		tabList := append(leftTables, rightTables...)
 		subPlanList := append(leftSubplans, rightSubplans...)
-		_, joins, err := parseWhere(c, subPlanList, tabList, joinTable.Condition.On)
+		_, joins, subqueryPreds, err := parseWhere(c, subPlanList, tabList, nil, joinTable.Condition.On)
 		if err != nil {
 			return nil, nil, nil, err
 		}
+		if len(subqueryPreds) > 0 {
+			return nil, nil, nil, GoDBError{ParseError, "subqueries are not supported in join conditions"}
+		}
 		return tabList, subPlanList, append(leftJoins, append(rightJoins, joins...)...), nil
 
 	}
 	return nil, nil, nil, GoDBError{ParseError, "unknown query type in parseFrom"}
 }
 
-func isAgg(funcName string) bool {
-	aggs := []string{"count", "sum", "avg", "min", "max"}
-	for _, s := range aggs {
-		if s == funcName {
-			return true
+// Return the names the tables and subqueries of a FROM clause are referred
+// to by, in the order they appear in it.
+func fromOrder(exprs sqlparser.TableExprs) []string {
+	var names []string
+	for _, e := range exprs {
+		switch e := e.(type) {
+		case *sqlparser.AliasedTableExpr:
+			name := strings.ToLower(sqlparser.String(e.As))
+			if t, ok := e.Expr.(sqlparser.TableName); ok && name == "" {
+				name = strings.ToLower(t.Name.CompliantName())
+			}
+			names = append(names, name)
+		case *sqlparser.ParenTableExpr:
+			names = append(names, fromOrder(e.Exprs)...)
+		case *sqlparser.JoinTableExpr:
+			names = append(names, fromOrder(sqlparser.TableExprs{e.LeftExpr, e.RightExpr})...)
 		}
 	}
-	return false
+	return names
 }
 
 func parseExpr(c *Catalog, expr sqlparser.Expr, alias string) (*LogicalSelectNode, error) {
 	switch expr := expr.(type) {
 	case *sqlparser.FuncExpr:
 		funName := strings.ToLower(sqlparser.String(expr.Name))
+		if funName == windowFuncPlaceholder {
+			return parseWindowExpr(c, expr, alias)
+		}
 		if isAgg(funName) {
-			if len(expr.Exprs) != 1 {
-				return nil, GoDBError{ParseError, fmt.Sprintf("expected one argument to aggregate %s in select list", sqlparser.String(expr.Name))}
+			if len(expr.Exprs) == 0 {
+				return nil, GoDBError{ParseError, fmt.Sprintf("expected argument to aggregate %s in select list", sqlparser.String(expr.Name))}
 			}
 			star, ok := expr.Exprs[0].(*sqlparser.StarExpr)
 			if ok {
 				if funName != "count" {
 					return nil, GoDBError{ParseError, "got * in non-count aggregate"}
 				}
+				if expr.Distinct {
+					return nil, GoDBError{ParseError, "got * in distinct aggregate"}
+				}
 				subField := NewFieldSelectNode(strings.ToLower(sqlparser.String(star.TableName)), "*", "")
 				field := NewAggrSelectNode(funName, &subField, alias)
 				return &field, nil
@@ -351,6 +645,17 @@ func parseExpr(c *Catalog, expr sqlparser.Expr, alias string) (*LogicalSelectNod
 				return nil, err
 			}
 			outer := NewAggrSelectNode(funName, field, alias)
+			outer.distinct = expr.Distinct
+			for _, param := range expr.Exprs[1:] {
+				paramNode, err := parseSelect(c, param)
+				if err != nil {
+					return nil, err
+				}
+				if paramNode.exprType != ExprConst {
+					return nil, GoDBError{ParseError, fmt.Sprintf("expected constant parameter to aggregate %s", funName)}
+				}
+				outer.args = append(outer.args, paramNode)
+			}
 			return &outer, nil
 		} else {
 			funName := strings.ToLower(sqlparser.String(expr.Name))
@@ -368,6 +673,31 @@ func parseExpr(c *Catalog, expr sqlparser.Expr, alias string) (*LogicalSelectNod
 			outer := NewFuncSelectNode(funName, exprList, alias)
 			return &outer, nil
 		}
+	case *sqlparser.GroupConcatExpr:
+		//group_concat(x order by y separator ',') is string_agg with an ordering
+		if len(expr.Exprs) != 1 {
+			return nil, GoDBError{ParseError, "expected one argument to aggregate group_concat in select list"}
+		}
+		field, err := parseSelect(c, expr.Exprs[0])
+		if err != nil {
+			return nil, err
+		}
+		sep := ","
+		if expr.Separator != "" {
+			sep = strings.TrimSuffix(strings.TrimPrefix(expr.Separator, " separator '"), "'")
+		}
+		sepNode := NewConstSelectNode(sep, "")
+		outer := NewAggrSelectNode("string_agg", field, alias)
+		outer.args = append(outer.args, &sepNode)
+		outer.distinct = expr.Distinct != ""
+		for _, oby := range expr.OrderBy {
+			obyExpr, err := parseExpr(c, oby.Expr, "")
+			if err != nil {
+				return nil, err
+			}
+			outer.aggOrderBy = append(outer.aggOrderBy, &OrderByNode{obyExpr, oby.Direction == sqlparser.AscScr})
+		}
+		return &outer, nil
 	case *sqlparser.BinaryExpr:
 		opname := expr.Operator
 		left, err := parseExpr(c, expr.Left, "")
@@ -385,6 +715,32 @@ func parseExpr(c *Catalog, expr sqlparser.Expr, alias string) (*LogicalSelectNod
 		return &outer, nil
 	case *sqlparser.ParenExpr:
 		return parseExpr(c, expr.Expr, alias)
+	case *sqlparser.CaseExpr:
+		//conditional forms are represented as function calls, see conditionalForms
+		op := "case"
+		var exprs []sqlparser.Expr
+		if expr.Expr != nil {
+			op = "simple case"
+			exprs = append(exprs, expr.Expr)
+		}
+		for _, when := range expr.Whens {
+			exprs = append(exprs, when.Cond, when.Val)
+		}
+		if expr.Else != nil {
+			exprs = append(exprs, expr.Else)
+		}
+		return parseFuncOfExprs(c, op, exprs, alias)
+	case *sqlparser.ComparisonExpr:
+		if _, ok := BoolOpMap[expr.Operator]; !ok {
+			return nil, GoDBError{ParseError, fmt.Sprintf("unsupported operator %s in expression", expr.Operator)}
+		}
+		return parseFuncOfExprs(c, expr.Operator, []sqlparser.Expr{expr.Left, expr.Right}, alias)
+	case *sqlparser.AndExpr:
+		return parseFuncOfExprs(c, "and", []sqlparser.Expr{expr.Left, expr.Right}, alias)
+	case *sqlparser.OrExpr:
+		return parseFuncOfExprs(c, "or", []sqlparser.Expr{expr.Left, expr.Right}, alias)
+	case *sqlparser.NotExpr:
+		return parseFuncOfExprs(c, "not", []sqlparser.Expr{expr.Expr}, alias)
 	case *sqlparser.ColName:
 		field := NewFieldSelectNode(strings.ToLower(sqlparser.String(expr.Qualifier)), strings.ToLower(sqlparser.String(expr.Name)), alias)
 		if len(field.table) > 1 && (field.table[0] == '\'' || field.table[0] == '`') {
@@ -396,6 +752,17 @@ func parseExpr(c *Catalog, expr sqlparser.Expr, alias string) (*LogicalSelectNod
 
 		return &field, nil
 	case *sqlparser.SQLVal:
+		if expr.Type == sqlparser.ValArg {
+			//placeholders are rewritten into bind variables :v1, :v2, ...
+			n, err := strconv.Atoi(strings.TrimPrefix(string(expr.Val), ":v"))
+			if err != nil || n < 1 {
+				return nil, GoDBError{ParseError, fmt.Sprintf("unsupported bind variable %s", expr.Val)}
+			}
+			if c.params == nil {
+				return nil, GoDBError{ParseError, "queries with parameters must be prepared"}
+			}
+			return &LogicalSelectNode{exprType: ExprParam, alias: alias, value: fmt.Sprintf("$%d", n), param: n}, nil
+		}
 		str := sqlparser.String(expr)
 		if str[0] == '\'' {
 			str = str[1 : len(str)-1]
@@ -408,6 +775,21 @@ func parseExpr(c *Catalog, expr sqlparser.Expr, alias string) (*LogicalSelectNod
 	}
 
 }
+
+// Parse a call of the function op on exprs.
+func parseFuncOfExprs(c *Catalog, op string, exprs []sqlparser.Expr, alias string) (*LogicalSelectNode, error) {
+	args := make([]*LogicalSelectNode, len(exprs))
+	for i, e := range exprs {
+		arg, err := parseExpr(c, e, "")
+		if err != nil {
+			return nil, err
+		}
+		args[i] = arg
+	}
+	outer := NewFuncSelectNode(op, args, alias)
+	return &outer, nil
+}
+
 func parseSelect(c *Catalog, stmt sqlparser.SelectExpr) (*LogicalSelectNode, error) {
 	star, ok := stmt.(*sqlparser.StarExpr)
 	if ok {
@@ -436,11 +818,234 @@ func extractAggs(s *LogicalSelectNode) []*LogicalSelectNode {
 			aggs = append(aggs, extractAggs(subs)...)
 		}
 		return aggs
+	case ExprWindow:
+		//window functions are computed after grouping, so may be over aggregates
+		var aggs []*LogicalSelectNode
+		for _, subs := range s.args {
+			aggs = append(aggs, extractAggs(subs)...)
+		}
+		for _, p := range s.window.partitionBy {
+			aggs = append(aggs, extractAggs(p)...)
+		}
+		for _, oby := range s.window.orderBy {
+			aggs = append(aggs, extractAggs(oby.expr)...)
+		}
+		return aggs
+	}
+	return nil
+}
+
+func extractWindows(s *LogicalSelectNode) []*LogicalSelectNode {
+	switch s.exprType {
+	case ExprWindow:
+		return []*LogicalSelectNode{s}
+	case ExprFunc:
+		var windows []*LogicalSelectNode
+		for _, subs := range s.args {
+			windows = append(windows, extractWindows(subs)...)
+		}
+		return windows
 	}
 	return nil
 }
 
+// Parse a call of windowFuncPlaceholder, i.e., a window function call
+// rewritten by preprocessQuery, whose first argument is the window function
+// and whose second argument is the text of its OVER clause.
+func parseWindowExpr(c *Catalog, expr *sqlparser.FuncExpr, alias string) (*LogicalSelectNode, error) {
+	if len(expr.Exprs) != 2 {
+		return nil, GoDBError{ParseError, "malformed window function"}
+	}
+	fExpr, ok1 := expr.Exprs[0].(*sqlparser.AliasedExpr)
+	sExpr, ok2 := expr.Exprs[1].(*sqlparser.AliasedExpr)
+	if !ok1 || !ok2 {
+		return nil, GoDBError{ParseError, "malformed window function"}
+	}
+	f, ok1 := fExpr.Expr.(*sqlparser.FuncExpr)
+	spec, ok2 := sExpr.Expr.(*sqlparser.SQLVal)
+	if !ok1 || !ok2 {
+		return nil, GoDBError{ParseError, "OVER must follow a function call"}
+	}
+	window, err := parseWindowSpec(c, string(spec.Val))
+	if err != nil {
+		return nil, err
+	}
+
+	funName := strings.ToLower(sqlparser.String(f.Name))
+	if isAgg(funName) {
+		node, err := parseExpr(c, f, alias)
+		if err != nil {
+			return nil, err
+		}
+		if node.distinct {
+			return nil, GoDBError{ParseError, fmt.Sprintf("distinct is not supported in window function %s", funName)}
+		}
+		node.exprType = ExprWindow
+		node.window = window
+		return node, nil
+	}
+
+	var args []*LogicalSelectNode
+	for _, e := range f.Exprs {
+		arg, err := parseSelect(c, e)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	switch funName {
+	case "row_number", "rank", "dense_rank":
+		if len(args) != 0 {
+			return nil, GoDBError{ParseError, fmt.Sprintf("window function %s takes no arguments", funName)}
+		}
+	case "lag", "lead":
+		if len(args) < 1 || len(args) > 3 {
+			return nil, GoDBError{ParseError, fmt.Sprintf("window function %s takes one to three arguments", funName)}
+		}
+		for _, arg := range args[1:] {
+			if arg.exprType != ExprConst {
+				return nil, GoDBError{ParseError, fmt.Sprintf("expected constant offset and default in window function %s", funName)}
+			}
+		}
+	default:
+		return nil, GoDBError{ParseError, fmt.Sprintf("unknown window function %s", funName)}
+	}
+	node := NewFuncSelectNode(funName, args, alias)
+	node.exprType = ExprWindow
+	node.window = window
+	return &node, nil
+}
+
+// Parse the text of an OVER clause, i.e.,
+//
+//	[PARTITION BY exprs] [ORDER BY exprs] [{ROWS | RANGE} frame]
+func parseWindowSpec(c *Catalog, spec string) (*LogicalWindowNode, error) {
+	scanned, err := scanSQL(spec)
+	if err != nil {
+		return nil, err
+	}
+	clauses := spec
+	frameText := ""
+	for _, w := range scanned.words {
+		lw := strings.ToLower(w.text)
+		if lw == "rows" || lw == "range" {
+			clauses = spec[:w.start]
+			frameText = spec[w.start:]
+			break
+		}
+	}
+	window := &LogicalWindowNode{spec: spec}
+
+	// parse the partition and order expressions as the group by and order
+	// by clauses of a dummy query
+	clauses = strings.TrimSpace(clauses)
+	if len(scanned.words) >= 2 && strings.EqualFold(scanned.words[0].text, "partition") && strings.EqualFold(scanned.words[1].text, "by") {
+		clauses = "group by " + strings.TrimSpace(spec[scanned.words[1].end:len(clauses)])
+	}
+	stmt, err := sqlparser.Parse("select 1 from godb_window " + clauses)
+	if err != nil {
+		return nil, GoDBError{ParseError, fmt.Sprintf("invalid window specification '%s'", spec)}
+	}
+	sel, ok := stmt.(*sqlparser.Select)
+	if !ok || sel.Where != nil || sel.Having != nil || sel.Limit != nil {
+		return nil, GoDBError{ParseError, fmt.Sprintf("invalid window specification '%s'", spec)}
+	}
+	for _, gby := range sel.GroupBy {
+		expr, err := parseExpr(c, gby, "")
+		if err != nil {
+			return nil, err
+		}
+		window.partitionBy = append(window.partitionBy, expr)
+	}
+	for _, oby := range sel.OrderBy {
+		expr, err := parseExpr(c, oby.Expr, "")
+		if err != nil {
+			return nil, err
+		}
+		window.orderBy = append(window.orderBy, &OrderByNode{expr, oby.Direction == sqlparser.AscScr})
+	}
+
+	if frameText != "" {
+		window.frame, err = parseWindowFrame(frameText)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return window, nil
+}
+
+// Parse a window frame, i.e.,
+//
+//	{ROWS | RANGE} {start | BETWEEN start AND end}
+//
+// where start and end are UNBOUNDED PRECEDING, n PRECEDING, CURRENT ROW,
+// n FOLLOWING or UNBOUNDED FOLLOWING.
+func parseWindowFrame(frameText string) (*WindowFrame, error) {
+	words := strings.Fields(strings.ToLower(frameText))
+	invalid := GoDBError{ParseError, fmt.Sprintf("invalid window frame '%s'", frameText)}
+	rows := words[0] == "rows"
+	words = words[1:]
+
+	parseBound := func() (FrameBound, error) {
+		if len(words) < 2 {
+			return FrameBound{}, invalid
+		}
+		first, second := words[0], words[1]
+		words = words[2:]
+		switch {
+		case first == "unbounded" && second == "preceding":
+			return FrameBound{UnboundedPreceding, 0}, nil
+		case first == "unbounded" && second == "following":
+			return FrameBound{UnboundedFollowing, 0}, nil
+		case first == "current" && second == "row":
+			return FrameBound{CurrentRow, 0}, nil
+		}
+		offset, err := strconv.ParseInt(first, 10, 64)
+		if err != nil {
+			return FrameBound{}, invalid
+		}
+		switch second {
+		case "preceding":
+			return FrameBound{Preceding, offset}, nil
+		case "following":
+			return FrameBound{Following, offset}, nil
+		}
+		return FrameBound{}, invalid
+	}
+
+	var start, end FrameBound
+	var err error
+	if len(words) > 0 && words[0] == "between" {
+		words = words[1:]
+		if start, err = parseBound(); err != nil {
+			return nil, err
+		}
+		if len(words) == 0 || words[0] != "and" {
+			return nil, invalid
+		}
+		words = words[1:]
+		if end, err = parseBound(); err != nil {
+			return nil, err
+		}
+	} else {
+		if start, err = parseBound(); err != nil {
+			return nil, err
+		}
+		end = FrameBound{CurrentRow, 0}
+	}
+	if len(words) > 0 {
+		return nil, invalid
+	}
+	return NewWindowFrame(rows, start, end)
+}
+
 func parseStatement(c *Catalog, s *sqlparser.Select) (*LogicalPlan, error) {
+	return parseScopedStatement(c, s, nil)
+}
+
+// Parse a select statement that, if it is a subquery of a WHERE clause, may
+// refer to the columns of the enclosing query in outer.
+func parseScopedStatement(c *Catalog, s *sqlparser.Select, outer *outerScope) (*LogicalPlan, error) {
 	from := s.From
 	var (
 		tables   []*LogicalTableNode
@@ -451,6 +1056,8 @@ func parseStatement(c *Catalog, s *sqlparser.Select) (*LogicalPlan, error) {
 		selects  []*LogicalSelectNode
 		groupBys []*GroupBy
 		orderBys []*OrderByNode
+
+		subqueryPreds []*LogicalSubqueryNode
 	)
 
 	for _, t := range from {
@@ -473,14 +1080,16 @@ func parseStatement(c *Catalog, s *sqlparser.Select) (*LogicalPlan, error) {
 					}
 		*/
 		//}
-		newFilters, newJoins, err := parseWhere(c, subplans, tables, where.Expr)
+		newFilters, newJoins, newSubqueryPreds, err := parseWhere(c, subplans, tables, outer, where.Expr)
 		if err != nil {
 			return nil, err
 		}
 		joins = append(joins, newJoins...)
 		filters = append(filters, newFilters...)
+		subqueryPreds = append(subqueryPreds, newSubqueryPreds...)
 	}
 	//extract select list
+	var windows []*LogicalSelectNode
 	for _, stmt := range s.SelectExprs {
 		sel, err := parseSelect(c, stmt)
 		if err != nil {
@@ -488,6 +1097,7 @@ func parseStatement(c *Catalog, s *sqlparser.Select) (*LogicalPlan, error) {
 		}
 		selects = append(selects, sel)
 		aggs = append(aggs, extractAggs(sel)...)
+		windows = append(windows, extractWindows(sel)...)
 	}
 
 	for _, gby := range s.GroupBy {
@@ -495,33 +1105,90 @@ func parseStatement(c *Catalog, s *sqlparser.Select) (*LogicalPlan, error) {
 		if err != nil {
 			return nil, err
 		}
+		//a group by name may refer to a computed select expression by its alias
+		if expr.exprType == ExprField && expr.table == "" {
+			for _, sel := range selects {
+				if sel.alias == expr.field && sel.exprType == ExprFunc {
+					selExpr := *sel
+					selExpr.alias = ""
+					expr = &selExpr
+				}
+			}
+		}
 		groupBys = append(groupBys, &GroupBy{expr})
 	}
 
-	for _, oby := range s.OrderBy {
-		expr, err := parseExpr(c, oby.Expr, "")
+	var having []*LogicalFilterNode
+	if s.Having != nil {
+		var err error
+		having, err = parseHaving(c, s.Having.Expr)
 		if err != nil {
 			return nil, err
 		}
-		orderBys = append(orderBys, &OrderByNode{expr, oby.Direction == sqlparser.AscScr})
-
+		// aggregates only referenced in HAVING still need to be computed
+		for _, h := range having {
+			aggs = append(aggs, extractAggs(&h.fieldExpr)...)
+			aggs = append(aggs, extractAggs(&h.constExpr)...)
+		}
+		if len(aggs) == 0 && len(groupBys) == 0 {
+			return nil, GoDBError{ParseError, "having clause requires a group by or aggregate"}
+		}
 	}
 
-	lim := s.Limit
-	var limExpr *LogicalSelectNode
-	if lim != nil {
-		var err error
-		limExpr, err = parseExpr(c, lim.Rowcount, "")
+	for _, oby := range s.OrderBy {
+		expr, err := parseExpr(c, oby.Expr, "")
 		if err != nil {
 			return nil, err
 		}
+		orderBys = append(orderBys, &OrderByNode{expr, oby.Direction == sqlparser.AscScr})
+
 	}
 
-	p := LogicalPlan{filters, joins, selects, aggs, tables, subplans, groupBys, orderBys, limExpr, s.Distinct != "", ""}
+	//window functions are computed just before the select list, so cannot
+	//be referenced by other clauses
+	var others []*LogicalSelectNode
+	for _, f := range filters {
+		others = append(others, &f.fieldExpr, &f.constExpr)
+	}
+	for _, j := range joins {
+		others = append(others, j.left, j.right)
+	}
+	for _, gby := range groupBys {
+		others = append(others, gby.expr)
+	}
+	for _, h := range having {
+		others = append(others, &h.fieldExpr, &h.constExpr)
+	}
+	for _, oby := range orderBys {
+		others = append(others, oby.expr)
+	}
+	for _, o := range others {
+		if len(extractWindows(o)) > 0 {
+			return nil, GoDBError{ParseError, "window functions are only allowed in the select list"}
+		}
+	}
+
+	limExpr, offsetExpr, err := parseLimit(c, s.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	p := LogicalPlan{filters, joins, selects, aggs, windows, tables, subplans, groupBys, having, subqueryPreds, orderBys, limExpr, offsetExpr, s.Distinct != "", "", nil, fromOrder(from)}
 
 	return &p, nil
 }
 
+// Parse a select statement, rewrite its logical plan and return its physical
+// plan.
+func planStatement(c *Catalog, s *sqlparser.Select) (Operator, error) {
+	plan, err := parseStatement(c, s)
+	if err != nil {
+		return nil, err
+	}
+	rewritePlan(c, plan)
+	return makePhysicalPlan(c, plan)
+}
+
 func fieldToOp(tab string, field string, opMap map[string]*PlanNode) (*PlanNode, error) {
 	node := opMap[tab]
 
@@ -576,7 +1243,7 @@ type PlanNode struct {
 
 func (s *LogicalSelectNode) generateExpr(c *Catalog, inputDesc *TupleDesc, tableMap map[string]*PlanNode) (Expr, string, error) {
 	switch s.exprType {
-	case ExprAggr:
+	case ExprAggr, ExprWindow:
 		fallthrough
 	case ExprField:
 		var field FieldType
@@ -616,6 +1283,9 @@ func (s *LogicalSelectNode) generateExpr(c *Catalog, inputDesc *TupleDesc, table
 			if tName != "" {
 				tName = tName + "."
 			}
+			if s.distinct {
+				fName = "distinct " + fName
+			}
 			fieldName = fmt.Sprintf("%s(%s%s)", *s.funcOp, tName, fName)
 		} else {
 			fieldName = s.field
@@ -650,6 +1320,9 @@ func (s *LogicalSelectNode) generateExpr(c *Catalog, inputDesc *TupleDesc, table
 		if s.alias != "" {
 			fieldName = s.alias
 		}
+		if s.cachedField != nil {
+			return &FieldExpr{*s.cachedField}, fieldName, nil
+		}
 		exprs := make([]*Expr, len(s.args))
 		for i, lsn := range s.args {
 			newExpr, _, err := lsn.generateExpr(c, inputDesc, tableMap)
@@ -659,13 +1332,69 @@ func (s *LogicalSelectNode) generateExpr(c *Catalog, inputDesc *TupleDesc, table
 			exprs[i] = &newExpr
 		}
 
-		fe := FuncExpr{*s.funcOp, exprs}
-		return &fe, fieldName, nil
+		if isConditionalForm(*s.funcOp) {
+			args := make([]Expr, len(exprs))
+			for i, e := range exprs {
+				args[i] = *e
+			}
+			ce, err := newConditionalExpr(*s.funcOp, args)
+			if err != nil {
+				return nil, "", err
+			}
+			if allConst(exprs) {
+				val, err := ce.EvalExpr(nil)
+				if err != nil {
+					return nil, "", err
+				}
+				return &ConstExpr{val, ce.GetExprType().Ftype}, fieldName, nil
+			}
+			return ce, fieldName, nil
+		}
+		fe, err := newFuncExpr(*s.funcOp, exprs)
+		if err != nil {
+			return nil, "", err
+		}
+		//evaluate deterministic functions of constants once, at plan time
+		if fe.fType.deterministic && allConst(exprs) {
+			val, err := fe.EvalExpr(nil)
+			if err != nil {
+				return nil, "", err
+			}
+			return &ConstExpr{val, fe.fType.outType}, fieldName, nil
+		}
+		return fe, fieldName, nil
+	case ExprOuterRef:
+		if s.outer.expr == nil {
+			return nil, "", GoDBError{ParseError, fmt.Sprintf("outer reference to %s was not planned", s.outer.node.field)}
+		}
+		fieldName := s.outer.node.field
+		if s.alias != "" {
+			fieldName = s.alias
+		}
+		return s.outer.expr, fieldName, nil
+	case ExprParam:
+		if c == nil || c.params == nil {
+			return nil, "", GoDBError{ParseError, "queries with parameters must be prepared"}
+		}
+		fieldName := s.value
+		if s.alias != "" {
+			fieldName = s.alias
+		}
+		return c.params.param(s.param), fieldName, nil
 	}
 	return nil, "", GoDBError{ParseError, "unhandled expression type in select list"}
 
 }
 
+func allConst(exprs []*Expr) bool {
+	for _, e := range exprs {
+		if _, ok := (*e).(*ConstExpr); !ok {
+			return false
+		}
+	}
+	return true
+}
+
 const JoinBufferSize int = 10000000
 
 func exprToStr(e Expr) string {
@@ -684,6 +1413,38 @@ func exprToStr(e Expr) string {
 			argStr += fmt.Sprintf("%s,", exprToStr(*arg))
 		}
 		return fmt.Sprintf("%s(%s)", ex.op, argStr)
+	case *OuterRefExpr:
+		return fmt.Sprintf("outer(%s)", ex.field.Fname)
+	case *ParamExpr:
+		return fmt.Sprintf("$%d", ex.n)
+	case *CompareExpr:
+		return fmt.Sprintf("(%s %s %s)", exprToStr(ex.left), opToStr(ex.op), exprToStr(ex.right))
+	case *BoolExpr:
+		argStr := ""
+		for _, arg := range ex.args {
+			argStr += exprToStr(arg) + ","
+		}
+		return fmt.Sprintf("%s(%s)", ex.op, argStr)
+	case *CaseExpr:
+		caseStr := "case "
+		if ex.operand != nil {
+			caseStr += exprToStr(ex.operand) + " "
+		}
+		for i := range ex.whens {
+			caseStr += fmt.Sprintf("when %s then %s ", exprToStr(ex.whens[i]), exprToStr(ex.thens[i]))
+		}
+		if ex.elseExpr != nil {
+			caseStr += fmt.Sprintf("else %s ", exprToStr(ex.elseExpr))
+		}
+		return caseStr + "end"
+	case *namedExpr:
+		return exprToStr(ex.Expr)
+	case *CoalesceExpr:
+		argStr := ""
+		for _, arg := range ex.args {
+			argStr += exprToStr(arg) + ","
+		}
+		return fmt.Sprintf("coalesce(%s)", argStr)
 	default:
 		return fmt.Sprintf("%+v, ", e)
 	}
@@ -738,48 +1499,95 @@ func getStrFromObj(obj any) string {
 }
 
 func PrintPhysicalPlan(o Operator, indent string) {
+	fmt.Printf("%s%s\n", indent, describeOp(o))
+	for _, child := range planChildren(o) {
+		PrintPhysicalPlan(*child, indent+"\t")
+	}
+}
+
+// Return a one line description of an operator, as printed by EXPLAIN.
+func describeOp(o Operator) string {
 	switch op := o.(type) {
 	case *EqualityJoin[int64]:
-		fmt.Printf("%sJoin, %+v == %+v\n", indent, exprToStr(op.leftField), exprToStr(op.rightField))
-		indent = indent + "\t"
-		PrintPhysicalPlan(*op.left, indent)
-		PrintPhysicalPlan(*op.right, indent)
+		return fmt.Sprintf("Join, %+v == %+v", exprToStr(op.leftField), exprToStr(op.rightField))
 	case *EqualityJoin[string]:
-		fmt.Printf("%sJoin, %+v == %+v\n", indent, exprToStr(op.leftField), exprToStr(op.rightField))
-		indent = indent + "\t"
-		PrintPhysicalPlan(*op.left, indent)
-		PrintPhysicalPlan(*op.right, indent)
-
+		return fmt.Sprintf("Join, %+v == %+v", exprToStr(op.leftField), exprToStr(op.rightField))
 	case *Project:
 		selectStr := ""
 		for _, ex := range op.selectFields {
 			selectStr += exprToStr(ex) + ","
 		}
-		fmt.Printf("%sProject %+v -> %+v\n", indent, selectStr, op.outputNames)
-		indent = indent + "\t"
-		PrintPhysicalPlan(op.child, indent)
+		return fmt.Sprintf("Project %+v -> %+v", selectStr, op.outputNames)
 	case *Filter[int64]:
-		fmt.Printf("%sFilter %s %s %s\n", indent, exprToStr(op.left), opToStr(op.op), exprToStr(op.right))
-		indent = indent + "\t"
-		PrintPhysicalPlan(op.child, indent)
+		return fmt.Sprintf("Filter %s %s %s", exprToStr(op.left), opToStr(op.op), exprToStr(op.right))
 	case *Filter[string]:
-		fmt.Printf("%sFilter %s %s %s\n", indent, exprToStr(op.left), opToStr(op.op), exprToStr(op.right))
-		indent = indent + "\t"
-		PrintPhysicalPlan(op.child, indent)
+		return fmt.Sprintf("Filter %s %s %s", exprToStr(op.left), opToStr(op.op), exprToStr(op.right))
 	case *HeapFile:
-		fmt.Printf("%sHeap Scan %v\n", indent, getStrFromObj(op))
+		return fmt.Sprintf("Heap Scan %v", getStrFromObj(op))
+	case *Analyze:
+		return fmt.Sprintf("Analyze %s", strings.Join(op.tables, ", "))
+	case *InsertOp:
+		return "Insert"
+	case *DeleteOp:
+		return "Delete"
+	case *ValueOp:
+		return fmt.Sprintf("Values, %d tuples", len(op.exprs))
+	case *SemiJoin:
+		name := "Semi Join"
+		if op.anti {
+			name = "Anti Join"
+		}
+		keyStr := ""
+		for i := range op.leftKeys {
+			keyStr += exprToStr(op.leftKeys[i]) + " == " + exprToStr(op.rightKeys[i]) + ","
+		}
+		return fmt.Sprintf("%s, %s", name, keyStr)
+	case *cteScan:
+		return fmt.Sprintf("CTE Scan %s, %d references", op.cte.name, op.cte.refs)
+	case *Materialize:
+		return "Materialize"
+	case *WorkTable:
+		return "Work Table"
+	case *RecursiveUnion:
+		all := ""
+		if op.all {
+			all = " All"
+		}
+		return fmt.Sprintf("Recursive Union%s", all)
+	case *Apply:
+		return fmt.Sprintf("Apply %s, %d outer references", op.pred, len(op.refs))
+	case *SetOp:
+		all := ""
+		if op.all {
+			all = " All"
+		}
+		return fmt.Sprintf("%s%s", op.op, all)
+	case *Window:
+		partStr := ""
+		for _, ex := range op.partitionBy {
+			partStr += exprToStr(ex) + ","
+		}
+		orderStr := ""
+		for _, ex := range op.orderBy {
+			orderStr += exprToStr(ex) + ","
+		}
+		funcStr := ""
+		for _, f := range op.funcs {
+			funcStr += f.String() + ","
+		}
+		return fmt.Sprintf("Window %s Partition By %s Order By %s", funcStr, partStr, orderStr)
 	case *OrderBy:
 		orderStr := ""
 		for _, ex := range op.orderBy {
 			orderStr += exprToStr(ex) + ","
 		}
-		fmt.Printf("%sOrder By %s\n", indent, orderStr)
-		indent = indent + "\t"
-		PrintPhysicalPlan(op.child, indent)
+		return fmt.Sprintf("Order By %s", orderStr)
 	case *LimitOp:
-		fmt.Printf("%sLimit %s\n", indent, exprToStr(op.limitTups))
-		indent = indent + "\t"
-		PrintPhysicalPlan(op.child, indent)
+		offsetStr := ""
+		if op.offset != nil {
+			offsetStr = " Offset " + exprToStr(op.offset)
+		}
+		return fmt.Sprintf("Limit %s%s", exprToStr(op.limitTups), offsetStr)
 	case *Aggregator:
 		gbyStr := ""
 		if len(op.groupByFields) > 0 {
@@ -795,15 +1603,73 @@ func PrintPhysicalPlan(o Operator, indent string) {
 			aggStr += fmt.Sprintf("%s(%s),", reflect.TypeOf(ex), ex.GetTupleDesc().HeaderString(false))
 		}
 
-		fmt.Printf("%sAggregate, %s %s\n", indent, aggStr, gbyStr)
-		indent = indent + "\t"
-		PrintPhysicalPlan(op.child, indent)
-	default:
-		fmt.Printf("%sUnknown op, %s\n", indent, reflect.TypeOf(op))
+		aggName := "Aggregate"
+		if op.sortedInput {
+			aggName = "Sorted Aggregate"
+		}
+		return fmt.Sprintf("%s, %s %s", aggName, aggStr, gbyStr)
+	case *Gather:
+		return fmt.Sprintf("Gather, %d workers", op.workers)
+	case *ParallelAggregator:
+		return fmt.Sprintf("Parallel %s, %d workers", describeOp(op.agg), op.workers)
+	case *instrumentedOp:
+		return describeOp(op.op)
 	}
+	return fmt.Sprintf("Unknown op, %s", reflect.TypeOf(o))
+}
+
+// Return pointers to the fields of an operator that hold its children.
+func planChildren(o Operator) []*Operator {
+	switch op := o.(type) {
+	case *EqualityJoin[int64]:
+		return []*Operator{op.left, op.right}
+	case *EqualityJoin[string]:
+		return []*Operator{op.left, op.right}
+	case *Project:
+		return []*Operator{&op.child}
+	case *Filter[int64]:
+		return []*Operator{&op.child}
+	case *Filter[string]:
+		return []*Operator{&op.child}
+	case *InsertOp:
+		return []*Operator{&op.child}
+	case *DeleteOp:
+		return []*Operator{&op.child}
+	case *SemiJoin:
+		return []*Operator{&op.left, &op.right}
+	case *Materialize:
+		return []*Operator{&op.child}
+	case *RecursiveUnion:
+		return []*Operator{&op.anchor, &op.recursive}
+	case *Apply:
+		return []*Operator{&op.child, &op.subquery}
+	case *SetOp:
+		return []*Operator{&op.left, &op.right}
+	case *Window:
+		return []*Operator{&op.child}
+	case *OrderBy:
+		return []*Operator{&op.child}
+	case *LimitOp:
+		return []*Operator{&op.child}
+	case *Aggregator:
+		return []*Operator{&op.child}
+	case *Gather:
+		return []*Operator{&op.child}
+	case *ParallelAggregator:
+		return []*Operator{&op.agg.child}
+	case *instrumentedOp:
+		return planChildren(op.op)
+	}
+	return nil
 }
 
 func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
+	if plan.cte != nil {
+		desc := plan.cte.desc.copy()
+		desc.setTableAlias(plan.alias)
+		return &cteScan{plan.cte, desc}, nil
+	}
+
 	//build mapping from table names / aliases to operators
 
 	tableMap := make(map[string]*PlanNode)
@@ -835,6 +1701,12 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
 		if err != nil {
 			return nil, err
 		}
+		if tabName == "" && fieldName == "" && !hasOuterRef(&f.fieldExpr) {
+			//predicates on constants, e.g., 1 = 0, filter the first input
+			if names := fromNames(plan); len(names) > 0 {
+				tabName = names[0]
+			}
+		}
 		node, err := fieldToOp(tabName, fieldName, tableMap)
 		if err != nil {
 			return nil, err
@@ -852,89 +1724,36 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
 		desc := *op.Descriptor()
 		desc.setTableAlias(tabName)
 
+		var newOp Operator
+		inferParamTypes(leftExpr, rightExpr)
 		switch leftExpr.GetExprType().Ftype {
 		case IntType:
-			newOp, err := NewIntFilter(rightExpr, f.predOp, leftExpr, op)
-			if err != nil {
-				return nil, err
-			}
-			tableMap[leftExpr.GetExprType().TableQualifier] = &PlanNode{newOp, &desc}
+			newOp, err = NewIntFilter(rightExpr, f.predOp, leftExpr, op)
 		case StringType:
-			newOp, err := NewStringFilter(rightExpr, f.predOp, leftExpr, op)
-			if err != nil {
-				return nil, err
-			}
-			tableMap[leftExpr.GetExprType().TableQualifier] = &PlanNode{newOp, &desc}
+			newOp, err = NewStringFilter(rightExpr, f.predOp, leftExpr, op)
 		}
-	}
-	//finally apply joins
-	for _, j := range plan.joins {
-		lTabName, lFieldName, err := j.left.getTableField(c, plan.subqueries, plan.tables)
-		if err != nil {
-			return nil, err
-		}
-
-		node1, err := fieldToOp(lTabName, lFieldName, tableMap)
 		if err != nil {
 			return nil, err
 		}
-
-		rTabName, rFieldName, err := j.right.getTableField(c, plan.subqueries, plan.tables)
-		if err != nil {
-			return nil, err
-		}
-
-		node2, err := fieldToOp(rTabName, rFieldName, tableMap)
-		if err != nil {
-			return nil, err
+		if newOp != nil {
+			//computed expressions have no table qualifier, so replace the
+			//filtered operator wherever it appears
+			newNode := &PlanNode{newOp, &desc}
+			for key, n := range tableMap {
+				if n.op == op {
+					tableMap[key] = newNode
+				}
+			}
 		}
-
-		/*desc1 := *op1.Descriptor()
-		desc1.setTableAlias(j.t1)
-		desc2 := *op2.Descriptor()
-		desc2.setTableAlias(j.t2)
-		*/
-		op1 := node1.op
-		op2 := node2.op
-
-		/*
-			leftField, _ := fieldNameToField(j.t1, j.f1, node1)
-			rightField, _ := fieldNameToField(j.t2, j.f2, node2)
-		*/
-		leftExpr, _, err := j.left.generateExpr(c, node1.desc, tableMap)
-		if err != nil {
+	}
+	//finally apply joins, in the order chosen by the optimizer
+	if len(plan.joins) > 0 {
+		if err := pruneJoinInputs(c, plan, tableMap); err != nil {
 			return nil, err
 		}
-		rightExpr, _, err := j.right.generateExpr(c, node2.desc, tableMap)
-		if err != nil {
+		if err := planJoins(c, plan, tableMap); err != nil {
 			return nil, err
 		}
-
-		var (
-			newOp Operator
-		)
-		switch leftExpr.GetExprType().Ftype {
-		case IntType:
-			newOp, err = NewIntJoin(op1, leftExpr, op2, rightExpr, JoinBufferSize)
-		case StringType:
-			newOp, err = NewStringJoin(op1, leftExpr, op2, rightExpr, JoinBufferSize)
-		}
-		if err != nil {
-			return nil, err
-		}
-		newNode := &PlanNode{newOp, newOp.Descriptor()}
-		for key, node := range tableMap {
-			if node.op == op1 {
-				tableMap[key] = newNode
-			}
-			if node.op == op2 {
-				tableMap[key] = newNode
-			}
-		}
-		tableMap[lTabName] = newNode
-		tableMap[rTabName] = newNode
-		//&PlanNode{newOp, newOp.Descriptor()}
-
 	}
 
 	//check that all tables have the same op (all tables are joined)
@@ -953,9 +1772,18 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
 
 	topOp := curOp
 
+	if len(plan.subqueryPreds) > 0 {
+		var err error
+		topOp, err = makeSubqueryPlan(c, plan, topOp, tableMap)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	//var fieldList []FieldType
 	var fieldNames []string
 	hasAgg := len(plan.aggs) > 0
+	hasWindow := len(plan.windows) > 0
 	selectAll := false
 
 	/*
@@ -1001,62 +1829,127 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
 					return nil, err
 				}
 
-				switch aggExpr.GetExprType().Ftype {
-				case IntType:
-					getter = intAggGetter
-				case StringType:
-					getter = stringAggGetter
-				}
+				getter = aggGetter(aggExpr.GetExprType().Ftype)
 
-				switch *s.funcOp {
-				case "max":
-					if aggExpr.GetExprType().Ftype == StringType {
-						as = &MaxAggState[string]{}
-					} else {
-						as = &MaxAggState[int64]{}
+				var params []DBValue
+				for _, arg := range s.args[1:] {
+					paramExpr, _, err := arg.generateExpr(c, node.desc, tableMap)
+					if err != nil {
+						return nil, err
 					}
-
-				case "min":
-					if aggExpr.GetExprType().Ftype == StringType {
-						as = &MinAggState[string]{}
-					} else {
-						as = &MinAggState[int64]{}
+					param, err := paramExpr.EvalExpr(nil)
+					if err != nil {
+						return nil, err
+					}
+					params = append(params, param)
+				}
+				as, err = newAggState(*s.funcOp, aggExpr.GetExprType().Ftype, params)
+				if err != nil {
+					return nil, err
+				}
+				if len(s.aggOrderBy) > 0 {
+					ordered, ok := as.(orderedAggState)
+					if !ok {
+						return nil, GoDBError{ParseError, fmt.Sprintf("aggregate %s does not support order by", *s.funcOp)}
+					}
+					var obys []Expr
+					var ascs []bool
+					for _, oby := range s.aggOrderBy {
+						expr, _, err := oby.expr.generateExpr(c, topOp.Descriptor(), tableMap)
+						if err != nil {
+							return nil, err
+						}
+						obys = append(obys, expr)
+						ascs = append(ascs, oby.ascending)
 					}
-				case "avg":
-					as = &AvgAggState[int64]{}
-				case "sum":
-					as = &SumAggState[int64]{}
-				case "count":
-					as = &CountAggState{}
-				default:
-					return nil, GoDBError{IllegalOperationError, fmt.Sprintf("unknown aggregate function %s", *s.funcOp)}
+					ordered.setOrderBy(obys, ascs)
+				}
+				if s.distinct {
+					as = NewDistinctAggState(as)
 				}
 				//make sure name has unique id
 				name := fmt.Sprintf("%s(%s.%s)%d", *s.funcOp, tabName, fieldName, aggCnt)
+				if s.distinct {
+					name = fmt.Sprintf("%s(distinct %s.%s)%d", *s.funcOp, tabName, fieldName, aggCnt)
+				}
 				aggCnt++
 				if s.alias != "" {
 					name = s.alias
 				}
-				as.Init(name, aggExpr, getter)
+				err = as.Init(name, aggExpr, getter)
+				if err != nil {
+					return nil, err
+				}
 				aggs = append(aggs, as)
 				s.cachedField = &as.GetTupleDesc().Fields[0] //track aggregates by reference rather than name
 			}
 		}
 
-		for _, gby := range plan.groupByFields {
+		for i, gby := range plan.groupByFields {
 			expr, _, err := gby.expr.generateExpr(c, topOp.Descriptor(), tableMap)
 			if err != nil {
 				return nil, err
 			}
+			if gby.expr.exprType == ExprFunc {
+				//give computed groups a unique name, by which later clauses refer to them
+				expr = &namedExpr{expr, FieldType{fmt.Sprintf("group%d", i), "", expr.GetExprType().Ftype}}
+			}
 			gbys = append(gbys, expr)
 		}
 
 		if len(gbys) == 0 {
 			topOp = NewAggregator(aggs, topOp)
+		} else if sortedOn(topOp, gbys) {
+			topOp = NewSortedAggregator(aggs, gbys, topOp)
 		} else {
 			topOp = NewGroupedAggregator(aggs, gbys, topOp)
 		}
+
+		//expressions equal to a computed group are read from the aggregator's output
+		for i, gby := range plan.groupByFields {
+			if gby.expr.exprType != ExprFunc {
+				continue
+			}
+			field := topOp.Descriptor().Fields[i]
+			for _, s := range plan.selects {
+				markGroupByExpr(s, gby.expr, &field)
+			}
+			for _, h := range plan.having {
+				markGroupByExpr(&h.fieldExpr, gby.expr, &field)
+				markGroupByExpr(&h.constExpr, gby.expr, &field)
+			}
+		}
+
+		//apply having predicates to the output of the aggregator
+		for _, h := range plan.having {
+			leftExpr, _, err := h.fieldExpr.generateExpr(c, topOp.Descriptor(), tableMap)
+			if err != nil {
+				return nil, err
+			}
+			rightExpr, _, err := h.constExpr.generateExpr(c, topOp.Descriptor(), tableMap)
+			if err != nil {
+				return nil, err
+			}
+			inferParamTypes(leftExpr, rightExpr)
+			switch leftExpr.GetExprType().Ftype {
+			case IntType:
+				topOp, err = NewIntFilter(rightExpr, h.predOp, leftExpr, topOp)
+			case StringType:
+				topOp, err = NewStringFilter(rightExpr, h.predOp, leftExpr, topOp)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
+	if hasWindow {
+		var err error
+		topOp, err = makeWindowPlan(c, plan, topOp, tableMap)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	exprList := make([]Expr, len(plan.selects))
 	for i, s := range plan.selects {
 		switch s.exprType {
@@ -1103,11 +1996,314 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
 	}
 
 	if plan.limit != nil {
-		expr, _, err := plan.limit.generateExpr(c, topOp.Descriptor(), tableMap)
+		var err error
+		topOp, err = makeLimitOp(c, plan.limit, plan.offset, topOp, tableMap)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return topOp, nil
+}
+
+// Parse a LIMIT clause into its row count and offset, either of which may be
+// nil.
+func parseLimit(c *Catalog, lim *sqlparser.Limit) (*LogicalSelectNode, *LogicalSelectNode, error) {
+	if lim == nil {
+		return nil, nil, nil
+	}
+	limExpr, err := parseExpr(c, lim.Rowcount, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	var offsetExpr *LogicalSelectNode
+	if lim.Offset != nil {
+		offsetExpr, err = parseExpr(c, lim.Offset, "")
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return limExpr, offsetExpr, nil
+}
+
+// Add a limit, with an optional offset, above topOp.
+func makeLimitOp(c *Catalog, limit *LogicalSelectNode, offset *LogicalSelectNode, topOp Operator, tableMap map[string]*PlanNode) (Operator, error) {
+	limExpr, _, err := limit.generateExpr(c, topOp.Descriptor(), tableMap)
+	if err != nil {
+		return nil, err
+	}
+	var offsetExpr Expr
+	if offset != nil {
+		offsetExpr, _, err = offset.generateExpr(c, topOp.Descriptor(), tableMap)
+		if err != nil {
+			return nil, err
+		}
+	}
+	setParamTypes([]Expr{limExpr, offsetExpr}, IntType)
+	return NewLimitOffsetOp(limExpr, offsetExpr, topOp)
+}
+
+// Return a copy of the plan of an uncorrelated or equality-correlated IN or
+// EXISTS subquery whose select list consists of the compared column (for IN)
+// followed by the inner sides of its correlated predicates, and the outer
+// references of those predicates, or nil if the subquery cannot be
+// decorrelated this way.
+func decorrelateSubquery(sq *LogicalSubqueryNode) (*LogicalPlan, []*outerRef) {
+	p := sq.plan
+	if sq.predType == ComparePred || len(p.aggs) > 0 || len(p.groupByFields) > 0 || len(p.having) > 0 || len(p.windows) > 0 || p.limit != nil {
+		return nil, nil
+	}
+	inner := *p
+	inner.filters = nil
+	inner.selects = nil
+	inner.orderByFields = nil
+	inner.distinct = false
+	if sq.predType == InPred || sq.predType == NotInPred {
+		if len(p.selects) != 1 || p.selects[0].exprType == ExprStar {
+			return nil, nil
+		}
+		sel := *p.selects[0]
+		sel.alias = "godb_in"
+		inner.selects = append(inner.selects, &sel)
+	}
+	var refs []*outerRef
+	for _, f := range p.filters {
+		if !hasOuterRef(&f.fieldExpr) && !hasOuterRef(&f.constExpr) {
+			inner.filters = append(inner.filters, f)
+			continue
+		}
+		if f.predOp != OpEq || f.constExpr.exprType != ExprOuterRef || hasOuterRef(&f.fieldExpr) {
+			return nil, nil
+		}
+		key := f.fieldExpr
+		key.alias = fmt.Sprintf("godb_key%d", len(refs))
+		inner.selects = append(inner.selects, &key)
+		refs = append(refs, f.constExpr.outer)
+	}
+	if len(inner.selects) == 0 {
+		//an uncorrelated exists only needs to know whether there is a tuple
+		one := NewConstSelectNode("1", "godb_exists")
+		inner.selects = append(inner.selects, &one)
+	}
+	return &inner, refs
+}
+
+// Apply the subquery predicates of plan to the output of topOp.  IN and
+// EXISTS subqueries that are uncorrelated, or only correlated through
+// equality predicates, are turned into semi joins (or anti joins, for NOT IN
+// and NOT EXISTS); all other subqueries are evaluated by an Apply operator,
+// which re-evaluates correlated subqueries for every tuple.
+func makeSubqueryPlan(c *Catalog, plan *LogicalPlan, topOp Operator, tableMap map[string]*PlanNode) (Operator, error) {
+	for _, sq := range plan.subqueryPreds {
+		var refs []*OuterRefExpr
+		var bindings []Expr
+		bindingOf := make(map[*outerRef]Expr)
+		for _, ref := range sq.outerRefs {
+			binding, _, err := ref.node.generateExpr(c, topOp.Descriptor(), tableMap)
+			if err != nil {
+				return nil, err
+			}
+			ref.expr = NewOuterRefExpr(binding.GetExprType())
+			refs = append(refs, ref.expr)
+			bindings = append(bindings, binding)
+			bindingOf[ref] = binding
+		}
+		var expr Expr
+		if sq.expr != nil {
+			var err error
+			expr, _, err = sq.expr.generateExpr(c, topOp.Descriptor(), tableMap)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var newOp Operator
+		if inner, keyRefs := decorrelateSubquery(sq); inner != nil {
+			innerOp, err := makePhysicalPlan(c, inner)
+			if err != nil {
+				return nil, err
+			}
+			var leftKeys, rightKeys []Expr
+			if expr != nil {
+				leftKeys = append(leftKeys, expr)
+			}
+			for _, ref := range keyRefs {
+				leftKeys = append(leftKeys, bindingOf[ref])
+			}
+			for _, f := range innerOp.Descriptor().Fields[:len(leftKeys)] {
+				rightKeys = append(rightKeys, &FieldExpr{f})
+			}
+			anti := sq.predType == NotInPred || sq.predType == NotExistsPred
+			newOp, err = NewSemiJoin(topOp, leftKeys, innerOp, rightKeys, anti)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			innerOp, err := makePhysicalPlan(c, sq.plan)
+			if err != nil {
+				return nil, err
+			}
+			newOp, err = NewApply(topOp, innerOp, sq.predType, expr, sq.predOp, refs, bindings)
+			if err != nil {
+				return nil, err
+			}
+		}
+		newNode := &PlanNode{newOp, newOp.Descriptor()}
+		for key, node := range tableMap {
+			if node.op == topOp {
+				tableMap[key] = newNode
+			}
+		}
+		topOp = newOp
+	}
+	return topOp, nil
+}
+
+// Return true if two expressions are the same, ignoring aliases.
+func sameExpr(a *LogicalSelectNode, b *LogicalSelectNode) bool {
+	if a.exprType != b.exprType || a.table != b.table || a.field != b.field || a.value != b.value || len(a.args) != len(b.args) {
+		return false
+	}
+	if (a.funcOp == nil) != (b.funcOp == nil) || (a.funcOp != nil && *a.funcOp != *b.funcOp) {
+		return false
+	}
+	for i := range a.args {
+		if !sameExpr(a.args[i], b.args[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Make the subexpressions of s equal to the GROUP BY expression gby refer to
+// the field of the aggregator's output that holds its value.
+func markGroupByExpr(s *LogicalSelectNode, gby *LogicalSelectNode, field *FieldType) {
+	if s.exprType == ExprFunc && sameExpr(s, gby) {
+		s.cachedField = field
+		return
+	}
+	for _, arg := range s.args {
+		markGroupByExpr(arg, gby, field)
+	}
+}
+
+// Add Window operators that compute the window functions of plan over the
+// output of topOp, one for each distinct OVER clause.
+func makeWindowPlan(c *Catalog, plan *LogicalPlan, topOp Operator, tableMap map[string]*PlanNode) (Operator, error) {
+	var specs []string
+	bySpec := make(map[string][]*LogicalSelectNode)
+	for _, w := range plan.windows {
+		if _, ok := bySpec[w.window.spec]; !ok {
+			specs = append(specs, w.window.spec)
+		}
+		bySpec[w.window.spec] = append(bySpec[w.window.spec], w)
+	}
+
+	var winCnt int
+	for _, spec := range specs {
+		nodes := bySpec[spec]
+		window := nodes[0].window
+		desc := topOp.Descriptor()
+		var partitionBy, orderBy []Expr
+		var ascs []bool
+		for _, p := range window.partitionBy {
+			expr, _, err := p.generateExpr(c, desc, tableMap)
+			if err != nil {
+				return nil, err
+			}
+			partitionBy = append(partitionBy, expr)
+		}
+		for _, oby := range window.orderBy {
+			expr, _, err := oby.expr.generateExpr(c, desc, tableMap)
+			if err != nil {
+				return nil, err
+			}
+			orderBy = append(orderBy, expr)
+			ascs = append(ascs, oby.ascending)
+		}
+
+		var funcs []*WindowFunc
+		for _, s := range nodes {
+			//make sure name has unique id
+			name := fmt.Sprintf("%s() over%d", *s.funcOp, winCnt)
+			winCnt++
+			if s.alias != "" {
+				name = s.alias
+			}
+			var args []Expr
+			for _, arg := range s.args {
+				expr, _, err := arg.generateExpr(c, desc, tableMap)
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, expr)
+			}
+
+			var f *WindowFunc
+			var err error
+			switch *s.funcOp {
+			case "row_number":
+				f, err = NewRankingWindowFunc(WindowRowNumber, name)
+			case "rank":
+				f, err = NewRankingWindowFunc(WindowRank, name)
+			case "dense_rank":
+				f, err = NewRankingWindowFunc(WindowDenseRank, name)
+			case "lag", "lead":
+				kind := WindowLag
+				if *s.funcOp == "lead" {
+					kind = WindowLead
+				}
+				offset := int64(1)
+				var defaultVal DBValue
+				if len(args) > 1 {
+					v, err := args[1].EvalExpr(nil)
+					if err != nil {
+						return nil, err
+					}
+					intV, ok := v.(IntField)
+					if !ok {
+						return nil, GoDBError{TypeMismatchError, fmt.Sprintf("expected int offset in window function %s", *s.funcOp)}
+					}
+					offset = intV.Value
+				}
+				if len(args) > 2 {
+					defaultVal, err = args[2].EvalExpr(nil)
+					if err != nil {
+						return nil, err
+					}
+				}
+				f, err = NewOffsetWindowFunc(kind, name, args[0], int(offset), defaultVal)
+			default:
+				var params []DBValue
+				for _, arg := range args[1:] {
+					param, err := arg.EvalExpr(nil)
+					if err != nil {
+						return nil, err
+					}
+					params = append(params, param)
+				}
+				argType := args[0].GetExprType().Ftype
+				as, err := newAggState(*s.funcOp, argType, params)
+				if err != nil {
+					return nil, err
+				}
+				if err := as.Init(name, args[0], aggGetter(argType)); err != nil {
+					return nil, err
+				}
+				f = NewAggWindowFunc(as, window.frame)
+			}
+			if err != nil {
+				return nil, err
+			}
+			funcs = append(funcs, f)
+			ft := f.fieldType()
+			s.cachedField = &ft //track window functions by reference rather than name
+		}
+
+		var err error
+		topOp, err = NewWindow(partitionBy, orderBy, ascs, funcs, topOp)
 		if err != nil {
 			return nil, err
 		}
-		topOp = NewLimitOp(expr, topOp)
 	}
 	return topOp, nil
 }
@@ -1127,7 +2323,7 @@ func parseInsert(c *Catalog, insStmt *sqlparser.Insert) (Operator, error) {
 		var exprAr []([]Expr)
 		for _, t := range stmt {
 			var tupAr []Expr
-			for _, e := range t {
+			for i, e := range t {
 				expr, err := parseExpr(c, e, "")
 				if err != nil {
 					return nil, err
@@ -1136,20 +2332,23 @@ func parseInsert(c *Catalog, insStmt *sqlparser.Insert) (Operator, error) {
 				if err != nil {
 					return nil, err
 				}
+				if i < len(file.Descriptor().Fields) {
+					setParamTypes([]Expr{exprOp}, file.Descriptor().Fields[i].Ftype)
+				}
 				tupAr = append(tupAr, exprOp)
 			}
 			exprAr = append(exprAr, tupAr)
 		}
 		iterOp := NewValueOp(exprAr)
+		// 值的类型与表的字段一致时，元组使用表的描述符，否则插入时报错
+		if sameTypes(iterOp.Descriptor(), file.Descriptor()) {
+			iterOp.td = file.Descriptor().copy()
+		}
 		insertOp := NewInsertOp(file, iterOp)
 		return insertOp, nil
 
 	case *sqlparser.Select:
-		plan, err := parseStatement(c, stmt)
-		if err != nil {
-			return nil, err
-		}
-		op, err := makePhysicalPlan(c, plan)
+		op, err := planStatement(c, stmt)
 		if err != nil {
 			return nil, err
 		}
@@ -1160,6 +2359,19 @@ func parseInsert(c *Catalog, insStmt *sqlparser.Insert) (Operator, error) {
 	return nil, nil
 }
 
+// Return true if the fields of d1 and d2 have the same types.
+func sameTypes(d1, d2 *TupleDesc) bool {
+	if len(d1.Fields) != len(d2.Fields) {
+		return false
+	}
+	for i, f := range d1.Fields {
+		if f.Ftype != d2.Fields[i].Ftype {
+			return false
+		}
+	}
+	return true
+}
+
 func parseDelete(c *Catalog, delStmt *sqlparser.Delete) (Operator, error) {
 	if len(delStmt.TableExprs) > 1 {
 		return nil, GoDBError{ParseError, "godb does not supporting deleting from multiple tables"}
@@ -1180,10 +2392,14 @@ func parseDelete(c *Catalog, delStmt *sqlparser.Delete) (Operator, error) {
 
 	var filters []*LogicalFilterNode = make([]*LogicalFilterNode, 0)
 	if delStmt.Where != nil {
-		filters, joins, err = parseWhere(c, subplans, tables, delStmt.Where.Expr)
+		var subqueryPreds []*LogicalSubqueryNode
+		filters, joins, subqueryPreds, err = parseWhere(c, subplans, tables, nil, delStmt.Where.Expr)
 		if err != nil {
 			return nil, err
 		}
+		if len(subqueryPreds) > 0 {
+			return nil, GoDBError{ParseError, "godb does not support subqueries in delete statements"}
+		}
 		if joins != nil {
 			return nil, GoDBError{ParseError, "godb does not supporting deleting from multiple tables"}
 		}
@@ -1211,6 +2427,7 @@ func parseDelete(c *Catalog, delStmt *sqlparser.Delete) (Operator, error) {
 		//op := node.op
 		//dbField, _ := fieldNameToField(f.table, f.field, &PlanNode{op, &desc})
 
+		inferParamTypes(leftExpr, rightExpr)
 		switch leftExpr.GetExprType().Ftype {
 		case IntType:
 			//newInt, _ := strconv.Atoi(f.constVal)
@@ -1229,6 +2446,293 @@ func parseDelete(c *Catalog, delStmt *sqlparser.Delete) (Operator, error) {
 
 }
 
+// Return a copy of the catalog in which the selects of stmt that start the
+// right branch of a set operation in marks (see rewriteSetOperations) are
+// marked with the operation.  The selects are numbered in the order in which
+// sqlparser.Walk visits them, which is the order of the query.
+func (c *Catalog) withSetOps(stmt sqlparser.SQLNode, marks setOpMarks) (*Catalog, error) {
+	if len(marks) == 0 {
+		return c, nil
+	}
+	cc := *c
+	cc.setOps = make(map[*sqlparser.Select]setOpMark)
+	for sel, mark := range c.setOps {
+		cc.setOps[sel] = mark
+	}
+	selects := 0
+	sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		if sel, ok := node.(*sqlparser.Select); ok {
+			if mark, ok := marks[selects]; ok {
+				cc.setOps[sel] = mark
+			}
+			selects++
+		}
+		return true, nil
+	}, stmt)
+	for n := range marks {
+		if n >= selects {
+			return nil, GoDBError{ParseError, "could not find the branches of a set operation"}
+		}
+	}
+	return &cc, nil
+}
+
+// Return the set operation that stmt is the right branch of (see
+// withSetOps), or a union if there is none.  The mark of a branch in
+// parentheses is on its first select.
+func (c *Catalog) setOpOfBranch(stmt sqlparser.SelectStatement) (SetOpType, bool) {
+	for {
+		if paren, ok := stmt.(*sqlparser.ParenSelect); ok {
+			stmt = paren.Select
+		} else if u, ok := stmt.(*sqlparser.Union); ok {
+			stmt = u.Left
+		} else {
+			break
+		}
+	}
+	sel, ok := stmt.(*sqlparser.Select)
+	if !ok {
+		return UnionOp, false
+	}
+	if mark, ok := c.setOps[sel]; ok {
+		return mark.op, mark.all
+	}
+	return UnionOp, false
+}
+
+// Plan a branch of a set operation.
+func parseSetBranch(c *Catalog, stmt sqlparser.SelectStatement) (Operator, error) {
+	switch stmt := stmt.(type) {
+	case *sqlparser.Select:
+		return planStatement(c, stmt)
+	case *sqlparser.ParenSelect:
+		return parseSetBranch(c, stmt.Select)
+	case *sqlparser.Union:
+		return parseSetOperation(c, stmt)
+	}
+	return nil, GoDBError{ParseError, fmt.Sprintf("unsupported query type %s in set operation", reflect.TypeOf(stmt))}
+}
+
+// A branch of a chain of set operations, and the operation that combines it
+// with the branches before it.
+type setBranch struct {
+	stmt sqlparser.SelectStatement
+	op   SetOpType
+	all  bool
+}
+
+// Plan UNION, INTERSECT and EXCEPT, which the parser represents as unions
+// (see rewriteSetOperations).  As in standard SQL, INTERSECT binds more
+// tightly than UNION and EXCEPT, which are evaluated left to right, e.g.,
+// a UNION b INTERSECT c is a UNION (b INTERSECT c).  ORDER BY and LIMIT apply
+// to the combined result.
+func parseSetOperation(c *Catalog, u *sqlparser.Union) (Operator, error) {
+	// the parser nests a chain of operations to the left, as in
+	// ((a op b) op c), so the branches are collected from the right
+	var branches []setBranch
+	var stmt sqlparser.SelectStatement = u
+	for {
+		cur, ok := stmt.(*sqlparser.Union)
+		if !ok {
+			break
+		}
+		op, all := c.setOpOfBranch(cur.Right)
+		if op == UnionOp {
+			all = cur.Type == sqlparser.UnionAllStr
+		}
+		branches = append(branches, setBranch{cur.Right, op, all})
+		stmt = cur.Left
+	}
+	branches = append(branches, setBranch{stmt: stmt})
+	for i, j := 0, len(branches)-1; i < j; i, j = i+1, j-1 {
+		branches[i], branches[j] = branches[j], branches[i]
+	}
+
+	// intersections are combined first, leaving the operands of the unions
+	// and differences
+	var operands []Operator
+	var ops []setBranch
+	for i, b := range branches {
+		op, err := parseSetBranch(c, b.stmt)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 && b.op == IntersectOp {
+			last := len(operands) - 1
+			if operands[last], err = NewSetOp(IntersectOp, b.all, operands[last], op); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if i > 0 {
+			ops = append(ops, b)
+		}
+		operands = append(operands, op)
+	}
+	topOp := operands[0]
+	var err error
+	for i, b := range ops {
+		if topOp, err = NewSetOp(b.op, b.all, topOp, operands[i+1]); err != nil {
+			return nil, err
+		}
+	}
+
+	tableMap := map[string]*PlanNode{"": {topOp, topOp.Descriptor()}}
+	if len(u.OrderBy) > 0 {
+		var exprs []Expr
+		var ascs []bool
+		for _, oby := range u.OrderBy {
+			node, err := parseExpr(c, oby.Expr, "")
+			if err != nil {
+				return nil, err
+			}
+			expr, _, err := node.generateExpr(c, topOp.Descriptor(), tableMap)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, expr)
+			ascs = append(ascs, oby.Direction == sqlparser.AscScr)
+		}
+		topOp, err = NewOrderBy(exprs, topOp, ascs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	limit, offset, err := parseLimit(c, u.Limit)
+	if err != nil {
+		return nil, err
+	}
+	if limit != nil {
+		topOp, err = makeLimitOp(c, limit, offset, topOp, tableMap)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return topOp, nil
+}
+
+// A common table expression of a WITH clause, planned before the query that
+// references it
+type cteTable struct {
+	name string
+	desc *TupleDesc
+	op   Operator
+	mat  *Materialize //read instead of op if the expression is referenced more than once
+	refs int
+}
+
+// Return the descriptor of a common table expression whose query returns
+// tuples described by desc.
+func cteDesc(cte cteText, desc *TupleDesc) (*TupleDesc, error) {
+	desc = desc.copy()
+	if len(cte.columns) > 0 {
+		if len(cte.columns) != len(desc.Fields) {
+			return nil, GoDBError{ParseError, fmt.Sprintf("common table expression %s has %d columns, but its query returns %d", cte.name, len(cte.columns), len(desc.Fields))}
+		}
+		for i, col := range cte.columns {
+			desc.Fields[i].Fname = col
+		}
+	}
+	desc.setTableAlias(cte.name)
+	return desc, nil
+}
+
+// Plan a recursive common table expression, whose query must be a UNION [ALL]
+// of an anchor and a recursive part that reads the tuples of the previous
+// iteration under the name of the expression.  Returns nil if the query does
+// not have this form or does not refer to itself.
+func planRecursiveCTE(c *Catalog, cte cteText, stmt sqlparser.SelectStatement) (*cteTable, error) {
+	u, ok := stmt.(*sqlparser.Union)
+	if !ok || len(u.OrderBy) > 0 || u.Limit != nil {
+		return nil, nil
+	}
+	if op, _ := c.setOpOfBranch(u.Right); op != UnionOp {
+		return nil, nil
+	}
+	anchor, err := parseSetBranch(c, u.Left)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := cteDesc(cte, anchor.Descriptor())
+	if err != nil {
+		return nil, err
+	}
+	work := NewWorkTable(desc)
+	workCTE := &cteTable{cte.name, desc, work, nil, 0}
+	recursive, err := parseSetBranch(c.withCTE(workCTE), u.Right)
+	if err != nil {
+		return nil, err
+	}
+	all := u.Type == sqlparser.UnionAllStr
+	var op Operator
+	if workCTE.refs > 0 {
+		op, err = NewRecursiveUnion(anchor, recursive, work, all)
+	} else {
+		op, err = NewSetOp(UnionOp, all, anchor, recursive)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cteTable{cte.name, desc, op, NewMaterialize(op), 0}, nil
+}
+
+// Plan the common table expressions of a WITH clause at the start of query,
+// returning a catalog in which they are visible and the rest of the query,
+// preprocessed, with its set operations.  Each expression may refer to those
+// before it, and, for WITH RECURSIVE, to itself.
+func parseWith(c *Catalog, query string) (*Catalog, string, setOpMarks, error) {
+	ctes, recursive, query, err := extractCTEs(query)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	query, marks, err := preprocessQuery(query)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	defined := make(map[string]bool)
+	for _, cte := range ctes {
+		if defined[cte.name] {
+			return nil, "", nil, GoDBError{ParseError, fmt.Sprintf("common table expression %s is defined more than once", cte.name)}
+		}
+		defined[cte.name] = true
+		body, bodyMarks, err := preprocessQuery(cte.body)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		stmt, err := sqlparser.Parse(body)
+		if err != nil {
+			return nil, "", nil, GoDBError{ParseError, err.Error()}
+		}
+		sel, ok := stmt.(sqlparser.SelectStatement)
+		if !ok {
+			return nil, "", nil, GoDBError{ParseError, fmt.Sprintf("common table expression %s must be a select statement", cte.name)}
+		}
+		if c, err = c.withSetOps(sel, bodyMarks); err != nil {
+			return nil, "", nil, err
+		}
+		var table *cteTable
+		if recursive {
+			table, err = planRecursiveCTE(c, cte, sel)
+			if err != nil {
+				return nil, "", nil, err
+			}
+		}
+		if table == nil {
+			op, err := parseSetBranch(c, sel)
+			if err != nil {
+				return nil, "", nil, err
+			}
+			desc, err := cteDesc(cte, op.Descriptor())
+			if err != nil {
+				return nil, "", nil, err
+			}
+			table = &cteTable{cte.name, desc, op, NewMaterialize(op), 0}
+		}
+		c = c.withCTE(table)
+	}
+	return c, query, marks, nil
+}
+
 type QueryType int
 
 const (
@@ -1285,20 +2789,34 @@ func processDDL(c *Catalog, ddl *sqlparser.DDL) (QueryType, error) {
 }
 
 func Parse(c *Catalog, query string) (QueryType, Operator, error) {
+	if op, ok, err := parseAnalyze(c, query); ok {
+		if err != nil {
+			return UnknownQueryType, nil, err
+		}
+		return IteratorType, op, nil
+	}
+	c, query, marks, err := parseWith(c, query)
+	if err != nil {
+		return UnknownQueryType, nil, err
+	}
 	stmt, err := sqlparser.Parse(query)
 	if err != nil {
+		return UnknownQueryType, nil, GoDBError{ParseError, err.Error()}
+	}
+	if c, err = c.withSetOps(stmt, marks); err != nil {
 		return UnknownQueryType, nil, err
 	}
 	switch stmt := stmt.(type) {
 	case *sqlparser.Select:
-		plan, err := parseStatement(c, stmt)
+		op, err := planStatement(c, stmt)
 		if err != nil {
 			//fmt.Printf("Err: %s\n", err.Error())
 			return UnknownQueryType, nil, err
 		}
-		op, err := makePhysicalPlan(c, plan)
+		return IteratorType, parallelizePlan(op, c.parallelism), nil
+	case *sqlparser.Union:
+		op, err := parseSetOperation(c, stmt)
 		if err != nil {
-			//fmt.Printf("Err: %s\n", err.Error())
 			return UnknownQueryType, nil, err
 		}
 		return IteratorType, op, nil
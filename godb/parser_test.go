@@ -0,0 +1,564 @@
+package godb
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// create the easy test database and load its catalog
+func makeParserTestCatalog(t *testing.T) (*Catalog, *BufferPool) {
+	bp := NewBufferPool(10)
+	err := MakeTestDatabaseEasy(bp)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+	c, err := NewCatalogFromFile("catalog.txt", bp, "./")
+	if err != nil {
+		t.Fatalf("failed load catalog, %s", err.Error())
+	}
+	return c, bp
+}
+
+// parse and run sql in its own transaction, returning all result tuples
+func runParsedQuery(t *testing.T, c *Catalog, bp *BufferPool, sql string) []*Tuple {
+	qType, plan, err := Parse(c, sql)
+	if err != nil {
+		t.Fatalf("failed to parse, q=%s, %s", sql, err.Error())
+	}
+	if qType != IteratorType {
+		t.Fatalf("expected iterator query, q=%s", sql)
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+	iter, err := plan.Iterator(tid)
+	if err != nil {
+		t.Fatalf("failed to get iterator, q=%s, %s", sql, err.Error())
+	}
+	var res []*Tuple
+	for {
+		tup, err := iter()
+		if err != nil {
+			t.Fatalf("failed to iterate, q=%s, %s", sql, err.Error())
+		}
+		if tup == nil {
+			break
+		}
+		res = append(res, tup)
+	}
+	return res
+}
+
+func TestParseHaving(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+
+	res := runParsedQuery(t, c, bp, "select name, count(*) cnt from t group by name having count(*) > 1")
+	if len(res) != 2 {
+		t.Fatalf("expected 2 groups with more than one tuple, got %d", len(res))
+	}
+	for _, tup := range res {
+		name := tup.Fields[0].(StringField).Value
+		if name != "sam" && name != "riza" {
+			t.Errorf("unexpected group %s", name)
+		}
+	}
+
+	// aggregate that does not appear in the select list, and a predicate on a
+	// group by column
+	res = runParsedQuery(t, c, bp, "select name from t group by name having max(age) >= 50 and name <> 'bo'")
+	if len(res) != 3 {
+		t.Fatalf("expected 3 groups, got %d", len(res))
+	}
+
+	// predicate comparing two aggregates
+	res = runParsedQuery(t, c, bp, "select name, sum(age) from t group by name having min(age) < max(age)")
+	if len(res) != 2 {
+		t.Fatalf("expected 2 groups, got %d", len(res))
+	}
+
+	_, _, err := Parse(c, "select name from t having age > 1")
+	if err == nil {
+		t.Errorf("expected having without aggregation to fail")
+	}
+}
+
+func TestParseDistinctAggs(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+
+	res := runParsedQuery(t, c, bp, "select count(distinct name), sum(distinct age), avg(distinct age), count(age) from t")
+	if len(res) != 1 {
+		t.Fatalf("expected one result, got %d", len(res))
+	}
+	expected := []int64{10, 452, 45, 12}
+	for i, e := range expected {
+		if v := res[0].Fields[i].(IntField).Value; v != e {
+			t.Errorf("field %d: expected %d, got %d", i, e, v)
+		}
+	}
+	names := []string{"count(distinct name)", "sum(distinct age)", "avg(distinct age)", "count(age)"}
+	for i, name := range names {
+		if f := res[0].Desc.Fields[i].Fname; f != name {
+			t.Errorf("field %d: expected the name %s, got %s", i, name, f)
+		}
+	}
+
+	res = runParsedQuery(t, c, bp, "select age, count(distinct name) from t group by age")
+	for _, tup := range res {
+		age := tup.Fields[0].(IntField).Value
+		cnt := tup.Fields[1].(IntField).Value
+		if (age == 22 || age == 99) != (cnt == 2) {
+			t.Errorf("unexpected distinct count %d for age %d", cnt, age)
+		}
+	}
+
+	_, _, err := Parse(c, "select count(distinct *) from t")
+	if err == nil {
+		t.Errorf("expected count(distinct *) to fail")
+	}
+}
+
+func TestParseStatisticalAggs(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+
+	res := runParsedQuery(t, c, bp, "select var_pop(age), var_samp(age), stddev_pop(age), stddev(age), median(age), percentile_disc(age, 0.5), percentile_cont(age, 1) from t")
+	if len(res) != 1 {
+		t.Fatalf("expected one result, got %d", len(res))
+	}
+	expected := []int64{646, 704, 25, 26, 41, 40, 99}
+	for i, e := range expected {
+		if v := res[0].Fields[i].(IntField).Value; v != e {
+			t.Errorf("field %d: expected %d, got %d", i, e, v)
+		}
+	}
+
+	_, _, err := Parse(c, "select median(name) from t")
+	if err == nil {
+		t.Errorf("expected median of strings to fail")
+	}
+	_, _, err = Parse(c, "select percentile_cont(age, 2) from t")
+	if err == nil {
+		t.Errorf("expected percentile outside of [0, 1] to fail")
+	}
+}
+
+func TestParseStringAgg(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+
+	res := runParsedQuery(t, c, bp, "select age, group_concat(name order by name desc separator '|') from t group by age")
+	got := make(map[int64]string)
+	for _, tup := range res {
+		got[tup.Fields[0].(IntField).Value] = tup.Fields[1].(StringField).Value
+	}
+	if got[22] != "riza|ang" || got[99] != "sam|bo" || got[25] != "sam" {
+		t.Errorf("unexpected ordered string aggregates %v", got)
+	}
+
+	res = runParsedQuery(t, c, bp, "select string_agg(age, ',') from t where name = 'sam'")
+	if len(res) != 1 || res[0].Fields[0].(StringField).Value != "25,99" {
+		t.Errorf("unexpected string aggregate %v", res)
+	}
+}
+
+func TestParseWindowFunctions(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+
+	res := runParsedQuery(t, c, bp, "select name, age, row_number() over (partition by name order by age) rn, rank() over (order by age desc) rk from t order by age, name")
+	if len(res) != 12 {
+		t.Fatalf("expected 12 results, got %d", len(res))
+	}
+	for _, tup := range res {
+		name := tup.Fields[0].(StringField).Value
+		age := tup.Fields[1].(IntField).Value
+		rn := tup.Fields[2].(IntField).Value
+		rk := tup.Fields[3].(IntField).Value
+		expectedRn := int64(1)
+		if (name == "sam" && age == 99) || (name == "riza" && age == 43) {
+			expectedRn = 2
+		}
+		if rn != expectedRn {
+			t.Errorf("%s, %d: expected row number %d, got %d", name, age, expectedRn, rn)
+		}
+		if (age == 99) != (rk == 1) || (age == 22 && rk != 11) {
+			t.Errorf("%s, %d: unexpected rank %d", name, age, rk)
+		}
+	}
+
+	res = runParsedQuery(t, c, bp, "select age, sum(age) over (order by age rows between 1 preceding and 1 following) s, lead(name, 2, 'none') over (order by age) ld from t where name <> 'riza'")
+	expected := map[int64][]any{25: {22 + 25 + 30, "pat"}, 45: {40 + 45 + 50, "sarah"}}
+	for _, tup := range res {
+		age := tup.Fields[0].(IntField).Value
+		if e, ok := expected[age]; ok {
+			if tup.Fields[1].(IntField).Value != int64(e[0].(int)) || tup.Fields[2].(StringField).Value != e[1].(string) {
+				t.Errorf("age %d: expected %v, got %v", age, e, tup.Fields[1:])
+			}
+		}
+	}
+
+	// the frame of the oldest is empty
+	res = runParsedQuery(t, c, bp, "select age, avg(age) over (order by age rows between 1 following and 1 following) a from t order by age desc")
+	if len(res) == 0 || res[0].Fields[1].(IntField).Value != 0 {
+		t.Errorf("expected an empty frame to average to 0, got %v", res)
+	}
+
+	// window functions are evaluated after grouping
+	res = runParsedQuery(t, c, bp, "select name, sum(age) total, rank() over (order by sum(age) desc) r from t group by name")
+	for _, tup := range res {
+		if tup.Fields[0].(StringField).Value == "sam" && tup.Fields[2].(IntField).Value != 1 {
+			t.Errorf("expected sam to have the largest total, got %v", tup.Fields)
+		}
+	}
+
+	for _, sql := range []string{
+		"select name from t where rank() over (order by age) > 1",
+		"select ntile(2) over (order by age) from t",
+		"select sum(age) over w from t",
+		"select sum(age) over (order by age rows between 1 following and 1 preceding) from t",
+		"select sum(age) over (order by age rows between 2 following and 1 following) from t",
+	} {
+		if _, _, err := Parse(c, sql); err == nil {
+			t.Errorf("expected '%s' to fail", sql)
+		}
+	}
+}
+
+func TestRewriteWindowFunctions(t *testing.T) {
+	query := "select 'over (x)', sum(age) OVER (partition by name order by 'it''s') from t"
+	rewritten, err := rewriteWindowFunctions(query)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected := `select 'over (x)', godb_over(sum(age), 'partition by name order by \'it\'\'s\'') from t`
+	if rewritten != expected {
+		t.Errorf("expected %s, got %s", expected, rewritten)
+	}
+
+	// comments, and words named over that do not start a window clause, are
+	// left alone
+	for _, query := range []string{
+		"select over from t -- it's over (x)",
+		"select (age) over, count(*) as over from t /* it's over (x) */",
+		"select age # it's over (x)\nfrom t",
+	} {
+		if rewritten, err := rewriteWindowFunctions(query); err != nil || rewritten != query {
+			t.Errorf("expected '%s' to be left alone, got '%s', %v", query, rewritten, err)
+		}
+	}
+	if _, err := rewriteWindowFunctions("select age /* it's over (x) from t"); err == nil {
+		t.Errorf("expected an unterminated comment to fail")
+	}
+}
+
+func TestParseCommentsAndOver(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+
+	res := runParsedQuery(t, c, bp, "select age over, sum(age) /* it's */ over (order by age) s -- it's the sum\nfrom t where name = 'sam'")
+	if len(res) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(res))
+	}
+	if name := res[0].Desc.Fields[0].Fname; name != "over" {
+		t.Errorf("expected a column named over, got %s", name)
+	}
+	for _, tup := range res {
+		if tup.Fields[0].(IntField).Value == 99 && tup.Fields[1].(IntField).Value != 99+25 {
+			t.Errorf("unexpected running sum %v", tup.Fields)
+		}
+	}
+}
+
+// return the sorted names in the first field of the result of a query
+func queryNames(t *testing.T, c *Catalog, bp *BufferPool, sql string) []string {
+	var names []string
+	for _, tup := range runParsedQuery(t, c, bp, sql) {
+		names = append(names, tup.Fields[0].(StringField).Value)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestParseSetOperations(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+
+	cases := []struct {
+		sql      string
+		expected []string
+	}{
+		{"select name from t where age < 30 union select name from t2 where age > 90", []string{"ang", "bo", "riza", "sam"}},
+		{"select name from t where age < 30 union all select name from t2 where age > 90", []string{"ang", "bo", "riza", "sam", "sam"}},
+		{"select name from t where age < 30 intersect select name from t2 where age > 90", []string{"sam"}},
+		{"select name from t except select name from t2 where age < 50", []string{"bo", "mark", "sarah"}},
+		{"select name from t except all select name from t2 where age < 50", []string{"bo", "mark", "sam", "sarah"}},
+		{"select name from t intersect all select name from t2 where age > 40", []string{"bo", "kathy", "mark", "riza", "sam", "sarah"}},
+		{"(select name from t where age < 25) union (select name from t where age > 90) except select name from t2 where name = 'bo'", []string{"ang", "riza", "sam"}},
+		// intersect binds more tightly than union and except
+		{"select name from t union select name from t2 where age > 90 intersect select name from t2 where age < 30", []string{"ang", "bill", "bo", "joe", "kathy", "mark", "pat", "riza", "sam", "sarah"}},
+		{"select name from t except select name from t where age < 50 intersect select name from t2 where age > 20", []string{"bo", "mark", "sarah"}},
+		{"select name from t except (select name from t where age < 50 intersect select name from t2 where age > 20)", []string{"bo", "mark", "sarah"}},
+		{"(select name from t where age < 30 union select name from t where age > 90) intersect select name from t2 where age < 30", []string{"ang", "riza", "sam"}},
+		// the branches are found after subqueries, and in common table expressions
+		{"select name from t where age in (select age from t2 where name = 'sam') intersect select name from t where age > 90", []string{"bo", "sam"}},
+		{"with x as (select name from t where age < 30 intersect select name from t2 where age > 90) select name from x", []string{"sam"}},
+		// comments cannot mark set operations
+		{"select name from t where age < 30 union all select /*godb_setop:intersect*/ name from t2 where age > 90", []string{"ang", "bo", "riza", "sam", "sam"}},
+		{"select name from t where age < 30 -- intersect it's\nunion select name from t2 where age > 90", []string{"ang", "bo", "riza", "sam"}},
+	}
+	for _, tc := range cases {
+		names := queryNames(t, c, bp, tc.sql)
+		if !reflect.DeepEqual(names, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.sql, tc.expected, names)
+		}
+	}
+
+	// order by and limit apply to the combined result
+	res := runParsedQuery(t, c, bp, "select name, age from t where age < 30 union select name, age from t2 where age > 90 order by age desc, name limit 3")
+	if len(res) != 3 || res[0].Fields[0].(StringField).Value != "bo" || res[2].Fields[1].(IntField).Value != 25 {
+		t.Errorf("unexpected ordered union %v", res)
+	}
+
+	for _, sql := range []string{
+		"select name from t union select name, age from t2",
+		"select name from t intersect select age from t2",
+	} {
+		if _, _, err := Parse(c, sql); err == nil {
+			t.Errorf("expected incompatible set operation '%s' to fail", sql)
+		}
+	}
+}
+
+func TestParseSubqueries(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+
+	cases := []struct {
+		sql      string
+		expected []string
+	}{
+		{"select name from t where age in (select age from t2 where name = 'sam')", []string{"bo", "sam", "sam"}},
+		{"select name from t where age not in (select age from t2 where age < 45) and age < 60", []string{"kathy", "mark"}},
+		{"select name from t where exists (select age from t2 where t2.age = t.age and t2.name = 'riza')", []string{"ang", "riza", "riza"}},
+		{"select name from t where exists (select name from t2 where t2.age = t.age and t2.name <> t.name)", []string{"ang", "bo", "riza", "sam"}},
+		{"select name from t where not exists (select name from t2 where age > 100)", []string{"ang", "bill", "bo", "joe", "kathy", "mark", "pat", "riza", "riza", "sam", "sam", "sarah"}},
+		{"select name from t where age > (select avg(age) from t2)", []string{"bo", "mark", "sam", "sarah"}},
+		{"select name from t where (select min(age) from t2) = age", []string{"ang", "riza"}},
+		{"select name from t where age = (select max(age) from t2 where t2.name = t.name) and name > 'r'", []string{"riza", "sam", "sarah"}},
+		{"select name from t where name in (select name from t2 where age in (select age from t where name = 'sam'))", []string{"bo", "sam", "sam"}},
+	}
+	for _, tc := range cases {
+		names := queryNames(t, c, bp, tc.sql)
+		if !reflect.DeepEqual(names, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.sql, tc.expected, names)
+		}
+	}
+
+	// equality-correlated subqueries are decorrelated into semi joins
+	_, plan, err := Parse(c, "select name from t where exists (select age from t2 where t2.age = t.age)")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, ok := plan.(*Project).child.(*SemiJoin); !ok {
+		t.Errorf("expected a semi join, got %T", plan.(*Project).child)
+	}
+
+	_, plan, err = Parse(c, "select name from t where age = (select age from t2)")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	iter, err := plan.Iterator(tid)
+	if err == nil {
+		_, err = iter()
+	}
+	if err == nil {
+		t.Errorf("expected scalar subquery with several results to fail")
+	}
+	bp.CommitTransaction(tid)
+
+	for _, sql := range []string{
+		"select name from t where age in (22, 25)",
+		"select name from t where age in (select name, age from t2)",
+		"select name from t where name in (select age from t2)",
+		"select name from t where not age > 1",
+	} {
+		if _, _, err := Parse(c, sql); err == nil {
+			t.Errorf("expected '%s' to fail", sql)
+		}
+	}
+}
+
+func TestParseCTEs(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+
+	cases := []struct {
+		sql      string
+		expected []string
+	}{
+		{"with old as (select name, age from t where age > 50) select name from old", []string{"bo", "sam", "sarah"}},
+		{"WITH old(n, a) AS (select name, age from t where age > 50), older as (select n from old where a > 90) select n from older", []string{"bo", "sam"}},
+		// a common table expression hides a table with the same name
+		{"with t as (select name from t2 where age = 22) select name from t", []string{"ang", "riza"}},
+		{"with young as (select name, age from t where age < 30) select y1.name from young y1 join young y2 on y1.age = y2.age where y2.name = 'riza'", []string{"ang", "riza"}},
+		{"with young as (select name from t where age < 30) select name from t2 where name in (select name from young)", []string{"ang", "riza", "riza", "sam", "sam"}},
+		{"with young as (select name from t where age < 25) select name from young union select name from t where age > 90", []string{"ang", "bo", "riza", "sam"}},
+	}
+	for _, tc := range cases {
+		names := queryNames(t, c, bp, tc.sql)
+		if !reflect.DeepEqual(names, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.sql, tc.expected, names)
+		}
+	}
+
+	// a common table expression referenced more than once is materialized
+	_, plan, err := Parse(c, "with young as (select name, age from t where age < 30) select y1.name from young y1 join young y2 on y1.age = y2.age")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	scan := plan.(*Project).child.(*EqualityJoin[int64])
+	if cte := (*scan.left).(*cteScan).cte; cte.refs != 2 {
+		t.Errorf("expected two references to young, got %d", cte.refs)
+	}
+
+	for _, sql := range []string{
+		"with a(x, y) as (select name from t) select x from a",
+		"with a as (select name from t), a as (select age from t) select name from a",
+		"with a as select name from t select name from a",
+	} {
+		if _, _, err := Parse(c, sql); err == nil {
+			t.Errorf("expected '%s' to fail", sql)
+		}
+	}
+}
+
+func TestParseRecursiveCTEs(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+
+	// the chain of people each 2 years older than the previous one, from pat
+	res := runParsedQuery(t, c, bp, "with recursive chain(name, age, depth) as (select name, age, 1 from t where name = 'pat' union all select t.name, t.age, chain.depth + 1 from t join chain on t.age = chain.age + 2) select name, depth from chain")
+	got := make(map[string]int64)
+	for _, tup := range res {
+		got[tup.Fields[0].(StringField).Value] = tup.Fields[1].(IntField).Value
+	}
+	if !reflect.DeepEqual(got, map[string]int64{"pat": 1, "joe": 2}) {
+		t.Errorf("unexpected recursive result %v", got)
+	}
+
+	// people of the same age reach each other; union removes duplicates, so
+	// the recursion terminates although reachability is cyclic
+	names := queryNames(t, c, bp, "with recursive reach(name, age) as (select name, age from t where name = 'ang' union select t.name, t.age from t join reach on t.age = reach.age) select name from reach")
+	if !reflect.DeepEqual(names, []string{"ang", "riza"}) {
+		t.Errorf("unexpected reachable names %v", names)
+	}
+
+	// without removing duplicates, a cycle never ends
+	defer func(depth int) { MaxRecursionDepth = depth }(MaxRecursionDepth)
+	MaxRecursionDepth = 20
+	_, plan, err := Parse(c, "with recursive loop(age) as (select age from t where name = 'ang' union all select loop.age from loop join t on loop.age = t.age where t.name = 'ang') select age from loop")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+	iter, err := plan.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for {
+		var tup *Tuple
+		tup, err = iter()
+		if err != nil || tup == nil {
+			break
+		}
+	}
+	if err == nil {
+		t.Errorf("expected non-terminating recursion to fail")
+	}
+}
+
+func TestParseConditionalExprs(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+
+	res := runParsedQuery(t, c, bp, "select name, age, case when age >= 60 then 'old' when age >= 40 then 'middle' else 'young' end, case name when 'sam' then 1 when 'bo' then 2 end, if(age > 30 and not name = 'joe', age, 0), coalesce(nullif(name, 'sam'), 'anon') from t")
+	expected := map[int64][]any{
+		25: {"young", int64(1), int64(0), "anon"},
+		40: {"middle", int64(0), int64(0), "joe"},
+		60: {"old", int64(0), int64(60), "sarah"},
+	}
+	for _, tup := range res {
+		e, ok := expected[tup.Fields[1].(IntField).Value]
+		if !ok {
+			continue
+		}
+		got := []any{tup.Fields[2].(StringField).Value, tup.Fields[3].(IntField).Value, tup.Fields[4].(IntField).Value, tup.Fields[5].(StringField).Value}
+		if !reflect.DeepEqual(got, e) {
+			t.Errorf("%v: expected %v, got %v", tup.Fields[:2], e, got)
+		}
+	}
+
+	// conditional expressions in where, group by and order by
+	names := queryNames(t, c, bp, "select name from t where case when age > 50 then name else '' end <> ''")
+	if !reflect.DeepEqual(names, []string{"bo", "sam", "sarah"}) {
+		t.Errorf("unexpected names %v", names)
+	}
+	res = runParsedQuery(t, c, bp, "select case when age >= 40 then 'old' else 'young' end grp, count(*) from t group by grp order by grp")
+	if len(res) != 2 || res[0].Fields[0].(StringField).Value != "old" || res[0].Fields[1].(IntField).Value != 7 || res[1].Fields[1].(IntField).Value != 5 {
+		t.Errorf("unexpected groups %v", res)
+	}
+	res = runParsedQuery(t, c, bp, "select name, age from t order by case when name = 'joe' then 0 else 1 end, age limit 2")
+	if len(res) != 2 || res[0].Fields[0].(StringField).Value != "joe" || res[1].Fields[1].(IntField).Value != 22 {
+		t.Errorf("unexpected order %v", res)
+	}
+
+	for _, sql := range []string{
+		"select case when age > 1 then 1 else 'x' end from t",
+		"select case when name then 1 end from t",
+		"select coalesce(name, age) from t",
+		"select nullif(age) from t",
+		"select age in (1, 2) from t",
+	} {
+		if _, _, err := Parse(c, sql); err == nil {
+			t.Errorf("expected '%s' to fail", sql)
+		}
+	}
+}
+
+func TestParseLimitOffset(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+
+	all := runParsedQuery(t, c, bp, "select name, age from t order by age, name")
+	for _, sql := range []string{
+		"select name, age from t order by age, name limit 3 offset 2",
+		"select name, age from t order by age, name limit 2, 3",
+	} {
+		res := runParsedQuery(t, c, bp, sql)
+		if len(res) != 3 {
+			t.Fatalf("%s: expected 3 tuples, got %d", sql, len(res))
+		}
+		for i, tup := range res {
+			if !tup.equals(all[i+2]) {
+				t.Errorf("%s: tuple %d is %v, expected %v", sql, i, tup, all[i+2])
+			}
+		}
+	}
+
+	// keyset pagination: the page after the third tuple
+	sql := fmt.Sprintf("select name, age from t where age > %d order by age, name limit 2", all[2].Fields[1].(IntField).Value)
+	res := runParsedQuery(t, c, bp, sql)
+	if len(res) != 2 || res[0].Fields[1].(IntField).Value <= all[2].Fields[1].(IntField).Value {
+		t.Errorf("unexpected page %v", res)
+	}
+
+	if res := runParsedQuery(t, c, bp, "select name from t union select name from t limit 10 offset 100"); len(res) != 0 {
+		t.Errorf("expected no tuples past the end, got %d", len(res))
+	}
+
+	for _, sql := range []string{
+		"select name from t limit 2 offset -1",
+		"select name from t limit 2 offset 'x'",
+		"select name from t limit 2 offset age",
+	} {
+		if _, _, err := Parse(c, sql); err == nil {
+			t.Errorf("expected '%s' to fail", sql)
+		}
+	}
+}
@@ -0,0 +1,701 @@
+package pgserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/srmadden/godb"
+)
+
+// pgError is an error reported to the client with a SQLSTATE code of its
+// own.
+type pgError struct {
+	state string
+	msg   string
+}
+
+func (e pgError) Error() string {
+	return e.msg
+}
+
+// statement is a statement of the extended query protocol.  Data definition
+// statements, which cannot be prepared, are parsed again each time they are
+// executed, and so are empty queries.
+type statement struct {
+	query string
+	cmd   command
+	stmt  *godb.Stmt // nil if the statement is not prepared
+}
+
+// Return the types of the parameters of the statement.
+func (st *statement) paramTypes() []godb.DBType {
+	if st.stmt == nil {
+		return nil
+	}
+	return st.stmt.ParamTypes()
+}
+
+// Return the descriptor of the rows the statement returns, or nil if it
+// returns none.
+func (st *statement) descriptor() *godb.TupleDesc {
+	if st.stmt == nil || !st.cmd.rows {
+		return nil
+	}
+	return st.stmt.Descriptor()
+}
+
+// portal is a statement bound to parameters, whose rows are read by
+// Execute messages.
+type portal struct {
+	st      *statement
+	args    []any
+	formats []int16 // formats of the columns
+	rows    *godb.Rows
+	cancel  context.CancelFunc // of the context of rows
+	count   int64              // rows returned so far
+}
+
+func (p *portal) close() {
+	if p.rows != nil {
+		p.rows.Close()
+		p.cancel()
+		p.rows = nil
+	}
+}
+
+// conn is a connection of a client, which runs its statements in a session.
+type conn struct {
+	srv     *Server
+	nc      net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	pid     int32
+	secret  int32
+	session *godb.Session
+	stmts   map[string]*statement
+	portals map[string]*portal
+	failed  bool // an extended query failed, so messages are skipped until Sync
+
+	mutex  sync.Mutex         // guards cancel
+	cancel context.CancelFunc // of the statement that last started
+}
+
+func newConn(srv *Server, nc net.Conn, pid int32, secret int32) *conn {
+	return &conn{
+		srv:     srv,
+		nc:      nc,
+		r:       bufio.NewReader(nc),
+		w:       bufio.NewWriter(nc),
+		pid:     pid,
+		secret:  secret,
+		stmts:   make(map[string]*statement),
+		portals: make(map[string]*portal),
+	}
+}
+
+// Serve the connection until the client terminates it or it fails.
+func (c *conn) serve() {
+	defer func() {
+		for _, p := range c.portals {
+			p.close()
+		}
+		if c.session != nil {
+			c.session.Close()
+		}
+		c.nc.Close()
+		c.srv.removeConn(c)
+	}()
+	if err := c.startup(); err != nil {
+		return
+	}
+	c.session = c.srv.db.NewSession()
+	if err := c.sendStartup(); err != nil {
+		return
+	}
+	for {
+		m, err := readMessage(c.r, true)
+		if err != nil {
+			return
+		}
+		if c.failed && m.typ != msgSync && m.typ != msgTerminate {
+			continue
+		}
+		switch m.typ {
+		case msgQuery:
+			err = c.simpleQuery(m)
+		case msgParse:
+			err = c.parse(m)
+		case msgBind:
+			err = c.bind(m)
+		case msgDescribe:
+			err = c.describe(m)
+		case msgExecute:
+			err = c.execute(m)
+		case msgClose:
+			err = c.close(m)
+		case msgSync:
+			err = c.sync()
+		case msgFlush:
+			err = c.w.Flush()
+		case msgTerminate:
+			return
+		default:
+			err = fmt.Errorf("%w: unknown message type %q", errProtocol, m.typ)
+		}
+		if errors.Is(err, errProtocol) {
+			writeMessage(c.w, fatalMessage("08P01", err.Error()))
+			c.w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read the startup message, answering requests for SSL, which is not
+// supported, and serving cancel requests, after which the connection is
+// closed.
+func (c *conn) startup() error {
+	for {
+		m, err := readMessage(c.r, false)
+		if err != nil {
+			return err
+		}
+		code := m.readInt32()
+		switch code {
+		case sslRequestCode, gssRequestCode:
+			if _, err := c.nc.Write([]byte{'N'}); err != nil {
+				return err
+			}
+		case cancelCode:
+			pid, secret := m.readInt32(), m.readInt32()
+			if m.err == nil {
+				c.srv.cancelRequest(pid, secret)
+			}
+			return errors.New("cancel request")
+		case protocolVersion:
+			// the parameters, e.g., user and database, are ignored
+			for m.err == nil && m.readString() != "" {
+			}
+			return m.err
+		default:
+			writeMessage(c.w, fatalMessage("0A000", fmt.Sprintf("unsupported frontend protocol %d.%d", code>>16, code&0xffff)))
+			c.w.Flush()
+			return errProtocol
+		}
+	}
+}
+
+// Tell the client the connection is ready.
+func (c *conn) sendStartup() error {
+	writeMessage(c.w, newMessage(msgAuthentication).int32(0))
+	for _, p := range [][2]string{
+		{"server_version", "14.0"},
+		{"server_encoding", "UTF8"},
+		{"client_encoding", "UTF8"},
+		{"DateStyle", "ISO, MDY"},
+		{"integer_datetimes", "on"},
+		{"standard_conforming_strings", "on"},
+	} {
+		writeMessage(c.w, newMessage(msgParameterStatus).string(p[0]).string(p[1]))
+	}
+	writeMessage(c.w, newMessage(msgBackendKeyData).int32(c.pid).int32(c.secret))
+	return c.readyForQuery()
+}
+
+func (c *conn) readyForQuery() error {
+	status := byte('I')
+	if c.session.InTransaction() {
+		status = 'T'
+	}
+	writeMessage(c.w, newMessage(msgReadyForQuery).bytes([]byte{status}))
+	return c.w.Flush()
+}
+
+// Return the context of a statement that is starting, which a cancel
+// request cancels.
+func (c *conn) startStatement() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(c.srv.ctx)
+	c.mutex.Lock()
+	c.cancel = cancel
+	c.mutex.Unlock()
+	return ctx, cancel
+}
+
+// Cancel the statement that last started, if it is still running.
+func (c *conn) cancelStatement() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+// Report an error of an extended query, after which messages are skipped
+// until Sync.  The error is sent at once, as a Flush would be skipped.
+func (c *conn) extendedError(err error) error {
+	c.failed = true
+	writeMessage(c.w, errorMessage(err))
+	return c.w.Flush()
+}
+
+// Run the statements of a Query message, stopping at the first that fails.
+func (c *conn) simpleQuery(m *message) error {
+	text := m.readString()
+	if m.err != nil {
+		return m.err
+	}
+	queries := splitStatements(text)
+	if len(queries) == 0 {
+		writeMessage(c.w, newMessage(msgEmptyQueryResponse))
+	}
+	for _, query := range queries {
+		if err := c.runSimple(query); err != nil {
+			if !isSQLError(err) {
+				return err
+			}
+			writeMessage(c.w, errorMessage(err))
+			break
+		}
+	}
+	return c.readyForQuery()
+}
+
+// sqlError is an error of a statement, which is reported to the client,
+// unlike an error writing to the connection, which closes it.
+type sqlError struct {
+	err error
+}
+
+func (e sqlError) Error() string {
+	return e.err.Error()
+}
+
+func (e sqlError) Unwrap() error {
+	return e.err
+}
+
+func isSQLError(err error) bool {
+	var serr sqlError
+	return errors.As(err, &serr)
+}
+
+func (c *conn) runSimple(query string) error {
+	ctx, cancel := c.startStatement()
+	defer cancel()
+	rows, err := c.session.QueryContext(ctx, query)
+	if err != nil {
+		return sqlError{err}
+	}
+	defer rows.Close()
+	cmd := commandOf(query)
+	if cmd.rows {
+		if cols := rows.Columns(); cols != nil {
+			writeMessage(c.w, rowDescription(cols, rows.ColumnTypes(), nil))
+		}
+	}
+	p := &portal{st: &statement{query: query, cmd: cmd}, rows: rows, cancel: cancel}
+	_, err = c.sendRows(p, 0)
+	return err
+}
+
+// Send up to max rows of a portal, or all of them if max is 0, followed by
+// CommandComplete, or by PortalSuspended if rows remain.  Return true if
+// the portal is suspended.
+func (c *conn) sendRows(p *portal, max int32) (bool, error) {
+	for sent := int32(0); max <= 0 || sent < max; {
+		if !p.rows.Next() {
+			if err := p.rows.Err(); err != nil {
+				return false, sqlError{err}
+			}
+			writeMessage(c.w, newMessage(msgCommandComplete).string(p.st.cmd.tagFor(p.count)))
+			return false, nil
+		}
+		tup := p.rows.Tuple()
+		if !p.st.cmd.rows {
+			// the number of tuples inserted or deleted
+			if n, ok := tup.Fields[0].(godb.IntField); ok {
+				p.count = n.Value
+			}
+			continue
+		}
+		if err := writeMessage(c.w, dataRow(tup, p.formats)); err != nil {
+			return false, err
+		}
+		p.count++
+		sent++
+	}
+	writeMessage(c.w, newMessage(msgPortalSuspended))
+	return true, nil
+}
+
+// Prepare a statement, replacing the statement of the same name if it is
+// unnamed.  The types the client gives the parameters are ignored, in favor
+// of those inferred by GoDB, which Describe returns.
+func (c *conn) parse(m *message) error {
+	name, query := m.readString(), m.readString()
+	if m.err != nil {
+		return m.err
+	}
+	if _, ok := c.stmts[name]; ok && name != "" {
+		return c.extendedError(pgError{"42P05", fmt.Sprintf("prepared statement %q already exists", name)})
+	}
+	query = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(query), ";"))
+	st := &statement{query: query, cmd: commandOf(query)}
+	if query != "" && st.cmd.prepare {
+		var err error
+		if st.stmt, err = c.srv.db.Prepare(query); err != nil {
+			return c.extendedError(err)
+		}
+	}
+	c.stmts[name] = st
+	return writeMessage(c.w, newMessage(msgParseComplete))
+}
+
+// Bind the parameters of a statement, creating a portal, which replaces the
+// portal of the same name if it is unnamed.
+func (c *conn) bind(m *message) error {
+	portalName, stmtName := m.readString(), m.readString()
+	paramFormats := readFormats(m)
+	nparams := int(m.readInt16())
+	values := make([][]byte, nparams)
+	for i := range values {
+		if n := m.readInt32(); n >= 0 {
+			values[i] = m.readBytes(int(n))
+		}
+	}
+	resultFormats := readFormats(m)
+	if m.err != nil {
+		return m.err
+	}
+	st, ok := c.stmts[stmtName]
+	if !ok {
+		return c.extendedError(pgError{"26000", fmt.Sprintf("prepared statement %q does not exist", stmtName)})
+	}
+	if old, ok := c.portals[portalName]; ok {
+		if portalName != "" {
+			return c.extendedError(pgError{"42P03", fmt.Sprintf("portal %q already exists", portalName)})
+		}
+		old.close()
+	}
+	types := st.paramTypes()
+	if nparams != len(types) {
+		return c.extendedError(pgError{"08P01", fmt.Sprintf("statement has %d parameters, got %d values", len(types), nparams)})
+	}
+	args := make([]any, nparams)
+	for i, v := range values {
+		format, err := formatOf(paramFormats, i)
+		if err != nil {
+			return c.extendedError(err)
+		}
+		if args[i], err = decodeParam(v, types[i], format); err != nil {
+			return c.extendedError(err)
+		}
+	}
+	p := &portal{st: st, args: args}
+	if desc := st.descriptor(); desc != nil {
+		p.formats = make([]int16, len(desc.Fields))
+		for i := range p.formats {
+			format, err := formatOf(resultFormats, i)
+			if err != nil {
+				return c.extendedError(err)
+			}
+			p.formats[i] = format
+		}
+	}
+	c.portals[portalName] = p
+	return writeMessage(c.w, newMessage(msgBindComplete))
+}
+
+// Read a list of format codes.
+func readFormats(m *message) []int16 {
+	formats := make([]int16, m.readInt16())
+	for i := range formats {
+		formats[i] = m.readInt16()
+	}
+	return formats
+}
+
+// Return the format of the i-th of a list of values, which have the formats
+// of formats: none, if all are text, one, shared by all, or one per value.
+func formatOf(formats []int16, i int) (int16, error) {
+	var format int16
+	switch {
+	case len(formats) == 0:
+		format = formatText
+	case len(formats) == 1:
+		format = formats[0]
+	case i < len(formats):
+		format = formats[i]
+	default:
+		return 0, pgError{"08P01", fmt.Sprintf("no format given for value %d", i+1)}
+	}
+	if format != formatText && format != formatBinary {
+		return 0, pgError{"08P01", fmt.Sprintf("unsupported format code %d", format)}
+	}
+	return format, nil
+}
+
+// Return the value of a parameter of type t sent by the client in format.
+func decodeParam(v []byte, t godb.DBType, format int16) (any, error) {
+	if v == nil {
+		return nil, pgError{"22004", "null parameters are not supported"}
+	}
+	if t == godb.StringType {
+		return string(v), nil
+	}
+	if format == formatText {
+		n, err := strconv.ParseInt(strings.TrimSpace(string(v)), 10, 64)
+		if err != nil {
+			return nil, pgError{"22P02", fmt.Sprintf("invalid input syntax for type bigint: %q", v)}
+		}
+		return n, nil
+	}
+	switch len(v) {
+	case 2:
+		return int64(int16(binary.BigEndian.Uint16(v))), nil
+	case 4:
+		return int64(int32(binary.BigEndian.Uint32(v))), nil
+	case 8:
+		return int64(binary.BigEndian.Uint64(v)), nil
+	}
+	return nil, pgError{"22P03", fmt.Sprintf("invalid binary integer of %d bytes", len(v))} // invalid_binary_representation
+}
+
+// Describe the parameters and rows of a statement, or the rows of a portal.
+func (c *conn) describe(m *message) error {
+	kind, name := m.readBytes(1), m.readString()
+	if m.err != nil {
+		return m.err
+	}
+	var desc *godb.TupleDesc
+	var formats []int16
+	switch kind[0] {
+	case 'S':
+		st, ok := c.stmts[name]
+		if !ok {
+			return c.extendedError(pgError{"26000", fmt.Sprintf("prepared statement %q does not exist", name)})
+		}
+		types := st.paramTypes()
+		pd := newMessage(msgParameterDescription).int16(int16(len(types)))
+		for _, t := range types {
+			oid, _ := typeOID(t)
+			pd.int32(oid)
+		}
+		writeMessage(c.w, pd)
+		desc = st.descriptor()
+	case 'P':
+		p, ok := c.portals[name]
+		if !ok {
+			return c.extendedError(pgError{"34000", fmt.Sprintf("portal %q does not exist", name)})
+		}
+		desc, formats = p.st.descriptor(), p.formats
+	default:
+		return fmt.Errorf("%w: invalid Describe kind %q", errProtocol, kind[0])
+	}
+	if desc == nil {
+		return writeMessage(c.w, newMessage(msgNoData))
+	}
+	names := make([]string, len(desc.Fields))
+	types := make([]godb.DBType, len(desc.Fields))
+	for i, f := range desc.Fields {
+		names[i], types[i] = f.Fname, f.Ftype
+	}
+	return writeMessage(c.w, rowDescription(names, types, formats))
+}
+
+// Run a portal, or continue a suspended one, sending up to the number of
+// rows the client asked for.
+func (c *conn) execute(m *message) error {
+	name, max := m.readString(), m.readInt32()
+	if m.err != nil {
+		return m.err
+	}
+	p, ok := c.portals[name]
+	if !ok {
+		return c.extendedError(pgError{"34000", fmt.Sprintf("portal %q does not exist", name)})
+	}
+	if p.st.query == "" {
+		return writeMessage(c.w, newMessage(msgEmptyQueryResponse))
+	}
+	if p.rows == nil {
+		ctx, cancel := c.startStatement()
+		var rows *godb.Rows
+		var err error
+		if p.st.stmt != nil {
+			rows, err = c.session.QueryStmt(ctx, p.st.stmt, p.args...)
+		} else {
+			rows, err = c.session.QueryContext(ctx, p.st.query)
+		}
+		if err != nil {
+			cancel()
+			return c.extendedError(err)
+		}
+		p.rows, p.cancel, p.count = rows, cancel, 0
+	}
+	suspended, err := c.sendRows(p, max)
+	if !suspended {
+		p.close()
+	}
+	if isSQLError(err) {
+		return c.extendedError(err)
+	}
+	return err
+}
+
+// Close a statement or a portal.
+func (c *conn) close(m *message) error {
+	kind, name := m.readBytes(1), m.readString()
+	if m.err != nil {
+		return m.err
+	}
+	switch kind[0] {
+	case 'S':
+		delete(c.stmts, name)
+	case 'P':
+		if p, ok := c.portals[name]; ok {
+			p.close()
+			delete(c.portals, name)
+		}
+	default:
+		return fmt.Errorf("%w: invalid Close kind %q", errProtocol, kind[0])
+	}
+	return writeMessage(c.w, newMessage(msgCloseComplete))
+}
+
+// End an extended query.  Outside of a transaction, the portals are closed,
+// which commits the transactions of their statements.
+func (c *conn) sync() error {
+	c.failed = false
+	if !c.session.InTransaction() {
+		for name, p := range c.portals {
+			p.close()
+			delete(c.portals, name)
+		}
+	}
+	return c.readyForQuery()
+}
+
+// Return a RowDescription of columns with the given names and types, sent
+// in formats (see formatOf).
+func rowDescription(names []string, types []godb.DBType, formats []int16) *message {
+	m := newMessage(msgRowDescription).int16(int16(len(names)))
+	for i, name := range names {
+		oid, size := typeOID(types[i])
+		format := int16(formatText)
+		if i < len(formats) {
+			format = formats[i]
+		}
+		m.string(name).int32(0).int16(0).int32(oid).int16(size).int32(-1).int16(format)
+	}
+	return m
+}
+
+// Return a DataRow of the fields of tup, sent in formats.
+func dataRow(tup *godb.Tuple, formats []int16) *message {
+	m := newMessage(msgDataRow).int16(int16(len(tup.Fields)))
+	for i, f := range tup.Fields {
+		var v []byte
+		switch f := f.(type) {
+		case godb.IntField:
+			if i < len(formats) && formats[i] == formatBinary {
+				v = binaryInt(f.Value)
+			} else {
+				v = strconv.AppendInt(nil, f.Value, 10)
+			}
+		case godb.StringField:
+			v = []byte(f.Value)
+		default:
+			v = []byte(fmt.Sprint(f))
+		}
+		m.int32(int32(len(v))).bytes(v)
+	}
+	return m
+}
+
+func binaryInt(n int64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(n))
+	return b[:]
+}
+
+// command is the kind of a statement, which determines the tag of its
+// CommandComplete message.
+type command struct {
+	tag     string // with %d for the number of rows, if any
+	rows    bool   // the statement returns rows, rather than a count
+	prepare bool   // the statement can be prepared
+}
+
+// Return the command of a statement, from its first keyword.
+func commandOf(query string) command {
+	word := strings.ToLower(strings.TrimLeft(query, " \t\r\n("))
+	if i := strings.IndexFunc(word, func(r rune) bool { return !unicode.IsLetter(r) }); i >= 0 {
+		word = word[:i]
+	}
+	switch word {
+	case "insert":
+		return command{"INSERT 0 %d", false, true}
+	case "delete":
+		return command{"DELETE %d", false, true}
+	case "begin", "start":
+		return command{"BEGIN", false, true}
+	case "commit", "end":
+		return command{"COMMIT", false, true}
+	case "rollback", "abort":
+		return command{"ROLLBACK", false, true}
+	case "create":
+		return command{"CREATE TABLE", false, false}
+	case "drop":
+		return command{"DROP TABLE", false, false}
+	}
+	return command{"SELECT %d", true, true}
+}
+
+// Return the tag of the command once it has returned or changed n rows.
+func (cmd command) tagFor(n int64) string {
+	if strings.Contains(cmd.tag, "%d") {
+		return fmt.Sprintf(cmd.tag, n)
+	}
+	return cmd.tag
+}
+
+// Split the text of a Query message into statements separated by
+// semicolons outside of quotes, dropping empty statements.
+func splitStatements(text string) []string {
+	var stmts []string
+	start := 0
+	var quote byte
+	for i := 0; i <= len(text); i++ {
+		if i < len(text) {
+			ch := text[i]
+			if quote != 0 {
+				if ch == quote {
+					quote = 0
+				}
+				continue
+			}
+			if ch == '\'' || ch == '"' || ch == '`' {
+				quote = ch
+				continue
+			}
+			if ch != ';' {
+				continue
+			}
+		}
+		if stmt := strings.TrimSpace(text[start:i]); stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+		start = i + 1
+	}
+	return stmts
+}
@@ -0,0 +1,243 @@
+package pgserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/srmadden/godb"
+)
+
+// Codes of the messages of version 3.0 of the protocol.
+const (
+	// sent by the frontend
+	msgBind      = 'B'
+	msgClose     = 'C'
+	msgDescribe  = 'D'
+	msgExecute   = 'E'
+	msgFlush     = 'H'
+	msgParse     = 'P'
+	msgQuery     = 'Q'
+	msgSync      = 'S'
+	msgTerminate = 'X'
+
+	// sent by the backend
+	msgAuthentication       = 'R'
+	msgBackendKeyData       = 'K'
+	msgBindComplete         = '2'
+	msgCloseComplete        = '3'
+	msgCommandComplete      = 'C'
+	msgDataRow              = 'D'
+	msgEmptyQueryResponse   = 'I'
+	msgErrorResponse        = 'E'
+	msgNoData               = 'n'
+	msgParameterDescription = 't'
+	msgParameterStatus      = 'S'
+	msgParseComplete        = '1'
+	msgPortalSuspended      = 's'
+	msgReadyForQuery        = 'Z'
+	msgRowDescription       = 'T'
+)
+
+// Codes of the untyped messages a connection starts with.
+const (
+	protocolVersion = 196608 // 3.0
+	sslRequestCode  = 80877103
+	gssRequestCode  = 80877104
+	cancelCode      = 80877102
+)
+
+// Object ids of the types of columns and parameters.
+const (
+	oidInt8 = 20
+	oidText = 25
+)
+
+// Formats of parameters and columns.
+const (
+	formatText   = 0
+	formatBinary = 1
+)
+
+// The longest message accepted from a client.
+const maxMessageSize = 1 << 24
+
+var errProtocol = errors.New("pgserver: protocol violation")
+
+// Return the object id and size of a type, as sent in a RowDescription.
+func typeOID(t godb.DBType) (int32, int16) {
+	if t == godb.IntType {
+		return oidInt8, 8
+	}
+	return oidText, -1
+}
+
+// message is a message being written, or one that was read and whose fields
+// are consumed in order.
+type message struct {
+	typ  byte
+	data []byte
+	err  error // set once a read runs past the end of the message
+}
+
+func newMessage(typ byte) *message {
+	return &message{typ: typ}
+}
+
+func (m *message) int16(v int16) *message {
+	m.data = binary.BigEndian.AppendUint16(m.data, uint16(v))
+	return m
+}
+
+func (m *message) int32(v int32) *message {
+	m.data = binary.BigEndian.AppendUint32(m.data, uint32(v))
+	return m
+}
+
+func (m *message) bytes(b []byte) *message {
+	m.data = append(m.data, b...)
+	return m
+}
+
+func (m *message) string(s string) *message {
+	m.data = append(append(m.data, s...), 0)
+	return m
+}
+
+func (m *message) readInt16() int16 {
+	if len(m.data) < 2 {
+		m.err = errProtocol
+		return 0
+	}
+	v := int16(binary.BigEndian.Uint16(m.data))
+	m.data = m.data[2:]
+	return v
+}
+
+func (m *message) readInt32() int32 {
+	if len(m.data) < 4 {
+		m.err = errProtocol
+		return 0
+	}
+	v := int32(binary.BigEndian.Uint32(m.data))
+	m.data = m.data[4:]
+	return v
+}
+
+func (m *message) readBytes(n int) []byte {
+	if n < 0 || len(m.data) < n {
+		m.err = errProtocol
+		return nil
+	}
+	b := m.data[:n]
+	m.data = m.data[n:]
+	return b
+}
+
+func (m *message) readString() string {
+	i := strings.IndexByte(string(m.data), 0)
+	if i < 0 {
+		m.err = errProtocol
+		return ""
+	}
+	s := string(m.data[:i])
+	m.data = m.data[i+1:]
+	return s
+}
+
+// Read a message with a type, or, if typed is false, one of the untyped
+// messages a connection starts with.
+func readMessage(r *bufio.Reader, typed bool) (*message, error) {
+	m := &message{}
+	if typed {
+		typ, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		m.typ = typ
+	}
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint32(header[:]))
+	if size < 4 || size > maxMessageSize {
+		return nil, fmt.Errorf("pgserver: invalid message size %d", size)
+	}
+	m.data = make([]byte, size-4)
+	if _, err := io.ReadFull(r, m.data); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Write a message, which is only sent once w is flushed.
+func writeMessage(w *bufio.Writer, m *message) error {
+	w.WriteByte(m.typ)
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(m.data)+4))
+	w.Write(header[:])
+	_, err := w.Write(m.data)
+	return err
+}
+
+// SQLSTATE codes of the errors of GoDB.
+var sqlStates = map[godb.GoDBErrorCode]string{
+	godb.TupleNotFoundError:      "02000", // no_data
+	godb.PageFullError:           "53000", // insufficient_resources
+	godb.IncompatibleTypesError:  "42804", // datatype_mismatch
+	godb.TypeMismatchError:       "42804",
+	godb.MalformedDataError:      "22P02", // invalid_text_representation
+	godb.BufferPoolFullError:     "53000",
+	godb.ParseError:              "42601", // syntax_error
+	godb.DuplicateTableError:     "42P07", // duplicate_table
+	godb.NoSuchTableError:        "42P01", // undefined_table
+	godb.AmbiguousNameError:      "42702", // ambiguous_column
+	godb.IllegalOperationError:   "55000", // object_not_in_prerequisite_state
+	godb.DeadlockError:           "40P01", // deadlock_detected
+	godb.IllegalTransactionError: "25000", // invalid_transaction_state
+	godb.DuplicateFunctionError:  "42723", // duplicate_function
+	godb.QueryCancelledError:     "57014", // query_canceled
+	godb.MemoryLimitError:        "53200", // out_of_memory
+}
+
+// Return the SQLSTATE code and message of an error.
+func sqlState(err error) (string, string) {
+	var perr pgError
+	if errors.As(err, &perr) {
+		return perr.state, perr.msg
+	}
+	var gerr godb.GoDBError
+	if errors.As(err, &gerr) {
+		if state, ok := sqlStates[gerr.Code()]; ok {
+			return state, gerr.Message()
+		}
+		return "XX000", gerr.Message()
+	}
+	return "XX000", err.Error() // internal_error
+}
+
+// Return an ErrorResponse for err.
+func errorMessage(err error) *message {
+	state, msg := sqlState(err)
+	m := newMessage(msgErrorResponse)
+	m.bytes([]byte{'S'}).string("ERROR")
+	m.bytes([]byte{'V'}).string("ERROR")
+	m.bytes([]byte{'C'}).string(state)
+	m.bytes([]byte{'M'}).string(msg)
+	return m.bytes([]byte{0})
+}
+
+// Return an ErrorResponse for a fatal error, after which the connection is
+// closed.
+func fatalMessage(state string, msg string) *message {
+	m := newMessage(msgErrorResponse)
+	m.bytes([]byte{'S'}).string("FATAL")
+	m.bytes([]byte{'V'}).string("FATAL")
+	m.bytes([]byte{'C'}).string(state)
+	m.bytes([]byte{'M'}).string(msg)
+	return m.bytes([]byte{0})
+}
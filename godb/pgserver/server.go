@@ -0,0 +1,157 @@
+// Package pgserver serves a GoDB database to clients of PostgreSQL, such as
+// psql and the standard client libraries, over version 3.0 of the
+// PostgreSQL frontend/backend protocol.
+//
+// Both the simple query protocol and the extended query protocol (Parse,
+// Bind, Describe, Execute) are supported.  Statements sent with the extended
+// protocol are prepared with [godb.Prepare], so that their plans are reused
+// each time they are bound; their parameters are sent as int8 or text,
+// according to the types GoDB infers for them.  Columns are described as
+// int8 or text.  Errors carry the SQLSTATE code of the closest PostgreSQL
+// error, e.g., 57014 for a query cancelled with a cancel request.
+//
+// Each connection is a [godb.Session], with its own transaction.  Clients
+// are not authenticated, and SSL is not supported.
+package pgserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/srmadden/godb"
+)
+
+// ErrServerClosed is returned by [Server.Serve] once the server is closed.
+var ErrServerClosed = errors.New("pgserver: server closed")
+
+// Server serves a database to the clients that connect to it.
+type Server struct {
+	db     *godb.DB
+	ctx    context.Context // cancelled when the server is closed
+	cancel context.CancelFunc
+
+	mutex     sync.Mutex // guards the fields below
+	listeners map[net.Listener]bool
+	conns     map[int32]*conn // by process id
+	nextPID   int32
+	closed    bool
+}
+
+// Return a server of db.
+func NewServer(db *godb.DB) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		db:        db,
+		ctx:       ctx,
+		cancel:    cancel,
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[int32]*conn),
+		nextPID:   1,
+	}
+}
+
+// Listen on the TCP address addr and serve the connections to it, as
+// [Server.Serve] does.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve the connections accepted by l, each in its own goroutine, until the
+// server is closed, in which case ErrServerClosed is returned, or l fails.
+// l is closed when Serve returns.
+func (s *Server) Serve(l net.Listener) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = true
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.listeners, l)
+		s.mutex.Unlock()
+		l.Close()
+	}()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				continue
+			}
+			return err
+		}
+		c := s.newConn(nc)
+		if c == nil {
+			nc.Close()
+			continue
+		}
+		go c.serve()
+	}
+}
+
+// Stop accepting connections, cancel the statements that are running, and
+// close the connections.  Their transactions are rolled back.
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for _, c := range s.conns {
+		c.nc.Close()
+	}
+	s.mutex.Unlock()
+	s.cancel()
+	return nil
+}
+
+// Register a connection, giving it a process id and secret key with which
+// its statements may be cancelled.  Return nil if the server is closed.
+func (s *Server) newConn(nc net.Conn) *conn {
+	var key [4]byte
+	rand.Read(key[:])
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil
+	}
+	c := newConn(s, nc, s.nextPID, int32(binary.BigEndian.Uint32(key[:])))
+	s.conns[c.pid] = c
+	s.nextPID++
+	return c
+}
+
+func (s *Server) removeConn(c *conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.conns, c.pid)
+}
+
+// Cancel the statement running on the connection with process id pid, if
+// secret is its key.
+func (s *Server) cancelRequest(pid int32, secret int32) {
+	s.mutex.Lock()
+	c, ok := s.conns[pid]
+	s.mutex.Unlock()
+	if ok && c.secret == secret {
+		c.cancelStatement()
+	}
+}
@@ -0,0 +1,422 @@
+package pgserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/srmadden/godb"
+)
+
+// start a server of a database with a table t of names and ages, returning
+// its address
+func startTestServer(t *testing.T) string {
+	t.Helper()
+	db, err := godb.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, sql := range []string{
+		"create table t (name varchar(20), age int)",
+		"create table u (a int)",
+		"insert into t values ('sam', 20)",
+		"insert into t values ('kathy', 30)",
+		"insert into t values ('bill', 40)",
+	} {
+		if _, err := db.Exec(sql); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+	srv := NewServer(db)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+// testClient speaks the protocol to a server.
+type testClient struct {
+	t      *testing.T
+	nc     net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	pid    int32
+	secret int32
+}
+
+// connect to the server at addr, asking for SSL first, as psql does
+func connect(t *testing.T, addr string) *testClient {
+	t.Helper()
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	t.Cleanup(func() { nc.Close() })
+	c := &testClient{t: t, nc: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	c.sendUntyped(newMessage(0).int32(sslRequestCode))
+	if b, err := c.r.ReadByte(); err != nil || b != 'N' {
+		t.Fatalf("expected SSL to be refused, got %q, %v", b, err)
+	}
+	c.sendUntyped(newMessage(0).int32(protocolVersion).string("user").string("test").string(""))
+	for _, m := range c.receiveUntilReady() {
+		switch m.typ {
+		case msgBackendKeyData:
+			c.pid, c.secret = m.readInt32(), m.readInt32()
+		case msgErrorResponse:
+			t.Fatalf("startup failed: %v", fields(m))
+		}
+	}
+	return c
+}
+
+func (c *testClient) sendUntyped(m *message) {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(m.data)+4))
+	c.w.Write(header[:])
+	c.w.Write(m.data)
+	c.w.Flush()
+}
+
+func (c *testClient) send(msgs ...*message) {
+	for _, m := range msgs {
+		writeMessage(c.w, m)
+	}
+	c.w.Flush()
+}
+
+func (c *testClient) receive() *message {
+	c.t.Helper()
+	m, err := readMessage(c.r, true)
+	if err != nil {
+		c.t.Fatalf("expected a message, got %v", err)
+	}
+	return m
+}
+
+// receive messages up to ReadyForQuery, which is the last one returned
+func (c *testClient) receiveUntilReady() []*message {
+	c.t.Helper()
+	var msgs []*message
+	for {
+		m := c.receive()
+		msgs = append(msgs, m)
+		if m.typ == msgReadyForQuery {
+			return msgs
+		}
+	}
+}
+
+// return the types of messages, as a string
+func types(msgs []*message) string {
+	s := ""
+	for _, m := range msgs {
+		s += string(m.typ)
+	}
+	return s
+}
+
+// return the fields of an ErrorResponse, by code
+func fields(m *message) map[byte]string {
+	f := make(map[byte]string)
+	for {
+		code := m.readBytes(1)
+		if m.err != nil || code[0] == 0 {
+			return f
+		}
+		f[code[0]] = m.readString()
+	}
+}
+
+// return the values of a DataRow as strings
+func values(m *message) []string {
+	var vals []string
+	for i := m.readInt16(); i > 0; i-- {
+		vals = append(vals, string(m.readBytes(int(m.readInt32()))))
+	}
+	return vals
+}
+
+// return the names and type ids of the columns of a RowDescription
+func columns(m *message) ([]string, []int32) {
+	var names []string
+	var oids []int32
+	for i := m.readInt16(); i > 0; i-- {
+		names = append(names, m.readString())
+		m.readInt32()
+		m.readInt16()
+		oids = append(oids, m.readInt32())
+		m.readInt16()
+		m.readInt32()
+		m.readInt16()
+	}
+	return names, oids
+}
+
+// results is what a simple query returned.
+type results struct {
+	rows   [][]string
+	tags   []string
+	states []string // SQLSTATE codes of errors
+	status byte     // of ReadyForQuery
+}
+
+func (c *testClient) query(sql string) results {
+	c.t.Helper()
+	c.send(newMessage(msgQuery).string(sql))
+	var res results
+	for _, m := range c.receiveUntilReady() {
+		switch m.typ {
+		case msgDataRow:
+			res.rows = append(res.rows, values(m))
+		case msgCommandComplete:
+			res.tags = append(res.tags, m.readString())
+		case msgErrorResponse:
+			res.states = append(res.states, fields(m)['C'])
+		case msgReadyForQuery:
+			res.status = m.readBytes(1)[0]
+		}
+	}
+	return res
+}
+
+func TestSimpleQuery(t *testing.T) {
+	c := connect(t, startTestServer(t))
+
+	c.send(newMessage(msgQuery).string("select name, age from t where age > 25 order by age"))
+	msgs := c.receiveUntilReady()
+	if types(msgs) != "TDDCZ" {
+		t.Fatalf("expected a row description, 2 rows and a command tag, got %s", types(msgs))
+	}
+	names, oids := columns(msgs[0])
+	if !reflect.DeepEqual(names, []string{"name", "age"}) || !reflect.DeepEqual(oids, []int32{oidText, oidInt8}) {
+		t.Errorf("expected columns name text and age int8, got %v %v", names, oids)
+	}
+	if vals := values(msgs[1]); !reflect.DeepEqual(vals, []string{"kathy", "30"}) {
+		t.Errorf("expected kathy 30, got %v", vals)
+	}
+	if tag := msgs[3].readString(); tag != "SELECT 2" {
+		t.Errorf("expected SELECT 2, got %s", tag)
+	}
+
+	res := c.query("insert into t values ('ang', 50); delete from t where age > 45; select count(*) from t")
+	if !reflect.DeepEqual(res.tags, []string{"INSERT 0 1", "DELETE 1", "SELECT 1"}) || res.rows[0][0] != "3" {
+		t.Errorf("expected the statements to run in order, got %v %v", res.tags, res.rows)
+	}
+
+	// statements after one that fails are not run
+	res = c.query("select * from nosuchtable; insert into t values ('ang', 50)")
+	if !reflect.DeepEqual(res.states, []string{"42P01"}) || len(res.tags) != 0 {
+		t.Errorf("expected an undefined table error, got %v %v", res.states, res.tags)
+	}
+	if res = c.query("select nme from t"); len(res.states) != 1 {
+		t.Errorf("expected an error, got %v", res)
+	}
+	if res = c.query("selct 1"); !reflect.DeepEqual(res.states, []string{"42601"}) {
+		t.Errorf("expected a syntax error, got %v", res.states)
+	}
+
+	c.send(newMessage(msgQuery).string(" ; "))
+	if msgs := c.receiveUntilReady(); types(msgs) != "IZ" {
+		t.Errorf("expected an empty query response, got %s", types(msgs))
+	}
+}
+
+func TestSessions(t *testing.T) {
+	addr := startTestServer(t)
+	c1, c2 := connect(t, addr), connect(t, addr)
+
+	if res := c1.query("begin; insert into u values (1)"); res.status != 'T' || len(res.states) != 0 {
+		t.Fatalf("expected a transaction, got %v", res)
+	}
+	// the other session is not in the transaction
+	if res := c2.query("select name from t where age = 20"); res.status != 'I' || len(res.rows) != 1 {
+		t.Errorf("expected one row outside of a transaction, got %v", res)
+	}
+	if res := c1.query("select a from u"); len(res.rows) != 1 {
+		t.Errorf("expected the transaction to see its insert, got %v", res)
+	}
+	if res := c1.query("rollback"); res.status != 'I' || !reflect.DeepEqual(res.tags, []string{"ROLLBACK"}) {
+		t.Errorf("expected the transaction to be rolled back, got %v", res)
+	}
+	if res := c2.query("select a from u"); len(res.rows) != 0 {
+		t.Errorf("expected the insert to be rolled back, got %v", res.rows)
+	}
+}
+
+// parse, describe, bind and execute a statement whose parameter is an int,
+// sent in paramFormat, returning the messages up to ReadyForQuery
+func (c *testClient) extended(sql string, param []byte, paramFormat int16, resultFormat int16) []*message {
+	c.send(
+		newMessage(msgParse).string("s").string(sql).int16(1).int32(oidInt8),
+		newMessage(msgDescribe).bytes([]byte{'S'}).string("s"),
+		newMessage(msgBind).string("").string("s").int16(1).int16(paramFormat).int16(1).int32(int32(len(param))).bytes(param).int16(1).int16(resultFormat),
+		newMessage(msgExecute).string("").int32(0),
+		newMessage(msgClose).bytes([]byte{'S'}).string("s"),
+		newMessage(msgSync),
+	)
+	return c.receiveUntilReady()
+}
+
+func TestExtendedQuery(t *testing.T) {
+	c := connect(t, startTestServer(t))
+
+	msgs := c.extended("select name, age from t where age > $1 order by age", []byte("25"), formatText, formatText)
+	if types(msgs) != "1tT2DDC3Z" {
+		t.Fatalf("unexpected messages %s", types(msgs))
+	}
+	if n, oid := msgs[1].readInt16(), msgs[1].readInt32(); n != 1 || oid != oidInt8 {
+		t.Errorf("expected one int8 parameter, got %d of type %d", n, oid)
+	}
+	if vals := values(msgs[4]); !reflect.DeepEqual(vals, []string{"kathy", "30"}) {
+		t.Errorf("expected kathy 30, got %v", vals)
+	}
+	if tag := msgs[6].readString(); tag != "SELECT 2" {
+		t.Errorf("expected SELECT 2, got %s", tag)
+	}
+
+	// binary parameters and results
+	msgs = c.extended("select age from t where age < ?", binaryInt(25), formatBinary, formatBinary)
+	if types(msgs) != "1tT2DC3Z" {
+		t.Fatalf("unexpected messages %s", types(msgs))
+	}
+	if vals := values(msgs[4]); len(vals) != 1 || int64(binary.BigEndian.Uint64([]byte(vals[0]))) != 20 {
+		t.Errorf("expected 20 in binary, got %v", vals)
+	}
+
+	// statements that return no rows have no row description
+	msgs = c.extended("insert into u values ($1)", []byte("7"), formatText, formatText)
+	if types(msgs) != "1tn2C3Z" {
+		t.Fatalf("unexpected messages %s", types(msgs))
+	}
+	if tag := msgs[4].readString(); tag != "INSERT 0 1" {
+		t.Errorf("expected INSERT 0 1, got %s", tag)
+	}
+
+	// after an error, messages are skipped until Sync
+	msgs = c.extended("select name from t where age > $1", []byte("old"), formatText, formatText)
+	if types(msgs) != "1tTEZ" {
+		t.Fatalf("unexpected messages %s", types(msgs))
+	}
+	if state := fields(msgs[3])['C']; state != "22P02" {
+		t.Errorf("expected an invalid integer error, got %s", state)
+	}
+	// which left the statement open
+	c.send(newMessage(msgClose).bytes([]byte{'S'}).string("s"), newMessage(msgSync))
+	if msgs := c.receiveUntilReady(); types(msgs) != "3Z" {
+		t.Fatalf("unexpected messages %s", types(msgs))
+	}
+	// which have no parameters
+	msgs = c.extended("create table v (a int)", nil, formatText, formatText)
+	if types(msgs) != "1tnEZ" {
+		t.Fatalf("unexpected messages %s", types(msgs))
+	}
+	// statements without parameters can be data definitions
+	c.send(
+		newMessage(msgParse).string("").string("create table v (a int)").int16(0),
+		newMessage(msgBind).string("").string("").int16(0).int16(0).int16(0),
+		newMessage(msgExecute).string("").int32(0),
+		newMessage(msgSync),
+	)
+	if msgs := c.receiveUntilReady(); types(msgs) != "12CZ" {
+		t.Fatalf("unexpected messages %s", types(msgs))
+	}
+	if res := c.query("select a from v"); len(res.states) != 0 {
+		t.Errorf("expected the table to be created, got %v", res.states)
+	}
+}
+
+// bind portal to statement s, with the text parameter param
+func bindPortal(portal string, param string) *message {
+	return newMessage(msgBind).string(portal).string("s").int16(0).int16(1).int32(int32(len(param))).bytes([]byte(param)).int16(0)
+}
+
+func TestPortals(t *testing.T) {
+	c := connect(t, startTestServer(t))
+
+	// a portal suspended after its first row keeps its parameter while
+	// another portal of the same statement runs in the transaction; out of
+	// one, the portals would wait for each other's locks
+	c.query("begin")
+	c.send(
+		newMessage(msgParse).string("s").string("select name from t where age < $1").int16(0),
+		bindPortal("a", "35"),
+		newMessage(msgExecute).string("a").int32(1),
+		bindPortal("b", "0"),
+		newMessage(msgExecute).string("b").int32(0),
+		newMessage(msgExecute).string("a").int32(0),
+		newMessage(msgSync),
+	)
+	msgs := c.receiveUntilReady()
+	if types(msgs) != "12Ds2CDCZ" {
+		t.Fatalf("unexpected messages %s", types(msgs))
+	}
+	if vals := append(values(msgs[2]), values(msgs[6])...); !reflect.DeepEqual(vals, []string{"sam", "kathy"}) {
+		t.Errorf("expected sam and kathy, got %v", vals)
+	}
+	if tag := msgs[5].readString(); tag != "SELECT 0" {
+		t.Errorf("expected SELECT 0, got %s", tag)
+	}
+	c.query("commit")
+}
+
+func TestCancelRequest(t *testing.T) {
+	addr := startTestServer(t)
+	c := connect(t, addr)
+
+	// a portal is suspended after its first row
+	c.send(
+		newMessage(msgParse).string("").string("select name from t").int16(0),
+		newMessage(msgBind).string("p").string("").int16(0).int16(0).int16(0),
+		newMessage(msgExecute).string("p").int32(1),
+		newMessage(msgFlush),
+	)
+	for _, typ := range "12Ds" {
+		if m := c.receive(); m.typ != byte(typ) {
+			t.Fatalf("expected %c, got %c", typ, m.typ)
+		}
+	}
+
+	// a cancel request with the wrong key is ignored
+	for _, secret := range []int32{c.secret + 1, c.secret} {
+		cancel, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		cc := &testClient{t: t, nc: cancel, w: bufio.NewWriter(cancel)}
+		cc.sendUntyped(newMessage(0).int32(cancelCode).int32(c.pid).int32(secret))
+		// the server closes the connection once the request is served
+		if _, err := io.ReadAll(cancel); err != nil {
+			t.Fatalf(err.Error())
+		}
+		cancel.Close()
+
+		c.send(newMessage(msgExecute).string("p").int32(1), newMessage(msgFlush))
+		m := c.receive()
+		if secret != c.secret {
+			if m.typ != msgDataRow {
+				t.Errorf("expected the portal to continue, got %c", m.typ)
+			}
+			c.receive() // PortalSuspended
+			continue
+		}
+		if m.typ != msgErrorResponse {
+			t.Fatalf("expected an error, got %c", m.typ)
+		}
+		if state := fields(m)['C']; state != "57014" {
+			t.Errorf("expected a query cancelled error, got %s", state)
+		}
+	}
+	c.send(newMessage(msgSync))
+	if msgs := c.receiveUntilReady(); types(msgs) != "Z" {
+		t.Errorf("unexpected messages %s", types(msgs))
+	}
+	if res := c.query("select name from t"); len(res.rows) != 3 {
+		t.Errorf("expected the connection to run statements after a cancel, got %v", res)
+	}
+}
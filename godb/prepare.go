@@ -0,0 +1,257 @@
+package godb
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// ParamExpr is a parameter of a prepared statement, written ? or $n in its
+// text, whose value is bound each time the statement is executed.  Its type
+// is inferred from where it appears when the statement is planned, e.g., from
+// the column it is compared with or the argument of the function it is
+// passed to.
+type ParamExpr struct {
+	n     int // number of the parameter, from 1
+	ftype DBType
+	value DBValue
+	bound bool
+}
+
+func (p *ParamExpr) EvalExpr(_ *Tuple) (DBValue, error) {
+	if !p.bound {
+		return nil, GoDBError{IllegalOperationError, fmt.Sprintf("parameter $%d is not bound", p.n)}
+	}
+	return p.value, nil
+}
+
+func (p *ParamExpr) GetExprType() FieldType {
+	return FieldType{fmt.Sprintf("$%d", p.n), "", p.ftype}
+}
+
+// Bind the parameter to v, which must be of its type.
+func (p *ParamExpr) bind(v DBValue) error {
+	ok := false
+	switch v.(type) {
+	case IntField:
+		ok = p.ftype == IntType
+	case StringField:
+		ok = p.ftype == StringType
+	}
+	if !ok {
+		return GoDBError{TypeMismatchError, fmt.Sprintf("parameter $%d expects a value of type %s, got %T", p.n, typeNames[p.ftype], v)}
+	}
+	p.value, p.bound = v, true
+	return nil
+}
+
+// Set the type of the parameters among exprs whose type is not known yet to
+// t.
+func setParamTypes(exprs []Expr, t DBType) {
+	if t == UnknownType {
+		return
+	}
+	for _, e := range exprs {
+		if p, ok := e.(*ParamExpr); ok && p.ftype == UnknownType {
+			p.ftype = t
+		}
+	}
+}
+
+// Give the parameters among exprs whose type is not known yet the type of
+// the first of exprs whose type is known, if any, as when a parameter is
+// compared with a column.
+func inferParamTypes(exprs ...Expr) {
+	for _, e := range exprs {
+		if e != nil && e.GetExprType().Ftype != UnknownType {
+			setParamTypes(exprs, e.GetExprType().Ftype)
+			return
+		}
+	}
+}
+
+// The parameters of a statement being prepared.
+type stmtParams struct {
+	exprs []*ParamExpr // by number, from 1
+}
+
+// Return the n-th parameter, creating it and those before it if needed.
+func (p *stmtParams) param(n int) *ParamExpr {
+	for len(p.exprs) < n {
+		p.exprs = append(p.exprs, &ParamExpr{n: len(p.exprs) + 1, ftype: UnknownType})
+	}
+	return p.exprs[n-1]
+}
+
+// Return a catalog in which the parameters of a statement being prepared
+// refer to params.
+func (c *Catalog) withParams(params *stmtParams) *Catalog {
+	cc := *c
+	cc.params = params
+	return &cc
+}
+
+// Stmt is a prepared statement: a query planned once, whose parameters are
+// bound to values each time it is executed.  A statement is re-planned only
+// if the catalog has changed since it was planned, e.g., because a table was
+// created or analyzed.
+//
+// The plan of a statement is reused by its executions, one at a time: an
+// execution that starts while the plan is bound to the parameters of another,
+// until [Stmt.Release], gets a plan of its own.
+type Stmt struct {
+	c       *Catalog
+	query   string // with placeholders rewritten into bind variables
+	nparams int
+	mutex   sync.Mutex // guards the fields below
+	qtype   QueryType
+	plan    Operator
+	params  []*ParamExpr
+	version int  // version of the catalog the plan was made for
+	busy    bool // plan is bound for an execution that was not released
+}
+
+// Prepare a query whose parameters are written either ? or $1, $2, ...
+// Data definition statements, which take effect when they are parsed, cannot
+// be prepared.
+func Prepare(c *Catalog, query string) (*Stmt, error) {
+	query, n, err := rewritePlaceholders(query)
+	if err != nil {
+		return nil, err
+	}
+	s := &Stmt{c: c, query: query, nparams: n}
+	if err := s.replan(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Plan the statement in the current catalog.
+func (s *Stmt) replan() error {
+	version := s.c.planVersion()
+	qtype, plan, params, err := s.planStmt()
+	if err != nil {
+		return err
+	}
+	s.qtype, s.plan, s.params, s.version, s.busy = qtype, plan, params, version, false
+	return nil
+}
+
+// Return a new plan of the statement in the current catalog, with its
+// parameters.
+func (s *Stmt) planStmt() (QueryType, Operator, []*ParamExpr, error) {
+	if stmt, err := sqlparser.Parse(s.query); err == nil {
+		if _, ok := stmt.(*sqlparser.DDL); ok {
+			return 0, nil, nil, GoDBError{ParseError, "data definition statements cannot be prepared"}
+		}
+	}
+	params := &stmtParams{}
+	if s.nparams > 0 {
+		params.param(s.nparams)
+	}
+	qtype, plan, err := Parse(s.c.withParams(params), s.query)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	for _, p := range params.exprs {
+		if p.ftype == UnknownType {
+			return 0, nil, nil, GoDBError{ParseError, fmt.Sprintf("could not determine the type of parameter $%d", p.n)}
+		}
+	}
+	return qtype, plan, params.exprs, nil
+}
+
+// Return the type of the statement.  Only statements of [IteratorType] have
+// a plan.
+func (s *Stmt) QueryType() QueryType {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.qtype
+}
+
+// Return the descriptor of the tuples the statement returns, or nil if it is
+// not of [IteratorType].
+func (s *Stmt) Descriptor() *TupleDesc {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.plan == nil {
+		return nil
+	}
+	return s.plan.Descriptor()
+}
+
+// Return the types of the parameters of the statement, in order.
+func (s *Stmt) ParamTypes() []DBType {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	types := make([]DBType, len(s.params))
+	for i, p := range s.params {
+		types[i] = p.ftype
+	}
+	return types
+}
+
+// Return the plan of the statement with its parameters bound to args, which
+// must have the types returned by [Stmt.ParamTypes].  The plan is nil if
+// the statement is not of [IteratorType].  The plan must be given back with
+// [Stmt.Release] once its execution is over, for the next execution to reuse
+// it; until then, executions get a new plan of the statement.
+func (s *Stmt) Bind(args ...DBValue) (Operator, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.c.planVersion() != s.version {
+		if err := s.replan(); err != nil {
+			return nil, err
+		}
+	}
+	if len(args) != len(s.params) {
+		return nil, GoDBError{IllegalOperationError, fmt.Sprintf("statement has %d parameters, got %d values", len(s.params), len(args))}
+	}
+	plan, params := s.plan, s.params
+	if plan != nil && s.busy {
+		// the plan is bound for another execution, which may still read
+		// its parameters
+		var err error
+		if _, plan, params, err = s.planStmt(); err != nil {
+			return nil, err
+		}
+	}
+	for i, p := range params {
+		if err := p.bind(args[i]); err != nil {
+			return nil, err
+		}
+	}
+	if plan != nil {
+		resetMaterialized(plan)
+		s.busy = s.busy || plan == s.plan
+	}
+	return plan, nil
+}
+
+// Give back a plan returned by [Stmt.Bind] once its execution is over.
+func (s *Stmt) Release(plan Operator) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if plan != nil && plan == s.plan {
+		s.busy = false
+	}
+}
+
+// Discard the tuples kept by the Materialize operators of op, which may
+// depend on the values the parameters were bound to before.
+func resetMaterialized(op Operator) {
+	switch op := op.(type) {
+	case *Materialize:
+		op.memStat.release(tuplesMemory(op.tuples))
+		op.tid, op.tuples = nil, nil
+	case *cteScan:
+		if op.cte.mat != nil {
+			resetMaterialized(op.cte.mat)
+		}
+		resetMaterialized(op.cte.op)
+	}
+	for _, child := range planChildren(op) {
+		resetMaterialized(*child)
+	}
+}
@@ -0,0 +1,246 @@
+package godb
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// bind the parameters of s to args and run it in its own transaction,
+// returning the results as sorted strings
+func runPrepared(t *testing.T, bp *BufferPool, s *Stmt, args ...DBValue) []string {
+	t.Helper()
+	plan, err := s.Bind(args...)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer s.Release(plan)
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+	var res []string
+	for _, tup := range collectTuples(t, plan, tid) {
+		res = append(res, tup.PrettyPrintString(false))
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestPrepareParams(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+
+	for _, q := range []struct {
+		sql      string
+		types    []DBType
+		args     []DBValue
+		expected string
+	}{
+		{"select name, age from t where age > ? and name <> ?", []DBType{IntType, StringType},
+			[]DBValue{IntField{25}, StringField{"kathy"}}, "select name, age from t where age > 25 and name <> 'kathy'"},
+		{"select name from t where $1 <= age and age <= $1 + 20", []DBType{IntType},
+			[]DBValue{IntField{25}}, "select name from t where 25 <= age and age <= 45"},
+		{"select name, age + $2 from t where getsubstr(name, 0, 1) = $1", []DBType{StringType, IntType},
+			[]DBValue{StringField{"s"}, IntField{1}}, "select name, age + 1 from t where getsubstr(name, 0, 1) = 's'"},
+		{"select name, case when age > ? then ? else 'young' end from t", []DBType{IntType, StringType},
+			[]DBValue{IntField{30}, StringField{"old"}}, "select name, case when age > 30 then 'old' else 'young' end from t"},
+		{"select name, age from t order by age limit ?", []DBType{IntType},
+			[]DBValue{IntField{3}}, "select name, age from t order by age limit 3"},
+		{"select t.name from t, t2 where t.name = t2.name and t2.age < ?", []DBType{IntType},
+			[]DBValue{IntField{30}}, "select t.name from t, t2 where t.name = t2.name and t2.age < 30"},
+		{"select name from t where age in (select age from t2 where name = ?)", []DBType{StringType},
+			[]DBValue{StringField{"sam"}}, "select name from t where age in (select age from t2 where name = 'sam')"},
+	} {
+		s, err := Prepare(c, q.sql)
+		if err != nil {
+			t.Fatalf("%s: %v", q.sql, err)
+		}
+		if !reflect.DeepEqual(s.ParamTypes(), q.types) {
+			t.Errorf("%s: expected parameter types %v, got %v", q.sql, q.types, s.ParamTypes())
+		}
+		expected := sortedResults(t, c, bp, q.expected)
+		if res := runPrepared(t, bp, s, q.args...); !reflect.DeepEqual(res, expected) {
+			t.Errorf("%s: expected %v, got %v", q.sql, expected, res)
+		}
+	}
+
+	// the same plan is run with other values
+	s, err := Prepare(c, "select name from t where age >= ?")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	plan, _ := s.Bind(IntField{0})
+	s.Release(plan)
+	for _, age := range []int64{0, 30, 100} {
+		res := runPrepared(t, bp, s, IntField{age})
+		if expected := sortedResults(t, c, bp, fmt.Sprintf("select name from t where age >= %d", age)); !reflect.DeepEqual(res, expected) {
+			t.Errorf("age %d: expected %v, got %v", age, expected, res)
+		}
+	}
+	if again, _ := s.Bind(IntField{0}); again != plan {
+		t.Errorf("expected the plan to be reused")
+	}
+}
+
+func TestPrepareInsert(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+	s, err := Prepare(c, "insert into t values ($1, $2)")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if types := s.ParamTypes(); !reflect.DeepEqual(types, []DBType{StringType, IntType}) {
+		t.Errorf("expected the types of the columns, got %v", types)
+	}
+	for _, args := range [][]DBValue{{StringField{"it's"}, IntField{7}}, {StringField{"x"}, IntField{8}}} {
+		plan, err := s.Bind(args...)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		tid := NewTID()
+		bp.BeginTransaction(tid)
+		iter, err := plan.Iterator(tid)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		// an insert returns the number of tuples inserted
+		if tup, err := iter(); err != nil || tup.Fields[0] != (IntField{1}) {
+			t.Fatalf("expected one tuple to be inserted, got %v, %v", tup, err)
+		}
+		bp.CommitTransaction(tid)
+		s.Release(plan)
+	}
+	if res := sortedResults(t, c, bp, "select name, age from t where age < 10"); len(res) != 2 {
+		t.Errorf("expected the inserted tuples, got %v", res)
+	}
+}
+
+func TestPrepareMaterialize(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+	// the expression is referenced twice, so it is materialized
+	s, err := Prepare(c, "with x as (select name, age from t where age > ?) select a.name from x a, x b where a.name = b.name")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ages := []int64{40, 0}
+	var expected []int
+	for _, age := range ages {
+		expected = append(expected, len(runParsedQuery(t, c, bp, fmt.Sprintf("with x as (select name, age from t where age > %d) select a.name from x a, x b where a.name = b.name", age))))
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+	for i, age := range ages {
+		plan, err := s.Bind(IntField{age})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if n := len(collectTuples(t, plan, tid)); n != expected[i] {
+			t.Errorf("age %d: expected %d tuples, got %d", age, expected[i], n)
+		}
+		s.Release(plan)
+	}
+}
+
+func TestPrepareOverlap(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+	s, err := Prepare(c, "select name from t where age >= ?")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected := len(sortedResults(t, c, bp, "select name from t"))
+	// an execution bound before another one ends gets a plan of its own
+	first, err := s.Bind(IntField{100})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	second, err := s.Bind(IntField{0})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if second == first {
+		t.Fatalf("expected a new plan while the first one is bound")
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+	if n := len(collectTuples(t, first, tid)); n != 0 {
+		t.Errorf("expected the first plan to keep its parameter, got %d tuples", n)
+	}
+	if n := len(collectTuples(t, second, tid)); n != expected {
+		t.Errorf("expected %d tuples, got %d", expected, n)
+	}
+
+	// releasing another plan does not make the first one free
+	s.Release(second)
+	if again, _ := s.Bind(IntField{0}); again == first {
+		t.Errorf("expected the bound plan not to be reused")
+	}
+	s.Release(first)
+	if again, _ := s.Bind(IntField{0}); again != first {
+		t.Errorf("expected the released plan to be reused")
+	}
+}
+
+func TestPrepareReplan(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+	s, err := Prepare(c, "select name, count(*) from t where age > ? group by name")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	plan, _ := s.Bind(IntField{0})
+	s.Release(plan)
+	expected := runPrepared(t, bp, s, IntField{0})
+	c.SetParallelism(4)
+	defer c.SetParallelism(1)
+	again, err := s.Bind(IntField{0})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if again == plan {
+		t.Errorf("expected the statement to be planned again after the catalog changed")
+	}
+	if res := runPrepared(t, bp, s, IntField{0}); !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+}
+
+func TestPrepareErrors(t *testing.T) {
+	c, _ := makeParserTestCatalog(t)
+
+	for _, sql := range []string{
+		"select ? from t", // no context to infer the type from
+		"select name from t where age > ? and ? = $1", // mixed placeholder styles
+		"select name from t where age > $0",
+		"create table u (a int)",
+		"select name from t where age > $2", // $1 is not used
+	} {
+		if _, err := Prepare(c, sql); err == nil {
+			t.Errorf("%s: expected an error", sql)
+		}
+	}
+	if _, _, err := Parse(c, "select name from t where age > ?"); err == nil {
+		t.Errorf("expected an error parsing a query with parameters")
+	}
+	if _, err := c.GetTable("u"); err == nil {
+		t.Errorf("expected preparing a create table statement not to create the table")
+	}
+
+	// placeholders in strings are not parameters
+	s, err := Prepare(c, "select name from t where name <> 'who?' and age > ?")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if n := len(s.ParamTypes()); n != 1 {
+		t.Errorf("expected one parameter, got %d", n)
+	}
+	if _, err := s.Bind(StringField{"a"}); err == nil {
+		t.Errorf("expected an error binding a string to an int parameter")
+	}
+	if _, err := s.Bind(); err == nil {
+		t.Errorf("expected an error binding too few values")
+	}
+	plan, err := s.Bind(IntField{1})
+	if err != nil || plan == nil {
+		t.Fatalf("expected a plan, got %v", err)
+	}
+}
@@ -1,5 +1,7 @@
 package godb
 
+import "context"
+
 type Project struct {
 	selectFields []Expr // required fields for parser
 	outputNames  []string
@@ -8,6 +10,7 @@ type Project struct {
 	// TODO: some code goes here
 	distinct bool       // 是否去重
 	desc     *TupleDesc // 描述符
+	memStat             //the distinct tuples returned so far
 }
 
 // Project constructor -- should save the list of selected field, child, and the child op.
@@ -29,7 +32,7 @@ func NewProjectOp(selectFields []Expr, outputNames []string, distinct bool, chil
 		fields[i] = field.GetExprType()
 		fields[i].Fname = outputNames[i]
 	}
-	return &Project{selectFields, outputNames, child, distinct, &TupleDesc{fields}}, nil
+	return &Project{selectFields, outputNames, child, distinct, &TupleDesc{fields}, memStat{}}, nil
 }
 
 // Return a TupleDescriptor for this projection. The returned descriptor should contain
@@ -49,13 +52,19 @@ func (p *Project) Descriptor() *TupleDesc {
 // distinct tuples seen so far.  Note that support for the distinct keyword is
 // optional as specified in the lab 2 assignment.
 func (p *Project) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	return p.IteratorContext(context.Background(), tid)
+}
+
+func (p *Project) IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error) {
 	// TODO: some code goes here
 	// 获取child的迭代器
-	iter, err := p.child.Iterator(tid)
+	iter, err := IteratorContext(ctx, p.child, tid)
 	if err != nil {
-		return nil, nil
+		return nil, err
 	}
 	var set = make(map[any]bool)
+	mem := p.account(ctx, "distinct")
+	var size int64
 	return func() (*Tuple, error) {
 		// 遍历child的迭代器
 		for {
@@ -65,6 +74,8 @@ func (p *Project) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
 			}
 			// 若tuple为nil，说明已经遍历完毕
 			if tuple == nil {
+				mem.release(size)
+				size = 0
 				break
 			}
 			// 提取出fileds
@@ -72,7 +83,7 @@ func (p *Project) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
 			for i, field := range p.selectFields {
 				fields[i], err = field.EvalExpr(tuple)
 				if err != nil {
-					return nil, nil
+					return nil, err
 				}
 			}
 			// 构造返回tuple
@@ -80,11 +91,17 @@ func (p *Project) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
 				Desc:   *p.desc,
 				Fields: fields,
 			}
+			// 若不需要去重，直接返回tuple
+			if !p.distinct {
+				return retTuple, nil
+			}
 			key := retTuple.tupleKey()
-			// 查重
-			_, ok := set[key]
-			// 若不需要去重或者没有重复，返回tuple
-			if !p.distinct || !ok {
+			// 查重，若没有重复，记录并返回tuple
+			if !set[key] {
+				if err := mem.grow(tupleMemory(retTuple)); err != nil {
+					return nil, err
+				}
+				size += tupleMemory(retTuple)
 				set[key] = true
 				return retTuple, nil
 			}
@@ -93,3 +110,51 @@ func (p *Project) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
 	}, nil
 
 }
+
+// Vectorized projection implementation.  Each select expression is evaluated
+// on a whole batch of the child at once; for a distinct projection, the rows
+// already returned are removed from each output batch.
+func (p *Project) BatchIterator(ctx context.Context, tid TransactionID) (func() (*Batch, error), error) {
+	iter, err := BatchIterator(ctx, p.child, tid)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[any]bool)
+	mem := p.account(ctx, "distinct")
+	var size int64
+	return func() (*Batch, error) {
+		for {
+			b, err := iter()
+			if err != nil || b == nil {
+				mem.release(size)
+				size = 0
+				return nil, err
+			}
+			out := &Batch{p.desc, make([]*Vector, len(p.selectFields)), b.n}
+			for i, field := range p.selectFields {
+				out.Columns[i], err = evalVector(field, b)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if !p.distinct {
+				return out, nil
+			}
+			sel := make([]int, 0, out.n)
+			for i := 0; i < out.n; i++ {
+				key := out.Tuple(i).tupleKey()
+				if !seen[key] {
+					if err := mem.grow(out.rowMemory(i)); err != nil {
+						return nil, err
+					}
+					size += out.rowMemory(i)
+					seen[key] = true
+					sel = append(sel, i)
+				}
+			}
+			if len(sel) > 0 {
+				return out.gather(sel), nil
+			}
+		}
+	}, nil
+}
@@ -0,0 +1,177 @@
+package godb
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// ContextOperator is implemented by operators whose iterators can be
+// cancelled.  The context passed to IteratorContext is passed on to the
+// iterators of the operator's children, so that the scans at the leaves of a
+// plan stop with an error once it is done, and operators that hold resources
+// until their output has been read register the release of those resources
+// with the [Query] that the context belongs to.
+type ContextOperator interface {
+	Operator
+
+	IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error)
+}
+
+// Return an iterator over the tuples of op that stops with an error once ctx
+// is done.  If op is not a [ContextOperator], ctx is checked before each call
+// to its iterator.
+func IteratorContext(ctx context.Context, op Operator, tid TransactionID) (func() (*Tuple, error), error) {
+	if cop, ok := op.(ContextOperator); ok {
+		return cop.IteratorContext(ctx, tid)
+	}
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	iter, err := op.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	return func() (*Tuple, error) {
+		if err := contextError(ctx); err != nil {
+			return nil, err
+		}
+		return iter()
+	}, nil
+}
+
+// Return the error returned by a query whose context is done, or nil if ctx
+// is not done.
+func contextError(ctx context.Context) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return GoDBError{QueryCancelledError, "query timed out"}
+	}
+	return GoDBError{QueryCancelledError, "query cancelled"}
+}
+
+type queryKey struct{}
+
+// queryResources holds the cleanups registered by the operators of a query
+// that have not released their resources yet, by order of registration, and
+// the tracker of the memory that the operators buffer.
+type queryResources struct {
+	mutex    sync.Mutex
+	next     int
+	cleanups map[int]func()
+	mem      *memTracker
+}
+
+// Register f to be called when the query that ctx belongs to is closed,
+// returning a function that unregisters it, which an operator calls once it
+// has released the resources itself.  If ctx does not belong to a query, f is
+// never called.
+func onClose(ctx context.Context, f func()) (unregister func()) {
+	res, ok := ctx.Value(queryKey{}).(*queryResources)
+	if !ok {
+		return func() {}
+	}
+	res.mutex.Lock()
+	defer res.mutex.Unlock()
+	id := res.next
+	res.next++
+	res.cleanups[id] = f
+	return func() {
+		res.mutex.Lock()
+		defer res.mutex.Unlock()
+		delete(res.cleanups, id)
+	}
+}
+
+// Call the registered cleanups in the order they were registered.
+func (res *queryResources) close() {
+	res.mutex.Lock()
+	ids := make([]int, 0, len(res.cleanups))
+	for id := range res.cleanups {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	cleanups := make([]func(), len(ids))
+	for i, id := range ids {
+		cleanups[i] = res.cleanups[id]
+	}
+	res.cleanups = make(map[int]func())
+	res.mutex.Unlock()
+	// a cleanup that waits for worker goroutines to stop is registered before
+	// the cleanups of the workers' operators, so the workers are stopped first
+	for _, f := range cleanups {
+		f()
+	}
+}
+
+// Query is a running plan.  Its tuples are read with [Query.Next], and it
+// must be closed with [Query.Close] once it is no longer needed, which stops
+// the plan and releases its spill files, worker goroutines and memory even if
+// not all of its tuples have been read.
+//
+// The plan stops with a [QueryCancelledError] once the context the query was
+// opened with is done, or once [Query.Cancel] is called.  Page locks taken by
+// the plan are held by its transaction, and so are only released when the
+// transaction commits or aborts.
+type Query struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	res    *queryResources
+	desc   *TupleDesc
+	iter   func() (*Tuple, error)
+}
+
+// Start running the plan op in the transaction tid.  If vectorized is true,
+// op is run with [VectorizedIterator].  The memory the plan may buffer is
+// limited if ctx was returned by [WithMemoryLimit].
+func OpenQuery(ctx context.Context, op Operator, tid TransactionID, vectorized bool) (*Query, error) {
+	res := &queryResources{cleanups: make(map[int]func()), mem: newMemTracker(ctx)}
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, queryKey{}, res))
+	q := &Query{ctx, cancel, res, op.Descriptor(), nil}
+	var err error
+	if vectorized {
+		q.iter, err = VectorizedIterator(ctx, op, tid)
+	} else {
+		q.iter, err = IteratorContext(ctx, op, tid)
+	}
+	if err != nil {
+		q.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// Return the descriptor of the tuples of the query.
+func (q *Query) Descriptor() *TupleDesc {
+	return q.desc
+}
+
+// Return the next tuple of the query, or nil once all tuples have been
+// returned.
+func (q *Query) Next() (*Tuple, error) {
+	if q.iter == nil {
+		return nil, GoDBError{IllegalOperationError, "query is closed"}
+	}
+	if err := contextError(q.ctx); err != nil {
+		return nil, err
+	}
+	return q.iter()
+}
+
+// Stop the query: a call to [Query.Next] that is running returns as soon as
+// the plan notices, and later calls return a [QueryCancelledError].  Unlike
+// the other methods of a query, Cancel may be called from any goroutine.
+func (q *Query) Cancel() {
+	q.cancel()
+}
+
+// Stop the query and release its resources.  Close must not be called while
+// a call to [Query.Next] is running; to interrupt one, use [Query.Cancel].
+func (q *Query) Close() error {
+	q.cancel()
+	q.res.close()
+	q.iter = nil
+	return nil
+}
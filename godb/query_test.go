@@ -0,0 +1,244 @@
+package godb
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// an operator that cancels a context after its child has returned n tuples
+type cancelAfterOp struct {
+	Operator
+	n      int
+	cancel context.CancelFunc
+}
+
+func (c *cancelAfterOp) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	iter, err := c.Operator.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	return func() (*Tuple, error) {
+		if n++; n > c.n {
+			c.cancel()
+		}
+		return iter()
+	}, nil
+}
+
+// check that err is a QueryCancelledError with the specified message
+func checkCancelled(t *testing.T, err error, msg string) {
+	t.Helper()
+	e, ok := err.(GoDBError)
+	if !ok || e.code != QueryCancelledError || e.errString != msg {
+		t.Errorf("expected %q error, got %v", msg, err)
+	}
+}
+
+func TestQueryCancel(t *testing.T) {
+	bp := NewBufferPool(50)
+	hf := makeParallelTestFile(t, bp, 1000, 10)
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+
+	q, err := OpenQuery(context.Background(), hf, tid, false)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for i := 0; i < 10; i++ {
+		if tup, err := q.Next(); tup == nil || err != nil {
+			t.Fatalf("expected a tuple, got %v", err)
+		}
+	}
+	q.Cancel()
+	_, err = q.Next()
+	checkCancelled(t, err, "query cancelled")
+	q.Close()
+	if _, err := q.Next(); err == nil {
+		t.Errorf("expected an error reading a closed query")
+	}
+
+	// the scan stops at the next page once the context is cancelled from
+	// below the root of the plan
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q, err = OpenQuery(ctx, &cancelAfterOp{hf, 5, cancel}, tid, false)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer q.Close()
+	n := 0
+	for ; ; n++ {
+		tup, err := q.Next()
+		if err != nil {
+			checkCancelled(t, err, "query cancelled")
+			break
+		}
+		if tup == nil {
+			t.Fatalf("expected the query to be cancelled")
+		}
+	}
+	if n < 5 || n >= 1000 {
+		t.Errorf("expected the query to stop after 5 tuples, got %d", n)
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+	plan := parsePlan(t, c, "select t.name, count(*) from t, t2 where t.age = t2.age group by t.name")
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+	for _, vectorized := range []bool{false, true} {
+		q, err := OpenQuery(ctx, plan, tid, vectorized)
+		if err == nil {
+			_, err = q.Next()
+			q.Close()
+		}
+		checkCancelled(t, err, "query timed out")
+	}
+	if _, err := ExplainAnalyze(ctx, c, plan, tid); err == nil {
+		t.Errorf("expected explain analyze to time out")
+	}
+}
+
+// return the number of files in dir
+func countFiles(t *testing.T, dir string) int {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return len(files)
+}
+
+func TestQueryCloseSpill(t *testing.T) {
+	bp := NewBufferPool(50)
+	hf := makeParallelTestFile(t, bp, 1000, 50)
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+	// small batches, so that a vectorized query returns its first groups
+	// before aggregating the spilled rows
+	defer func(size int) { BatchSize = size }(BatchSize)
+	BatchSize = 2
+
+	nameExpr := &FieldExpr{hf.Descriptor().Fields[0]}
+	ageExpr := &FieldExpr{hf.Descriptor().Fields[1]}
+	newAgg := func(child Operator) *Aggregator {
+		cnt := &CountAggState{}
+		cnt.Init("cnt", ageExpr, intAggGetter)
+		distinct := NewDistinctAggState(&CountAggState{})
+		distinct.SetMaxValues(5)
+		distinct.Init("distinct", ageExpr, intAggGetter)
+		agg := NewGroupedAggregator([]AggState{cnt, distinct}, []Expr{nameExpr}, child)
+		agg.SetMaxGroups(5)
+		return agg
+	}
+
+	for _, vectorized := range []bool{false, true} {
+		// abandoned while returning the groups, after the input has been
+		// spilled
+		agg := newAgg(hf)
+		q, err := OpenQuery(context.Background(), agg, tid, vectorized)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if tup, err := q.Next(); tup == nil || err != nil {
+			t.Fatalf("expected a group, got %v", err)
+		}
+		if countFiles(t, tmp) == 0 {
+			t.Fatalf("vectorized %t: expected the aggregation to spill", vectorized)
+		}
+		q.Close()
+		if n := countFiles(t, tmp); n != 0 {
+			t.Errorf("vectorized %t: expected spill files to be removed on close, found %d", vectorized, n)
+		}
+		if agg.cur != 0 {
+			t.Errorf("vectorized %t: expected the memory of the groups to be released, got %d", vectorized, agg.cur)
+		}
+
+		// cancelled while reading the input
+		ctx, cancel := context.WithCancel(context.Background())
+		q, err = OpenQuery(ctx, newAgg(&cancelAfterOp{hf, 500, cancel}), tid, vectorized)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		_, err = q.Next()
+		checkCancelled(t, err, "query cancelled")
+		q.Close()
+		cancel()
+		if n := countFiles(t, tmp); n != 0 {
+			t.Errorf("vectorized %t: expected spill files to be removed on cancel, found %d", vectorized, n)
+		}
+	}
+
+	// spill files of a query that runs to completion are removed as it runs
+	q, err := OpenQuery(context.Background(), newAgg(hf), tid, false)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	n := 0
+	for ; ; n++ {
+		tup, err := q.Next()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if tup == nil {
+			break
+		}
+	}
+	if n != 50 {
+		t.Errorf("expected 50 groups, got %d", n)
+	}
+	if len(q.res.cleanups) != 0 {
+		t.Errorf("expected no cleanups to be left once the query has run")
+	}
+	q.Close()
+}
+
+func TestQueryCloseGather(t *testing.T) {
+	bp := NewBufferPool(50)
+	hf := makeParallelTestFile(t, bp, 2000, 10)
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+	// small batches, so that the workers are still sending when the query is
+	// closed
+	defer func(size int) { BatchSize = size }(BatchSize)
+	BatchSize = 8
+
+	before := runtime.NumGoroutine()
+	g, err := NewGather(hf, 4)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	q, err := OpenQuery(context.Background(), g, tid, true)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if tup, err := q.Next(); tup == nil || err != nil {
+		t.Fatalf("expected a tuple, got %v", err)
+	}
+	if runtime.NumGoroutine() <= before {
+		t.Fatalf("expected the gather to start workers")
+	}
+	q.Close()
+	// the goroutine that closes the channel of results may take a moment to
+	// exit after the workers
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("expected the workers to exit on close, %d goroutines left of %d", n, before)
+	}
+}
@@ -0,0 +1,590 @@
+package godb
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Before a select statement is planned, rewritePlan applies rules to its
+// LogicalPlan that do not change its result, but let makePhysicalPlan build a
+// cheaper plan:
+//
+//   - constant folding evaluates functions of constants in predicates once,
+//     so that, e.g., age > 1+2 compares a column with a constant, and drops
+//     predicates that are always true;
+//   - transitive inference adds, for a predicate comparing one side of an
+//     equality join with a constant, the same predicate on the other side,
+//     e.g., t.a = s.b and t.a > 5 imply s.b > 5;
+//   - predicate pushdown moves predicates on the columns of a subquery in the
+//     FROM clause into the subquery, where they filter its input (or, for
+//     columns computed by aggregates, its groups) rather than its output;
+//   - column pruning removes the columns of subqueries in the FROM clause
+//     that the enclosing query does not use.
+//
+// The columns of the inputs of joins are pruned when the physical plan is
+// made instead (see pruneJoinInputs), as plans may be copied and changed
+// after they are rewritten (see decorrelateSubquery).
+
+// Rewrite plan, and the plans of its subqueries.
+func rewritePlan(c *Catalog, plan *LogicalPlan) {
+	if plan.cte != nil {
+		return
+	}
+	foldPredicates(c, plan)
+	inferPredicates(c, plan)
+	pushDownPredicates(c, plan)
+	pruneSubqueryColumns(c, plan)
+	for _, sub := range plan.subqueries {
+		rewritePlan(c, sub)
+	}
+	for _, sq := range plan.subqueryPreds {
+		rewritePlan(c, sq.plan)
+	}
+}
+
+// Replace the functions of constants in node by their values.  Functions
+// whose value cannot be told apart from a constant of another type when
+// written as text, such as the string '12', are kept.
+func foldConstants(c *Catalog, node *LogicalSelectNode) {
+	for _, arg := range node.args {
+		foldConstants(c, arg)
+	}
+	if node.exprType != ExprFunc || node.cachedField != nil {
+		return
+	}
+	for _, arg := range node.args {
+		if arg.exprType != ExprConst {
+			return
+		}
+	}
+	expr, _, err := node.generateExpr(c, nil, nil)
+	if err != nil {
+		//left for the planner to report
+		return
+	}
+	ce, ok := expr.(*ConstExpr)
+	if !ok {
+		return
+	}
+	var value string
+	switch v := ce.val.(type) {
+	case IntField:
+		value = strconv.FormatInt(v.Value, 10)
+	case StringField:
+		if _, err := strconv.Atoi(v.Value); err == nil {
+			return
+		}
+		value = v.Value
+	default:
+		return
+	}
+	node.exprType = ExprConst
+	node.value = value
+	node.funcOp = nil
+	node.args = nil
+}
+
+// Return true if node is a constant or a parameter, whose value is the same
+// for every tuple, but may only be known when the plan is run.
+func isConstant(node *LogicalSelectNode) bool {
+	return node.exprType == ExprConst || node.exprType == ExprParam
+}
+
+// Return the value of a predicate on constants, and whether it could be
+// evaluated.
+func evalConstPredicate(c *Catalog, f *LogicalFilterNode) (bool, bool) {
+	left, _, err := f.fieldExpr.generateExpr(c, nil, nil)
+	if err != nil {
+		return false, false
+	}
+	right, _, err := f.constExpr.generateExpr(c, nil, nil)
+	if err != nil {
+		return false, false
+	}
+	lv, err := left.EvalExpr(nil)
+	if err != nil {
+		return false, false
+	}
+	rv, err := right.EvalExpr(nil)
+	if err != nil {
+		return false, false
+	}
+	res, err := evalValuePred(lv, rv, f.predOp)
+	return res, err == nil
+}
+
+// Fold the constants of the WHERE and HAVING predicates of plan.  Predicates
+// are turned around so that a constant is on their right side, which is where
+// the planner expects it, and predicates on constants that are true are
+// dropped; those that are false are kept, so that the query returns nothing.
+func foldPredicates(c *Catalog, plan *LogicalPlan) {
+	var filters []*LogicalFilterNode
+	for _, f := range plan.filters {
+		foldConstants(c, &f.fieldExpr)
+		foldConstants(c, &f.constExpr)
+		if isConstant(&f.fieldExpr) && !isConstant(&f.constExpr) {
+			f.fieldExpr, f.constExpr = f.constExpr, f.fieldExpr
+			f.predOp = flipBoolOp(f.predOp)
+		}
+		if f.fieldExpr.exprType == ExprConst && f.constExpr.exprType == ExprConst {
+			if res, ok := evalConstPredicate(c, f); ok && res {
+				continue
+			}
+		}
+		filters = append(filters, f)
+	}
+	plan.filters = filters
+	for _, h := range plan.having {
+		foldConstants(c, &h.fieldExpr)
+		foldConstants(c, &h.constExpr)
+	}
+}
+
+// Return the names of the inputs of plan, i.e., its subqueries and the
+// aliases or names of its tables, in the order of the FROM clause.
+func fromNames(plan *LogicalPlan) []string {
+	var names []string
+	for _, p := range plan.subqueries {
+		names = append(names, p.alias)
+	}
+	for _, t := range plan.tables {
+		name := t.tableName
+		if t.alias != "" {
+			name = t.alias
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// Return the input of plan and the name of the column that node, a column
+// of the FROM clause, refers to, or false if it cannot be resolved.
+func resolveColumn(c *Catalog, plan *LogicalPlan, node *LogicalSelectNode) (string, string, bool) {
+	if node.exprType != ExprField || node.field == "*" {
+		return "", "", false
+	}
+	col := *node
+	col.alias = ""
+	tab, field, err := col.getTableField(c, plan.subqueries, plan.tables)
+	if err != nil || tab == "" {
+		return "", "", false
+	}
+	for _, name := range fromNames(plan) {
+		if name == tab {
+			return tab, field, true
+		}
+	}
+	return "", "", false
+}
+
+// Add the predicates of plan implied by its equality joins: columns that are
+// joined are equal, so a comparison of one of them with a constant holds
+// for all of them.
+func inferPredicates(c *Catalog, plan *LogicalPlan) {
+	if len(plan.joins) == 0 {
+		return
+	}
+	//union-find over the joined columns, named table.field
+	parent := make(map[string]string)
+	columns := make(map[string]LogicalSelectNode)
+	var order []string
+	var find func(string) string
+	find = func(k string) string {
+		if parent[k] == k {
+			return k
+		}
+		parent[k] = find(parent[k])
+		return parent[k]
+	}
+	add := func(n *LogicalSelectNode) (string, bool) {
+		tab, field, ok := resolveColumn(c, plan, n)
+		if !ok {
+			return "", false
+		}
+		k := tab + "." + field
+		if _, ok := parent[k]; !ok {
+			parent[k] = k
+			columns[k] = NewFieldSelectNode(tab, field, "")
+			order = append(order, k)
+		}
+		return k, true
+	}
+	for _, j := range plan.joins {
+		if j.predOp != OpEq {
+			continue
+		}
+		l, ok1 := add(j.left)
+		r, ok2 := add(j.right)
+		if ok1 && ok2 {
+			parent[find(l)] = find(r)
+		}
+	}
+
+	seen := make(map[string]bool)
+	type columnPred struct {
+		col string
+		f   *LogicalFilterNode
+	}
+	var preds []columnPred
+	for _, f := range plan.filters {
+		if !isConstant(&f.constExpr) {
+			continue
+		}
+		tab, field, ok := resolveColumn(c, plan, &f.fieldExpr)
+		if !ok {
+			continue
+		}
+		k := tab + "." + field
+		seen[fmt.Sprintf("%s %d %s", k, f.predOp, f.constExpr.value)] = true
+		if _, ok := parent[k]; ok {
+			preds = append(preds, columnPred{k, f})
+		}
+	}
+	for _, p := range preds {
+		for _, k := range order {
+			key := fmt.Sprintf("%s %d %s", k, p.f.predOp, p.f.constExpr.value)
+			if find(k) != find(p.col) || seen[key] {
+				continue
+			}
+			seen[key] = true
+			plan.filters = append(plan.filters, &LogicalFilterNode{columns[k], p.f.constExpr, p.f.predOp})
+		}
+	}
+}
+
+// Return a copy of node and its arguments.
+func (node *LogicalSelectNode) clone() *LogicalSelectNode {
+	n := *node
+	n.args = make([]*LogicalSelectNode, len(node.args))
+	for i, arg := range node.args {
+		n.args[i] = arg.clone()
+	}
+	return &n
+}
+
+// Return the name of the column of a subquery computed by s, an expression
+// of its select list, or "" if it has no name by which the enclosing query
+// can refer to it.
+func selectName(s *LogicalSelectNode) string {
+	if s.alias != "" {
+		return s.alias
+	}
+	if s.exprType == ExprField {
+		return s.field
+	}
+	return ""
+}
+
+// Return the expression of the select list of sub named name, or nil if
+// there is not exactly one.
+func subplanSelect(sub *LogicalPlan, name string) *LogicalSelectNode {
+	var sel *LogicalSelectNode
+	for _, s := range sub.selects {
+		if selectName(s) != name {
+			continue
+		}
+		if sel != nil {
+			return nil
+		}
+		sel = s
+	}
+	return sel
+}
+
+// Return true if the columns node refers to are all of one input of plan.
+func singleInput(c *Catalog, plan *LogicalPlan, node *LogicalSelectNode) bool {
+	input := ""
+	var visit func(n *LogicalSelectNode) bool
+	visit = func(n *LogicalSelectNode) bool {
+		switch n.exprType {
+		case ExprField:
+			tab, _, ok := resolveColumn(c, plan, n)
+			if !ok || (input != "" && tab != input) {
+				return false
+			}
+			input = tab
+		case ExprFunc:
+			for _, arg := range n.args {
+				if !visit(arg) {
+					return false
+				}
+			}
+		case ExprConst, ExprParam:
+		default:
+			return false
+		}
+		return true
+	}
+	return visit(node) && input != ""
+}
+
+// Move the predicates of plan on columns of its subqueries into them.
+func pushDownPredicates(c *Catalog, plan *LogicalPlan) {
+	if len(plan.subqueries) == 0 {
+		return
+	}
+	var filters []*LogicalFilterNode
+	for _, f := range plan.filters {
+		if !pushDownPredicate(c, plan, f) {
+			filters = append(filters, f)
+		}
+	}
+	plan.filters = filters
+}
+
+// Move f, a predicate of plan, into the subquery whose column it compares
+// with a constant, returning false if it cannot be moved.  A predicate on
+// a column computed from aggregates becomes a HAVING predicate; predicates
+// cannot be moved past a LIMIT or window functions, which would see fewer
+// tuples.
+func pushDownPredicate(c *Catalog, plan *LogicalPlan, f *LogicalFilterNode) bool {
+	if !isConstant(&f.constExpr) {
+		return false
+	}
+	tab, field, ok := resolveColumn(c, plan, &f.fieldExpr)
+	if !ok {
+		return false
+	}
+	var sub *LogicalPlan
+	for _, p := range plan.subqueries {
+		if p.alias == tab {
+			sub = p
+		}
+	}
+	if sub == nil || sub.cte != nil || sub.limit != nil || len(sub.windows) > 0 {
+		return false
+	}
+	sel := subplanSelect(sub, field)
+	if sel == nil || hasOuterRef(sel) {
+		return false
+	}
+	if aggs := extractAggs(sel); len(aggs) > 0 {
+		h := &LogicalFilterNode{*sel, f.constExpr, f.predOp}
+		h.fieldExpr.alias = ""
+		if sel.exprType == ExprAggr {
+			//read the aggregate from the output of the aggregator, by the
+			//name it has there
+			h.fieldExpr = NewFieldSelectNode("", sel.alias, "")
+		}
+		//the aggregates of a computed column are those of the select list,
+		//so are not computed again
+		for _, agg := range extractAggs(&h.fieldExpr) {
+			computed := false
+			for _, a := range sub.aggs {
+				computed = computed || a == agg
+			}
+			if !computed {
+				sub.aggs = append(sub.aggs, agg)
+			}
+		}
+		sub.having = append(sub.having, h)
+		return true
+	}
+	//columns of grouped subqueries are group by expressions, so can be
+	//filtered before grouping
+	if !singleInput(c, sub, sel) {
+		return false
+	}
+	pred := sel.clone()
+	pred.alias = ""
+	sub.filters = append(sub.filters, &LogicalFilterNode{*pred, f.constExpr, f.predOp})
+	return true
+}
+
+// Return the columns of the inputs of plan that it uses, by input and name,
+// or false if they cannot all be resolved.  The columns used by the WHERE
+// predicates are included if withFilters is true.
+func usedColumns(c *Catalog, plan *LogicalPlan, withFilters bool) (map[string]map[string]bool, bool) {
+	used := make(map[string]map[string]bool)
+	ok := true
+	var visit func(n *LogicalSelectNode)
+	visit = func(n *LogicalSelectNode) {
+		switch n.exprType {
+		case ExprStar:
+			ok = false
+			return
+		case ExprField:
+			if n.field == "*" {
+				return
+			}
+			tab, field, resolved := resolveColumn(c, plan, n)
+			if !resolved {
+				//names of computed select expressions, e.g., in ORDER BY
+				if n.table == "" && selectAliased(plan, n.field) {
+					return
+				}
+				ok = false
+				return
+			}
+			if used[tab] == nil {
+				used[tab] = make(map[string]bool)
+			}
+			used[tab][field] = true
+		}
+		for _, arg := range n.args {
+			visit(arg)
+		}
+		for _, oby := range n.aggOrderBy {
+			visit(oby.expr)
+		}
+		if n.window != nil {
+			for _, p := range n.window.partitionBy {
+				visit(p)
+			}
+			for _, oby := range n.window.orderBy {
+				visit(oby.expr)
+			}
+		}
+	}
+	for _, s := range plan.selects {
+		visit(s)
+	}
+	for _, s := range plan.aggs {
+		visit(s)
+	}
+	for _, s := range plan.windows {
+		visit(s)
+	}
+	for _, gby := range plan.groupByFields {
+		visit(gby.expr)
+	}
+	for _, h := range plan.having {
+		visit(&h.fieldExpr)
+		visit(&h.constExpr)
+	}
+	for _, oby := range plan.orderByFields {
+		visit(oby.expr)
+	}
+	for _, j := range plan.joins {
+		visit(j.left)
+		visit(j.right)
+	}
+	for _, sq := range plan.subqueryPreds {
+		if sq.expr != nil {
+			visit(sq.expr)
+		}
+		for _, ref := range sq.outerRefs {
+			visit(&ref.node)
+		}
+	}
+	if withFilters {
+		for _, f := range plan.filters {
+			visit(&f.fieldExpr)
+			visit(&f.constExpr)
+		}
+	}
+	return used, ok
+}
+
+// Return true if an expression of the select list of plan is named name.
+func selectAliased(plan *LogicalPlan, name string) bool {
+	for _, s := range plan.selects {
+		if s.alias == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if a clause of plan other than its select list refers to name
+// without a table, and so possibly to an expression of the select list.
+func refersToName(plan *LogicalPlan, name string) bool {
+	var visit func(n *LogicalSelectNode) bool
+	visit = func(n *LogicalSelectNode) bool {
+		if n.exprType == ExprField && n.table == "" && n.field == name {
+			return true
+		}
+		for _, arg := range n.args {
+			if visit(arg) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, oby := range plan.orderByFields {
+		if visit(oby.expr) {
+			return true
+		}
+	}
+	for _, h := range plan.having {
+		if visit(&h.fieldExpr) || visit(&h.constExpr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove the columns of the subqueries of plan that plan does not use.  The
+// select lists of DISTINCT subqueries are kept, as they determine which
+// tuples are duplicates.
+func pruneSubqueryColumns(c *Catalog, plan *LogicalPlan) {
+	if len(plan.subqueries) == 0 {
+		return
+	}
+	used, ok := usedColumns(c, plan, true)
+	if !ok {
+		return
+	}
+	for _, sub := range plan.subqueries {
+		if sub.cte != nil || sub.distinct {
+			continue
+		}
+		var selects []*LogicalSelectNode
+		for _, s := range sub.selects {
+			if s.exprType == ExprStar {
+				selects = sub.selects
+				break
+			}
+			name := selectName(s)
+			if name == "" || used[sub.alias][name] || refersToName(sub, name) {
+				selects = append(selects, s)
+			}
+		}
+		if len(selects) == 0 {
+			selects = sub.selects[:1]
+		}
+		sub.selects = selects
+	}
+}
+
+// Narrow the inputs of the joins of plan in tableMap, which have been
+// filtered already, to the columns used by the joins and the rest of the
+// query, so that the joins buffer and copy smaller tuples.
+func pruneJoinInputs(c *Catalog, plan *LogicalPlan, tableMap map[string]*PlanNode) error {
+	used, ok := usedColumns(c, plan, false)
+	if !ok {
+		return nil
+	}
+	for _, name := range fromNames(plan) {
+		node := tableMap[name]
+		if node == nil {
+			continue
+		}
+		opDesc := node.op.Descriptor()
+		var exprs []Expr
+		var names []string
+		var fields []FieldType
+		for i, f := range node.desc.Fields {
+			if used[name][f.Fname] {
+				exprs = append(exprs, &FieldExpr{opDesc.Fields[i]})
+				names = append(names, opDesc.Fields[i].Fname)
+				fields = append(fields, f)
+			}
+		}
+		if len(fields) == len(node.desc.Fields) {
+			continue
+		}
+		if len(fields) == 0 {
+			//only the number of tuples is used, e.g., by count(*)
+			exprs = []Expr{&FieldExpr{opDesc.Fields[0]}}
+			names = []string{opDesc.Fields[0].Fname}
+			fields = []FieldType{node.desc.Fields[0]}
+		}
+		op, err := NewProjectOp(exprs, names, false, node.op)
+		if err != nil {
+			return err
+		}
+		tableMap[name] = &PlanNode{op, &TupleDesc{fields}}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package godb
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// return the operators of the plan op, in preorder
+func planOps(op Operator) []Operator {
+	ops := []Operator{op}
+	for _, child := range planChildren(op) {
+		ops = append(ops, planOps(*child)...)
+	}
+	return ops
+}
+
+// return the filters of the plan op
+func planFilters(op Operator) []Operator {
+	var filters []Operator
+	for _, o := range planOps(op) {
+		switch o.(type) {
+		case *Filter[int64], *Filter[string]:
+			filters = append(filters, o)
+		}
+	}
+	return filters
+}
+
+// return the results of sql, as sorted strings
+func sortedResults(t *testing.T, c *Catalog, bp *BufferPool, sql string) []string {
+	var res []string
+	for _, tup := range runParsedQuery(t, c, bp, sql) {
+		res = append(res, tup.PrettyPrintString(false))
+	}
+	sort.Strings(res)
+	return res
+}
+
+func parsePlan(t *testing.T, c *Catalog, sql string) Operator {
+	_, plan, err := Parse(c, sql)
+	if err != nil {
+		t.Fatalf("failed to parse, q=%s, %s", sql, err.Error())
+	}
+	return plan
+}
+
+func TestFoldConstants(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+
+	for _, q := range []struct{ sql, expected string }{
+		{"select name, age from t where 50 < age", "select name, age from t where age > 50"},
+		{"select name, age from t where age > 40 + 10", "select name, age from t where age > 50"},
+		{"select name, age from t where 1 = 1", "select name, age from t"},
+		{"select name, age from t where 'ab' < getsubstr('xac', 1, 2) and age >= 50", "select name, age from t where age >= 50"},
+	} {
+		res, expected := sortedResults(t, c, bp, q.sql), sortedResults(t, c, bp, q.expected)
+		if !reflect.DeepEqual(res, expected) {
+			t.Errorf("%s: expected %v, got %v", q.sql, expected, res)
+		}
+	}
+
+	filters := planFilters(parsePlan(t, c, "select name from t where age > 40 + 10"))
+	if len(filters) != 1 {
+		t.Fatalf("expected one filter, got %d", len(filters))
+	}
+	if _, ok := filters[0].(*Filter[int64]).right.(*ConstExpr); !ok {
+		t.Errorf("expected the filter to compare with a constant, got %s", exprToStr(filters[0].(*Filter[int64]).right))
+	}
+	if len(planFilters(parsePlan(t, c, "select name from t where 1 = 1"))) != 0 {
+		t.Errorf("expected a true predicate to be dropped")
+	}
+	if res := runParsedQuery(t, c, bp, "select name from t where 1 = 0"); len(res) != 0 {
+		t.Errorf("expected a false predicate to return nothing, got %d tuples", len(res))
+	}
+	if res := runParsedQuery(t, c, bp, "select count(*) from t where 2 < 1"); len(res) != 1 || res[0].Fields[0].(IntField).Value != 0 {
+		t.Errorf("expected a count of 0, got %v", res)
+	}
+}
+
+func TestInferPredicates(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+
+	sql := "select t.name, t2.age from t join t2 on t.name = t2.name where t.name = 'sam'"
+	if n := len(planFilters(parsePlan(t, c, sql))); n != 2 {
+		t.Errorf("expected the predicate on t.name to be applied to t2.name too, got %d filters", n)
+	}
+	expected := sortedResults(t, c, bp, "select t.name, t2.age from t join t2 on t.name = t2.name where t.name = 'sam' and t2.name = 'sam'")
+	if res := sortedResults(t, c, bp, sql); len(res) == 0 || !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+
+	// predicates are not repeated
+	sql = "select t.name from t join t2 on t.name = t2.name where t.name = 'sam' and t2.name = 'sam'"
+	if n := len(planFilters(parsePlan(t, c, sql))); n != 2 {
+		t.Errorf("expected 2 filters, got %d", n)
+	}
+}
+
+func TestPushDownPredicates(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+
+	for _, q := range []struct {
+		sql, expected string
+		pushed        bool
+	}{
+		{"select sq.n from (select name n, age a from t) sq where sq.a > 50",
+			"select name from t where age > 50", true},
+		{"select sq.x from (select age + 1 x from t) sq where sq.x > 51",
+			"select age + 1 from t where age + 1 > 51", true},
+		{"select sq.name, sq.cnt from (select name, count(*) cnt from t group by name) sq where sq.cnt > 1",
+			"select name, count(*) cnt from t group by name having count(*) > 1", true},
+		{"select sq.name from (select name from t group by name) sq where sq.name = 'sam'",
+			"select name from t where name = 'sam' group by name", true},
+		{"select sq.name from (select name, age from t order by age limit 5) sq where sq.age > 30",
+			"select name from (select name, age from t order by age limit 5) sq where sq.age > 30", false},
+	} {
+		res, expected := sortedResults(t, c, bp, q.sql), sortedResults(t, c, bp, q.expected)
+		if len(res) == 0 || !reflect.DeepEqual(res, expected) {
+			t.Errorf("%s: expected %v, got %v", q.sql, expected, res)
+		}
+		plan := parsePlan(t, c, q.sql)
+		_, filterOnTop := plan.(*Project).child.(*Filter[int64])
+		if filterOnTop == q.pushed {
+			t.Errorf("%s: expected pushed=%v, got plan\n%v", q.sql, q.pushed, describeOp(plan.(*Project).child))
+		}
+	}
+
+	// predicates are pushed through several subqueries
+	plan := parsePlan(t, c, "select s2.a from (select s1.a from (select age a from t) s1) s2 where s2.a > 50")
+	ops := planOps(plan)
+	if _, ok := ops[len(ops)-2].(*Filter[int64]); !ok {
+		t.Errorf("expected the predicate to filter the scan, got %s", describeOp(ops[len(ops)-2]))
+	}
+}
+
+func TestPruneColumns(t *testing.T) {
+	c, bp := makeParserTestCatalog(t)
+
+	sql := "select t.name from t join t2 on t.name = t2.name where t.age > 50"
+	for _, o := range planOps(parsePlan(t, c, sql)) {
+		if j, ok := o.(*EqualityJoin[string]); ok {
+			for _, child := range []Operator{*j.left, *j.right} {
+				if n := len(child.Descriptor().Fields); n != 1 {
+					t.Errorf("expected the inputs of the join to be narrowed to one column, got %d", n)
+				}
+			}
+		}
+	}
+	expected := sortedResults(t, c, bp, "select t.name from t join t2 on t.name = t2.name where t.age > 50 and t.age > 0")
+	if res := sortedResults(t, c, bp, sql); len(res) == 0 || !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+
+	// unused columns of subqueries are not computed
+	plan := parsePlan(t, c, "select sq.n from (select name n, age a, age + 1 b from t) sq")
+	if n := len(plan.(*Project).child.Descriptor().Fields); n != 1 {
+		t.Errorf("expected the subquery to compute one column, got %d", n)
+	}
+	// but those of distinct subqueries are
+	plan = parsePlan(t, c, "select sq.n from (select distinct name n, age a from t) sq")
+	if n := len(plan.(*Project).child.Descriptor().Fields); n != 2 {
+		t.Errorf("expected the distinct subquery to compute two columns, got %d", n)
+	}
+	// and so are those used by the subquery's order by
+	if res := runParsedQuery(t, c, bp, "select sq.n from (select name n, age a from t order by a limit 3) sq"); len(res) != 3 {
+		t.Errorf("expected 3 results, got %d", len(res))
+	}
+	if res := runParsedQuery(t, c, bp, "select count(*) from t join t2 on t.name = t2.name"); len(res) != 1 || res[0].Fields[0].(IntField).Value == 0 {
+		t.Errorf("expected a count of joined tuples, got %v", res)
+	}
+}
@@ -0,0 +1,152 @@
+package godb
+
+import (
+	"context"
+	"fmt"
+)
+
+// SetOpType is the kind of set operation a [SetOp] performs.
+type SetOpType int
+
+const (
+	UnionOp     SetOpType = iota
+	IntersectOp SetOpType = iota
+	ExceptOp    SetOpType = iota
+)
+
+func (t SetOpType) String() string {
+	switch t {
+	case IntersectOp:
+		return "Intersect"
+	case ExceptOp:
+		return "Except"
+	}
+	return "Union"
+}
+
+// SetOp combines the tuples of two children with the same number and types
+// of fields.  Unless all is set, the result is a set, i.e., duplicates are
+// removed (UNION, INTERSECT and EXCEPT); otherwise duplicates are kept
+// according to the bag semantics of UNION ALL, INTERSECT ALL and EXCEPT ALL.
+// The fields of the result are named after those of the left child.
+type SetOp struct {
+	op          SetOpType
+	all         bool
+	left, right Operator
+	desc        *TupleDesc
+}
+
+// Construct a set operation, or return an error if the children's tuples
+// are not compatible.
+func NewSetOp(op SetOpType, all bool, left Operator, right Operator) (*SetOp, error) {
+	ld := left.Descriptor()
+	rd := right.Descriptor()
+	if len(ld.Fields) != len(rd.Fields) {
+		return nil, GoDBError{IncompatibleTypesError, fmt.Sprintf("each side of %s must have the same number of fields (%d vs %d)", op, len(ld.Fields), len(rd.Fields))}
+	}
+	for i := range ld.Fields {
+		if ld.Fields[i].Ftype != rd.Fields[i].Ftype {
+			return nil, GoDBError{IncompatibleTypesError, fmt.Sprintf("field %d of %s has type %s on the left and %s on the right", i+1, op, typeNames[ld.Fields[i].Ftype], typeNames[rd.Fields[i].Ftype])}
+		}
+	}
+	return &SetOp{op, all, left, right, ld.copy()}, nil
+}
+
+func (s *SetOp) Descriptor() *TupleDesc {
+	return s.desc.copy()
+}
+
+// Return the tuple with the descriptor of the set operation, and its key for
+// detecting duplicates.
+func (s *SetOp) retag(t *Tuple) (*Tuple, any) {
+	tup := &Tuple{*s.desc, t.Fields, nil}
+	return tup, tup.tupleKey()
+}
+
+// Read all tuples of op, counting the occurrences of each distinct tuple.
+func (s *SetOp) countTuples(ctx context.Context, op Operator, tid TransactionID) (map[any]int, error) {
+	iter, err := IteratorContext(ctx, op, tid)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[any]int)
+	for {
+		t, err := iter()
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			return counts, nil
+		}
+		_, key := s.retag(t)
+		counts[key]++
+	}
+}
+
+// Return an iterator over the result of the set operation.  UNION streams
+// the tuples of its children, remembering the keys of those it has returned
+// when removing duplicates; INTERSECT and EXCEPT first read the right child
+// into a hash table, and then stream the left child.
+func (s *SetOp) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	return s.IteratorContext(context.Background(), tid)
+}
+
+func (s *SetOp) IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error) {
+	var rightCounts map[any]int
+	if s.op != UnionOp {
+		var err error
+		rightCounts, err = s.countTuples(ctx, s.right, tid)
+		if err != nil {
+			return nil, err
+		}
+	}
+	iter, err := IteratorContext(ctx, s.left, tid)
+	if err != nil {
+		return nil, err
+	}
+	onRight := false
+	seen := make(map[any]bool)
+	return func() (*Tuple, error) {
+		for {
+			t, err := iter()
+			if err != nil {
+				return nil, err
+			}
+			if t == nil {
+				if s.op != UnionOp || onRight {
+					return nil, nil
+				}
+				onRight = true
+				iter, err = IteratorContext(ctx, s.right, tid)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			tup, key := s.retag(t)
+			if !s.all && seen[key] {
+				continue
+			}
+			switch s.op {
+			case IntersectOp:
+				if rightCounts[key] == 0 {
+					continue
+				}
+				if s.all {
+					rightCounts[key]--
+				}
+			case ExceptOp:
+				if rightCounts[key] > 0 {
+					if s.all {
+						rightCounts[key]--
+					}
+					continue
+				}
+			}
+			if !s.all {
+				seen[key] = true
+			}
+			return tup, nil
+		}
+	}, nil
+}
@@ -0,0 +1,53 @@
+package godb
+
+import (
+	"os"
+	"testing"
+)
+
+// test the bag semantics of the set operations over two heap files with
+// overlapping contents
+func TestSetOps(t *testing.T) {
+	_, t1, t2, hf, bp, tid := makeTestVars()
+	hf.insertTuple(&t1, tid)
+	hf.insertTuple(&t1, tid)
+	hf.insertTuple(&t2, tid)
+
+	os.Remove(TestingFile2)
+	hf2, err := NewHeapFile(TestingFile2, hf.Descriptor(), bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	hf2.insertTuple(&t1, tid)
+
+	cases := []struct {
+		op       SetOpType
+		all      bool
+		expected int
+	}{
+		{UnionOp, false, 2},
+		{UnionOp, true, 4},
+		{IntersectOp, false, 1},
+		{IntersectOp, true, 1},
+		{ExceptOp, false, 1},
+		{ExceptOp, true, 2},
+	}
+	for _, tc := range cases {
+		op, err := NewSetOp(tc.op, tc.all, hf, hf2)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		res := collectTuples(t, op, tid)
+		if len(res) != tc.expected {
+			t.Errorf("%s (all=%t): expected %d tuples, got %d", tc.op, tc.all, tc.expected, len(res))
+		}
+	}
+
+	proj, err := NewProjectOp([]Expr{&FieldExpr{hf.Descriptor().Fields[1]}}, []string{"age"}, false, hf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := NewSetOp(UnionOp, false, hf, proj); err == nil {
+		t.Errorf("expected union of tuples with different numbers of fields to fail")
+	}
+}
@@ -0,0 +1,89 @@
+package godb
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"unsafe"
+)
+
+// spillFile is a temporary, append-only run of tuples that share a
+// TupleDesc. Operators that cannot keep all of their intermediate state in
+// memory (e.g., the hash aggregator) write tuples to a spillFile and read them
+// back later with [spillFile.iterator]. Tuples are serialized with
+// [Tuple.writeTo], so they have the same fixed-length layout as heap pages.
+//
+// The backing file is removed by [spillFile.close].
+type spillFile struct {
+	desc    *TupleDesc
+	file    *os.File
+	writer  *bufio.Writer
+	tupSize int
+	count   int
+}
+
+// Create a new, empty spill file for tuples of the specified TupleDesc.
+func newSpillFile(desc *TupleDesc) (*spillFile, error) {
+	f, err := os.CreateTemp("", "godb-spill-*")
+	if err != nil {
+		return nil, err
+	}
+	return &spillFile{desc.copy(), f, bufio.NewWriter(f), tupleSize(desc), 0}, nil
+}
+
+// Return the number of bytes used to serialize a tuple of the specified
+// TupleDesc.
+func tupleSize(desc *TupleDesc) int {
+	size := 0
+	for _, f := range desc.Fields {
+		switch f.Ftype {
+		case IntType:
+			size += int(unsafe.Sizeof(int64(0)))
+		case StringType:
+			size += StringLength * int(unsafe.Sizeof(byte('a')))
+		}
+	}
+	return size
+}
+
+// Append a tuple to the end of the spill file.
+func (s *spillFile) append(t *Tuple) error {
+	// 使用spill文件的描述符序列化，保证读写的格式一致
+	tup := Tuple{*s.desc, t.Fields, nil}
+	buf := bytes.NewBuffer(make([]byte, 0, s.tupSize))
+	if err := tup.writeTo(buf); err != nil {
+		return err
+	}
+	if _, err := s.writer.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	s.count++
+	return nil
+}
+
+// Return an iterator over the tuples appended to the spill file so far, in
+// the order they were appended.
+func (s *spillFile) iterator() (func() (*Tuple, error), error) {
+	if err := s.writer.Flush(); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(io.NewSectionReader(s.file, 0, int64(s.count*s.tupSize)))
+	rec := make([]byte, s.tupSize)
+	return func() (*Tuple, error) {
+		_, err := io.ReadFull(r, rec)
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return readTupleFrom(bytes.NewBuffer(rec), s.desc)
+	}, nil
+}
+
+// Close the spill file and remove it from disk.
+func (s *spillFile) close() error {
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
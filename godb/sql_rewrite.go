@@ -0,0 +1,400 @@
+package godb
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The SQL parser GoDB uses (github.com/xwb1989/sqlparser) implements the
+// MySQL 5.7 dialect, which lacks some of the syntax GoDB supports.  Before a
+// query is handed to the parser, preprocessQuery rewrites such syntax into
+// something the parser accepts, and that parseStatement knows how to undo.
+
+// Name of the function that window function calls are rewritten into:
+//
+//	f(args) OVER (spec)  =>  godb_over(f(args), 'spec')
+const windowFuncPlaceholder = "godb_over"
+
+// A word (identifier, keyword or number) in a query, outside of comments,
+// string literals and quoted identifiers.
+type sqlWord struct {
+	text       string
+	start, end int // query[start:end] == text
+}
+
+// The words of a query and the positions of its matching parentheses.
+type scannedSQL struct {
+	query        string
+	words        []sqlWord
+	closeParen   map[int]int // position of '(' -> position of its ')'
+	openParen    map[int]int // position of ')' -> position of its '('
+	marks        []int       // positions of ? parameter placeholders
+	commentEnd   map[int]int // start of a comment -> position after its end
+	commentStart map[int]int // last character of a comment -> its start
+}
+
+func isWordChar(ch byte) bool {
+	return ch == '_' || ch == '$' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9')
+}
+
+// Split a query into words, skipping comments, string literals and quoted
+// identifiers, and match its parentheses.  As in the parser, a comment is
+// either enclosed in /* */ or runs from --, # or // to the end of the line.
+func scanSQL(query string) (*scannedSQL, error) {
+	s := &scannedSQL{query, nil, make(map[int]int), make(map[int]int), nil, make(map[int]int), make(map[int]int)}
+	var parens []int
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		switch {
+		case ch == '\'' || ch == '"' || ch == '`':
+			j := i + 1
+			for ; j < len(query); j++ {
+				if query[j] == '\\' && ch != '`' {
+					j++
+				} else if query[j] == ch {
+					if j+1 < len(query) && query[j+1] == ch {
+						j++ // doubled quote
+					} else {
+						break
+					}
+				}
+			}
+			if j >= len(query) {
+				return nil, GoDBError{ParseError, "unterminated quoted string in query"}
+			}
+			i = j
+		case ch == '#' || ((ch == '-' || ch == '/') && i+1 < len(query) && query[i+1] == ch):
+			end := len(query)
+			if j := strings.IndexByte(query[i:], '\n'); j >= 0 {
+				end = i + j
+			}
+			s.commentEnd[i], s.commentStart[end-1] = end, i
+			i = end - 1
+		case ch == '/' && i+1 < len(query) && query[i+1] == '*':
+			j := strings.Index(query[i+2:], "*/")
+			if j < 0 {
+				return nil, GoDBError{ParseError, "unterminated comment in query"}
+			}
+			end := i + j + 4
+			s.commentEnd[i], s.commentStart[end-1] = end, i
+			i = end - 1
+		case ch == '(':
+			parens = append(parens, i)
+		case ch == ')':
+			if len(parens) == 0 {
+				return nil, GoDBError{ParseError, "unbalanced parentheses in query"}
+			}
+			open := parens[len(parens)-1]
+			parens = parens[:len(parens)-1]
+			s.closeParen[open] = i
+			s.openParen[i] = open
+		case ch == '?':
+			s.marks = append(s.marks, i)
+		case isWordChar(ch):
+			j := i
+			for j < len(query) && isWordChar(query[j]) {
+				j++
+			}
+			s.words = append(s.words, sqlWord{query[i:j], i, j})
+			i = j - 1
+		}
+	}
+	if len(parens) > 0 {
+		return nil, GoDBError{ParseError, "unbalanced parentheses in query"}
+	}
+	return s, nil
+}
+
+// Return the position of the first character at or after i that is neither
+// a space nor in a comment, or len(query) if there is none.
+func (s *scannedSQL) skipSpaceForward(i int) int {
+	for i < len(s.query) {
+		if end, ok := s.commentEnd[i]; ok {
+			i = end
+		} else if strings.ContainsRune(" \t\r\n", rune(s.query[i])) {
+			i++
+		} else {
+			break
+		}
+	}
+	return i
+}
+
+// Return the position of the last character at or before i that is neither a
+// space nor in a comment, or -1 if there is none.
+func (s *scannedSQL) skipSpaceBackward(i int) int {
+	for i >= 0 {
+		if start, ok := s.commentStart[i]; ok {
+			i = start - 1
+		} else if strings.ContainsRune(" \t\r\n", rune(s.query[i])) {
+			i--
+		} else {
+			break
+		}
+	}
+	return i
+}
+
+// Return the index of the word ending at position end, or -1.
+func (s *scannedSQL) wordEndingAt(end int) int {
+	for i, w := range s.words {
+		if w.end == end {
+			return i
+		}
+	}
+	return -1
+}
+
+// Return the index of the word starting at position start, or -1.
+func (s *scannedSQL) wordStartingAt(start int) int {
+	for i, w := range s.words {
+		if w.start == start {
+			return i
+		}
+	}
+	return -1
+}
+
+// Quote a string as a SQL string literal.
+func quoteSQLString(str string) string {
+	str = strings.ReplaceAll(str, `\`, `\\`)
+	str = strings.ReplaceAll(str, `'`, `\'`)
+	return "'" + str + "'"
+}
+
+// A replacement of query[start:end] by text.
+type sqlEdit struct {
+	start, end int
+	text       string
+}
+
+// Apply non-overlapping edits to a query.
+func applySQLEdits(query string, edits []sqlEdit) (string, error) {
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	var sb strings.Builder
+	pos := 0
+	for _, e := range edits {
+		if e.start < pos {
+			return "", GoDBError{ParseError, fmt.Sprintf("unsupported nesting in '%s'", query[e.start:e.end])}
+		}
+		sb.WriteString(query[pos:e.start])
+		sb.WriteString(e.text)
+		pos = e.end
+	}
+	sb.WriteString(query[pos:])
+	return sb.String(), nil
+}
+
+// Rewrite the window function calls of a query into calls of
+// windowFuncPlaceholder, whose second argument is the text of the OVER
+// clause.  OVER starts a window clause only between a function call and a
+// parenthesized window specification; elsewhere it is left to the parser,
+// e.g., as the name of a column or an alias.
+func rewriteWindowFunctions(query string) (string, error) {
+	s, err := scanSQL(query)
+	if err != nil {
+		return "", err
+	}
+	var edits []sqlEdit
+	for _, w := range s.words {
+		if !strings.EqualFold(w.text, "over") {
+			continue
+		}
+		specOpen := s.skipSpaceForward(w.end)
+		if specOpen >= len(query) || query[specOpen] != '(' {
+			continue
+		}
+		specClose := s.closeParen[specOpen]
+		callClose := s.skipSpaceBackward(w.start - 1)
+		if callClose < 0 || query[callClose] != ')' {
+			continue
+		}
+		nameWord := s.wordEndingAt(s.skipSpaceBackward(s.openParen[callClose]-1) + 1)
+		if nameWord < 0 {
+			continue
+		}
+		callStart := s.words[nameWord].start
+		spec := strings.TrimSpace(query[specOpen+1 : specClose])
+		text := fmt.Sprintf("%s(%s, %s)", windowFuncPlaceholder, query[callStart:callClose+1], quoteSQLString(spec))
+		edits = append(edits, sqlEdit{callStart, specClose + 1, text})
+	}
+	if len(edits) == 0 {
+		return query, nil
+	}
+	return applySQLEdits(query, edits)
+}
+
+// A set operation other than UNION, which the parser does not support, and
+// whether it keeps duplicates.
+type setOpMark struct {
+	op  SetOpType
+	all bool
+}
+
+// The set operations of a query that rewriteSetOperations rewrote into UNION
+// ALL, by the position of their right branch: the number of the SELECT
+// keyword that starts the branch, counting from 0 in the order of the query.
+type setOpMarks map[int]setOpMark
+
+// Rewrite INTERSECT and EXCEPT into UNION ALL,
+//
+//	a INTERSECT [ALL] b  =>  a UNION ALL b
+//
+// and likewise for EXCEPT, returning the operations that were rewritten.
+func rewriteSetOperations(query string) (string, setOpMarks, error) {
+	s, err := scanSQL(query)
+	if err != nil {
+		return "", nil, err
+	}
+	var edits []sqlEdit
+	marks := make(setOpMarks)
+	selects := 0 // number of SELECT keywords before the current word
+	for i, w := range s.words {
+		var mark setOpMark
+		switch strings.ToLower(w.text) {
+		case "select":
+			selects++
+			continue
+		case "intersect":
+			mark.op = IntersectOp
+		case "except":
+			mark.op = ExceptOp
+		default:
+			continue
+		}
+		end := w.end
+		next := i + 1
+		if next < len(s.words) {
+			switch strings.ToLower(s.words[next].text) {
+			case "all":
+				mark.all = true
+				end = s.words[next].end
+				next++
+			case "distinct":
+				end = s.words[next].end
+				next++
+			}
+		}
+		if next >= len(s.words) || !strings.EqualFold(s.words[next].text, "select") {
+			return "", nil, GoDBError{ParseError, fmt.Sprintf("expected select after %s", w.text)}
+		}
+		edits = append(edits, sqlEdit{w.start, end, "union all"})
+		marks[selects] = mark
+	}
+	if len(edits) == 0 {
+		return query, marks, nil
+	}
+	query, err = applySQLEdits(query, edits)
+	return query, marks, err
+}
+
+// A common table expression of a WITH clause
+type cteText struct {
+	name    string
+	columns []string //empty if the names of the columns of body are used
+	body    string
+}
+
+// Split a query starting with a WITH clause into its common table expressions
+// and the query that follows them, which are parsed separately:
+//
+//	WITH [RECURSIVE] name [(columns)] AS (body) [, ...] query
+//
+// Queries without a WITH clause are returned unchanged.
+func extractCTEs(query string) ([]cteText, bool, string, error) {
+	s, err := scanSQL(query)
+	if err != nil {
+		return nil, false, "", err
+	}
+	if len(s.words) == 0 || !strings.EqualFold(s.words[0].text, "with") || s.skipSpaceForward(0) != s.words[0].start {
+		return nil, false, query, nil
+	}
+	// return the index of the word at position pos, after any spaces
+	wordAt := func(pos int) int {
+		return s.wordStartingAt(s.skipSpaceForward(pos))
+	}
+	recursive := false
+	pos := s.words[0].end
+	if i := wordAt(pos); i >= 0 && strings.EqualFold(s.words[i].text, "recursive") {
+		recursive = true
+		pos = s.words[i].end
+	}
+	var ctes []cteText
+	for {
+		i := wordAt(pos)
+		if i < 0 {
+			return nil, false, "", GoDBError{ParseError, "expected name of common table expression in with clause"}
+		}
+		cte := cteText{name: strings.ToLower(s.words[i].text)}
+		pos = s.skipSpaceForward(s.words[i].end)
+		if pos < len(query) && query[pos] == '(' {
+			for _, col := range strings.Split(query[pos+1:s.closeParen[pos]], ",") {
+				cte.columns = append(cte.columns, strings.ToLower(strings.TrimSpace(col)))
+			}
+			pos = s.closeParen[pos] + 1
+		}
+		i = wordAt(pos)
+		if i < 0 || !strings.EqualFold(s.words[i].text, "as") {
+			return nil, false, "", GoDBError{ParseError, fmt.Sprintf("expected as after common table expression %s", cte.name)}
+		}
+		pos = s.skipSpaceForward(s.words[i].end)
+		if pos >= len(query) || query[pos] != '(' {
+			return nil, false, "", GoDBError{ParseError, fmt.Sprintf("expected parenthesized query for common table expression %s", cte.name)}
+		}
+		cte.body = query[pos+1 : s.closeParen[pos]]
+		ctes = append(ctes, cte)
+		pos = s.skipSpaceForward(s.closeParen[pos] + 1)
+		if pos >= len(query) || query[pos] != ',' {
+			return ctes, recursive, query[pos:], nil
+		}
+		pos++
+	}
+}
+
+// Rewrite the parameter placeholders of a prepared statement, either ? or
+// $1, $2, ..., into the bind variables :v1, :v2, ... of the parser, returning
+// the number of parameters.  ? placeholders are numbered in order, before the
+// query is split into parts that are parsed separately (see extractCTEs), so
+// that each part numbers them alike.
+func rewritePlaceholders(query string) (string, int, error) {
+	s, err := scanSQL(query)
+	if err != nil {
+		return "", 0, err
+	}
+	var edits []sqlEdit
+	n := 0
+	for i, pos := range s.marks {
+		edits = append(edits, sqlEdit{pos, pos + 1, fmt.Sprintf(":v%d", i+1)})
+		n = i + 1
+	}
+	for _, w := range s.words {
+		if w.text[0] != '$' {
+			continue
+		}
+		num, err := strconv.Atoi(w.text[1:])
+		if err != nil || num < 1 {
+			return "", 0, GoDBError{ParseError, fmt.Sprintf("invalid parameter %s", w.text)}
+		}
+		if len(s.marks) > 0 {
+			return "", 0, GoDBError{ParseError, "cannot mix ? and $n parameters"}
+		}
+		edits = append(edits, sqlEdit{w.start, w.end, fmt.Sprintf(":v%d", num)})
+		if num > n {
+			n = num
+		}
+	}
+	query, err = applySQLEdits(query, edits)
+	return query, n, err
+}
+
+// Rewrite syntax the SQL parser does not support, see above, returning the
+// set operations that the parsed query is marked with.
+func preprocessQuery(query string) (string, setOpMarks, error) {
+	query, err := rewriteWindowFunctions(query)
+	if err != nil {
+		return "", nil, err
+	}
+	return rewriteSetOperations(query)
+}
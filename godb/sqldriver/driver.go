@@ -0,0 +1,413 @@
+// Package sqldriver is a [database/sql] driver for GoDB, registered as
+// "godb".  The data source name is the directory of the database, as passed
+// to [godb.Open], optionally followed by options:
+//
+//	db, err := sql.Open("godb", "path/to/db?parallelism=4&memory_limit=67108864")
+//
+// The options are catalog (the name of the catalog file), buffer_pool_pages,
+// parallelism, memory_limit (in bytes) and vectorized (true or false); see
+// [godb.Options].  The connections opened with the same data source name
+// share one [godb.DB], which is closed with the last of them, and each is a
+// [godb.Session] of it, with its own transaction.  An open DB is used with
+// database/sql through [NewConnector].
+//
+// Statements take ? or $n parameters, whose values may be integers, strings
+// or byte slices.  Integer columns are returned as int64s and string columns
+// as strings.
+package sqldriver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/srmadden/godb"
+)
+
+func init() {
+	sql.Register("godb", godbDriver)
+}
+
+var godbDriver = &Driver{dbs: make(map[string]*sharedDB)}
+
+// Driver is the driver registered as "godb".
+type Driver struct {
+	mutex sync.Mutex
+	dbs   map[string]*sharedDB // by data source name
+}
+
+// sharedDB is a database opened by the driver, with the number of its open
+// connections.
+type sharedDB struct {
+	db    *godb.DB
+	conns int
+}
+
+// Open a connection to the database named by dsn.
+func (d *Driver) Open(dsn string) (driver.Conn, error) {
+	c, err := d.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return c.Connect(context.Background())
+}
+
+// Return a connector to the database named by dsn, which is opened by its
+// first connection.
+func (d *Driver) OpenConnector(dsn string) (driver.Connector, error) {
+	if _, _, err := parseDSN(dsn); err != nil {
+		return nil, err
+	}
+	return &connector{d: d, dsn: dsn}, nil
+}
+
+// Return the database named by dsn for a new connection, opening it unless
+// it is already open.
+func (d *Driver) acquire(dsn string) (*godb.DB, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	shared, ok := d.dbs[dsn]
+	if !ok {
+		dir, opts, err := parseDSN(dsn)
+		if err != nil {
+			return nil, err
+		}
+		db, err := godb.Open(dir, opts)
+		if err != nil {
+			return nil, err
+		}
+		shared = &sharedDB{db: db}
+		d.dbs[dsn] = shared
+	}
+	shared.conns++
+	return shared.db, nil
+}
+
+// Give back the database named by dsn once a connection to it is closed,
+// closing it with its last connection.
+func (d *Driver) release(dsn string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	shared, ok := d.dbs[dsn]
+	if !ok {
+		return nil
+	}
+	if shared.conns--; shared.conns > 0 {
+		return nil
+	}
+	delete(d.dbs, dsn)
+	return shared.db.Close()
+}
+
+// Split a data source name into the directory of the database and its
+// options.
+func parseDSN(dsn string) (string, *godb.Options, error) {
+	dir, query, _ := strings.Cut(dsn, "?")
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "", nil, err
+	}
+	opts := &godb.Options{}
+	for name := range values {
+		v := values.Get(name)
+		var err error
+		switch name {
+		case "catalog":
+			opts.Catalog = v
+		case "buffer_pool_pages":
+			opts.BufferPoolPages, err = strconv.Atoi(v)
+		case "parallelism":
+			opts.Parallelism, err = strconv.Atoi(v)
+		case "memory_limit":
+			opts.MemoryLimit, err = strconv.ParseInt(v, 10, 64)
+		case "vectorized":
+			opts.Vectorized, err = strconv.ParseBool(v)
+		default:
+			return "", nil, fmt.Errorf("godb: unknown option %s", name)
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("godb: invalid value %q of option %s", v, name)
+		}
+	}
+	return dir, opts, nil
+}
+
+// Return a connector to db, so that it may be used with [sql.OpenDB].  The
+// caller closes db once it is no longer used.
+func NewConnector(db *godb.DB) driver.Connector {
+	return &connector{db: db}
+}
+
+// connector connects either to an open database or, through the driver, to
+// the database named by a data source name.
+type connector struct {
+	db  *godb.DB
+	d   *Driver
+	dsn string
+}
+
+func (c *connector) Connect(context.Context) (driver.Conn, error) {
+	if c.d == nil {
+		return &conn{db: c.db, s: c.db.NewSession()}, nil
+	}
+	db, err := c.d.acquire(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{db: db, s: db.NewSession(), d: c.d, dsn: c.dsn}, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return godbDriver
+}
+
+// conn is a connection, which runs its statements in a session.
+type conn struct {
+	db  *godb.DB
+	s   *godb.Session
+	d   *Driver // driver that opened db, if any
+	dsn string
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+// Data definition statements cannot be prepared, but are run without being
+// prepared by ExecContext.
+func (c *conn) PrepareContext(_ context.Context, query string) (driver.Stmt, error) {
+	st, err := c.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &stmt{c: c, st: st}, nil
+}
+
+// Roll back the transaction of the connection, if any, and close the
+// database if the driver opened it and this is its last connection.
+func (c *conn) Close() error {
+	err := c.s.Close()
+	if c.d != nil {
+		if cerr := c.d.release(c.dsn); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// Transactions are serializable, as pages are locked until they end.
+func (c *conn) BeginTx(_ context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	switch sql.IsolationLevel(opts.Isolation) {
+	case sql.LevelDefault, sql.LevelSerializable:
+	default:
+		return nil, fmt.Errorf("godb: unsupported isolation level %s", sql.IsolationLevel(opts.Isolation))
+	}
+	if err := c.s.Begin(); err != nil {
+		return nil, err
+	}
+	return &tx{c.s}, nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	values, err := paramValues(args)
+	if err != nil {
+		return nil, err
+	}
+	n, err := c.s.ExecContext(ctx, query, values...)
+	if err != nil {
+		return nil, err
+	}
+	return result(n), nil
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	values, err := paramValues(args)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.s.QueryContext(ctx, query, values...)
+	if err != nil {
+		return nil, err
+	}
+	return &rows{r}, nil
+}
+
+// Return the values of the parameters of a statement, in order.
+func paramValues(args []driver.NamedValue) ([]any, error) {
+	values := make([]any, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, fmt.Errorf("godb: named parameter %s is not supported", arg.Name)
+		}
+		switch v := arg.Value.(type) {
+		case []byte:
+			values[i] = string(v)
+		default:
+			values[i] = v
+		}
+	}
+	return values, nil
+}
+
+// stmt is a prepared statement, which keeps its plan between executions.
+// A query run while the rows of another one are open gets a plan of its own;
+// see [godb.Stmt.Bind].
+type stmt struct {
+	c      *conn
+	st     *godb.Stmt
+	closed bool
+}
+
+// Close the statement, which may not be run again.  Its rows that are still
+// open remain valid.
+func (s *stmt) Close() error {
+	s.closed = true
+	return nil
+}
+
+// Return an error if the statement is closed.
+func (s *stmt) check() error {
+	if s.closed {
+		return fmt.Errorf("godb: statement is closed")
+	}
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	return len(s.st.ParamTypes())
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	values, err := paramValues(args)
+	if err != nil {
+		return nil, err
+	}
+	n, err := s.c.s.ExecStmt(ctx, s.st, values...)
+	if err != nil {
+		return nil, err
+	}
+	return result(n), nil
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	values, err := paramValues(args)
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.c.s.QueryStmt(ctx, s.st, values...)
+	if err != nil {
+		return nil, err
+	}
+	return &rows{r}, nil
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return named
+}
+
+type tx struct {
+	s *godb.Session
+}
+
+func (t *tx) Commit() error {
+	return t.s.Commit()
+}
+
+func (t *tx) Rollback() error {
+	return t.s.Rollback()
+}
+
+// result is the number of tuples a statement inserted or deleted.
+type result int64
+
+func (r result) LastInsertId() (int64, error) {
+	return 0, fmt.Errorf("godb: LastInsertId is not supported")
+}
+
+func (r result) RowsAffected() (int64, error) {
+	return int64(r), nil
+}
+
+type rows struct {
+	r *godb.Rows
+}
+
+func (r *rows) Columns() []string {
+	if cols := r.r.Columns(); cols != nil {
+		return cols
+	}
+	return []string{}
+}
+
+func (r *rows) Close() error {
+	return r.r.Close()
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if !r.r.Next() {
+		if err := r.r.Err(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	for i, f := range r.r.Tuple().Fields {
+		switch f := f.(type) {
+		case godb.IntField:
+			dest[i] = f.Value
+		case godb.StringField:
+			dest[i] = f.Value
+		default:
+			return fmt.Errorf("godb: unsupported value %v of column %d", f, i)
+		}
+	}
+	return nil
+}
+
+func (r *rows) ColumnTypeDatabaseTypeName(i int) string {
+	switch r.r.ColumnTypes()[i] {
+	case godb.IntType:
+		return "INT"
+	case godb.StringType:
+		return "VARCHAR"
+	}
+	return ""
+}
+
+func (r *rows) ColumnTypeScanType(i int) reflect.Type {
+	switch r.r.ColumnTypes()[i] {
+	case godb.IntType:
+		return reflect.TypeOf(int64(0))
+	case godb.StringType:
+		return reflect.TypeOf("")
+	}
+	return reflect.TypeOf(new(any)).Elem()
+}
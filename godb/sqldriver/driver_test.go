@@ -0,0 +1,291 @@
+package sqldriver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/srmadden/godb"
+)
+
+// open a database in a new directory with a table t of names and ages
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("godb", t.TempDir())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec("create table t (name varchar(20), age int)"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	ins, err := db.Prepare("insert into t values (?, ?)")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer ins.Close()
+	for i, name := range []string{"sam", "kathy", "bill", "ang"} {
+		res, err := ins.Exec(name, 20+10*i)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if n, _ := res.RowsAffected(); n != 1 {
+			t.Fatalf("expected one tuple to be inserted, got %d", n)
+		}
+	}
+	return db
+}
+
+type person struct {
+	name string
+	age  int64
+}
+
+// return the people in t older than age, by age
+func queryPeople(t *testing.T, q interface {
+	Query(string, ...any) (*sql.Rows, error)
+}, age int) []person {
+	t.Helper()
+	rows, err := q.Query("select name, age from t where age > $1 order by age", age)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer rows.Close()
+	var people []person
+	for rows.Next() {
+		var p person
+		if err := rows.Scan(&p.name, &p.age); err != nil {
+			t.Fatalf(err.Error())
+		}
+		people = append(people, p)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	return people
+}
+
+func TestDriverQuery(t *testing.T) {
+	db := openTestDB(t)
+	expected := []person{{"bill", 40}, {"ang", 50}}
+	if people := queryPeople(t, db, 30); !reflect.DeepEqual(people, expected) {
+		t.Errorf("expected %v, got %v", expected, people)
+	}
+
+	var n int
+	if err := db.QueryRow("select count(*) as n from t where name <> ?", "sam").Scan(&n); err != nil || n != 3 {
+		t.Errorf("expected a count of 3, got %d, %v", n, err)
+	}
+
+	rows, err := db.Query("select name, age from t")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if types[0].DatabaseTypeName() != "VARCHAR" || types[1].DatabaseTypeName() != "INT" {
+		t.Errorf("expected VARCHAR and INT columns, got %s and %s", types[0].DatabaseTypeName(), types[1].DatabaseTypeName())
+	}
+	rows.Close()
+
+	res, err := db.Exec("delete from t where age < ?", 35)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if n, _ := res.RowsAffected(); n != 2 {
+		t.Errorf("expected 2 tuples to be deleted, got %d", n)
+	}
+	if _, err := db.Exec("select * from nosuchtable"); err == nil {
+		t.Errorf("expected an error querying a missing table")
+	}
+}
+
+func TestDriverTransactions(t *testing.T) {
+	db := openTestDB(t)
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := tx.Exec("insert into t values (?, ?)", "tim", 60); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if people := queryPeople(t, tx, 55); len(people) != 1 {
+		t.Errorf("expected the transaction to see its insert, got %v", people)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if people := queryPeople(t, db, 55); len(people) != 0 {
+		t.Errorf("expected the insert to be rolled back, got %v", people)
+	}
+
+	tx, err = db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tx.Exec("insert into t values ('tim', 60)")
+	if err := tx.Commit(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if people := queryPeople(t, db, 55); !reflect.DeepEqual(people, []person{{"tim", 60}}) {
+		t.Errorf("expected the insert to be committed, got %v", people)
+	}
+
+	if _, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadUncommitted}); err == nil {
+		t.Errorf("expected an error starting a read uncommitted transaction")
+	}
+}
+
+func TestDriverConcurrentReaders(t *testing.T) {
+	db := openTestDB(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				var n int
+				if err := db.QueryRow("select count(*) from t").Scan(&n); err != nil || n != 4 {
+					t.Errorf("expected a count of 4, got %d, %v", n, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestDriverConnector(t *testing.T) {
+	gdb, err := godb.Open(t.TempDir(), &godb.Options{Vectorized: true})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := gdb.Exec("create table u (a int)"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := gdb.Exec("insert into u values (7)"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	db := sql.OpenDB(NewConnector(gdb))
+	defer db.Close()
+	var a any
+	if err := db.QueryRow("select a from u").Scan(&a); err != nil || a != int64(7) {
+		t.Errorf("expected 7, got %v, %v", a, err)
+	}
+
+	for _, opts := range []string{"?parallelism=x", "?nosuchoption=1"} {
+		if _, err := sql.Open("godb", t.TempDir()+opts); err == nil {
+			t.Errorf("%s: expected an error opening the database", opts)
+		}
+	}
+}
+
+func TestDriverStmtOverlap(t *testing.T) {
+	db := openTestDB(t)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer tx.Rollback()
+	st, err := tx.Prepare("select name from t where age < ?")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer st.Close()
+
+	// the second query runs while the rows of the first one are open
+	rows1, err := st.Query(35)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer rows1.Close()
+	var names []string
+	if rows1.Next() {
+		var name string
+		rows1.Scan(&name)
+		names = append(names, name)
+	}
+	rows2, err := st.Query(25)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var others []string
+	for rows2.Next() {
+		var name string
+		rows2.Scan(&name)
+		others = append(others, name)
+	}
+	if err := rows2.Err(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for rows1.Next() {
+		var name string
+		rows1.Scan(&name)
+		names = append(names, name)
+	}
+	if err := rows1.Err(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !reflect.DeepEqual(names, []string{"sam", "kathy"}) || !reflect.DeepEqual(others, []string{"sam"}) {
+		t.Errorf("expected [sam kathy] and [sam], got %v and %v", names, others)
+	}
+}
+
+func TestDriverClose(t *testing.T) {
+	dsn := t.TempDir()
+	db, err := sql.Open("godb", dsn)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := db.Exec("create table u (a int)"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := db.Exec("insert into u values (7)"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	godbDriver.mutex.Lock()
+	_, open := godbDriver.dbs[dsn]
+	godbDriver.mutex.Unlock()
+	if !open {
+		t.Errorf("expected the database to be open")
+	}
+
+	// the database is closed with its last connection, and opened again
+	db.Close()
+	godbDriver.mutex.Lock()
+	_, open = godbDriver.dbs[dsn]
+	godbDriver.mutex.Unlock()
+	if open {
+		t.Errorf("expected the database to be closed")
+	}
+	db, err = sql.Open("godb", dsn)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer db.Close()
+	var a int
+	if err := db.QueryRow("select a from u").Scan(&a); err != nil || a != 7 {
+		t.Errorf("expected 7, got %d, %v", a, err)
+	}
+
+	// a closed statement cannot be run
+	c, err := godbDriver.Open(dsn)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer c.Close()
+	st, err := c.Prepare("select a from u where a > ?")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	st.Close()
+	if _, err := st.Query([]driver.Value{int64(0)}); err == nil {
+		t.Errorf("expected an error running a closed statement")
+	}
+}
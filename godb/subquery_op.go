@@ -0,0 +1,313 @@
+package godb
+
+import (
+	"context"
+	"fmt"
+)
+
+// OuterRefExpr is a column of an outer query referenced by a correlated
+// subquery.  An [Apply] operator sets its value from each outer tuple before
+// re-evaluating the subquery.
+type OuterRefExpr struct {
+	field FieldType
+	value DBValue
+}
+
+// Create a reference to an outer column of the specified type.
+func NewOuterRefExpr(field FieldType) *OuterRefExpr {
+	return &OuterRefExpr{field: field}
+}
+
+func (r *OuterRefExpr) EvalExpr(_ *Tuple) (DBValue, error) {
+	if r.value == nil {
+		return nil, GoDBError{IllegalOperationError, fmt.Sprintf("outer reference to %s is not bound", r.field.Fname)}
+	}
+	return r.value, nil
+}
+
+func (r *OuterRefExpr) GetExprType() FieldType {
+	return r.field
+}
+
+// SemiJoin returns the tuples of its left child for which the right child has
+// a tuple with equal keys, or, for an anti join, has no such tuple.  It is the
+// decorrelated form of IN and EXISTS subqueries (and, for anti joins, of NOT
+// IN and NOT EXISTS), and hashes the keys of the right child's tuples before
+// streaming the left child.
+type SemiJoin struct {
+	left, right         Operator
+	leftKeys, rightKeys []Expr
+	anti                bool
+	keyDesc             *TupleDesc
+	memStat             //the hashed keys of the right child
+}
+
+// Construct a semi join (or, if anti is set, an anti join) of left and right
+// on the equality of each of leftKeys with the corresponding rightKeys.
+func NewSemiJoin(left Operator, leftKeys []Expr, right Operator, rightKeys []Expr, anti bool) (*SemiJoin, error) {
+	if len(leftKeys) != len(rightKeys) {
+		return nil, GoDBError{IllegalOperationError, "semi join requires the same number of keys on each side"}
+	}
+	keyDesc := &TupleDesc{}
+	for i := range leftKeys {
+		ft := leftKeys[i].GetExprType().Ftype
+		if ft != rightKeys[i].GetExprType().Ftype {
+			return nil, GoDBError{TypeMismatchError, "can't join fields of different types"}
+		}
+		keyDesc.Fields = append(keyDesc.Fields, FieldType{"", "", ft})
+	}
+	return &SemiJoin{left, right, leftKeys, rightKeys, anti, keyDesc, memStat{}}, nil
+}
+
+func (j *SemiJoin) Descriptor() *TupleDesc {
+	return j.left.Descriptor()
+}
+
+// Return the hash key of the values of keys on t.
+func (j *SemiJoin) key(t *Tuple, keys []Expr) (any, error) {
+	vals := make([]DBValue, len(keys))
+	for i, k := range keys {
+		v, err := k.EvalExpr(t)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = v
+	}
+	return (&Tuple{*j.keyDesc, vals, nil}).tupleKey(), nil
+}
+
+func (j *SemiJoin) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	return j.IteratorContext(context.Background(), tid)
+}
+
+func (j *SemiJoin) IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error) {
+	rightIter, err := IteratorContext(ctx, j.right, tid)
+	if err != nil {
+		return nil, err
+	}
+	rightKeys := make(map[any]bool)
+	mem := j.account(ctx, "semi join")
+	var size int64
+	for {
+		t, err := rightIter()
+		if err != nil {
+			mem.release(size)
+			return nil, err
+		}
+		if t == nil {
+			break
+		}
+		k, err := j.key(t, j.rightKeys)
+		if err == nil && !rightKeys[k] {
+			keySize := int64(16 * (len(j.rightKeys) + 1))
+			if err = mem.grow(keySize); err == nil {
+				rightKeys[k] = true
+				size += keySize
+			}
+		}
+		if err != nil {
+			mem.release(size)
+			return nil, err
+		}
+	}
+	leftIter, err := IteratorContext(ctx, j.left, tid)
+	if err != nil {
+		mem.release(size)
+		return nil, err
+	}
+	return func() (*Tuple, error) {
+		for {
+			t, err := leftIter()
+			if err != nil || t == nil {
+				mem.release(size)
+				size = 0
+				return nil, err
+			}
+			k, err := j.key(t, j.leftKeys)
+			if err != nil {
+				return nil, err
+			}
+			if rightKeys[k] != j.anti {
+				return t, nil
+			}
+		}
+	}, nil
+}
+
+// SubqueryPredType is the kind of subquery predicate an [Apply] evaluates.
+type SubqueryPredType int
+
+const (
+	ExistsPred    SubqueryPredType = iota // EXISTS (subquery)
+	NotExistsPred SubqueryPredType = iota // NOT EXISTS (subquery)
+	InPred        SubqueryPredType = iota // expr IN (subquery)
+	NotInPred     SubqueryPredType = iota // expr NOT IN (subquery)
+	ComparePred   SubqueryPredType = iota // expr op (scalar subquery)
+)
+
+func (p SubqueryPredType) String() string {
+	switch p {
+	case ExistsPred:
+		return "Exists"
+	case NotExistsPred:
+		return "Not Exists"
+	case InPred:
+		return "In"
+	case NotInPred:
+		return "Not In"
+	}
+	return "Compare"
+}
+
+// Apply returns the tuples of its child that satisfy a predicate on a
+// subquery.  If the subquery is correlated, i.e., refers to columns of the
+// child through [OuterRefExpr]s, it is re-evaluated for every child tuple
+// after binding the references; otherwise its results are computed once.
+type Apply struct {
+	child    Operator
+	subquery Operator
+	pred     SubqueryPredType
+	expr     Expr   // left side of IN and comparison predicates
+	op       BoolOp // operator of comparison predicates
+	refs     []*OuterRefExpr
+	bindings []Expr // expressions over the child's tuples that refs are bound to
+}
+
+// Construct an Apply operator.  expr and op are only used by InPred,
+// NotInPred and ComparePred, for which the subquery must return a single
+// field of the same type as expr.  Before each evaluation of the subquery,
+// refs[i] is bound to the value of bindings[i] on the child tuple.
+func NewApply(child Operator, subquery Operator, pred SubqueryPredType, expr Expr, op BoolOp, refs []*OuterRefExpr, bindings []Expr) (*Apply, error) {
+	if len(refs) != len(bindings) {
+		return nil, GoDBError{IllegalOperationError, "each outer reference requires a binding"}
+	}
+	if pred == InPred || pred == NotInPred || pred == ComparePred {
+		fields := subquery.Descriptor().Fields
+		if len(fields) != 1 {
+			return nil, GoDBError{ParseError, fmt.Sprintf("subquery must return one field, got %d", len(fields))}
+		}
+		if expr == nil || fields[0].Ftype != expr.GetExprType().Ftype {
+			return nil, GoDBError{TypeMismatchError, "subquery field does not match the type of the compared expression"}
+		}
+	}
+	return &Apply{child, subquery, pred, expr, op, refs, bindings}, nil
+}
+
+func (a *Apply) Descriptor() *TupleDesc {
+	return a.child.Descriptor()
+}
+
+// Return the values of the first field of the subquery's tuples, reading at
+// most limit tuples if limit > 0.
+func (a *Apply) subqueryValues(ctx context.Context, tid TransactionID, limit int) ([]DBValue, error) {
+	iter, err := IteratorContext(ctx, a.subquery, tid)
+	if err != nil {
+		return nil, err
+	}
+	var vals []DBValue
+	for limit <= 0 || len(vals) < limit {
+		t, err := iter()
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			break
+		}
+		var v DBValue
+		if len(t.Fields) > 0 {
+			v = t.Fields[0]
+		}
+		vals = append(vals, v)
+	}
+	return vals, nil
+}
+
+// Return the number of subquery tuples to read to evaluate the predicate.
+func (a *Apply) readLimit() int {
+	switch a.pred {
+	case ExistsPred, NotExistsPred:
+		return 1
+	case ComparePred:
+		return 2 // to detect scalar subqueries with more than one result
+	}
+	return 0
+}
+
+// Evaluate the predicate on a child tuple given the subquery's results.
+func (a *Apply) eval(t *Tuple, vals []DBValue) (bool, error) {
+	switch a.pred {
+	case ExistsPred:
+		return len(vals) > 0, nil
+	case NotExistsPred:
+		return len(vals) == 0, nil
+	}
+	v, err := a.expr.EvalExpr(t)
+	if err != nil {
+		return false, err
+	}
+	if a.pred == ComparePred {
+		if len(vals) > 1 {
+			return false, GoDBError{IllegalOperationError, "scalar subquery returned more than one tuple"}
+		}
+		if len(vals) == 0 {
+			// the subquery's value is NULL, so the comparison is not true
+			return false, nil
+		}
+		return evalValuePred(v, vals[0], a.op)
+	}
+	found := false
+	for _, sv := range vals {
+		if sv == v {
+			found = true
+			break
+		}
+	}
+	return found == (a.pred == InPred), nil
+}
+
+func (a *Apply) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	return a.IteratorContext(context.Background(), tid)
+}
+
+func (a *Apply) IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error) {
+	var cached []DBValue
+	if len(a.refs) == 0 {
+		var err error
+		cached, err = a.subqueryValues(ctx, tid, a.readLimit())
+		if err != nil {
+			return nil, err
+		}
+	}
+	childIter, err := IteratorContext(ctx, a.child, tid)
+	if err != nil {
+		return nil, err
+	}
+	return func() (*Tuple, error) {
+		for {
+			t, err := childIter()
+			if err != nil || t == nil {
+				return nil, err
+			}
+			vals := cached
+			if len(a.refs) > 0 {
+				for i, b := range a.bindings {
+					a.refs[i].value, err = b.EvalExpr(t)
+					if err != nil {
+						return nil, err
+					}
+				}
+				vals, err = a.subqueryValues(ctx, tid, a.readLimit())
+				if err != nil {
+					return nil, err
+				}
+			}
+			ok, err := a.eval(t, vals)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return t, nil
+			}
+		}
+	}, nil
+}
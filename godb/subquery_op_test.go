@@ -0,0 +1,101 @@
+package godb
+
+import (
+	"os"
+	"testing"
+)
+
+// build two heap files: hf with sam (25) twice and george jones (999), and
+// hf2 with sam (25)
+func makeSubqueryTestFiles(t *testing.T) (*HeapFile, *HeapFile, TransactionID) {
+	_, t1, t2, hf, bp, tid := makeTestVars()
+	hf.insertTuple(&t1, tid)
+	hf.insertTuple(&t1, tid)
+	hf.insertTuple(&t2, tid)
+
+	os.Remove(TestingFile2)
+	hf2, err := NewHeapFile(TestingFile2, hf.Descriptor(), bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	hf2.insertTuple(&t1, tid)
+	return hf, hf2, tid
+}
+
+func TestSemiJoin(t *testing.T) {
+	hf, hf2, tid := makeSubqueryTestFiles(t)
+	ageField := hf.Descriptor().Fields[1]
+	for _, anti := range []bool{false, true} {
+		j, err := NewSemiJoin(hf, []Expr{&FieldExpr{ageField}}, hf2, []Expr{&FieldExpr{ageField}}, anti)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		res := collectTuples(t, j, tid)
+		expected := 2
+		if anti {
+			expected = 1
+		}
+		if len(res) != expected {
+			t.Errorf("anti=%t: expected %d tuples, got %d", anti, expected, len(res))
+		}
+	}
+
+	nameField := hf.Descriptor().Fields[0]
+	if _, err := NewSemiJoin(hf, []Expr{&FieldExpr{ageField}}, hf2, []Expr{&FieldExpr{nameField}}, false); err == nil {
+		t.Errorf("expected semi join on keys of different types to fail")
+	}
+}
+
+func TestApply(t *testing.T) {
+	hf, hf2, tid := makeSubqueryTestFiles(t)
+	ageField := hf.Descriptor().Fields[1]
+
+	// correlated exists: tuples of hf2 with an age smaller than the outer age
+	ref := NewOuterRefExpr(ageField)
+	filter, err := NewIntFilter(ref, OpLt, &FieldExpr{ageField}, hf2)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	apply, err := NewApply(hf, filter, ExistsPred, nil, OpEq, []*OuterRefExpr{ref}, []Expr{&FieldExpr{ageField}})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	res := collectTuples(t, apply, tid)
+	if len(res) != 1 || res[0].Fields[1].(IntField).Value != 999 {
+		t.Errorf("expected only the tuple with age 999, got %v", res)
+	}
+
+	// uncorrelated scalar comparison
+	ages, err := NewProjectOp([]Expr{&FieldExpr{ageField}}, []string{"age"}, false, hf2)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	apply, err = NewApply(hf, ages, ComparePred, &FieldExpr{ageField}, OpGt, nil, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if res := collectTuples(t, apply, tid); len(res) != 1 {
+		t.Errorf("expected one tuple with age greater than 25, got %d", len(res))
+	}
+
+	// a scalar subquery that returns more than one tuple is an error
+	ages, err = NewProjectOp([]Expr{&FieldExpr{ageField}}, []string{"age"}, false, hf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	apply, err = NewApply(hf2, ages, ComparePred, &FieldExpr{ageField}, OpEq, nil, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, err := apply.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := iter(); err == nil {
+		t.Errorf("expected scalar subquery with several results to fail")
+	}
+
+	if _, err := NewApply(hf, hf2, InPred, &FieldExpr{ageField}, OpEq, nil, nil); err == nil {
+		t.Errorf("expected in subquery with two fields to fail")
+	}
+}
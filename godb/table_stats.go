@@ -0,0 +1,499 @@
+package godb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+// TableStats summarizes the contents of a table for the query optimizer.  It
+// is collected by ANALYZE (see [Catalog.Analyze]).
+type TableStats struct {
+	Rows    int64                   // number of tuples
+	Pages   int                     // number of pages of the heap file
+	Columns map[string]*ColumnStats // statistics of each field, by field name
+}
+
+// ColumnStats summarizes the values of a field of a table.
+type ColumnStats struct {
+	Type     DBType
+	Distinct int64 // estimated number of distinct values
+	// Bounds of an equi-depth histogram: the k buckets, between Bounds[i] and
+	// Bounds[i+1], each hold about 1/k of the values.  Bounds[0] and
+	// Bounds[k] are the smallest and largest value.  Empty for empty tables.
+	Bounds []DBValue
+}
+
+// The number of rows assumed for operators whose output cannot be estimated,
+// such as common table expressions.
+const defaultCardinality = 1000
+
+// Selectivities of predicates on fields without statistics, as in System R.
+const (
+	defaultEqSelectivity    = 0.1
+	defaultRangeSelectivity = 1.0 / 3
+	defaultLikeSelectivity  = 0.25
+)
+
+// The number of buckets of histograms, and of tuples sampled to build them.
+const (
+	histogramBuckets = 64
+	statsSampleSize  = 30000
+)
+
+// Compare two values of the same type, returning -1, 0 or 1.
+func compareValues(v1 DBValue, v2 DBValue) int {
+	switch v1 := v1.(type) {
+	case IntField:
+		v2 := v2.(IntField)
+		switch {
+		case v1.Value < v2.Value:
+			return -1
+		case v1.Value > v2.Value:
+			return 1
+		}
+	case StringField:
+		v2 := v2.(StringField)
+		switch {
+		case v1.Value < v2.Value:
+			return -1
+		case v1.Value > v2.Value:
+			return 1
+		}
+	}
+	return 0
+}
+
+// Return the fraction of the values of the column that equal v.
+func (s *ColumnStats) eqFraction(v DBValue) float64 {
+	k := len(s.Bounds) - 1
+	if k < 1 || compareValues(v, s.Bounds[0]) < 0 || compareValues(v, s.Bounds[k]) > 0 {
+		return 0
+	}
+	frac := 1 / math.Max(float64(s.Distinct), 1)
+	// a value that fills whole buckets is more frequent than average
+	full := 0
+	for i := 0; i < k; i++ {
+		if compareValues(s.Bounds[i], v) == 0 && compareValues(s.Bounds[i+1], v) == 0 {
+			full++
+		}
+	}
+	return math.Max(frac, float64(full)/float64(k))
+}
+
+// Return the fraction of the values of the column that are less than v,
+// interpolating linearly within the bucket of v for integers.
+func (s *ColumnStats) ltFraction(v DBValue) float64 {
+	k := len(s.Bounds) - 1
+	if k < 1 {
+		return 0
+	}
+	frac := 0.0
+	for i := 0; i < k; i++ {
+		lo, hi := s.Bounds[i], s.Bounds[i+1]
+		switch {
+		case compareValues(hi, v) < 0:
+			frac += 1
+		case compareValues(lo, v) < 0:
+			if lo, ok := lo.(IntField); ok {
+				hi := hi.(IntField)
+				frac += float64(v.(IntField).Value-lo.Value) / float64(hi.Value-lo.Value)
+			} else {
+				frac += 0.5
+			}
+		}
+	}
+	return frac / float64(k)
+}
+
+// Selectivity returns the estimated fraction of the values of the column for
+// which value op v holds.
+func (s *ColumnStats) Selectivity(op BoolOp, v DBValue) float64 {
+	if len(s.Bounds) == 0 {
+		return 0
+	}
+	if v == nil || s.Bounds[0] == nil || !sameType(v, s.Bounds[0]) {
+		return defaultRangeSelectivity
+	}
+	var sel float64
+	switch op {
+	case OpEq:
+		sel = s.eqFraction(v)
+	case OpNeq:
+		sel = 1 - s.eqFraction(v)
+	case OpLt:
+		sel = s.ltFraction(v)
+	case OpLe:
+		sel = s.ltFraction(v) + s.eqFraction(v)
+	case OpGt:
+		sel = 1 - s.ltFraction(v) - s.eqFraction(v)
+	case OpGe:
+		sel = 1 - s.ltFraction(v)
+	default:
+		sel = defaultLikeSelectivity
+	}
+	return math.Min(math.Max(sel, 0), 1)
+}
+
+// Return true if v1 and v2 have the same type.
+func sameType(v1 DBValue, v2 DBValue) bool {
+	_, int1 := v1.(IntField)
+	_, int2 := v2.(IntField)
+	return int1 == int2
+}
+
+// columnStatsJSON is the serialized form of [ColumnStats], in which the
+// bounds of the histogram are strings.
+type columnStatsJSON struct {
+	Type     DBType
+	Distinct int64
+	Bounds   []string
+}
+
+func (s *ColumnStats) MarshalJSON() ([]byte, error) {
+	js := columnStatsJSON{s.Type, s.Distinct, make([]string, len(s.Bounds))}
+	for i, b := range s.Bounds {
+		switch b := b.(type) {
+		case IntField:
+			js.Bounds[i] = strconv.FormatInt(b.Value, 10)
+		case StringField:
+			js.Bounds[i] = b.Value
+		}
+	}
+	return json.Marshal(js)
+}
+
+func (s *ColumnStats) UnmarshalJSON(data []byte) error {
+	var js columnStatsJSON
+	if err := json.Unmarshal(data, &js); err != nil {
+		return err
+	}
+	s.Type, s.Distinct, s.Bounds = js.Type, js.Distinct, make([]DBValue, len(js.Bounds))
+	for i, b := range js.Bounds {
+		switch js.Type {
+		case IntType:
+			v, err := strconv.ParseInt(b, 10, 64)
+			if err != nil {
+				return GoDBError{MalformedDataError, fmt.Sprintf("bad histogram bound %s", b)}
+			}
+			s.Bounds[i] = IntField{v}
+		default:
+			s.Bounds[i] = StringField{b}
+		}
+	}
+	return nil
+}
+
+// hyperLogLog estimates the number of distinct values added to it, with a
+// standard error of about 1.6% using 2^12 registers.
+type hyperLogLog struct {
+	registers []uint8
+}
+
+const hllPrecision = 12
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{make([]uint8, 1<<hllPrecision)}
+}
+
+// Return a 64 bit hash of v.
+func hashValue(v DBValue) uint64 {
+	h := fnv.New64a()
+	switch v := v.(type) {
+	case IntField:
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], uint64(v.Value))
+		h.Write(buf[:])
+	case StringField:
+		h.Write([]byte(v.Value))
+	}
+	// mix the bits, as the high bits of FNV of short inputs are poor
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (h *hyperLogLog) add(v DBValue) {
+	x := hashValue(v)
+	idx := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+func (h *hyperLogLog) estimate() int64 {
+	m := float64(len(h.registers))
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	est := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if est <= 2.5*m && zeros > 0 {
+		// linear counting is more accurate for small cardinalities
+		est = m * math.Log(m/float64(zeros))
+	}
+	return int64(math.Round(est))
+}
+
+// Build the equi-depth histogram of sorted sample values, with the exact
+// smallest and largest values of the column as its outer bounds.
+func equiDepthBounds(sample []DBValue, min DBValue, max DBValue) []DBValue {
+	n := len(sample)
+	if n == 0 {
+		return nil
+	}
+	k := histogramBuckets
+	if n < k {
+		k = n
+	}
+	bounds := make([]DBValue, k+1)
+	bounds[0] = min
+	for i := 1; i < k; i++ {
+		bounds[i] = sample[i*n/k-1]
+	}
+	bounds[k] = max
+	return bounds
+}
+
+// Return the statistics collected for the table stored in hf, scaled to its
+// current number of pages, or, if there are none, an estimate from the size
+// of its file that assumes full pages.
+func (c *Catalog) fileStats(hf *HeapFile) *TableStats {
+	pages := hf.NumPages()
+	for _, t := range c.tables {
+		if c.tableNameToFile(t.name) != hf.fromFile {
+			continue
+		}
+		c.planState.mutex.RLock()
+		s := c.stats[t.name]
+		c.planState.mutex.RUnlock()
+		if s == nil {
+			break
+		}
+		if s.Pages > 0 && pages != s.Pages {
+			scaled := *s
+			scaled.Rows = int64(float64(s.Rows) * float64(pages) / float64(s.Pages))
+			scaled.Pages = pages
+			return &scaled
+		}
+		return s
+	}
+	slots := newHeapPage(hf.Descriptor(), 0, hf).getNumSlots()
+	return &TableStats{Rows: int64(pages * slots), Pages: pages}
+}
+
+// opEstimate is the estimated output of an operator: its number of tuples,
+// and the statistics of the table it reads, if any, for estimating the
+// selectivity of predicates on its fields.
+type opEstimate struct {
+	rows  float64
+	table *TableStats
+}
+
+// Return the statistics of field, or nil if there are none.
+func (e opEstimate) column(field FieldType) *ColumnStats {
+	if e.table == nil {
+		return nil
+	}
+	return e.table.Columns[field.Fname]
+}
+
+// Return the estimated number of distinct values of field in the output,
+// which, if unknown, is assumed to be that of a key.
+func (e opEstimate) distinct(field FieldType) float64 {
+	if s := e.column(field); s != nil && s.Distinct > 0 {
+		return math.Min(float64(s.Distinct), e.rows)
+	}
+	return e.rows
+}
+
+// Estimate the output of op.
+func (c *Catalog) estimateOp(op Operator) opEstimate {
+	switch op := op.(type) {
+	case *HeapFile:
+		s := c.fileStats(op)
+		return opEstimate{math.Max(float64(s.Rows), 1), s}
+	case *Filter[int64]:
+		return c.estimateFilter(op.child, op.left, op.op, op.right)
+	case *Filter[string]:
+		return c.estimateFilter(op.child, op.left, op.op, op.right)
+	case *Project:
+		e := c.estimateOp(op.child)
+		if op.distinct {
+			e.table = nil
+		}
+		return e
+	case *LimitOp:
+		e := c.estimateOp(op.child)
+		if n, err := evalLimitCount(op.limitTups, "limit"); err == nil {
+			e.rows = math.Max(math.Min(e.rows, float64(n)), 1)
+		}
+		return e
+	case *OrderBy:
+		return c.estimateOp(op.child)
+	case *Window:
+		return c.estimateOp(op.child)
+	case *Materialize:
+		return c.estimateOp(op.child)
+	case *SemiJoin:
+		return c.estimateOp(op.left)
+	case *Apply:
+		return c.estimateOp(op.child)
+	case *cteScan:
+		return opEstimate{rows: c.estimateOp(op.cte.op).rows}
+	case *EqualityJoin[int64]:
+		return c.estimateJoin(*op.left, op.leftField, *op.right, op.rightField)
+	case *EqualityJoin[string]:
+		return c.estimateJoin(*op.left, op.leftField, *op.right, op.rightField)
+	case *SetOp:
+		return opEstimate{rows: c.estimateOp(op.left).rows + c.estimateOp(op.right).rows}
+	case *Gather:
+		return c.estimateOp(op.child)
+	case *ParallelAggregator:
+		return c.estimateOp(op.agg)
+	case *Aggregator:
+		if len(op.groupByFields) == 0 {
+			return opEstimate{rows: 1}
+		}
+		e := c.estimateOp(op.child)
+		rows := 1.0
+		for _, g := range op.groupByFields {
+			rows *= e.exprDistinct(g)
+		}
+		return opEstimate{rows: math.Min(rows, e.rows)}
+	case *ValueOp:
+		return opEstimate{rows: float64(len(op.exprs))}
+	case *InsertOp, *DeleteOp:
+		return opEstimate{rows: 1}
+	case *Analyze:
+		return opEstimate{rows: float64(len(op.tables))}
+	}
+	return opEstimate{rows: defaultCardinality}
+}
+
+// Return the estimated number of distinct values of expr in the output.
+func (e opEstimate) exprDistinct(expr Expr) float64 {
+	if f, ok := expr.(*FieldExpr); ok {
+		return e.distinct(f.selectField)
+	}
+	return e.rows
+}
+
+// Estimate the output of an equality join of left and right.
+func (c *Catalog) estimateJoin(left Operator, leftExpr Expr, right Operator, rightExpr Expr) opEstimate {
+	l, r := c.estimateOp(left), c.estimateOp(right)
+	d := math.Max(math.Max(l.exprDistinct(leftExpr), r.exprDistinct(rightExpr)), 1)
+	return opEstimate{rows: math.Max(l.rows*r.rows/d, 1)}
+}
+
+// Estimate the output of a filter of child on left op right.
+func (c *Catalog) estimateFilter(child Operator, left Expr, op BoolOp, right Expr) opEstimate {
+	e := c.estimateOp(child)
+	e.rows = math.Max(e.rows*e.selectivity(left, op, right), 1)
+	return e
+}
+
+// Return the estimated fraction of tuples that satisfy left op right, from
+// the histogram of the field if one side is a field with statistics and the
+// other a constant.
+func (e opEstimate) selectivity(left Expr, op BoolOp, right Expr) float64 {
+	field, ok := left.(*FieldExpr)
+	constExpr, isConst := right.(*ConstExpr)
+	if !ok || !isConst {
+		field, ok = right.(*FieldExpr)
+		constExpr, isConst = left.(*ConstExpr)
+		op = flipBoolOp(op)
+	}
+	if ok && isConst {
+		if s := e.column(field.selectField); s != nil {
+			v, _ := constExpr.val.(DBValue)
+			return s.Selectivity(op, v)
+		}
+	}
+	switch op {
+	case OpEq:
+		return defaultEqSelectivity
+	case OpNeq:
+		return 1 - defaultEqSelectivity
+	case OpLike:
+		return defaultLikeSelectivity
+	}
+	return defaultRangeSelectivity
+}
+
+// Scan the table named name and compute its statistics.
+func (c *Catalog) analyzeTable(name string, tid TransactionID) (*TableStats, error) {
+	file, err := c.GetTable(name)
+	if err != nil {
+		return nil, err
+	}
+	hf := file.(*HeapFile)
+	fields := hf.Descriptor().Fields
+	hlls := make([]*hyperLogLog, len(fields))
+	mins := make([]DBValue, len(fields))
+	maxs := make([]DBValue, len(fields))
+	for i := range fields {
+		hlls[i] = newHyperLogLog()
+	}
+	// a reservoir sample of the tuples, for the histograms
+	var sample []*Tuple
+	rng := rand.New(rand.NewSource(1)) //fixed, so that ANALYZE is repeatable
+	iter, err := hf.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	var rows int64
+	for {
+		t, err := iter()
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			break
+		}
+		rows++
+		for i, v := range t.Fields {
+			hlls[i].add(v)
+			if mins[i] == nil || compareValues(v, mins[i]) < 0 {
+				mins[i] = v
+			}
+			if maxs[i] == nil || compareValues(v, maxs[i]) > 0 {
+				maxs[i] = v
+			}
+		}
+		if len(sample) < statsSampleSize {
+			sample = append(sample, t)
+		} else if j := rng.Int63n(rows); j < statsSampleSize {
+			sample[j] = t
+		}
+	}
+
+	stats := &TableStats{rows, hf.NumPages(), make(map[string]*ColumnStats)}
+	for i, f := range fields {
+		vals := make([]DBValue, len(sample))
+		for j, t := range sample {
+			vals[j] = t.Fields[i]
+		}
+		sort.Slice(vals, func(a, b int) bool { return compareValues(vals[a], vals[b]) < 0 })
+		distinct := hlls[i].estimate()
+		if distinct > rows {
+			distinct = rows
+		}
+		stats.Columns[f.Fname] = &ColumnStats{f.Ftype, distinct, equiDepthBounds(vals, mins[i], maxs[i])}
+	}
+	return stats, nil
+}
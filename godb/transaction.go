@@ -1,12 +1,14 @@
 package godb
 
+import "sync/atomic"
+
 type TransactionID *int
 
-var nextTid = 0
+// 会话可能在不同的goroutine中同时开始事务
+var nextTid int64
 
 func NewTID() TransactionID {
-	id := nextTid
-	nextTid++
+	id := int(atomic.AddInt64(&nextTid, 1) - 1)
 	return &id
 }
 
@@ -140,6 +140,18 @@ func TestTransactions(t *testing.T) {
 	wg.Add(1)
 	go readXaction(hf, bp, &wg)
 	wg.Wait()
+	// c is shared by the runs of the test
+	if val := <-c; val == 0 {
+		t.Errorf("transaction test failed")
+	}
+}
+
+// Locks that time out must not pile up from one run of the transactions to
+// the next.
+func TestTransactionsRepeated(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		t.Run(fmt.Sprintf("run%d", i), TestTransactions)
+	}
 }
 
 func transactionTestSetUpVarLen(t *testing.T, tupCnt int, pgCnt int) (*BufferPool, *HeapFile, TransactionID, TransactionID, Tuple, Tuple) {
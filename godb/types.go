@@ -24,6 +24,9 @@ const (
 	IllegalOperationError   GoDBErrorCode = iota
 	DeadlockError           GoDBErrorCode = iota
 	IllegalTransactionError GoDBErrorCode = iota
+	DuplicateFunctionError  GoDBErrorCode = iota
+	QueryCancelledError     GoDBErrorCode = iota
+	MemoryLimitError        GoDBErrorCode = iota
 )
 
 type GoDBError struct {
@@ -35,6 +38,16 @@ func (e GoDBError) Error() string {
 	return fmt.Sprintf("code %d;  err: %s", e.code, e.errString)
 }
 
+// Return the code of the error, e.g., to report it to a client.
+func (e GoDBError) Code() GoDBErrorCode {
+	return e.code
+}
+
+// Return the description of the error, without its code.
+func (e GoDBError) Message() string {
+	return e.errString
+}
+
 const (
 	PageSize     int = 4096
 	StringLength int = 32
@@ -119,3 +132,18 @@ func evalPred[T constraints.Ordered](i1 T, i2 T, op BoolOp) bool {
 	return false
 
 }
+
+// Compare two values of the same type with op.
+func evalValuePred(v1 DBValue, v2 DBValue, op BoolOp) (bool, error) {
+	switch v1 := v1.(type) {
+	case IntField:
+		if v2, ok := v2.(IntField); ok {
+			return evalPred(v1.Value, v2.Value, op), nil
+		}
+	case StringField:
+		if v2, ok := v2.(StringField); ok {
+			return evalPred(v1.Value, v2.Value, op), nil
+		}
+	}
+	return false, GoDBError{TypeMismatchError, fmt.Sprintf("cannot compare %v and %v", v1, v2)}
+}
@@ -1,5 +1,7 @@
 package godb
 
+import "context"
+
 //methods to expose an array of constant expressions as tuples
 // to iterate through (e.g., for insert statements or select from a constant list)
 
@@ -27,6 +29,10 @@ func (v *ValueOp) Descriptor() *TupleDesc {
 }
 
 func (v *ValueOp) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	return v.IteratorContext(context.Background(), tid)
+}
+
+func (v *ValueOp) IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error) {
 	curTup := 0
 	return func() (*Tuple, error) {
 		if curTup >= len(v.exprs) {
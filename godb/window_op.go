@@ -0,0 +1,532 @@
+package godb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// WindowFuncKind is the kind of function a [Window] operator evaluates.
+type WindowFuncKind int
+
+const (
+	WindowRowNumber WindowFuncKind = iota // position of the row in its partition
+	WindowRank      WindowFuncKind = iota // rank with gaps after ties
+	WindowDenseRank WindowFuncKind = iota // rank without gaps after ties
+	WindowLag       WindowFuncKind = iota // value of an expression on a preceding row
+	WindowLead      WindowFuncKind = iota // value of an expression on a following row
+	WindowAggregate WindowFuncKind = iota // aggregate over the frame of the row
+)
+
+// FrameBoundKind is the kind of bound of a [WindowFrame].
+type FrameBoundKind int
+
+const (
+	UnboundedPreceding FrameBoundKind = iota
+	Preceding          FrameBoundKind = iota
+	CurrentRow         FrameBoundKind = iota
+	Following          FrameBoundKind = iota
+	UnboundedFollowing FrameBoundKind = iota
+)
+
+// FrameBound is the start or end of a [WindowFrame].  Offset is only used
+// by Preceding and Following bounds.
+type FrameBound struct {
+	Kind   FrameBoundKind
+	Offset int64
+}
+
+// WindowFrame specifies the rows of a partition that a windowed aggregate is
+// computed over, relative to the current row.  In a ROWS frame, offsets count
+// rows; in a RANGE frame, they are distances between values of the (single,
+// int) ORDER BY expression, and CURRENT ROW includes all peers of the row.
+type WindowFrame struct {
+	rows       bool
+	start, end FrameBound
+}
+
+// Construct a window frame, or return an error if the bounds are invalid,
+// e.g., the frame starts at UNBOUNDED FOLLOWING.
+func NewWindowFrame(rows bool, start FrameBound, end FrameBound) (*WindowFrame, error) {
+	if start.Kind == UnboundedFollowing || end.Kind == UnboundedPreceding {
+		return nil, GoDBError{ParseError, "invalid window frame bounds"}
+	}
+	if start.Kind > end.Kind {
+		return nil, GoDBError{ParseError, "window frame cannot start after its end"}
+	}
+	if start.Offset < 0 || end.Offset < 0 {
+		return nil, GoDBError{ParseError, "window frame offsets must not be negative"}
+	}
+	if (start.Kind == Preceding && end.Kind == Preceding && start.Offset < end.Offset) ||
+		(start.Kind == Following && end.Kind == Following && start.Offset > end.Offset) {
+		return nil, GoDBError{ParseError, "window frame cannot start after its end"}
+	}
+	return &WindowFrame{rows, start, end}, nil
+}
+
+// Return true if the frame has a PRECEDING or FOLLOWING bound with an offset.
+func (f *WindowFrame) hasOffset() bool {
+	for _, b := range []FrameBound{f.start, f.end} {
+		if b.Kind == Preceding || b.Kind == Following {
+			return true
+		}
+	}
+	return false
+}
+
+// WindowFunc is a function evaluated over the partition of each row by a
+// [Window] operator.
+type WindowFunc struct {
+	kind WindowFuncKind
+	name string
+
+	// for lag and lead, the expression to evaluate on the row offset rows
+	// away, and the value used when there is no such row in the partition
+	expr       Expr
+	offset     int
+	defaultVal DBValue
+
+	// for aggregates, the initialized template aggregation state and frame
+	agg   AggState
+	frame *WindowFrame
+}
+
+// Construct a ranking window function (row_number, rank or dense_rank) whose
+// result is named name.
+func NewRankingWindowFunc(kind WindowFuncKind, name string) (*WindowFunc, error) {
+	if kind != WindowRowNumber && kind != WindowRank && kind != WindowDenseRank {
+		return nil, GoDBError{IllegalOperationError, "not a ranking window function"}
+	}
+	return &WindowFunc{kind: kind, name: name}, nil
+}
+
+// Construct a lag or lead window function whose result is named name.  Since
+// GoDB has no NULLs, rows without a row offset rows before (lag) or after
+// (lead) them in their partition get defaultVal, or the zero value of the
+// expression's type if defaultVal is nil.
+func NewOffsetWindowFunc(kind WindowFuncKind, name string, expr Expr, offset int, defaultVal DBValue) (*WindowFunc, error) {
+	if kind != WindowLag && kind != WindowLead {
+		return nil, GoDBError{IllegalOperationError, "not an offset window function"}
+	}
+	if offset < 0 {
+		return nil, GoDBError{IllegalOperationError, "window function offset must not be negative"}
+	}
+	ftype := expr.GetExprType().Ftype
+	if defaultVal == nil {
+		switch ftype {
+		case IntType:
+			defaultVal = IntField{0}
+		case StringType:
+			defaultVal = StringField{""}
+		}
+	}
+	switch defaultVal.(type) {
+	case IntField:
+		if ftype != IntType {
+			return nil, GoDBError{TypeMismatchError, "default value of window function does not match its argument type"}
+		}
+	case StringField:
+		if ftype != StringType {
+			return nil, GoDBError{TypeMismatchError, "default value of window function does not match its argument type"}
+		}
+	}
+	return &WindowFunc{kind: kind, name: name, expr: expr, offset: offset, defaultVal: defaultVal}, nil
+}
+
+// Construct an aggregate window function from an initialized aggregation
+// state, whose alias names the result.  If frame is nil, the frame is the
+// whole partition when the window has no ORDER BY, and otherwise RANGE
+// BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW, as in standard SQL.
+func NewAggWindowFunc(agg AggState, frame *WindowFrame) *WindowFunc {
+	return &WindowFunc{kind: WindowAggregate, name: agg.GetTupleDesc().Fields[0].Fname, agg: agg, frame: frame}
+}
+
+// Return the type of the field the window function produces.
+func (f *WindowFunc) fieldType() FieldType {
+	switch f.kind {
+	case WindowLag, WindowLead:
+		return FieldType{f.name, "", f.expr.GetExprType().Ftype}
+	case WindowAggregate:
+		return FieldType{f.name, "", f.agg.GetTupleDesc().Fields[0].Ftype}
+	}
+	return FieldType{f.name, "", IntType}
+}
+
+// Window evaluates window functions.  It sorts its input on the PARTITION BY
+// expressions followed by the ORDER BY expressions, and appends the result
+// of each function to each input tuple.  Tuples are returned in that sorted
+// order.
+type Window struct {
+	partitionBy []Expr
+	orderBy     []Expr
+	ascending   []bool
+	funcs       []*WindowFunc
+	child       Operator
+	desc        *TupleDesc
+	memStat     //the buffered input
+}
+
+// Construct a Window operator that computes funcs over partitions of the
+// child's tuples with equal partitionBy values, ordered by orderBy within
+// each partition.
+func NewWindow(partitionBy []Expr, orderBy []Expr, ascending []bool, funcs []*WindowFunc, child Operator) (*Window, error) {
+	if len(orderBy) != len(ascending) {
+		return nil, GoDBError{IllegalOperationError, "length of orderBy and ascending not equal"}
+	}
+	fields := make([]FieldType, len(funcs))
+	for i, f := range funcs {
+		if f.kind == WindowAggregate && f.frame == nil {
+			start := FrameBound{UnboundedPreceding, 0}
+			end := FrameBound{UnboundedFollowing, 0}
+			if len(orderBy) > 0 {
+				end = FrameBound{CurrentRow, 0}
+			}
+			f.frame = &WindowFrame{false, start, end}
+		}
+		if f.kind == WindowAggregate && !f.frame.rows && f.frame.hasOffset() {
+			if len(orderBy) != 1 || orderBy[0].GetExprType().Ftype != IntType {
+				return nil, GoDBError{IllegalOperationError, "RANGE frames with offsets require a single int ORDER BY expression"}
+			}
+		}
+		fields[i] = f.fieldType()
+	}
+	desc := child.Descriptor().merge(&TupleDesc{fields})
+	return &Window{partitionBy, orderBy, ascending, funcs, child, desc, memStat{}}, nil
+}
+
+func (w *Window) Descriptor() *TupleDesc {
+	return w.desc.copy()
+}
+
+// Return an iterator over the child's tuples, sorted on the partition and
+// order expressions, each extended with the results of the window
+// functions.  The iterator is blocking: it reads all of the child's tuples
+// before returning the first result.
+func (w *Window) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	return w.IteratorContext(context.Background(), tid)
+}
+
+func (w *Window) IteratorContext(ctx context.Context, tid TransactionID) (func() (*Tuple, error), error) {
+	childIter, err := IteratorContext(ctx, w.child, tid)
+	if err != nil {
+		return nil, err
+	}
+	var tuples []*Tuple
+	mem := w.account(ctx, "window")
+	var size int64
+	for {
+		t, err := childIter()
+		if err == nil && t != nil {
+			err = mem.grow(tupleMemory(t))
+		}
+		if err != nil {
+			mem.release(size)
+			return nil, err
+		}
+		if t == nil {
+			break
+		}
+		size += tupleMemory(t)
+		tuples = append(tuples, t)
+	}
+	var sortErr error
+	sort.SliceStable(tuples, func(i, j int) bool {
+		res, err := w.compare(tuples[i], tuples[j])
+		if err != nil {
+			sortErr = err
+		}
+		return res == OrderedLessThan
+	})
+	if sortErr != nil {
+		mem.release(size)
+		return nil, sortErr
+	}
+
+	start := 0 // first tuple of the current partition
+	var results [][]DBValue
+	i := 0
+	return func() (*Tuple, error) {
+		if i >= len(tuples) {
+			mem.release(size)
+			size = 0
+			return nil, nil
+		}
+		if results == nil || i-start >= len(results) {
+			// compute the results of the next partition
+			start = i
+			end := i + 1
+			for end < len(tuples) {
+				same, err := w.samePartition(tuples[start], tuples[end])
+				if err != nil {
+					mem.release(size)
+					size = 0
+					return nil, err
+				}
+				if !same {
+					break
+				}
+				end++
+			}
+			results, err = w.evalPartition(tuples[start:end])
+			if err != nil {
+				mem.release(size)
+				size = 0
+				return nil, err
+			}
+		}
+		t := tuples[i]
+		fields := make([]DBValue, 0, len(t.Fields)+len(w.funcs))
+		fields = append(fields, t.Fields...)
+		fields = append(fields, results[i-start]...)
+		i++
+		return &Tuple{*w.desc, fields, t.Rid}, nil
+	}, nil
+}
+
+// Compare two tuples on the partition expressions, in ascending order, and
+// then on the order expressions.
+func (w *Window) compare(t1 *Tuple, t2 *Tuple) (orderByState, error) {
+	for _, e := range w.partitionBy {
+		res, err := t1.compareField(t2, e)
+		if err != nil || res != OrderedEqual {
+			return res, err
+		}
+	}
+	return w.compareOrder(t1, t2)
+}
+
+func (w *Window) compareOrder(t1 *Tuple, t2 *Tuple) (orderByState, error) {
+	for i, e := range w.orderBy {
+		res, err := t1.compareField(t2, e)
+		if err != nil || res == OrderedEqual {
+			if err != nil {
+				return res, err
+			}
+			continue
+		}
+		if !w.ascending[i] {
+			if res == OrderedLessThan {
+				return OrderedGreaterThan, nil
+			}
+			return OrderedLessThan, nil
+		}
+		return res, nil
+	}
+	return OrderedEqual, nil
+}
+
+func (w *Window) samePartition(t1 *Tuple, t2 *Tuple) (bool, error) {
+	for _, e := range w.partitionBy {
+		res, err := t1.compareField(t2, e)
+		if err != nil {
+			return false, err
+		}
+		if res != OrderedEqual {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Evaluate the window functions over a sorted partition, returning for each
+// tuple the values of the functions, in order.
+func (w *Window) evalPartition(part []*Tuple) ([][]DBValue, error) {
+	// peerStart[i] and peerEnd[i] are the first and last tuples that are equal
+	// to tuple i on the order expressions
+	peerStart := make([]int, len(part))
+	peerEnd := make([]int, len(part))
+	for i := range part {
+		if i > 0 {
+			res, err := w.compareOrder(part[i-1], part[i])
+			if err != nil {
+				return nil, err
+			}
+			if res == OrderedEqual {
+				peerStart[i] = peerStart[i-1]
+				continue
+			}
+		}
+		peerStart[i] = i
+	}
+	for i := len(part) - 1; i >= 0; i-- {
+		if i < len(part)-1 && peerStart[i+1] == peerStart[i] {
+			peerEnd[i] = peerEnd[i+1]
+		} else {
+			peerEnd[i] = i
+		}
+	}
+
+	results := make([][]DBValue, len(part))
+	for i := range results {
+		results[i] = make([]DBValue, len(w.funcs))
+	}
+	for fNo, f := range w.funcs {
+		switch f.kind {
+		case WindowRowNumber:
+			for i := range part {
+				results[i][fNo] = IntField{int64(i + 1)}
+			}
+		case WindowRank:
+			for i := range part {
+				results[i][fNo] = IntField{int64(peerStart[i] + 1)}
+			}
+		case WindowDenseRank:
+			rank := int64(0)
+			for i := range part {
+				if peerStart[i] == i {
+					rank++
+				}
+				results[i][fNo] = IntField{rank}
+			}
+		case WindowLag, WindowLead:
+			for i := range part {
+				j := i - f.offset
+				if f.kind == WindowLead {
+					j = i + f.offset
+				}
+				if j < 0 || j >= len(part) {
+					results[i][fNo] = f.defaultVal
+					continue
+				}
+				v, err := f.expr.EvalExpr(part[j])
+				if err != nil {
+					return nil, err
+				}
+				results[i][fNo] = v
+			}
+		case WindowAggregate:
+			if err := w.evalFramedAgg(f, part, peerStart, peerEnd, results, fNo); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return results, nil
+}
+
+// Evaluate an aggregate window function over the frame of each tuple of a
+// partition, storing the results in column fNo of results.
+func (w *Window) evalFramedAgg(f *WindowFunc, part []*Tuple, peerStart []int, peerEnd []int, results [][]DBValue, fNo int) error {
+	frames := make([][2]int, len(part))
+	for i := range part {
+		lo, err := w.frameIndex(f.frame, f.frame.start, part, i, peerStart, peerEnd, true)
+		if err != nil {
+			return err
+		}
+		hi, err := w.frameIndex(f.frame, f.frame.end, part, i, peerStart, peerEnd, false)
+		if err != nil {
+			return err
+		}
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > len(part)-1 {
+			hi = len(part) - 1
+		}
+		frames[i] = [2]int{lo, hi}
+	}
+
+	// an empty frame, e.g., 1 FOLLOWING to 1 FOLLOWING on the last row, has
+	// no aggregate, so its result is the zero value, as for NULL elsewhere
+	empty := zeroValue(f.agg.GetTupleDesc().Fields[0].Ftype)
+	if f.frame.start.Kind == UnboundedPreceding {
+		// the frame only grows, so the aggregate can be computed
+		// incrementally, as a running aggregate
+		as := f.agg.Copy()
+		next := 0
+		for i := range part {
+			for ; next <= frames[i][1]; next++ {
+				as.AddTuple(part[next])
+			}
+			if frames[i][0] > frames[i][1] {
+				results[i][fNo] = empty
+				continue
+			}
+			results[i][fNo] = as.Finalize().Fields[0]
+		}
+		return nil
+	}
+	for i := range part {
+		if frames[i][0] > frames[i][1] {
+			results[i][fNo] = empty
+			continue
+		}
+		as := f.agg.Copy()
+		for j := frames[i][0]; j <= frames[i][1]; j++ {
+			as.AddTuple(part[j])
+		}
+		results[i][fNo] = as.Finalize().Fields[0]
+	}
+	return nil
+}
+
+// Return the index in part of the first (if isStart) or last tuple in the
+// frame of tuple i that is delimited by bound b.  Indexes may fall outside
+// of the partition, in which case the frame is clipped (or empty).
+func (w *Window) frameIndex(frame *WindowFrame, b FrameBound, part []*Tuple, i int, peerStart []int, peerEnd []int, isStart bool) (int, error) {
+	switch b.Kind {
+	case UnboundedPreceding:
+		return 0, nil
+	case UnboundedFollowing:
+		return len(part) - 1, nil
+	}
+	offset := b.Offset
+	if b.Kind == Preceding {
+		offset = -offset
+	}
+	if frame.rows {
+		return i + int(offset), nil
+	}
+	if b.Kind == CurrentRow {
+		if isStart {
+			return peerStart[i], nil
+		}
+		return peerEnd[i], nil
+	}
+
+	// RANGE frame with an offset: find the tuples whose distance from tuple
+	// i along the order expression, in the direction of the sort, is at
+	// least (for the start) or at most (for the end) offset
+	key, err := w.orderBy[0].EvalExpr(part[i])
+	if err != nil {
+		return 0, err
+	}
+	sign := int64(1)
+	if !w.ascending[0] {
+		sign = -1
+	}
+	var searchErr error
+	distance := func(j int) int64 {
+		v, err := w.orderBy[0].EvalExpr(part[j])
+		if err != nil {
+			searchErr = err
+			return 0
+		}
+		return (v.(IntField).Value - key.(IntField).Value) * sign
+	}
+	var idx int
+	if isStart {
+		idx = sort.Search(len(part), func(j int) bool { return distance(j) >= offset })
+	} else {
+		idx = sort.Search(len(part), func(j int) bool { return distance(j) > offset }) - 1
+	}
+	if searchErr != nil {
+		return 0, searchErr
+	}
+	return idx, nil
+}
+
+func (f *WindowFunc) String() string {
+	switch f.kind {
+	case WindowRowNumber:
+		return fmt.Sprintf("row_number() -> %s", f.name)
+	case WindowRank:
+		return fmt.Sprintf("rank() -> %s", f.name)
+	case WindowDenseRank:
+		return fmt.Sprintf("dense_rank() -> %s", f.name)
+	case WindowLag:
+		return fmt.Sprintf("lag(%s, %d) -> %s", exprToStr(f.expr), f.offset, f.name)
+	case WindowLead:
+		return fmt.Sprintf("lead(%s, %d) -> %s", exprToStr(f.expr), f.offset, f.name)
+	}
+	return fmt.Sprintf("%T -> %s", f.agg, f.name)
+}
@@ -0,0 +1,228 @@
+package godb
+
+import (
+	"testing"
+)
+
+// collect all tuples of an operator
+func collectTuples(t *testing.T, op Operator, tid TransactionID) []*Tuple {
+	iter, err := op.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var res []*Tuple
+	for {
+		tup, err := iter()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if tup == nil {
+			return res
+		}
+		res = append(res, tup)
+	}
+}
+
+// test ranking, offset and running aggregate functions over 10 tuples in
+// two groups (name0 has ages 0, 2, ..., 8 and name1 has ages 1, 3, ..., 9)
+func TestWindowPartitions(t *testing.T) {
+	_, _, _, hf, _, tid := makeTestVars()
+	insertGroupedTuples(t, hf, tid, 10, 2)
+	nameExpr := &FieldExpr{hf.Descriptor().Fields[0]}
+	ageExpr := &FieldExpr{hf.Descriptor().Fields[1]}
+
+	rn, _ := NewRankingWindowFunc(WindowRowNumber, "rn")
+	lag, err := NewOffsetWindowFunc(WindowLag, "prev", ageExpr, 1, IntField{-1})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	sum := &SumAggState[int64]{}
+	sum.Init("running", ageExpr, intAggGetter)
+	w, err := NewWindow([]Expr{nameExpr}, []Expr{ageExpr}, []bool{true}, []*WindowFunc{rn, lag, NewAggWindowFunc(sum, nil)}, hf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(w.Descriptor().Fields) != 5 {
+		t.Fatalf("expected 5 fields, got %d", len(w.Descriptor().Fields))
+	}
+
+	res := collectTuples(t, w, tid)
+	if len(res) != 10 {
+		t.Fatalf("expected 10 tuples, got %d", len(res))
+	}
+	for i, tup := range res {
+		pos := int64(i % 5)
+		age := tup.Fields[1].(IntField).Value
+		if tup.Fields[2].(IntField).Value != pos+1 {
+			t.Errorf("tuple %d: expected row number %d, got %v", i, pos+1, tup.Fields[2])
+		}
+		prev := age - 2
+		if pos == 0 {
+			prev = -1
+		}
+		if tup.Fields[3].(IntField).Value != prev {
+			t.Errorf("tuple %d: expected lag %d, got %v", i, prev, tup.Fields[3])
+		}
+		// sum of the ages up to and including this one in the partition
+		running := (pos + 1) * (age - pos)
+		if tup.Fields[4].(IntField).Value != running {
+			t.Errorf("tuple %d: expected running sum %d, got %v", i, running, tup.Fields[4])
+		}
+	}
+}
+
+// test frames over ties in the order expression
+func TestWindowFrames(t *testing.T) {
+	_, _, _, hf, _, tid := makeTestVars()
+	ages := []int64{1, 2, 2, 3, 7}
+	for _, age := range ages {
+		tup := Tuple{*hf.Descriptor(), []DBValue{StringField{"a"}, IntField{age}}, nil}
+		hf.insertTuple(&tup, tid)
+	}
+	ageExpr := &FieldExpr{hf.Descriptor().Fields[1]}
+
+	newSum := func(name string) AggState {
+		sum := &SumAggState[int64]{}
+		sum.Init(name, ageExpr, intAggGetter)
+		return sum
+	}
+	rowsFrame, err := NewWindowFrame(true, FrameBound{Preceding, 1}, FrameBound{Following, 1})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	rangeFrame, err := NewWindowFrame(false, FrameBound{Preceding, 1}, FrameBound{CurrentRow, 0})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	rank, _ := NewRankingWindowFunc(WindowRank, "rank")
+	dense, _ := NewRankingWindowFunc(WindowDenseRank, "dense")
+	funcs := []*WindowFunc{
+		rank,
+		dense,
+		NewAggWindowFunc(newSum("default"), nil),
+		NewAggWindowFunc(newSum("rows"), rowsFrame),
+		NewAggWindowFunc(newSum("range"), rangeFrame),
+	}
+	w, err := NewWindow(nil, []Expr{ageExpr}, []bool{true}, funcs, hf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	expected := [][]int64{
+		{1, 1, 1, 3, 1},
+		{2, 2, 5, 5, 5},
+		{2, 2, 5, 7, 5},
+		{4, 3, 8, 12, 7},
+		{5, 4, 15, 10, 7},
+	}
+	res := collectTuples(t, w, tid)
+	if len(res) != len(expected) {
+		t.Fatalf("expected %d tuples, got %d", len(expected), len(res))
+	}
+	for i, tup := range res {
+		for j, e := range expected[i] {
+			if v := tup.Fields[2+j].(IntField).Value; v != e {
+				t.Errorf("tuple %d, %s: expected %d, got %d", i, funcs[j].name, e, v)
+			}
+		}
+	}
+
+	if _, err := NewWindowFrame(true, FrameBound{Following, 1}, FrameBound{Preceding, 1}); err == nil {
+		t.Errorf("expected frame starting after its end to fail")
+	}
+	if _, err := NewWindow(nil, nil, nil, []*WindowFunc{NewAggWindowFunc(newSum("s"), rangeFrame)}, hf); err == nil {
+		t.Errorf("expected range frame with offset and no order by to fail")
+	}
+}
+
+// test frames that are empty for some rows, whose aggregates are the zero
+// value, rather than those of no tuples, e.g., a division by zero for avg
+func TestWindowEmptyFrames(t *testing.T) {
+	_, _, _, hf, _, tid := makeTestVars()
+	for _, age := range []int64{1, 2, 2, 3, 7} {
+		tup := Tuple{*hf.Descriptor(), []DBValue{StringField{"a"}, IntField{age}}, nil}
+		hf.insertTuple(&tup, tid)
+	}
+	ageExpr := &FieldExpr{hf.Descriptor().Fields[1]}
+
+	next, err := NewWindowFrame(true, FrameBound{Following, 1}, FrameBound{Following, 1})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	before, err := NewWindowFrame(true, FrameBound{UnboundedPreceding, 0}, FrameBound{Preceding, 1})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	avg := &AvgAggState[int64]{}
+	avg.Init("avg", ageExpr, intAggGetter)
+	min := &MinAggState[int64]{}
+	min.Init("min", ageExpr, intAggGetter)
+	max := &MaxAggState[int64]{}
+	max.Init("max", ageExpr, intAggGetter)
+	running := &AvgAggState[int64]{}
+	running.Init("running", ageExpr, intAggGetter)
+	funcs := []*WindowFunc{
+		NewAggWindowFunc(avg, next),
+		NewAggWindowFunc(min, next),
+		NewAggWindowFunc(max, next),
+		NewAggWindowFunc(running, before),
+	}
+	w, err := NewWindow(nil, []Expr{ageExpr}, []bool{true}, funcs, hf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	expected := [][]int64{
+		{2, 2, 2, 0},
+		{2, 2, 2, 1},
+		{3, 3, 3, 1},
+		{7, 7, 7, 1},
+		{0, 0, 0, 2},
+	}
+	res := collectTuples(t, w, tid)
+	if len(res) != len(expected) {
+		t.Fatalf("expected %d tuples, got %d", len(expected), len(res))
+	}
+	for i, tup := range res {
+		for j, e := range expected[i] {
+			if v := tup.Fields[2+j].(IntField).Value; v != e {
+				t.Errorf("tuple %d, %s: expected %d, got %d", i, funcs[j].name, e, v)
+			}
+		}
+	}
+
+	for _, bounds := range [][2]FrameBound{
+		{{Following, 2}, {Following, 1}},
+		{{Preceding, 1}, {Preceding, 2}},
+	} {
+		if _, err := NewWindowFrame(true, bounds[0], bounds[1]); err == nil {
+			t.Errorf("expected frame %v starting after its end to fail", bounds)
+		}
+	}
+}
+
+// test that the buffered input is released when a function fails
+func TestWindowErrorReleasesMemory(t *testing.T) {
+	_, _, _, hf, _, tid := makeTestVars()
+	insertGroupedTuples(t, hf, tid, 10, 2)
+	ageExpr := &FieldExpr{hf.Descriptor().Fields[1]}
+	missing := &FieldExpr{FieldType{"missing", "", IntType}}
+	lag, err := NewOffsetWindowFunc(WindowLag, "prev", missing, 1, IntField{0})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	w, err := NewWindow(nil, []Expr{ageExpr}, []bool{true}, []*WindowFunc{lag}, hf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, err := w.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := iter(); err == nil {
+		t.Fatalf("expected the lag of a missing field to fail")
+	}
+	if w.cur != 0 {
+		t.Errorf("expected the memory of the window to be released, got %d", w.cur)
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime/pprof"
@@ -13,6 +16,8 @@ import (
 
 	"github.com/chzyer/readline"
 	"github.com/srmadden/godb"
+	"github.com/srmadden/godb/httpapi"
+	"github.com/srmadden/godb/pgserver"
 )
 
 func check(e error) {
@@ -29,6 +34,10 @@ Available shell commands:
 	\d : List tables and fields in the current database
 	\f : List available functions for use in queries
 	\a : Toggle aligned vs csv output
+	\v : Toggle vectorized (batch at a time) vs tuple at a time execution.  Default to tuple at a time
+	\p n : Run queries with n parallel workers.  Default to n = 1 (no parallelism)
+	\t n : Stop queries that run for more than n seconds.  Default to n = 0 (no timeout)
+	\m n : Limit the memory each query may buffer to n MB, spilling to disk where possible.  Default to n = 0 (no limit)
 	\l table path/to/file [sep] [hasHeader]: Append csv file to end of table.  Default to sep = ',', hasHeader = 'true'`
 
 /*func printCatalog(fname string) {
@@ -49,16 +58,96 @@ Available shell commands:
 	f.Close()
 }*/
 
+// Return the context of a query, which is cancelled when the query is
+// interrupted with Ctrl-C or runs for longer than timeout, if timeout > 0,
+// and limits the memory the query may buffer to memLimit bytes, if
+// memLimit > 0.  The returned function must be called once the query is done.
+func queryContext(alarm chan int, timeout time.Duration, memLimit int64) (context.Context, context.CancelFunc) {
+	// ignore an interrupt received while no query was running
+	select {
+	case <-alarm:
+	default:
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	go func() {
+		select {
+		case <-alarm:
+			fmt.Println("Aborting")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return godb.WithMemoryLimit(ctx, memLimit), cancel
+}
+
 func printCatalog(c *godb.Catalog) {
 	s := c.CatalogString()
 	fmt.Printf("\033[34m%s\n\033[0m", s)
 }
 
+var (
+	pgAddr   = flag.String("pg", "", "serve the database to PostgreSQL clients at this address, e.g. localhost:5432, instead of running the shell")
+	httpAddr = flag.String("http", "", "serve the database's HTTP/JSON API at this address, e.g. localhost:8080, instead of running the shell")
+)
+
+// Serve the database with the catalog catName in catPath to PostgreSQL
+// clients at pgAddr and over HTTP at httpAddr, where they are not empty,
+// until interrupted.
+func serve(pgAddr string, httpAddr string, catPath string, catName string) {
+	db, err := godb.Open(catPath, &godb.Options{Catalog: catName, BufferPoolPages: 10000})
+	if err != nil {
+		log.Fatalf("failed to open database, %s", err.Error())
+	}
+	defer db.Close()
+
+	errs := make(chan error, 2)
+	var pgSrv *pgserver.Server
+	if pgAddr != "" {
+		pgSrv = pgserver.NewServer(db)
+		go func() { errs <- pgSrv.ListenAndServe(pgAddr) }()
+		fmt.Printf("Serving %s/%s to PostgreSQL clients at %s\n", catPath, catName, pgAddr)
+	}
+	var httpSrv *http.Server
+	if httpAddr != "" {
+		api := httpapi.NewHandler(db)
+		defer api.Close()
+		httpSrv = &http.Server{Addr: httpAddr, Handler: api}
+		go func() { errs <- httpSrv.ListenAndServe() }()
+		fmt.Printf("Serving %s/%s over HTTP at %s\n", catPath, catName, httpAddr)
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-c:
+	case err := <-errs:
+		log.Print(err)
+	}
+	if pgSrv != nil {
+		pgSrv.Close()
+	}
+	if httpSrv != nil {
+		httpSrv.Close()
+	}
+}
+
 func main() {
+	flag.Parse()
+	if *pgAddr != "" || *httpAddr != "" {
+		serve(*pgAddr, *httpAddr, "godb", "catalog.txt")
+		return
+	}
+
 	alarm := make(chan int, 1)
 
 	go func() {
-		c := make(chan os.Signal)
+		c := make(chan os.Signal, 1)
 
 		signal.Notify(c, os.Interrupt, syscall.SIGINT)
 		go func() {
@@ -117,6 +206,10 @@ func main() {
 	var autocommit bool = true
 	var tid godb.TransactionID
 	aligned := true
+	vectorized := false
+	workers := 1
+	var timeout time.Duration
+	var memLimit int64
 	for {
 
 		//text := "SELECT l_orderkey, sum(l_extendedprice * (1 - l_discount)) as revenue, o_orderdate, o_shippriority FROM customer, orders, lineitem WHERE c_mktsegment = 'BUILDING' AND c_custkey = o_custkey AND l_orderkey = o_orderkey GROUP BY l_orderkey, o_orderdate, o_shippriority ORDER BY revenue desc, o_orderdate LIMIT 20"
@@ -153,6 +246,7 @@ func main() {
 						fmt.Printf("failed load catalog, %s\n", err.Error())
 						continue
 					}
+					c.SetParallelism(workers)
 					fmt.Printf("Loaded %s/%s\n", catPath, catName)
 					//	printCatalog(catPath + "/" + catName)
 					printCatalog(c)
@@ -170,6 +264,55 @@ func main() {
 				} else {
 					fmt.Println("Output unaligned")
 				}
+			case 'p':
+				workers = 1
+				if len(text) > 3 {
+					n, err := strconv.Atoi(strings.TrimSpace(text[3:]))
+					if err != nil || n < 1 {
+						fmt.Printf("Expected a positive number of workers after \\p\n")
+						continue
+					}
+					workers = n
+				}
+				c.SetParallelism(workers)
+				fmt.Printf("Running queries with %d workers\n", workers)
+			case 't':
+				timeout = 0
+				if len(text) > 3 {
+					secs, err := strconv.ParseFloat(strings.TrimSpace(text[3:]), 64)
+					if err != nil || secs < 0 {
+						fmt.Printf("Expected a number of seconds after \\t\n")
+						continue
+					}
+					timeout = time.Duration(secs * float64(time.Second))
+				}
+				if timeout > 0 {
+					fmt.Printf("Query timeout %v\n", timeout)
+				} else {
+					fmt.Println("No query timeout")
+				}
+			case 'm':
+				memLimit = 0
+				if len(text) > 3 {
+					mb, err := strconv.ParseFloat(strings.TrimSpace(text[3:]), 64)
+					if err != nil || mb < 0 {
+						fmt.Printf("Expected a number of MB after \\m\n")
+						continue
+					}
+					memLimit = int64(mb * (1 << 20))
+				}
+				if memLimit > 0 {
+					fmt.Printf("Query memory limit %d bytes\n", memLimit)
+				} else {
+					fmt.Println("No query memory limit")
+				}
+			case 'v':
+				vectorized = !vectorized
+				if vectorized {
+					fmt.Println("Vectorized execution on")
+				} else {
+					fmt.Println("Vectorized execution off")
+				}
 
 			case '?':
 				fallthrough
@@ -224,6 +367,17 @@ func main() {
 			query = strings.Join(queryParts[1:], " ")
 			explain = true
 		}
+		analyze := false
+		if explain {
+			queryParts := strings.Fields(query)
+			if len(queryParts) > 1 && strings.ToLower(queryParts[0]) == "analyze" {
+				switch strings.ToLower(queryParts[1]) {
+				case "select", "with", "insert", "delete", "(":
+					query = strings.Join(queryParts[1:], " ")
+					analyze = true
+				}
+			}
+		}
 
 		queryType, plan, err := godb.Parse(c, query)
 		//fmt.Println(query)
@@ -258,6 +412,27 @@ func main() {
 
 		switch queryType {
 		case godb.IteratorType:
+			if explain && analyze {
+				if autocommit {
+					tid = godb.NewTID()
+					bp.BeginTransaction(tid)
+				}
+				ctx, cancel := queryContext(alarm, timeout, memLimit)
+				stats, err := godb.ExplainAnalyze(ctx, c, plan, tid)
+				cancel()
+				if err != nil {
+					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+					if autocommit {
+						bp.AbortTransaction(tid)
+					}
+					break
+				}
+				if autocommit {
+					bp.CommitTransaction(tid)
+				}
+				fmt.Printf("\033[32m%s\033[0m\n", stats.String())
+				break
+			}
 			if explain {
 				fmt.Printf("\033[32m")
 				godb.PrintPhysicalPlan(plan, "")
@@ -270,18 +445,25 @@ func main() {
 			}
 			start := time.Now()
 
-			iter, err := plan.Iterator(tid)
+			ctx, cancel := queryContext(alarm, timeout, memLimit)
+			q, err := godb.OpenQuery(ctx, plan, tid, vectorized)
 			if err != nil {
+				cancel()
 				fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+				if autocommit {
+					bp.AbortTransaction(tid)
+				}
 				continue
 			}
 
 			fmt.Printf("\033[32;4m%s\033[0m\n", plan.Descriptor().HeaderString(aligned))
 
+			failed := false
 			for {
-				tup, err := iter()
+				tup, err := q.Next()
 				if err != nil {
-					fmt.Printf("%s\n", err.Error())
+					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+					failed = true
 					break
 				}
 				if tup == nil {
@@ -290,18 +472,18 @@ func main() {
 					fmt.Printf("\033[32m%s\033[0m\n", tup.PrettyPrintString(aligned))
 				}
 				nresults++
-				select {
-				case <-alarm:
-					fmt.Println("Aborting")
-					goto outer
-				default:
-
-				}
 			}
+			q.Close()
+			cancel()
+			// an interrupted or failed statement is rolled back, unless it is
+			// part of a transaction, which the user can still commit or abort
 			if autocommit {
-				bp.CommitTransaction(tid)
+				if failed {
+					bp.AbortTransaction(tid)
+				} else {
+					bp.CommitTransaction(tid)
+				}
 			}
-		outer:
 			fmt.Printf("\033[32;1m(%d results)\033[0m\n", nresults)
 			duration := time.Since(start)
 			fmt.Printf("\033[32;1m%v\033[0m\n\n", duration)